@@ -0,0 +1,244 @@
+package base
+
+import (
+	"sort"
+	"sync"
+	"time"
+)
+
+// Clock tells the time and waits for it. SystemClock follows the real time, a FakeClock only moves when a test
+// advances it. Its Now method fits the FNNow parameters, logx loggers for example.
+type Clock interface {
+	Now() time.Time
+	After(d time.Duration) <-chan time.Time
+	NewTimer(d time.Duration) Timer
+	Sleep(d time.Duration)
+}
+
+// Timer is a time.Timer of a Clock.
+type Timer interface {
+	C() <-chan time.Time
+	// Stop prevents the timer from firing, it reports false if the timer already fired or was stopped.
+	Stop() bool
+	// Reset stops the timer and starts it again with d, it reports whether the timer was active.
+	Reset(d time.Duration) bool
+}
+
+// SystemClock is the Clock of the time package.
+var SystemClock Clock = systemClock{}
+
+// GetClock returns clock, SystemClock if it is nil.
+func GetClock(clock Clock) Clock {
+	if clock == nil {
+		return SystemClock
+	}
+
+	return clock
+}
+
+type systemClock struct{}
+
+func (systemClock) Now() time.Time {
+	return time.Now()
+}
+
+func (systemClock) After(d time.Duration) <-chan time.Time {
+	return time.After(d)
+}
+
+func (systemClock) NewTimer(d time.Duration) Timer {
+	return &systemTimer{t: time.NewTimer(d)}
+}
+
+func (systemClock) Sleep(d time.Duration) {
+	time.Sleep(d)
+}
+
+type systemTimer struct {
+	t *time.Timer
+}
+
+func (t *systemTimer) C() <-chan time.Time {
+	return t.t.C
+}
+
+func (t *systemTimer) Stop() bool {
+	return t.t.Stop()
+}
+
+func (t *systemTimer) Reset(d time.Duration) bool {
+	return t.t.Reset(d)
+}
+
+// FakeClock is a Clock for tests: its time only moves with Advance, which fires the timers that became due.
+type FakeClock struct {
+	lock    sync.Mutex
+	cond    *sync.Cond
+	now     time.Time
+	seq     uint64
+	waiters []*fakeTimer
+}
+
+func NewFakeClock(now time.Time) *FakeClock {
+	c := &FakeClock{
+		now: now,
+	}
+
+	c.cond = sync.NewCond(&c.lock)
+
+	return c
+}
+
+func (c *FakeClock) Now() time.Time {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	return c.now
+}
+
+func (c *FakeClock) After(d time.Duration) <-chan time.Time {
+	return c.NewTimer(d).C()
+}
+
+func (c *FakeClock) NewTimer(d time.Duration) Timer {
+	t := &fakeTimer{
+		clock: c,
+		ch:    make(chan time.Time, 1),
+	}
+
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	c.startLocked(t, d)
+
+	return t
+}
+
+// Sleep blocks until another goroutine advanced the clock by d.
+func (c *FakeClock) Sleep(d time.Duration) {
+	<-c.After(d)
+}
+
+// Advance moves the time forward by d and fires the timers that became due, the earliest first.
+func (c *FakeClock) Advance(d time.Duration) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	c.now = c.now.Add(d)
+
+	sort.SliceStable(c.waiters, func(i, j int) bool {
+		if !c.waiters[i].at.Equal(c.waiters[j].at) {
+			return c.waiters[i].at.Before(c.waiters[j].at)
+		}
+
+		return c.waiters[i].seq < c.waiters[j].seq
+	})
+
+	n := 0
+	for n < len(c.waiters) && !c.waiters[n].at.After(c.now) {
+		c.waiters[n].fireLocked(c.now)
+		n++
+	}
+
+	c.waiters = append(c.waiters[:0], c.waiters[n:]...)
+	c.cond.Broadcast()
+}
+
+// BlockUntil waits until at least n timers, sleeps included, are waiting for the clock.
+func (c *FakeClock) BlockUntil(n int) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	for len(c.waiters) < n {
+		c.cond.Wait()
+	}
+}
+
+// Waiters is the number of timers waiting for the clock.
+func (c *FakeClock) Waiters() int {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	return len(c.waiters)
+}
+
+func (c *FakeClock) startLocked(t *fakeTimer, d time.Duration) {
+	t.at = c.now.Add(d)
+
+	if d <= 0 {
+		t.fireLocked(c.now)
+
+		return
+	}
+
+	c.seq++
+	t.seq = c.seq
+	t.active = true
+	c.waiters = append(c.waiters, t)
+	c.cond.Broadcast()
+}
+
+func (c *FakeClock) stopLocked(t *fakeTimer) bool {
+	if !t.active {
+		return false
+	}
+
+	t.active = false
+
+	for i, w := range c.waiters {
+		if w == t {
+			c.waiters = append(c.waiters[:i], c.waiters[i+1:]...)
+
+			break
+		}
+	}
+
+	c.cond.Broadcast()
+
+	return true
+}
+
+type fakeTimer struct {
+	clock  *FakeClock
+	ch     chan time.Time
+	at     time.Time
+	seq    uint64
+	active bool
+}
+
+func (t *fakeTimer) fireLocked(now time.Time) {
+	t.active = false
+
+	select {
+	case t.ch <- now:
+	default:
+	}
+}
+
+func (t *fakeTimer) C() <-chan time.Time {
+	return t.ch
+}
+
+func (t *fakeTimer) Stop() bool {
+	t.clock.lock.Lock()
+	defer t.clock.lock.Unlock()
+
+	return t.clock.stopLocked(t)
+}
+
+// Reset drops a fire time that was not received yet, like a time.Timer does since Go 1.23.
+func (t *fakeTimer) Reset(d time.Duration) bool {
+	t.clock.lock.Lock()
+	defer t.clock.lock.Unlock()
+
+	active := t.clock.stopLocked(t)
+
+	select {
+	case <-t.ch:
+	default:
+	}
+
+	t.clock.startLocked(t, d)
+
+	return active
+}
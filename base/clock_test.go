@@ -0,0 +1,47 @@
+package base
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestFakeClock(t *testing.T) {
+	start := time.Unix(1000, 0)
+	clock := NewFakeClock(start)
+
+	later := clock.NewTimer(2 * time.Second)
+	sooner := clock.NewTimer(time.Second)
+	stopped := clock.NewTimer(time.Second)
+
+	assert.Equal(t, 3, clock.Waiters())
+	assert.True(t, stopped.Stop())
+	assert.False(t, stopped.Stop())
+
+	clock.Advance(time.Second)
+	assert.Equal(t, start.Add(time.Second), <-sooner.C())
+	assert.Empty(t, later.C())
+	assert.Empty(t, stopped.C())
+
+	assert.True(t, later.Reset(time.Second))
+	clock.Advance(500 * time.Millisecond)
+	assert.Empty(t, later.C())
+
+	clock.Advance(500 * time.Millisecond)
+	assert.Equal(t, start.Add(2*time.Second), <-later.C())
+	assert.Zero(t, clock.Waiters())
+
+	done := make(chan struct{})
+
+	go func() {
+		clock.Sleep(time.Minute)
+		close(done)
+	}()
+
+	clock.BlockUntil(1)
+	clock.Advance(time.Minute)
+	<-done
+
+	assert.Equal(t, start.Add(2*time.Second+time.Minute), clock.Now())
+}
@@ -0,0 +1,23 @@
+//go:build !unix
+
+package syncx
+
+import (
+	"os"
+
+	"github.com/GizmoVault/gotools/base/errorx"
+)
+
+var errFileLockUnsupported = errorx.ErrLogic.WithMsg("file lock is not supported on this platform")
+
+func LockFile(*os.File) error {
+	return errFileLockUnsupported
+}
+
+func TryLockFile(*os.File) (bool, error) {
+	return false, errFileLockUnsupported
+}
+
+func UnlockFile(*os.File) error {
+	return nil
+}
@@ -0,0 +1,28 @@
+//go:build unix
+
+package syncx
+
+import (
+	"errors"
+	"os"
+	"syscall"
+)
+
+// LockFile takes the exclusive lock of f, it waits while another file holds it.
+func LockFile(f *os.File) error {
+	return syscall.Flock(int(f.Fd()), syscall.LOCK_EX)
+}
+
+// TryLockFile takes the exclusive lock of f without waiting, it reports false if another file holds it.
+func TryLockFile(f *os.File) (bool, error) {
+	err := syscall.Flock(int(f.Fd()), syscall.LOCK_EX|syscall.LOCK_NB)
+	if errors.Is(err, syscall.EWOULDBLOCK) {
+		return false, nil
+	}
+
+	return err == nil, err
+}
+
+func UnlockFile(f *os.File) error {
+	return syscall.Flock(int(f.Fd()), syscall.LOCK_UN)
+}
@@ -1,38 +1,365 @@
 package mtx
 
 import (
+	"container/heap"
 	"context"
 	"sync"
 	"time"
 
-	"golang.org/x/sync/semaphore"
+	"github.com/GizmoVault/gotools/base"
+	"github.com/GizmoVault/gotools/base/errorx"
 )
 
+// holdTimeSmoothing is the weight of the latest hold time in the average the wait estimates use.
+const holdTimeSmoothing = 0.2
+
+type SemaphoreConfig struct {
+	// TenantShares are the shares of the tenants in the weighted fair queuing, 1 for the tenants missing.
+	TenantShares map[string]int64
+	Clock        base.Clock
+}
+
+// AcquireOptions places a waiter in the queue. The waiters of a higher priority go first, those of a priority
+// class share it by tenant: a tenant with twice the share of another gets twice the weight through while both
+// wait.
+type AcquireOptions struct {
+	Priority int
+	Tenant   string
+}
+
+// WaitInfo is where a waiter stands in the queue.
+type WaitInfo struct {
+	// Position is 1 for the next waiter to acquire.
+	Position int
+	// WeightAhead is the weight of the waiters before it.
+	WeightAhead int64
+	// EstimatedWait is a guess from the average hold time, 0 until a hold was released.
+	EstimatedWait time.Duration
+}
+
+type semWaiter struct {
+	id       uint64
+	weight   int64
+	priority int
+	tenant   string
+	// tag is the virtual finish time of the waiter in its priority class.
+	tag     float64
+	seq     uint64
+	index   int
+	timeout time.Duration
+	fn      func(id uint64)
+	ready   chan struct{}
+}
+
+type semHolder struct {
+	weight int64
+	start  time.Time
+	done   chan struct{}
+}
+
+type tenantKey struct {
+	priority int
+	tenant   string
+}
+
+type tenantState struct {
+	lastTag float64
+	waiting int
+}
+
+type classState struct {
+	// virtual is the tag of the last waiter of the class that acquired.
+	virtual float64
+	waiting int
+}
+
+type waiterHeap []*semWaiter
+
+func (wh *waiterHeap) Len() int {
+	return len(*wh)
+}
+
+// Less orders the waiters by priority, then by tag, then by arrival.
+func (wh *waiterHeap) Less(i, j int) bool {
+	return (*wh)[i].before((*wh)[j])
+}
+
+func (wh *waiterHeap) Swap(i, j int) {
+	(*wh)[i], (*wh)[j] = (*wh)[j], (*wh)[i]
+	(*wh)[i].index = i
+	(*wh)[j].index = j
+}
+
+func (wh *waiterHeap) Push(x any) {
+	w := x.(*semWaiter)
+	w.index = len(*wh)
+	*wh = append(*wh, w)
+}
+
+func (wh *waiterHeap) Pop() any {
+	old := *wh
+	n := len(old)
+	x := old[n-1]
+	*wh = old[0 : n-1]
+	return x
+}
+
+func (w *semWaiter) before(o *semWaiter) bool {
+	if w.priority != o.priority {
+		return w.priority > o.priority
+	}
+
+	if w.tag != o.tag {
+		return w.tag < o.tag
+	}
+
+	return w.seq < o.seq
+}
+
+// TimeoutSemaphore is a weighted semaphore whose acquisitions are released on their own once their timeout
+// passes. The waiters are served by priority, then by self-clocked weighted fair queuing across the tenants
+// of a priority class: the cost of a waiter is its weight over the share of its tenant, so a heavy waiter
+// queues behind the light ones of the other tenants instead of blocking them. A waiter that does not fit yet is
+// only overtaken by a higher priority, so the heavy waiters of a class do not starve.
 type TimeoutSemaphore struct {
-	sem    *semaphore.Weighted
-	mu     sync.Mutex
-	timers map[uint64]*time.Timer
+	size   int64
+	shares map[string]int64
+	clock  base.Clock
+
+	mu       sync.Mutex
+	cur      int64
+	seq      uint64
+	waiters  waiterHeap
+	waiting  map[uint64]*semWaiter
+	holders  map[uint64]*semHolder
+	classes  map[int]*classState
+	tenants  map[tenantKey]*tenantState
+	avgHold  time.Duration
+	holdSeen bool
 }
 
 func NewTimeoutSemaphore(maxCount int64) *TimeoutSemaphore {
+	return NewTimeoutSemaphoreWithConfig(maxCount, SemaphoreConfig{})
+}
+
+//nolint:gocritic // config is copied on purpose
+func NewTimeoutSemaphoreWithConfig(maxCount int64, cfg SemaphoreConfig) *TimeoutSemaphore {
 	return &TimeoutSemaphore{
-		sem:    semaphore.NewWeighted(maxCount),
-		timers: make(map[uint64]*time.Timer),
+		size:    maxCount,
+		shares:  cfg.TenantShares,
+		clock:   base.GetClock(cfg.Clock),
+		waiting: make(map[uint64]*semWaiter),
+		holders: make(map[uint64]*semHolder),
+		classes: make(map[int]*classState),
+		tenants: make(map[tenantKey]*tenantState),
 	}
 }
 
+// AcquireWithAutoRelease acquires weight for id in the default priority class and tenant, see
+// AcquireWithOptions.
 func (ts *TimeoutSemaphore) AcquireWithAutoRelease(ctx context.Context, weight int64, timeout time.Duration, id uint64,
 	fnTimeoutCallback func(id uint64)) error {
-	if err := ts.sem.Acquire(ctx, weight); err != nil {
-		return err
+	return ts.AcquireWithOptions(ctx, weight, timeout, id, AcquireOptions{}, fnTimeoutCallback)
+}
+
+// AcquireWithOptions waits until weight is acquired for id or ctx is done. Unless released before, the weight
+// is released timeout after it was acquired, fnTimeoutCallback is called first. A weight above the size of the
+// semaphore fails with errorx.ErrInvalidArgs, an id that waits or holds already with errorx.ErrConflict.
+//
+//nolint:gocritic // options are copied on purpose
+func (ts *TimeoutSemaphore) AcquireWithOptions(ctx context.Context, weight int64, timeout time.Duration, id uint64,
+	opts AcquireOptions, fnTimeoutCallback func(id uint64)) error {
+	if weight < 0 || weight > ts.size {
+		return errorx.ErrInvalidArgs
+	}
+
+	ts.mu.Lock()
+
+	if _, ok := ts.holders[id]; ok {
+		ts.mu.Unlock()
+
+		return errorx.ErrConflict
+	}
+
+	if _, ok := ts.waiting[id]; ok {
+		ts.mu.Unlock()
+
+		return errorx.ErrConflict
 	}
 
+	w := ts.enqueueLocked(id, weight, timeout, opts, fnTimeoutCallback)
+	// w may go first, ahead of a waiter that does not fit yet
+	ts.notifyLocked()
+	ts.mu.Unlock()
+
+	select {
+	case <-w.ready:
+		return nil
+	case <-ctx.Done():
+	}
+
+	ts.mu.Lock()
+	defer ts.mu.Unlock()
+
+	select {
+	case <-w.ready:
+		// acquired after ctx was done, give it back
+		ts.releaseLocked(id)
+	default:
+		ts.dequeueLocked(w)
+		heap.Remove(&ts.waiters, w.index)
+		// the next waiter may fit now
+		ts.notifyLocked()
+	}
+
+	return ctx.Err()
+}
+
+// Release releases what id acquired unless its timeout passed already. The acquired weight is released, weight
+// is only kept for the callers.
+func (ts *TimeoutSemaphore) Release(id uint64, _ int64) {
+	ts.mu.Lock()
+	defer ts.mu.Unlock()
+
+	ts.releaseLocked(id)
+}
+
+// WaitInfo returns where id stands in the queue, false if it does not wait.
+func (ts *TimeoutSemaphore) WaitInfo(id uint64) (WaitInfo, bool) {
 	ts.mu.Lock()
-	timer := time.AfterFunc(timeout, func() {
+	defer ts.mu.Unlock()
+
+	w, ok := ts.waiting[id]
+	if !ok {
+		return WaitInfo{}, false
+	}
+
+	info := WaitInfo{Position: 1}
+
+	for _, o := range ts.waiters {
+		if o.before(w) {
+			info.Position++
+			info.WeightAhead += o.weight
+		}
+	}
+
+	// the waiters go through one after another as weight is released, at size per average hold time
+	if missing := info.WeightAhead + w.weight - (ts.size - ts.cur); missing > 0 && ts.holdSeen && ts.size > 0 {
+		info.EstimatedWait = time.Duration(float64(ts.avgHold) * float64(missing) / float64(ts.size))
+	}
+
+	return info, true
+}
+
+func (ts *TimeoutSemaphore) enqueueLocked(id uint64, weight int64, timeout time.Duration, opts AcquireOptions,
+	fn func(id uint64)) *semWaiter {
+	class, ok := ts.classes[opts.Priority]
+	if !ok {
+		class = &classState{}
+		ts.classes[opts.Priority] = class
+	}
+
+	key := tenantKey{priority: opts.Priority, tenant: opts.Tenant}
+
+	state, ok := ts.tenants[key]
+	if !ok {
+		state = &tenantState{}
+		ts.tenants[key] = state
+	}
+
+	share := ts.shares[opts.Tenant]
+	if share <= 0 {
+		share = 1
+	}
+
+	start := max(class.virtual, state.lastTag)
+	state.lastTag = start + float64(weight)/float64(share)
+	state.waiting++
+	class.waiting++
+
+	ts.seq++
+
+	w := &semWaiter{
+		id:       id,
+		weight:   weight,
+		priority: opts.Priority,
+		tenant:   opts.Tenant,
+		tag:      state.lastTag,
+		seq:      ts.seq,
+		timeout:  timeout,
+		fn:       fn,
+		ready:    make(chan struct{}),
+	}
+
+	ts.waiting[id] = w
+	heap.Push(&ts.waiters, w)
+
+	return w
+}
+
+// dequeueLocked forgets w, and the tenants and priority classes that no longer wait.
+func (ts *TimeoutSemaphore) dequeueLocked(w *semWaiter) {
+	delete(ts.waiting, w.id)
+
+	key := tenantKey{priority: w.priority, tenant: w.tenant}
+	if state := ts.tenants[key]; state != nil {
+		state.waiting--
+		if state.waiting <= 0 {
+			delete(ts.tenants, key)
+		}
+	}
+
+	if class := ts.classes[w.priority]; class != nil {
+		class.waiting--
+		if class.waiting <= 0 {
+			delete(ts.classes, w.priority)
+		}
+	}
+}
+
+// notifyLocked hands the released weight to the waiters in order.
+func (ts *TimeoutSemaphore) notifyLocked() {
+	for len(ts.waiters) > 0 {
+		w := ts.waiters[0]
+		if ts.size-ts.cur < w.weight {
+			return
+		}
+
+		heap.Pop(&ts.waiters)
+
+		ts.cur += w.weight
+		ts.classes[w.priority].virtual = w.tag
+		ts.dequeueLocked(w)
+		ts.holdLocked(w.id, w.weight, w.timeout, w.fn)
+
+		close(w.ready)
+	}
+}
+
+func (ts *TimeoutSemaphore) holdLocked(id uint64, weight int64, timeout time.Duration, fn func(id uint64)) {
+	h := &semHolder{
+		weight: weight,
+		start:  ts.clock.Now(),
+		done:   make(chan struct{}),
+	}
+
+	ts.holders[id] = h
+
+	timer := ts.clock.NewTimer(timeout)
+
+	go func() {
+		defer timer.Stop()
+
+		select {
+		case <-h.done:
+			return
+		case <-timer.C():
+		}
+
 		ts.mu.Lock()
-		_, ok := ts.timers[id]
+		ok := ts.holders[id] == h
 		if ok {
-			delete(ts.timers, id)
+			delete(ts.holders, id)
 		}
 		ts.mu.Unlock()
 
@@ -40,30 +367,40 @@ func (ts *TimeoutSemaphore) AcquireWithAutoRelease(ctx context.Context, weight i
 			return
 		}
 
-		if fnTimeoutCallback != nil {
-			fnTimeoutCallback(id)
+		if fn != nil {
+			fn(id)
 		}
 
-		ts.sem.Release(weight)
-	})
-	ts.timers[id] = timer
-	ts.mu.Unlock()
-
-	return nil
+		ts.mu.Lock()
+		ts.putLocked(h)
+		ts.mu.Unlock()
+	}()
 }
 
-func (ts *TimeoutSemaphore) Release(id uint64, weight int64) {
-	ts.mu.Lock()
-	timer, ok := ts.timers[id]
-	if ok {
-		delete(ts.timers, id)
-	}
-	ts.mu.Unlock()
-
+func (ts *TimeoutSemaphore) releaseLocked(id uint64) {
+	h, ok := ts.holders[id]
 	if !ok {
 		return
 	}
 
-	timer.Stop()
-	ts.sem.Release(weight)
+	delete(ts.holders, id)
+	close(h.done)
+
+	ts.putLocked(h)
+}
+
+// putLocked gives the weight of h back and records how long it was held.
+func (ts *TimeoutSemaphore) putLocked(h *semHolder) {
+	ts.cur -= h.weight
+
+	d := ts.clock.Now().Sub(h.start)
+
+	if ts.holdSeen {
+		ts.avgHold = time.Duration((1-holdTimeSmoothing)*float64(ts.avgHold) + holdTimeSmoothing*float64(d))
+	} else {
+		ts.avgHold = d
+		ts.holdSeen = true
+	}
+
+	ts.notifyLocked()
 }
@@ -6,6 +6,11 @@ import (
 	"sync"
 	"testing"
 	"time"
+
+	"github.com/GizmoVault/gotools/base"
+	"github.com/GizmoVault/gotools/base/errorx"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
 )
 
 func TestSemaphore(t *testing.T) {
@@ -77,3 +82,139 @@ func TestSemaphore2(t *testing.T) {
 
 	wg.Wait()
 }
+
+// queue starts an acquire of id and waits until it is queued, the acquired ids go to acquired.
+//
+//nolint:gocritic // options are copied on purpose
+func queue(t *testing.T, ts *TimeoutSemaphore, id uint64, weight int64, opts AcquireOptions,
+	acquired chan<- uint64) {
+	t.Helper()
+
+	go func() {
+		if err := ts.AcquireWithOptions(t.Context(), weight, time.Hour, id, opts, nil); err == nil {
+			acquired <- id
+		}
+	}()
+
+	require.Eventually(t, func() bool {
+		_, ok := ts.WaitInfo(id)
+
+		return ok
+	}, time.Second, time.Millisecond)
+}
+
+// drain releases every acquired id in turn and returns the order they were acquired in.
+func drain(t *testing.T, ts *TimeoutSemaphore, acquired <-chan uint64, n int) []uint64 {
+	t.Helper()
+
+	var order []uint64
+
+	for range n {
+		select {
+		case id := <-acquired:
+			order = append(order, id)
+			ts.Release(id, 1)
+		case <-time.After(time.Second):
+			require.FailNow(t, "timeout waiting for an acquire")
+		}
+	}
+
+	return order
+}
+
+func TestSemaphoreAutoRelease(t *testing.T) {
+	clock := base.NewFakeClock(time.Unix(1000, 0))
+	ts := NewTimeoutSemaphoreWithConfig(6, SemaphoreConfig{Clock: clock})
+
+	timeouts := make(chan uint64, 1)
+
+	require.NoError(t, ts.AcquireWithAutoRelease(t.Context(), 6, time.Second, 1, func(id uint64) {
+		timeouts <- id
+	}))
+	require.ErrorIs(t, ts.AcquireWithAutoRelease(t.Context(), 1, time.Second, 1, nil), errorx.ErrConflict)
+	require.ErrorIs(t, ts.AcquireWithAutoRelease(t.Context(), 7, time.Second, 2, nil), errorx.ErrInvalidArgs)
+
+	ctx, cancel := context.WithTimeout(t.Context(), 10*time.Millisecond)
+	defer cancel()
+
+	require.ErrorIs(t, ts.AcquireWithAutoRelease(ctx, 1, time.Second, 2, nil), context.DeadlineExceeded)
+
+	acquired := make(chan uint64, 1)
+	queue(t, ts, 2, 1, AcquireOptions{}, acquired)
+
+	clock.BlockUntil(1)
+	clock.Advance(time.Second)
+
+	assert.Equal(t, uint64(1), <-timeouts)
+	assert.Equal(t, uint64(2), <-acquired)
+
+	// released already by the timeout
+	ts.Release(1, 6)
+	ts.Release(2, 1)
+	require.NoError(t, ts.AcquireWithAutoRelease(t.Context(), 6, time.Hour, 3, nil))
+
+	queue(t, ts, 4, 3, AcquireOptions{}, acquired)
+	queue(t, ts, 5, 3, AcquireOptions{}, acquired)
+
+	// 1 and 2 were held for a second and no time, 6 units wait for a semaphore of 6
+	info, ok := ts.WaitInfo(5)
+	require.True(t, ok)
+	assert.Equal(t, WaitInfo{Position: 2, WeightAhead: 3, EstimatedWait: 800 * time.Millisecond}, info)
+}
+
+func TestSemaphorePriority(t *testing.T) {
+	ts := NewTimeoutSemaphore(4)
+
+	require.NoError(t, ts.AcquireWithAutoRelease(t.Context(), 4, time.Hour, 1, nil))
+
+	acquired := make(chan uint64, 4)
+
+	queue(t, ts, 2, 4, AcquireOptions{}, acquired)
+	queue(t, ts, 3, 1, AcquireOptions{}, acquired)
+	queue(t, ts, 4, 1, AcquireOptions{Priority: 1}, acquired)
+
+	info, ok := ts.WaitInfo(4)
+	require.True(t, ok)
+	assert.Equal(t, 1, info.Position)
+
+	info, _ = ts.WaitInfo(3)
+	assert.Equal(t, WaitInfo{Position: 3, WeightAhead: 5}, info)
+
+	_, ok = ts.WaitInfo(1)
+	assert.False(t, ok)
+
+	ts.Release(1, 4)
+
+	assert.Equal(t, []uint64{4, 2, 3}, drain(t, ts, acquired, 3))
+}
+
+func TestSemaphoreFairness(t *testing.T) {
+	ts := NewTimeoutSemaphoreWithConfig(4, SemaphoreConfig{TenantShares: map[string]int64{"b": 2}})
+
+	// one unit is free at a time until 2 releases
+	require.NoError(t, ts.AcquireWithAutoRelease(t.Context(), 1, time.Hour, 1, nil))
+	require.NoError(t, ts.AcquireWithAutoRelease(t.Context(), 3, time.Hour, 2, nil))
+
+	acquired := make(chan uint64, 8)
+
+	// the heavy waiter of c comes first but costs 4 turns of a
+	queue(t, ts, 10, 4, AcquireOptions{Tenant: "c"}, acquired)
+
+	for id := uint64(20); id < 24; id++ {
+		queue(t, ts, id, 1, AcquireOptions{Tenant: "a"}, acquired)
+	}
+
+	// b has twice the share of a
+	queue(t, ts, 30, 1, AcquireOptions{Tenant: "b"}, acquired)
+	queue(t, ts, 31, 1, AcquireOptions{Tenant: "b"}, acquired)
+
+	ts.Release(1, 1)
+	assert.Equal(t, []uint64{30, 20, 31, 21, 22}, drain(t, ts, acquired, 5))
+
+	// c is not overtaken once it is next
+	info, _ := ts.WaitInfo(23)
+	assert.Equal(t, 2, info.Position)
+
+	ts.Release(2, 3)
+	assert.Equal(t, []uint64{10, 23}, drain(t, ts, acquired, 2))
+}
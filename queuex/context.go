@@ -0,0 +1,103 @@
+package queuex
+
+import (
+	"context"
+	"sync"
+
+	"github.com/GizmoVault/gotools/base/errorx"
+)
+
+type TaskMeta struct {
+	ID       string
+	Queue    string
+	Retried  int
+	MaxRetry int
+}
+
+type taskMetaCtxKey struct{}
+
+func WithTaskMeta(ctx context.Context, meta TaskMeta) context.Context {
+	return context.WithValue(ctx, taskMetaCtxKey{}, meta)
+}
+
+func GetTaskMeta(ctx context.Context) (meta TaskMeta, ok bool) {
+	meta, ok = ctx.Value(taskMetaCtxKey{}).(TaskMeta)
+
+	return
+}
+
+func GetRetryCount(ctx context.Context) (int, bool) {
+	meta, ok := GetTaskMeta(ctx)
+
+	return meta.Retried, ok
+}
+
+func GetMaxRetry(ctx context.Context) (int, bool) {
+	meta, ok := GetTaskMeta(ctx)
+
+	return meta.MaxRetry, ok
+}
+
+// ResultWriter collects the result payload a handler produces.
+type ResultWriter struct {
+	lock sync.Mutex
+	data []byte
+}
+
+func (w *ResultWriter) Write(p []byte) (int, error) {
+	w.lock.Lock()
+	defer w.lock.Unlock()
+
+	w.data = append(w.data, p...)
+
+	return len(p), nil
+}
+
+func (w *ResultWriter) Result() []byte {
+	w.lock.Lock()
+	defer w.lock.Unlock()
+
+	if w.data == nil {
+		return nil
+	}
+
+	return append([]byte(nil), w.data...)
+}
+
+func (w *ResultWriter) reset(data []byte) {
+	w.lock.Lock()
+	defer w.lock.Unlock()
+
+	w.data = append([]byte(nil), data...)
+}
+
+type resultWriterCtxKey struct{}
+
+// WithResultWriter returns ctx carrying a ResultWriter, the existing one if ctx already has it.
+func WithResultWriter(ctx context.Context) (context.Context, *ResultWriter) {
+	if w, ok := GetResultWriter(ctx); ok {
+		return ctx, w
+	}
+
+	w := &ResultWriter{}
+
+	return context.WithValue(ctx, resultWriterCtxKey{}, w), w
+}
+
+func GetResultWriter(ctx context.Context) (w *ResultWriter, ok bool) {
+	w, ok = ctx.Value(resultWriterCtxKey{}).(*ResultWriter)
+
+	return
+}
+
+// SetResult replaces the result of the task being handled, it fails with errorx.ErrLogic outside a handler.
+func SetResult(ctx context.Context, data []byte) error {
+	w, ok := GetResultWriter(ctx)
+	if !ok {
+		return errorx.ErrLogic
+	}
+
+	w.reset(data)
+
+	return nil
+}
@@ -0,0 +1,90 @@
+package queuex
+
+import (
+	"encoding/json"
+	"fmt"
+	"time"
+)
+
+const (
+	DefaultAggregationGracePeriod = time.Minute
+)
+
+// AggregateFunc merges the tasks of an aggregation group, in the order they were enqueued, into the task
+// passed to the handler.
+type AggregateFunc func(group string, tasks []*Task) *Task
+
+// AggregationConfig decides when the pending tasks of an aggregation group are merged into one task.
+type AggregationConfig struct {
+	// GracePeriod is how long a group waits for more tasks after the last one arrived,
+	// DefaultAggregationGracePeriod if 0.
+	GracePeriod time.Duration
+	// MaxDelay bounds how long the first task of a group waits, 0 for no bound.
+	MaxDelay time.Duration
+	// MaxSize merges a group as soon as it holds that many tasks, 0 for no limit.
+	MaxSize int
+	// Aggregate merges the tasks, AggregateTasks if nil.
+	Aggregate AggregateFunc
+}
+
+func (cfg *AggregationConfig) GetGracePeriod() time.Duration {
+	if cfg.GracePeriod <= 0 {
+		return DefaultAggregationGracePeriod
+	}
+
+	return cfg.GracePeriod
+}
+
+func (cfg *AggregationConfig) GetAggregate() AggregateFunc {
+	if cfg.Aggregate == nil {
+		return AggregateTasks
+	}
+
+	return cfg.Aggregate
+}
+
+// MergeAt is when the n tasks of a group, due first at first and last at last, are merged: a grace period after
+// the last one, no later than the max delay after the first one, or at once when the group is full.
+func (cfg *AggregationConfig) MergeAt(first, last time.Time, n int) time.Time {
+	if cfg.MaxSize > 0 && n >= cfg.MaxSize {
+		return last
+	}
+
+	at := last.Add(cfg.GetGracePeriod())
+
+	if cfg.MaxDelay > 0 {
+		if t := first.Add(cfg.MaxDelay); t.Before(at) {
+			at = t
+		}
+	}
+
+	return at
+}
+
+// AggregateTasks keeps the key of the first task and packs the payloads of all of them, AggregatedPayloads
+// unpacks them in the handler.
+func AggregateTasks(_ string, tasks []*Task) *Task {
+	if len(tasks) == 0 {
+		return nil
+	}
+
+	payloads := make([][]byte, 0, len(tasks))
+	for _, task := range tasks {
+		payloads = append(payloads, task.Payload)
+	}
+
+	payload, _ := json.Marshal(payloads)
+
+	return &Task{
+		Key:     tasks[0].Key,
+		Payload: payload,
+	}
+}
+
+func AggregatedPayloads(task *Task) (payloads [][]byte, err error) {
+	if err = json.Unmarshal(task.Payload, &payloads); err != nil {
+		err = fmt.Errorf("%w: %w", ErrorInvalidPayload, err)
+	}
+
+	return
+}
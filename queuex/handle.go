@@ -0,0 +1,115 @@
+package queuex
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/GizmoVault/gotools/base/errorx"
+)
+
+const (
+	// DefaultResultRetention is how long EnqueueWithHandle keeps a completed task and its result by default.
+	DefaultResultRetention = time.Hour
+
+	defaultHandlePollInterval = 100 * time.Millisecond
+)
+
+// TaskHandle follows a task through an Inspector of its queue.
+type TaskHandle struct {
+	id           string
+	inspector    Inspector
+	pollInterval time.Duration
+}
+
+func NewTaskHandle(id string, inspector Inspector) *TaskHandle {
+	return &TaskHandle{
+		id:           id,
+		inspector:    inspector,
+		pollInterval: defaultHandlePollInterval,
+	}
+}
+
+// EnqueueWithHandle enqueues task and returns a handle on it. The task is retained for DefaultResultRetention
+// after completion unless opts set another Retention, a task that is not retained cannot be awaited.
+func EnqueueWithHandle(q ProducerQueue, inspector Inspector, task *Task, delay time.Duration,
+	opts ...Option) (*TaskHandle, error) {
+	if q == nil || inspector == nil {
+		return nil, errorx.ErrInvalidArgs
+	}
+
+	id, err := q.Enqueue(task, delay, append([]Option{Retention(DefaultResultRetention)}, opts...)...)
+	if err != nil {
+		return nil, err
+	}
+
+	return NewTaskHandle(id, inspector), nil
+}
+
+func (h *TaskHandle) ID() string {
+	return h.id
+}
+
+// WithPollInterval sets how often Wait looks at the task.
+func (h *TaskHandle) WithPollInterval(d time.Duration) *TaskHandle {
+	if d > 0 {
+		h.pollInterval = d
+	}
+
+	return h
+}
+
+func (h *TaskHandle) State() (TaskState, error) {
+	info, err := h.inspector.GetTaskInfo(h.id)
+	if err != nil {
+		return 0, err
+	}
+
+	return info.State, nil
+}
+
+// Result returns the result of a completed task, errorx.ErrConflict if the task is not completed yet and
+// ErrorTaskFailed if it is dead.
+func (h *TaskHandle) Result() ([]byte, error) {
+	info, err := h.inspector.GetTaskInfo(h.id)
+	if err != nil {
+		return nil, err
+	}
+
+	return infoResult(info)
+}
+
+// Wait blocks until the task is completed or dead, or ctx is done.
+func (h *TaskHandle) Wait(ctx context.Context) ([]byte, error) {
+	ticker := time.NewTicker(h.pollInterval)
+	defer ticker.Stop()
+
+	for {
+		info, err := h.inspector.GetTaskInfo(h.id)
+		if err != nil {
+			return nil, err
+		}
+
+		if result, err := infoResult(info); !errors.Is(err, errorx.ErrConflict) {
+			return result, err
+		}
+
+		select {
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		case <-ticker.C:
+		}
+	}
+}
+
+func infoResult(info *TaskInfo) ([]byte, error) {
+	switch info.State {
+	case TaskStateCompleted:
+		return info.Result, nil
+	case TaskStateDead:
+		return nil, fmt.Errorf("%w: %s", ErrorTaskFailed, info.LastErr)
+	default:
+		return nil, errorx.ErrConflict
+	}
+}
@@ -0,0 +1,180 @@
+package asynqx
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"time"
+
+	"github.com/GizmoVault/gotools/queuex"
+	"github.com/hibiken/asynq"
+	"github.com/redis/go-redis/v9"
+)
+
+const (
+	groupHeader      = "queuex-group"
+	groupEntryHeader = "queuex-group-entry"
+	groupKeyPrefix   = "queuex:group:"
+
+	// groupPostponeDelay is how long a task waits when it is not the head of its group. asynq forwards the
+	// postponed tasks on its DelayedTaskCheckInterval, the head running the next task when it finishes is what
+	// keeps a group moving.
+	groupPostponeDelay = time.Second
+	// groupEnqueueGrace is how long a head may miss from asynq before it is dropped.
+	groupEnqueueGrace = 10 * time.Second
+)
+
+// ApplyAggregation configures the asynq server to merge the tasks enqueued with queuex.AggregateGroup as agg says.
+//
+//nolint:gocritic // follow asynq
+func ApplyAggregation(cfg *asynq.Config, agg queuex.AggregationConfig) {
+	aggregate := agg.GetAggregate()
+
+	cfg.GroupAggregator = asynq.GroupAggregatorFunc(func(group string, tasks []*asynq.Task) *asynq.Task {
+		qTasks := make([]*queuex.Task, 0, len(tasks))
+		for _, task := range tasks {
+			qTasks = append(qTasks, &queuex.Task{
+				Key:     task.Type(),
+				Payload: task.Payload(),
+			})
+		}
+
+		task := aggregate(group, qTasks)
+		if task == nil {
+			return nil
+		}
+
+		return asynq.NewTask(task.Key, task.Payload)
+	})
+	cfg.GroupGracePeriod = agg.GetGracePeriod()
+	cfg.GroupMaxDelay = agg.MaxDelay
+	cfg.GroupMaxSize = agg.MaxSize
+}
+
+// groupSequencer runs the tasks of a group one at a time, in the order they were enqueued, across every consumer
+// process. The producer appends the task to a redis list of its group before enqueueing it, a consumer only runs
+// the task at the head of the list and postpones the others without holding a worker. The head is removed once it
+// finished for good, and the next task is moved to pending at once instead of waiting for its postpone delay.
+type groupSequencer struct {
+	rdb       redis.UniversalClient
+	inspector *asynq.Inspector
+}
+
+type groupEntry struct {
+	ID    string `json:"id"`
+	Queue string `json:"queue"`
+	At    int64  `json:"at"`
+}
+
+func newGroupSequencer(rdb redis.UniversalClient) *groupSequencer {
+	return &groupSequencer{
+		rdb:       rdb,
+		inspector: asynq.NewInspectorFromRedisClient(rdb),
+	}
+}
+
+func groupListKey(group string) string {
+	return groupKeyPrefix + group
+}
+
+// push appends the task to its group, the returned entry goes with the task.
+func (gs *groupSequencer) push(ctx context.Context, group, queue, id string) (string, error) {
+	d, err := json.Marshal(groupEntry{ID: id, Queue: queue, At: time.Now().UnixNano()})
+	if err != nil {
+		return "", err
+	}
+
+	entry := string(d)
+
+	if err = gs.rdb.RPush(ctx, groupListKey(group), entry).Err(); err != nil {
+		return "", err
+	}
+
+	return entry, nil
+}
+
+// remove drops the entry of a task that was not enqueued.
+func (gs *groupSequencer) remove(ctx context.Context, group, entry string) error {
+	return gs.rdb.LRem(ctx, groupListKey(group), 1, entry).Err()
+}
+
+// turn tells whether the task of entry is the head of its group. The heads whose task is gone or finished are
+// dropped on the way, so a task deleted through the inspector does not block its group.
+func (gs *groupSequencer) turn(ctx context.Context, group, entry string) (bool, error) {
+	key := groupListKey(group)
+
+	for {
+		head, err := gs.rdb.LIndex(ctx, key, 0).Result()
+		if errors.Is(err, redis.Nil) {
+			// dropped as stale, nothing is ahead of it any more
+			return true, nil
+		}
+
+		if err != nil {
+			return false, err
+		}
+
+		if head == entry {
+			return true, nil
+		}
+
+		if _, err = gs.rdb.LPos(ctx, key, entry, redis.LPosArgs{}).Result(); errors.Is(err, redis.Nil) {
+			return true, nil
+		} else if err != nil {
+			return false, err
+		}
+
+		if !gs.stale(head) {
+			return false, nil
+		}
+
+		if err = gs.rdb.LRem(ctx, key, 1, head).Err(); err != nil {
+			return false, err
+		}
+	}
+}
+
+// stale tells whether the task of a head entry no longer runs. A task missing for a while is stale, right after
+// it was pushed its producer may not have enqueued it yet.
+func (gs *groupSequencer) stale(head string) bool {
+	var e groupEntry
+	if err := json.Unmarshal([]byte(head), &e); err != nil {
+		return true
+	}
+
+	info, err := gs.inspector.GetTaskInfo(e.Queue, e.ID)
+	if err != nil {
+		return (errors.Is(err, asynq.ErrTaskNotFound) || errors.Is(err, asynq.ErrQueueNotFound)) &&
+			time.Since(time.Unix(0, e.At)) > groupEnqueueGrace
+	}
+
+	return info.State == asynq.TaskStateCompleted || info.State == asynq.TaskStateArchived
+}
+
+// done removes the finished head and runs the next task of the group.
+func (gs *groupSequencer) done(ctx context.Context, group, entry string) error {
+	key := groupListKey(group)
+
+	if err := gs.rdb.LRem(ctx, key, 1, entry).Err(); err != nil {
+		return err
+	}
+
+	next, err := gs.rdb.LIndex(ctx, key, 0).Result()
+	if errors.Is(err, redis.Nil) {
+		return nil
+	}
+
+	if err != nil {
+		return err
+	}
+
+	var e groupEntry
+	if err = json.Unmarshal([]byte(next), &e); err != nil {
+		return nil
+	}
+
+	// the next task may be pending or running already
+	_ = gs.inspector.RunTask(e.Queue, e.ID)
+
+	return nil
+}
@@ -0,0 +1,86 @@
+package asynqx
+
+import (
+	"encoding/json"
+	"testing"
+	"time"
+
+	"github.com/GizmoVault/gotools/queuex"
+	"github.com/alicebob/miniredis/v2"
+	"github.com/hibiken/asynq"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestGroupSequencer(t *testing.T) {
+	rdb := RedisClientOpt{Addr: miniredis.RunT(t).Addr()}.makeRedisClient()
+	defer rdb.Close()
+
+	gs := newGroupSequencer(rdb)
+	client := asynq.NewClientFromRedisClient(rdb)
+
+	enqueue := func(group, id string) string {
+		entry, err := gs.push(t.Context(), group, "default", id)
+		require.NoError(t, err)
+
+		_, err = client.Enqueue(asynq.NewTask("k", nil), asynq.TaskID(id))
+		require.NoError(t, err)
+
+		return entry
+	}
+
+	turn := func(group, entry string) bool {
+		ok, err := gs.turn(t.Context(), group, entry)
+		require.NoError(t, err)
+
+		return ok
+	}
+
+	first, second, third := enqueue("default:g", "1"), enqueue("default:g", "2"), enqueue("default:g", "3")
+
+	assert.False(t, turn("default:g", second))
+	assert.True(t, turn("default:g", first))
+
+	require.NoError(t, gs.done(t.Context(), "default:g", first))
+	assert.True(t, turn("default:g", second))
+
+	// a finished head does not block its group
+	require.NoError(t, gs.inspector.ArchiveTask("default", "2"))
+	assert.True(t, turn("default:g", third))
+
+	// a head missing right after it was pushed may still be enqueued, an old one was deleted
+	missing, err := gs.push(t.Context(), "default:h", "default", "missing")
+	require.NoError(t, err)
+
+	fourth := enqueue("default:h", "4")
+	assert.False(t, turn("default:h", fourth))
+
+	require.NoError(t, gs.remove(t.Context(), "default:h", missing))
+
+	old, err := json.Marshal(groupEntry{ID: "deleted", Queue: "default", At: time.Now().Add(-time.Minute).UnixNano()})
+	require.NoError(t, err)
+	require.NoError(t, rdb.LPush(t.Context(), groupListKey("default:h"), string(old)).Err())
+
+	assert.True(t, turn("default:h", fourth))
+}
+
+func TestToAsynqTask(t *testing.T) {
+	opts := queuex.NewOptions(queuex.GroupKey("u1"))
+	assert.Equal(t, "default:u1", groupName(opts))
+
+	task := toAsynqTask(&queuex.Task{Key: "k"}, opts, groupName(opts), "entry")
+	assert.Equal(t, "default:u1", task.Headers()[groupHeader])
+	assert.Equal(t, "entry", task.Headers()[groupEntryHeader])
+	assert.Equal(t, map[string]string{maxRetryHeader: "0"},
+		toAsynqTask(&queuex.Task{Key: "k"}, queuex.NewOptions(queuex.MaxRetry(0)), "", "").Headers())
+
+	cfg := asynq.Config{}
+	ApplyAggregation(&cfg, queuex.AggregationConfig{MaxSize: 2})
+	assert.Equal(t, queuex.DefaultAggregationGracePeriod, cfg.GroupGracePeriod)
+
+	merged := cfg.GroupAggregator.Aggregate("g", []*asynq.Task{asynq.NewTask("k", []byte("a")),
+		asynq.NewTask("k", []byte("b"))})
+	payloads, err := queuex.AggregatedPayloads(&queuex.Task{Key: merged.Type(), Payload: merged.Payload()})
+	require.NoError(t, err)
+	assert.Equal(t, [][]byte{[]byte("a"), []byte("b")}, payloads)
+}
@@ -0,0 +1,275 @@
+package asynqx
+
+import (
+	"errors"
+	"strings"
+
+	"github.com/GizmoVault/gotools/base/errorx"
+	"github.com/GizmoVault/gotools/queuex"
+	"github.com/hibiken/asynq"
+)
+
+const (
+	listPageSize = 100
+)
+
+// NewInspector inspects the given queues and all their priority queues, the default queue if none is given.
+//
+//nolint:gocritic // follow asynq
+func NewInspector(redisClientOpt RedisClientOpt, queues ...string) queuex.Inspector {
+	return NewInspectorWithAsynq(asynq.NewInspector(redisClientOpt.ToAsyncQRedisClientOpt()), queues...)
+}
+
+func NewInspectorWithAsynq(inspector *asynq.Inspector, queues ...string) queuex.Inspector {
+	if len(queues) == 0 {
+		queues = []string{queuex.DefaultQueueName}
+	}
+
+	impl := &inspectorImpl{
+		inspector: inspector,
+	}
+
+	for queue := range PriorityQueues(queues...) {
+		impl.queues = append(impl.queues, queue)
+	}
+
+	return impl
+}
+
+type inspectorImpl struct {
+	inspector *asynq.Inspector
+	queues    []string
+}
+
+func toTaskState(state asynq.TaskState) queuex.TaskState {
+	switch state {
+	case asynq.TaskStateActive:
+		return queuex.TaskStateActive
+	case asynq.TaskStateScheduled:
+		return queuex.TaskStateScheduled
+	case asynq.TaskStateRetry:
+		return queuex.TaskStateRetry
+	case asynq.TaskStateArchived:
+		return queuex.TaskStateDead
+	case asynq.TaskStateCompleted:
+		return queuex.TaskStateCompleted
+	default:
+		return queuex.TaskStatePending
+	}
+}
+
+func splitPriorityQueueName(name string) (queue string, p queuex.Priority) {
+	for priority := range priorityWeights {
+		if priority != queuex.PriorityDefault && strings.HasSuffix(name, ":"+priority.String()) {
+			return strings.TrimSuffix(name, ":"+priority.String()), priority
+		}
+	}
+
+	return name, queuex.PriorityDefault
+}
+
+func toTaskInfo(info *asynq.TaskInfo) *queuex.TaskInfo {
+	queue, priority := splitPriorityQueueName(info.Queue)
+	maxRetry, _ := taskMaxRetry(info.Headers, info.MaxRetry)
+
+	return &queuex.TaskInfo{
+		ID:            info.ID,
+		Key:           info.Type,
+		Payload:       info.Payload,
+		Queue:         queue,
+		Priority:      priority,
+		State:         toTaskState(info.State),
+		MaxRetry:      maxRetry,
+		Retried:       info.Retried,
+		LastErr:       info.LastErr,
+		LastFailedAt:  info.LastFailedAt,
+		NextProcessAt: info.NextProcessAt,
+		CompletedAt:   info.CompletedAt,
+		Result:        info.Result,
+	}
+}
+
+func isNotFound(err error) bool {
+	return errors.Is(err, asynq.ErrQueueNotFound) || errors.Is(err, asynq.ErrTaskNotFound)
+}
+
+// findTask returns the queue holding the task with id.
+func (impl *inspectorImpl) findTask(id string) (queue string, info *asynq.TaskInfo, err error) {
+	for _, queue = range impl.queues {
+		info, err = impl.inspector.GetTaskInfo(queue, id)
+		if err == nil {
+			return
+		}
+
+		if !isNotFound(err) {
+			return
+		}
+	}
+
+	err = errorx.ErrNotExists
+
+	return
+}
+
+func (impl *inspectorImpl) GetTaskInfo(id string) (*queuex.TaskInfo, error) {
+	_, info, err := impl.findTask(id)
+	if err != nil {
+		return nil, err
+	}
+
+	return toTaskInfo(info), nil
+}
+
+func (impl *inspectorImpl) list(method func(queue string, opts ...asynq.ListOption) ([]*asynq.TaskInfo, error)) (
+	infos []*queuex.TaskInfo, err error) {
+	for _, queue := range impl.queues {
+		for page := 1; ; page++ {
+			tasks, e := method(queue, asynq.Page(page), asynq.PageSize(listPageSize))
+			if e != nil {
+				if errors.Is(e, asynq.ErrQueueNotFound) {
+					break
+				}
+
+				err = e
+
+				return
+			}
+
+			for _, task := range tasks {
+				infos = append(infos, toTaskInfo(task))
+			}
+
+			if len(tasks) < listPageSize {
+				break
+			}
+		}
+	}
+
+	return
+}
+
+func (impl *inspectorImpl) ListPending() ([]*queuex.TaskInfo, error) {
+	return impl.list(impl.inspector.ListPendingTasks)
+}
+
+func (impl *inspectorImpl) ListScheduled() ([]*queuex.TaskInfo, error) {
+	return impl.list(impl.inspector.ListScheduledTasks)
+}
+
+func (impl *inspectorImpl) ListRetry() ([]*queuex.TaskInfo, error) {
+	return impl.list(impl.inspector.ListRetryTasks)
+}
+
+func (impl *inspectorImpl) ListDead() ([]*queuex.TaskInfo, error) {
+	return impl.list(impl.inspector.ListArchivedTasks)
+}
+
+func (impl *inspectorImpl) Cancel(id string) error {
+	queue, info, err := impl.findTask(id)
+	if err != nil {
+		return err
+	}
+
+	if info.State == asynq.TaskStateActive || info.State == asynq.TaskStateCompleted {
+		return errorx.ErrConflict
+	}
+
+	return impl.inspector.DeleteTask(queue, id)
+}
+
+func (impl *inspectorImpl) Requeue(id string) error {
+	queue, info, err := impl.findTask(id)
+	if err != nil {
+		return err
+	}
+
+	switch info.State {
+	case asynq.TaskStateScheduled, asynq.TaskStateRetry, asynq.TaskStateArchived:
+		return impl.inspector.RunTask(queue, id)
+	default:
+		return errorx.ErrConflict
+	}
+}
+
+func (impl *inspectorImpl) Purge(state queuex.TaskState) (n int, err error) {
+	var method func(queue string) (int, error)
+
+	switch state {
+	case queuex.TaskStatePending:
+		method = impl.inspector.DeleteAllPendingTasks
+	case queuex.TaskStateScheduled:
+		method = impl.inspector.DeleteAllScheduledTasks
+	case queuex.TaskStateRetry:
+		method = impl.inspector.DeleteAllRetryTasks
+	case queuex.TaskStateDead:
+		method = impl.inspector.DeleteAllArchivedTasks
+	case queuex.TaskStateCompleted:
+		method = impl.inspector.DeleteAllCompletedTasks
+	default:
+		return 0, errorx.ErrInvalidArgs
+	}
+
+	queues, err := impl.existingQueues()
+	if err != nil {
+		return
+	}
+
+	for _, queue := range queues {
+		cnt, e := method(queue)
+		if e != nil {
+			return n, e
+		}
+
+		n += cnt
+	}
+
+	return
+}
+
+// existingQueues returns the inspected queues redis knows, asynq does not wrap the not found errors of the queue
+// wide operations.
+func (impl *inspectorImpl) existingQueues() (queues []string, err error) {
+	all, err := impl.inspector.Queues()
+	if err != nil {
+		return
+	}
+
+	known := make(map[string]bool, len(all))
+
+	for _, queue := range all {
+		known[queue] = true
+	}
+
+	for _, queue := range impl.queues {
+		if known[queue] {
+			queues = append(queues, queue)
+		}
+	}
+
+	return
+}
+
+func (impl *inspectorImpl) Stats() (*queuex.QueueStats, error) {
+	stats := &queuex.QueueStats{}
+
+	queues, err := impl.existingQueues()
+	if err != nil {
+		return nil, err
+	}
+
+	for _, queue := range queues {
+		info, err := impl.inspector.GetQueueInfo(queue)
+		if err != nil {
+			return nil, err
+		}
+
+		stats.Pending += info.Pending + info.Aggregating
+		stats.Active += info.Active
+		stats.Scheduled += info.Scheduled
+		stats.Retry += info.Retry
+		stats.Dead += info.Archived
+		stats.Completed += info.Completed
+	}
+
+	return stats, nil
+}
@@ -0,0 +1,48 @@
+package asynqx
+
+import (
+	"testing"
+	"time"
+
+	"github.com/GizmoVault/gotools/base/errorx"
+	"github.com/GizmoVault/gotools/queuex"
+	"github.com/alicebob/miniredis/v2"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestInspector(t *testing.T) {
+	redisOpt := RedisClientOpt{Addr: miniredis.RunT(t).Addr()}
+
+	queue, err := NewProducerQueue(redisOpt)
+	require.NoError(t, err)
+
+	inspector := NewInspector(redisOpt)
+
+	pendingID, err := queue.Enqueue(&queuex.Task{Key: "insp:pending"}, 0)
+	require.NoError(t, err)
+
+	scheduledID, err := queue.Enqueue(&queuex.Task{Key: "insp:scheduled"}, time.Hour)
+	require.NoError(t, err)
+
+	stats, err := inspector.Stats()
+	require.NoError(t, err)
+	assert.Equal(t, 1, stats.Pending)
+	assert.Equal(t, 1, stats.Scheduled)
+
+	require.ErrorIs(t, inspector.Requeue(pendingID), errorx.ErrConflict)
+	require.ErrorIs(t, inspector.Requeue("unknown"), errorx.ErrNotExists)
+
+	require.NoError(t, inspector.Requeue(scheduledID))
+
+	info, err := inspector.GetTaskInfo(scheduledID)
+	require.NoError(t, err)
+	assert.Equal(t, queuex.TaskStatePending, info.State)
+
+	require.NoError(t, inspector.Cancel(pendingID))
+	require.ErrorIs(t, inspector.Cancel(pendingID), errorx.ErrNotExists)
+
+	n, err := inspector.Purge(queuex.TaskStatePending)
+	require.NoError(t, err)
+	assert.Equal(t, 1, n)
+}
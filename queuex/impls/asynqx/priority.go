@@ -0,0 +1,36 @@
+package asynqx
+
+import "github.com/GizmoVault/gotools/queuex"
+
+// asynq has no per-task priority, tasks are routed to one weighted queue per priority instead.
+var priorityWeights = map[queuex.Priority]int{
+	queuex.PriorityLow:      1,
+	queuex.PriorityDefault:  3,
+	queuex.PriorityHigh:     6,
+	queuex.PriorityCritical: 9,
+}
+
+func PriorityQueueName(queue string, p queuex.Priority) string {
+	if queue == "" {
+		queue = queuex.DefaultQueueName
+	}
+
+	if p == queuex.PriorityDefault || p == 0 {
+		return queue
+	}
+
+	return queue + ":" + p.String()
+}
+
+// PriorityQueues returns the asynq.Config Queues that consume every priority of the given queues.
+func PriorityQueues(queues ...string) map[string]int {
+	m := make(map[string]int, len(queues)*len(priorityWeights))
+
+	for _, queue := range queues {
+		for p, weight := range priorityWeights {
+			m[PriorityQueueName(queue, p)] = weight
+		}
+	}
+
+	return m
+}
@@ -0,0 +1,18 @@
+package asynqx
+
+import (
+	"testing"
+
+	"github.com/GizmoVault/gotools/queuex"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestPriorityQueues(t *testing.T) {
+	assert.Equal(t, "default", PriorityQueueName("", queuex.PriorityDefault))
+	assert.Equal(t, "email:high", PriorityQueueName("email", queuex.PriorityHigh))
+
+	queues := PriorityQueues("email")
+	assert.Len(t, queues, 4)
+	assert.Equal(t, 9, queues["email:critical"])
+	assert.Equal(t, 3, queues["email"])
+}
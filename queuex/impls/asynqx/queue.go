@@ -3,10 +3,16 @@ package asynqx
 import (
 	"context"
 	"errors"
+	"fmt"
+	"strconv"
+	"sync"
 	"time"
 
+	"github.com/GizmoVault/gotools/base/errorx"
 	"github.com/GizmoVault/gotools/queuex"
+	"github.com/google/uuid"
 	"github.com/hibiken/asynq"
+	"github.com/redis/go-redis/v9"
 )
 
 type RedisClientOpt struct {
@@ -69,62 +75,262 @@ func (opt RedisClientOpt) ToAsyncQRedisClientOpt() asynq.RedisClientOpt {
 	}
 }
 
+//nolint:gocritic // follow asynq
+func (opt RedisClientOpt) makeRedisClient() redis.UniversalClient {
+	rdb, _ := opt.ToAsyncQRedisClientOpt().MakeRedisClient().(redis.UniversalClient)
+
+	return rdb
+}
+
+func defaultServerConfig() asynq.Config {
+	cfg := asynq.Config{
+		Concurrency: 10,
+		Queues:      PriorityQueues(queuex.DefaultQueueName),
+	}
+
+	ApplyAggregation(&cfg, queuex.AggregationConfig{})
+	ApplyFlowControl(&cfg)
+
+	return cfg
+}
+
 //
 //
 //
 
 //nolint:gocritic // follow asynq
 func NewConsumerQueue(redisClientOpt RedisClientOpt) (queuex.ConsumerQueue, error) {
-	return NewConsumerQueueWithServer(asynq.NewServer(
-		redisClientOpt.ToAsyncQRedisClientOpt(),
-		asynq.Config{
-			Concurrency: 10,
-		},
-	))
+	rdb := redisClientOpt.makeRedisClient()
+
+	server := asynq.NewServerFromRedisClient(rdb, defaultServerConfig())
+	if err := server.Ping(); err != nil {
+		_ = rdb.Close()
+
+		return nil, err
+	}
+
+	impl := newServerQueueImpl(server, newGroupSequencer(rdb), nil)
+	impl.rdb = rdb
+
+	return impl, nil
 }
 
+// NewConsumerQueueWithServer consumes through server. It has no redis client to order the groups with, the
+// tasks enqueued with queuex.GroupKey run as they come.
 func NewConsumerQueueWithServer(server *asynq.Server) (q queuex.ConsumerQueue, err error) {
+	return NewConsumerQueueWithServerAndMux(server, nil)
+}
+
+func NewConsumerQueueWithServerAndMux(server *asynq.Server, mux *queuex.ServeMux) (q queuex.ConsumerQueue, err error) {
 	err = server.Ping()
 	if err != nil {
 		return
 	}
 
+	return newServerQueueImpl(server, nil, mux), nil
+}
+
+func newServerQueueImpl(server *asynq.Server, groups *groupSequencer, mux *queuex.ServeMux) *serverQueueImpl {
+	if mux == nil {
+		mux = queuex.NewServeMux()
+	}
+
 	return &serverQueueImpl{
 		server: server,
-		mux:    asynq.NewServeMux(),
-	}, nil
+		mux:    mux,
+		groups: groups,
+		stopCh: make(chan struct{}),
+	}
 }
 
 type serverQueueImpl struct {
 	server *asynq.Server
-	mux    *asynq.ServeMux
+	mux    *queuex.ServeMux
+	// groups is nil without a redis client, the groups then run unordered.
+	groups *groupSequencer
+	// rdb is closed on Stop, nil unless the queue made it.
+	rdb redis.UniversalClient
+
+	stopOnce sync.Once
+	stopCh   chan struct{}
+}
+
+func (impl *serverQueueImpl) Run(ctx context.Context) error {
+	select {
+	case <-impl.stopCh:
+		return errorx.ErrLogic
+	default:
+	}
+
+	if err := impl.server.Start(asynq.HandlerFunc(impl.processTask)); err != nil {
+		return err
+	}
+
+	select {
+	case <-ctx.Done():
+		impl.Stop()
+	case <-impl.stopCh:
+	}
+
+	return nil
 }
 
-func (impl *serverQueueImpl) Run() error {
-	return impl.server.Run(impl.mux)
+// Stop waits for the running handlers and shuts the server down, it cannot be started again.
+func (impl *serverQueueImpl) Stop() {
+	impl.stopOnce.Do(func() {
+		impl.server.Shutdown()
+
+		if impl.rdb != nil {
+			_ = impl.rdb.Close()
+		}
+
+		close(impl.stopCh)
+	})
 }
 
 func (impl *serverQueueImpl) HandleFunc(key string, h queuex.Handler) {
-	impl.mux.HandleFunc(key, func(ctx context.Context, task *asynq.Task) error {
-		taskID, _ := asynq.GetTaskID(ctx)
+	impl.mux.HandleFunc(key, h)
+}
+
+func (impl *serverQueueImpl) Use(mws ...queuex.Middleware) {
+	impl.mux.Use(mws...)
+}
 
-		err := h(ctx, taskID, &queuex.Task{
-			Key:     task.Type(),
-			Payload: task.Payload(),
-		})
+func (impl *serverQueueImpl) ServeMux() *queuex.ServeMux {
+	return impl.mux
+}
 
-		if err != nil && errors.Is(err, queuex.ErrorSkipRetry) {
-			err = asynq.SkipRetry
-		}
+func (impl *serverQueueImpl) processTask(ctx context.Context, task *asynq.Task) error {
+	taskID, _ := asynq.GetTaskID(ctx)
+	retried, _ := asynq.GetRetryCount(ctx)
+	maxRetry, _ := asynq.GetMaxRetry(ctx)
+	maxRetry, enforced := taskMaxRetry(task.Headers(), maxRetry)
+	queueName, _ := asynq.GetQueueName(ctx)
+	queue, _ := splitPriorityQueueName(queueName)
+
+	ctx = queuex.WithTaskMeta(ctx, queuex.TaskMeta{
+		ID:       taskID,
+		Queue:    queue,
+		Retried:  retried,
+		MaxRetry: maxRetry,
+	})
+
+	ctx, w := queuex.WithResultWriter(ctx)
 
+	group, entry := task.Headers()[groupHeader], task.Headers()[groupEntryHeader]
+	if impl.groups == nil {
+		entry = ""
+	}
+
+	if entry != "" {
+		turn, err := impl.groups.turn(ctx, group, entry)
 		if err != nil {
-			_, _ = task.ResultWriter().Write([]byte(err.Error()))
-		} else {
-			_, _ = task.ResultWriter().Write([]byte(""))
+			return err
 		}
 
-		return err
+		if !turn {
+			return &queuex.RateLimitError{Delay: groupPostponeDelay, Reason: "waiting for group " + group}
+		}
+	}
+
+	err := impl.mux.ProcessTask(ctx, taskID, &queuex.Task{
+		Key:     task.Type(),
+		Payload: task.Payload(),
 	})
+
+	if err != nil && (errors.Is(err, queuex.ErrorSkipRetry) || enforced && exhausted(err, retried, maxRetry)) {
+		err = fmt.Errorf("%w: %w", asynq.SkipRetry, err)
+	}
+
+	if entry != "" && finished(err, retried, maxRetry) {
+		_ = impl.groups.done(context.WithoutCancel(ctx), group, entry)
+	}
+
+	if err != nil {
+		return err
+	}
+
+	if result := w.Result(); len(result) > 0 {
+		_, _ = task.ResultWriter().Write(result)
+	}
+
+	return nil
+}
+
+// finished tells whether a task is done with its attempts, so the next task of its group may run.
+func finished(err error, retried, maxRetry int) bool {
+	if err == nil || errors.Is(err, asynq.SkipRetry) {
+		return true
+	}
+
+	return exhausted(err, retried, maxRetry)
+}
+
+//
+//
+//
+
+// NewQueue produces and consumes through the same redis, with the default server config of NewConsumerQueue.
+//
+//nolint:gocritic // follow asynq
+func NewQueue(redisClientOpt RedisClientOpt) (queuex.Queue, error) {
+	rdb := redisClientOpt.makeRedisClient()
+
+	q, err := newQueueImpl(rdb, defaultServerConfig(), nil)
+	if err != nil {
+		_ = rdb.Close()
+
+		return nil, err
+	}
+
+	q.rdb = rdb
+
+	return q, nil
+}
+
+// NewQueueWithRedisClient produces and consumes through rdb, which the caller closes after Stop. cfg needs
+// ApplyFlowControl for the tasks of a group to wait for their turn.
+//
+//nolint:gocritic // follow asynq
+func NewQueueWithRedisClient(rdb redis.UniversalClient, cfg asynq.Config, mux *queuex.ServeMux) (queuex.Queue, error) {
+	return newQueueImpl(rdb, cfg, mux)
+}
+
+//nolint:gocritic // follow asynq
+func newQueueImpl(rdb redis.UniversalClient, cfg asynq.Config, mux *queuex.ServeMux) (*queueImpl, error) {
+	server := asynq.NewServerFromRedisClient(rdb, cfg)
+	if err := server.Ping(); err != nil {
+		return nil, err
+	}
+
+	groups := newGroupSequencer(rdb)
+
+	return &queueImpl{
+		serverQueueImpl: newServerQueueImpl(server, groups, mux),
+		clientQueueImpl: &clientQueueImpl{client: asynq.NewClientFromRedisClient(rdb), groups: groups},
+	}, nil
+}
+
+// NewQueueWithServerAndClient has no redis client to order the groups with, see NewConsumerQueueWithServer and
+// NewProducerQueueWithClient.
+func NewQueueWithServerAndClient(server *asynq.Server, client *asynq.Client, mux *queuex.ServeMux) (queuex.Queue, error) {
+	if err := server.Ping(); err != nil {
+		return nil, err
+	}
+
+	if err := client.Ping(); err != nil {
+		return nil, err
+	}
+
+	return &queueImpl{
+		serverQueueImpl: newServerQueueImpl(server, nil, mux),
+		clientQueueImpl: &clientQueueImpl{client: client},
+	}, nil
+}
+
+type queueImpl struct {
+	*serverQueueImpl
+	*clientQueueImpl
 }
 
 //
@@ -133,9 +339,23 @@ func (impl *serverQueueImpl) HandleFunc(key string, h queuex.Handler) {
 
 //nolint:gocritic // follow asynq
 func NewProducerQueue(redisClientOpt RedisClientOpt) (queuex.ProducerQueue, error) {
-	return NewProducerQueueWithClient(asynq.NewClient(redisClientOpt.ToAsyncQRedisClientOpt()))
+	rdb := redisClientOpt.makeRedisClient()
+
+	client := asynq.NewClientFromRedisClient(rdb)
+	if err := client.Ping(); err != nil {
+		_ = rdb.Close()
+
+		return nil, err
+	}
+
+	return &clientQueueImpl{
+		client: client,
+		groups: newGroupSequencer(rdb),
+	}, nil
 }
 
+// NewProducerQueueWithClient enqueues through client. It has no redis client to order the groups with, so
+// queuex.GroupKey fails with errorx.ErrInvalidArgs.
 func NewProducerQueueWithClient(client *asynq.Client) (q queuex.ProducerQueue, err error) {
 	err = client.Ping()
 	if err != nil {
@@ -149,19 +369,60 @@ func NewProducerQueueWithClient(client *asynq.Client) (q queuex.ProducerQueue, e
 
 type clientQueueImpl struct {
 	client *asynq.Client
+	// groups is nil without a redis client.
+	groups *groupSequencer
 }
 
-func (impl *clientQueueImpl) Enqueue(task *queuex.Task, delay time.Duration) (id string, err error) {
-	var options []asynq.Option
+func (impl *clientQueueImpl) Enqueue(task *queuex.Task, delay time.Duration, opts ...queuex.Option) (id string, err error) {
+	if task == nil || task.Key == "" {
+		err = errorx.ErrInvalidArgs
+
+		return
+	}
+
+	qOptions := queuex.NewOptions(opts...)
+
+	var group, entry string
+
+	if qOptions.GroupKey != "" {
+		if impl.groups == nil {
+			err = errorx.ErrInvalidArgs
+
+			return
+		}
+
+		if qOptions.TaskID == "" {
+			qOptions.TaskID = uuid.NewString()
+		}
+
+		group = groupName(qOptions)
+
+		entry, err = impl.groups.push(context.Background(), group, PriorityQueueName(qOptions.Queue, qOptions.Priority),
+			qOptions.TaskID)
+		if err != nil {
+			return
+		}
+	}
 
-	options = append(options, asynq.Retention(time.Hour))
+	options := toAsynqOptions(qOptions)
 
 	if delay > 0 {
 		options = append(options, asynq.ProcessIn(delay))
 	}
 
-	taskInfo, err := impl.client.Enqueue(asynq.NewTask(task.Key, task.Payload), options...)
+	taskInfo, err := impl.client.Enqueue(toAsynqTask(task, qOptions, group, entry), options...)
 	if err != nil {
+		if entry != "" {
+			_ = impl.groups.remove(context.Background(), group, entry)
+		}
+
+		switch {
+		case errors.Is(err, asynq.ErrDuplicateTask):
+			err = queuex.ErrorDuplicateTask
+		case errors.Is(err, asynq.ErrTaskIDConflict):
+			err = queuex.ErrorTaskIDConflict
+		}
+
 		return
 	}
 
@@ -169,3 +430,52 @@ func (impl *clientQueueImpl) Enqueue(task *queuex.Task, delay time.Duration) (id
 
 	return
 }
+
+func groupName(opts *queuex.Options) string {
+	return opts.Queue + ":" + opts.GroupKey
+}
+
+func toAsynqTask(task *queuex.Task, opts *queuex.Options, group, entry string) *asynq.Task {
+	headers := map[string]string{
+		maxRetryHeader: strconv.Itoa(maxRetryOf(opts)),
+	}
+
+	if entry != "" {
+		headers[groupHeader] = group
+		headers[groupEntryHeader] = entry
+	}
+
+	return asynq.NewTaskWithHeaders(task.Key, task.Payload, headers)
+}
+
+func toAsynqOptions(opts *queuex.Options) (options []asynq.Option) {
+	options = append(options, asynq.Queue(PriorityQueueName(opts.Queue, opts.Priority)))
+
+	if opts.TaskID != "" {
+		options = append(options, asynq.TaskID(opts.TaskID))
+	}
+
+	if opts.UniqueTTL > 0 {
+		options = append(options, asynq.Unique(opts.UniqueTTL))
+	}
+
+	if !opts.Deadline.IsZero() {
+		options = append(options, asynq.Deadline(opts.Deadline))
+	}
+
+	if opts.Timeout > 0 {
+		options = append(options, asynq.Timeout(opts.Timeout))
+	}
+
+	options = append(options, asynq.MaxRetry(maxRetryOf(opts)+1))
+
+	if opts.Retention > 0 {
+		options = append(options, asynq.Retention(opts.Retention))
+	}
+
+	if opts.AggregateKey != "" {
+		options = append(options, asynq.Group(opts.AggregateKey))
+	}
+
+	return
+}
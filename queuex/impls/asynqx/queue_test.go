@@ -5,8 +5,13 @@ import (
 	"testing"
 	"time"
 
+	"github.com/GizmoVault/gotools/base/errorx"
 	"github.com/GizmoVault/gotools/queuex"
+	"github.com/GizmoVault/gotools/queuex/queuextest"
+	"github.com/alicebob/miniredis/v2"
+	"github.com/hibiken/asynq"
 	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
 )
 
 func TestQueue(t *testing.T) {
@@ -35,7 +40,7 @@ func TestQueue(t *testing.T) {
 			return nil
 		})
 
-		_ = consumeQueue.Run()
+		_ = consumeQueue.Run(t.Context())
 	}()
 
 	t.Log(time.Now(), "start enqueue")
@@ -87,7 +92,209 @@ func TestQueue2(t *testing.T) {
 		return nil
 	})
 
-	_ = consumeQueue.Run()
+	_ = consumeQueue.Run(t.Context())
 
 	time.Sleep(time.Second * 10)
 }
+
+func TestConformance(t *testing.T) {
+	// the queues of a name share their redis, Persistence reopens one
+	servers := map[string]*miniredis.Miniredis{}
+
+	queuextest.RunConformance(t, queuextest.Factory{
+		New: func(t *testing.T, name string) queuex.Queue {
+			t.Helper()
+
+			server, ok := servers[name]
+			if !ok {
+				server = miniredis.RunT(t)
+				servers[name] = server
+			}
+
+			rdb := RedisClientOpt{Addr: server.Addr()}.makeRedisClient()
+			t.Cleanup(func() { _ = rdb.Close() })
+
+			cfg := asynq.Config{
+				Concurrency:              10,
+				Queues:                   PriorityQueues(queuex.DefaultQueueName),
+				TaskCheckInterval:        100 * time.Millisecond,
+				DelayedTaskCheckInterval: 100 * time.Millisecond,
+				RetryDelayFunc: func(int, error, *asynq.Task) time.Duration {
+					return 0
+				},
+			}
+
+			ApplyFlowControl(&cfg)
+
+			q, err := NewQueueWithRedisClient(rdb, cfg, nil)
+			require.NoError(t, err)
+
+			return q
+		},
+		Precision: time.Second,
+	})
+}
+
+func TestProducerQueueGroupKey(t *testing.T) {
+	redisOpt := RedisClientOpt{Addr: miniredis.RunT(t).Addr()}
+
+	queue, err := NewProducerQueueWithClient(asynq.NewClient(redisOpt.ToAsyncQRedisClientOpt()))
+	require.NoError(t, err)
+
+	_, err = queue.Enqueue(&queuex.Task{Key: "k"}, 0, queuex.GroupKey("g"))
+	require.ErrorIs(t, err, errorx.ErrInvalidArgs)
+
+	queue, err = NewProducerQueue(redisOpt)
+	require.NoError(t, err)
+
+	id, err := queue.Enqueue(&queuex.Task{Key: "k"}, 0, queuex.GroupKey("g"))
+	require.NoError(t, err)
+	assert.NotEmpty(t, id)
+}
+
+func TestQueueRetention(t *testing.T) {
+	redisOpt := RedisClientOpt{Addr: miniredis.RunT(t).Addr()}
+
+	rdb := redisOpt.makeRedisClient()
+	defer rdb.Close()
+
+	queue, err := NewQueueWithRedisClient(rdb, asynq.Config{TaskCheckInterval: 100 * time.Millisecond}, nil)
+	require.NoError(t, err)
+
+	defer queue.Stop()
+
+	done := make(chan string, 2)
+
+	queue.HandleFunc("kept", func(_ context.Context, id string, _ *queuex.Task) error {
+		done <- id
+
+		return nil
+	})
+
+	droppedID, err := queue.Enqueue(&queuex.Task{Key: "kept"}, 0)
+	require.NoError(t, err)
+
+	keptID, err := queue.Enqueue(&queuex.Task{Key: "kept"}, 0, queuex.Retention(time.Hour))
+	require.NoError(t, err)
+
+	go func() {
+		_ = queue.Run(t.Context())
+	}()
+
+	for range 2 {
+		select {
+		case <-done:
+		case <-time.After(5 * time.Second):
+			require.FailNow(t, "task not handled")
+		}
+	}
+
+	inspector := NewInspector(redisOpt)
+
+	// a task is only kept after it completed if it asked for it, as with the other backends
+	require.Eventually(t, func() bool {
+		info, err := inspector.GetTaskInfo(keptID)
+
+		return err == nil && info.State == queuex.TaskStateCompleted
+	}, 5*time.Second, 10*time.Millisecond)
+
+	_, err = inspector.GetTaskInfo(droppedID)
+	require.ErrorIs(t, err, errorx.ErrNotExists)
+}
+
+func TestQueuePostponeWithoutRetries(t *testing.T) {
+	redisOpt := RedisClientOpt{Addr: miniredis.RunT(t).Addr()}
+
+	rdb := redisOpt.makeRedisClient()
+	defer rdb.Close()
+
+	cfg := asynq.Config{Concurrency: 2, TaskCheckInterval: 100 * time.Millisecond}
+	ApplyFlowControl(&cfg)
+
+	queue, err := NewQueueWithRedisClient(rdb, cfg, nil)
+	require.NoError(t, err)
+
+	defer queue.Stop()
+
+	release := make(chan struct{})
+
+	queue.HandleFunc("head", func(context.Context, string, *queuex.Task) error {
+		<-release
+
+		return nil
+	})
+	queue.HandleFunc("next", func(context.Context, string, *queuex.Task) error {
+		return nil
+	})
+
+	_, err = queue.Enqueue(&queuex.Task{Key: "head"}, 0, queuex.GroupKey("g"))
+	require.NoError(t, err)
+
+	id, err := queue.Enqueue(&queuex.Task{Key: "next"}, 0, queuex.GroupKey("g"), queuex.MaxRetry(0))
+	require.NoError(t, err)
+
+	go func() {
+		_ = queue.Run(t.Context())
+	}()
+
+	defer close(release)
+
+	inspector := NewInspector(redisOpt)
+
+	// a task waiting for its turn is postponed, not archived, although it has no retry
+	var info *queuex.TaskInfo
+
+	require.Eventually(t, func() bool {
+		info, err = inspector.GetTaskInfo(id)
+
+		return err == nil && (info.State == queuex.TaskStateRetry || info.State == queuex.TaskStateDead)
+	}, 5*time.Second, 10*time.Millisecond)
+
+	assert.Equal(t, queuex.TaskStateRetry, info.State)
+	assert.Zero(t, info.Retried)
+	assert.Zero(t, info.MaxRetry)
+}
+
+func TestQueuePausedWithoutRetries(t *testing.T) {
+	redisOpt := RedisClientOpt{Addr: miniredis.RunT(t).Addr()}
+
+	rdb := redisOpt.makeRedisClient()
+	defer rdb.Close()
+
+	cfg := asynq.Config{TaskCheckInterval: 100 * time.Millisecond}
+	ApplyFlowControl(&cfg)
+
+	queue, err := NewQueueWithRedisClient(rdb, cfg, nil)
+	require.NoError(t, err)
+
+	defer queue.Stop()
+
+	fc := queuex.NewFlowControl()
+	fc.PauseKeys("paused")
+
+	queue.Use(fc.Middleware())
+	queue.HandleFunc("paused", func(context.Context, string, *queuex.Task) error {
+		return nil
+	})
+
+	id, err := queue.Enqueue(&queuex.Task{Key: "paused"}, 0, queuex.MaxRetry(0))
+	require.NoError(t, err)
+
+	go func() {
+		_ = queue.Run(t.Context())
+	}()
+
+	inspector := NewInspector(redisOpt)
+
+	// a paused task is rescheduled rather than failed, whatever its retries
+	var info *queuex.TaskInfo
+
+	require.Eventually(t, func() bool {
+		info, err = inspector.GetTaskInfo(id)
+
+		return err == nil && (info.State == queuex.TaskStateRetry || info.State == queuex.TaskStateDead)
+	}, 5*time.Second, 10*time.Millisecond)
+
+	assert.Equal(t, queuex.TaskStateRetry, info.State)
+	assert.Zero(t, info.Retried)
+}
@@ -0,0 +1,73 @@
+package asynqx
+
+import (
+	"strconv"
+	"time"
+
+	"github.com/GizmoVault/gotools/queuex"
+	"github.com/hibiken/asynq"
+)
+
+// maxRetryHeader keeps the MaxRetry of a task enqueued by this package. asynq gets one more retry than that,
+// so it never archives a postponed task that used up its retries, processTask archives the failures past
+// MaxRetry itself.
+const maxRetryHeader = "queuex-max-retry"
+
+func maxRetryOf(opts *queuex.Options) int {
+	n, ok := opts.GetMaxRetry()
+	if !ok {
+		return queuex.DefaultMaxRetry
+	}
+
+	return max(n, 0)
+}
+
+// taskMaxRetry returns the MaxRetry of the task with headers and whether processTask enforces it, the MaxRetry
+// of asynq for the tasks enqueued by others.
+func taskMaxRetry(headers map[string]string, asynqMaxRetry int) (int, bool) {
+	n, err := strconv.Atoi(headers[maxRetryHeader])
+	if err != nil {
+		return asynqMaxRetry, false
+	}
+
+	return n, true
+}
+
+// exhausted tells whether the failure err of a task that retried retried times is its last one.
+func exhausted(err error, retried, maxRetry int) bool {
+	if _, ok := queuex.IsRateLimited(err); ok {
+		return false
+	}
+
+	return retried >= maxRetry
+}
+
+// ApplyFlowControl configures the asynq server to postpone the tasks failing with a queuex.RateLimitError
+// by the delay they ask for, without counting them as failures. The tasks enqueued by this package keep a spare
+// asynq retry for that, so they are postponed even with no retries left; asynq archives those enqueued by others
+// once their retries are used up.
+//
+//nolint:gocritic // follow asynq
+func ApplyFlowControl(cfg *asynq.Config) {
+	isFailure := cfg.IsFailure
+	retryDelayFunc := cfg.RetryDelayFunc
+
+	if retryDelayFunc == nil {
+		retryDelayFunc = asynq.DefaultRetryDelayFunc
+	}
+
+	cfg.IsFailure = func(err error) bool {
+		if _, ok := queuex.IsRateLimited(err); ok {
+			return false
+		}
+
+		return isFailure == nil || isFailure(err)
+	}
+	cfg.RetryDelayFunc = func(n int, err error, task *asynq.Task) time.Duration {
+		if delay, ok := queuex.IsRateLimited(err); ok {
+			return delay
+		}
+
+		return retryDelayFunc(n, err, task)
+	}
+}
@@ -0,0 +1,107 @@
+package fs
+
+import (
+	"strings"
+	"time"
+
+	"github.com/GizmoVault/gotools/base"
+	"github.com/GizmoVault/gotools/queuex"
+)
+
+const (
+	DefaultConcurrency     = 10
+	DefaultShutdownTimeout = 8 * time.Second
+	DefaultLeaseTimeout    = 30 * time.Second
+	DefaultPollInterval    = time.Second
+)
+
+type Config struct {
+	// Clock drives the timers of the queue: due tasks, leases and polling. Now, if set, replaces the time
+	// they compare to but not the waits. A Now without a Clock is polled every schedulex.FNNowPollInterval,
+	// prefer a base.FakeClock for a virtual time.
+	Clock base.Clock
+	Now   base.FNNow
+
+	// MaxRetry is used for tasks that do not set their own limit. 0 means queuex.DefaultMaxRetry,
+	// a negative value disables retries.
+	MaxRetry       int
+	RetryDelayFunc queuex.RetryDelayFunc
+
+	// Concurrency is the total weight of handlers that may run at the same time.
+	Concurrency int64
+	// KeyWeights maps task key prefixes to the weight a running task of that key takes, default 1.
+	KeyWeights map[string]int64
+	// ShutdownTimeout is how long Stop waits for running handlers before cancelling their context.
+	ShutdownTimeout time.Duration
+
+	// Mux routes the tasks to handlers, a new one is created if nil.
+	Mux *queuex.ServeMux
+
+	// Shared lets several processes on one machine consume the same queue files. Every access takes a file
+	// lock, and a worker claims a task with a lease before handling it. The lease is renewed by a heartbeat
+	// while the handler runs, so a task whose worker crashed is delivered again once its lease expired.
+	// All the workers must register the same handlers.
+	Shared bool
+	// LeaseTimeout is how long a claimed task stays invisible to the other workers without a heartbeat.
+	LeaseTimeout time.Duration
+	// PollInterval is how often a shared queue looks for the tasks enqueued by other processes.
+	PollInterval time.Duration
+
+	// Aggregation decides when the tasks enqueued with queuex.AggregateGroup are merged.
+	Aggregation queuex.AggregationConfig
+}
+
+func (cfg *Config) maxRetry() int {
+	return queuex.MaxRetryOrDefault(cfg.MaxRetry)
+}
+
+func (cfg *Config) retryDelayFunc() queuex.RetryDelayFunc {
+	return queuex.RetryDelayOrDefault(cfg.RetryDelayFunc)
+}
+
+func (cfg *Config) concurrency() int64 {
+	if cfg.Concurrency <= 0 {
+		return DefaultConcurrency
+	}
+
+	return cfg.Concurrency
+}
+
+func (cfg *Config) shutdownTimeout() time.Duration {
+	if cfg.ShutdownTimeout <= 0 {
+		return DefaultShutdownTimeout
+	}
+
+	return cfg.ShutdownTimeout
+}
+
+func (cfg *Config) keyWeight(key string) int64 {
+	var weight int64 = 1
+
+	matched := -1
+
+	for prefix, w := range cfg.KeyWeights {
+		if strings.HasPrefix(key, prefix) && len(prefix) > matched {
+			matched = len(prefix)
+			weight = w
+		}
+	}
+
+	return weight
+}
+
+func (cfg *Config) leaseTimeout() time.Duration {
+	if cfg.LeaseTimeout <= 0 {
+		return DefaultLeaseTimeout
+	}
+
+	return cfg.LeaseTimeout
+}
+
+func (cfg *Config) pollInterval() time.Duration {
+	if cfg.PollInterval <= 0 {
+		return DefaultPollInterval
+	}
+
+	return cfg.PollInterval
+}
@@ -0,0 +1,240 @@
+package fs
+
+import (
+	"container/heap"
+	"sync"
+	"time"
+
+	"github.com/GizmoVault/gotools/base"
+	"github.com/GizmoVault/gotools/queuex"
+)
+
+type readyTask struct {
+	id       string
+	weight   int64
+	priority queuex.Priority
+	at       int64
+	taskSeq  int64
+	seq      uint64
+}
+
+type readyHeap []*readyTask
+
+func (h *readyHeap) Len() int {
+	return len(*h)
+}
+
+// Less puts the higher priorities first, then the tasks that were due earlier, then the ones enqueued first.
+func (h *readyHeap) Less(i, j int) bool {
+	a, b := (*h)[i], (*h)[j]
+
+	switch {
+	case a.priority != b.priority:
+		return a.priority > b.priority
+	case a.at != b.at:
+		return a.at < b.at
+	case a.taskSeq != b.taskSeq:
+		return a.taskSeq < b.taskSeq
+	default:
+		return a.seq < b.seq
+	}
+}
+
+func (h *readyHeap) Swap(i, j int) {
+	(*h)[i], (*h)[j] = (*h)[j], (*h)[i]
+}
+
+func (h *readyHeap) Push(x any) {
+	*h = append(*h, x.(*readyTask))
+}
+
+func (h *readyHeap) Pop() any {
+	old := *h
+	n := len(old)
+	x := old[n-1]
+	old[n-1] = nil
+	*h = old[0 : n-1]
+
+	return x
+}
+
+// dispatcher runs due tasks with a bounded total weight. Tasks that are dropped on stop
+// are still persisted by the queue, so they run again after a restart.
+type dispatcher struct {
+	lock     sync.Mutex
+	capacity int64
+	used     int64
+	running  bool
+	stopped  bool
+	ready    readyHeap
+	seq      uint64
+	queued   map[string]bool
+	active   map[string]bool
+	// rerun holds the tasks pushed again while they run, a retry due at once for example. They are queued when
+	// the run ends.
+	rerun map[string]*readyTask
+	wg    sync.WaitGroup
+	exec  func(id string)
+	clock base.Clock
+}
+
+func newDispatcher(capacity int64, clock base.Clock, exec func(id string)) *dispatcher {
+	return &dispatcher{
+		capacity: capacity,
+		clock:    clock,
+		queued:   make(map[string]bool),
+		active:   make(map[string]bool),
+		rerun:    make(map[string]*readyTask),
+		exec:     exec,
+	}
+}
+
+func (d *dispatcher) push(task *innerTask, weight int64) {
+	if weight > d.capacity {
+		weight = d.capacity
+	}
+
+	if weight <= 0 {
+		weight = 1
+	}
+
+	d.lock.Lock()
+	defer d.lock.Unlock()
+
+	if d.stopped {
+		return
+	}
+
+	t := &readyTask{
+		id:       task.ID,
+		weight:   weight,
+		priority: task.Priority,
+		at:       task.At,
+		taskSeq:  task.Seq,
+	}
+
+	if d.active[task.ID] {
+		d.rerun[task.ID] = t
+
+		return
+	}
+
+	if d.queued[task.ID] {
+		return
+	}
+
+	d.queueLocked(t)
+	d.dispatchLocked()
+}
+
+func (d *dispatcher) queueLocked(t *readyTask) {
+	d.seq++
+	t.seq = d.seq
+	d.queued[t.id] = true
+	heap.Push(&d.ready, t)
+}
+
+func (d *dispatcher) start() {
+	d.lock.Lock()
+	defer d.lock.Unlock()
+
+	d.running = true
+
+	d.dispatchLocked()
+}
+
+func (d *dispatcher) dispatchLocked() {
+	if !d.running || d.stopped {
+		return
+	}
+
+	for d.ready.Len() > 0 {
+		t := d.ready[0]
+		if d.used+t.weight > d.capacity {
+			return
+		}
+
+		heap.Pop(&d.ready)
+		d.used += t.weight
+		d.active[t.id] = true
+
+		d.wg.Add(1)
+
+		go d.run(t)
+	}
+}
+
+func (d *dispatcher) run(t *readyTask) {
+	defer d.wg.Done()
+
+	d.exec(t.id)
+
+	d.lock.Lock()
+	defer d.lock.Unlock()
+
+	d.used -= t.weight
+	delete(d.queued, t.id)
+	delete(d.active, t.id)
+
+	if rerun, ok := d.rerun[t.id]; ok {
+		delete(d.rerun, t.id)
+
+		if !d.stopped {
+			d.queueLocked(rerun)
+		}
+	}
+
+	d.dispatchLocked()
+}
+
+// stop drops the tasks that have not started yet and waits for the running ones.
+// It reports false if they did not finish within timeout.
+func (d *dispatcher) stop(timeout time.Duration) bool {
+	d.lock.Lock()
+	d.stopped = true
+	d.ready = nil
+	d.lock.Unlock()
+
+	done := make(chan struct{})
+
+	go func() {
+		d.wg.Wait()
+		close(done)
+	}()
+
+	timer := d.clock.NewTimer(timeout)
+	defer timer.Stop()
+
+	select {
+	case <-done:
+		return true
+	case <-timer.C():
+		return false
+	}
+}
+
+func (d *dispatcher) isStopped() bool {
+	d.lock.Lock()
+	defer d.lock.Unlock()
+
+	return d.stopped
+}
+
+func (d *dispatcher) isActive(id string) bool {
+	d.lock.Lock()
+	defer d.lock.Unlock()
+
+	return d.active[id]
+}
+
+func (d *dispatcher) activeIDs() []string {
+	d.lock.Lock()
+	defer d.lock.Unlock()
+
+	ids := make([]string, 0, len(d.active))
+	for id := range d.active {
+		ids = append(ids, id)
+	}
+
+	return ids
+}
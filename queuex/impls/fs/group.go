@@ -0,0 +1,162 @@
+package fs
+
+import (
+	"sort"
+	"time"
+
+	"github.com/GizmoVault/gotools/base/errorx"
+	"github.com/GizmoVault/gotools/base/logx"
+	"github.com/GizmoVault/gotools/queuex"
+	"github.com/google/uuid"
+)
+
+const (
+	aggregationKeyPrefix = "aggregation:"
+)
+
+// isGroupHead reports whether no task enqueued before task in its group is left in m.
+func isGroupHead(m map[string]*innerTask, task *innerTask) bool {
+	if task.GroupKey == "" {
+		return true
+	}
+
+	group := task.groupOf()
+
+	for _, t := range m {
+		if t.ID != task.ID && t.groupOf() == group && t.GroupSeq < task.GroupSeq {
+			return false
+		}
+	}
+
+	return true
+}
+
+// dispatchGroupHead dispatches the next task of group once the one before it finished.
+func (impl *queueImpl) dispatchGroupHead(group string) {
+	var head *innerTask
+
+	if !impl.read(impl.stg, func(m map[string]*innerTask) {
+		for _, t := range m {
+			if t.groupOf() == group && (head == nil || t.GroupSeq < head.GroupSeq) {
+				head = t
+			}
+		}
+	}) {
+		return
+	}
+
+	if head == nil || head.At > impl.now().UnixNano() {
+		return
+	}
+
+	impl.dispatcher.push(head, impl.cfg.keyWeight(head.Key))
+}
+
+func aggregationMembers(m map[string]*innerTask, queue, aggregateKey string) (members []*innerTask) {
+	for _, t := range m {
+		if t.AggregateKey == aggregateKey && t.Queue == queue {
+			members = append(members, t)
+		}
+	}
+
+	sort.Slice(members, func(i, j int) bool {
+		return members[i].GroupSeq < members[j].GroupSeq
+	})
+
+	return
+}
+
+// aggregationAt is when the members are merged, see queuex.AggregationConfig.MergeAt.
+func (impl *queueImpl) aggregationAt(members []*innerTask) time.Time {
+	first, last := members[0].At, members[0].At
+
+	for _, t := range members {
+		first = min(first, t.At)
+		last = max(last, t.At)
+	}
+
+	return impl.cfg.Aggregation.MergeAt(time.Unix(0, first), time.Unix(0, last), len(members))
+}
+
+func (impl *queueImpl) scheduleAggregation(queue, aggregateKey string) {
+	var members []*innerTask
+
+	if !impl.read(impl.stg, func(m map[string]*innerTask) {
+		members = aggregationMembers(m, queue, aggregateKey)
+	}) {
+		return
+	}
+
+	key := aggregationKeyPrefix + queue + ":" + aggregateKey
+
+	if len(members) == 0 {
+		_ = impl.taskPool.RemoveTask(key)
+
+		return
+	}
+
+	if err := impl.taskPool.AddTask(key, impl.aggregationAt(members), impl.aggregationCallback,
+		queue, aggregateKey); err != nil {
+		impl.logger.WithFields(logx.ErrorField(err)).Error("taskPool AddTask failed")
+	}
+}
+
+// aggregationCallback replaces the members of an aggregation group by the task they merge into.
+func (impl *queueImpl) aggregationCallback(_ string, params ...any) {
+	queue, _ := params[0].(string)
+	aggregateKey, _ := params[1].(string)
+
+	cfg := &impl.cfg.Aggregation
+	timeNow := impl.now()
+
+	var merged *innerTask
+
+	err := impl.stg.Change(func(oldM map[string]*innerTask) (newM map[string]*innerTask, err error) {
+		newM = oldM
+
+		members := aggregationMembers(newM, queue, aggregateKey)
+		if len(members) == 0 || impl.aggregationAt(members).After(timeNow) {
+			err = errorx.NoErrSkip
+
+			return
+		}
+
+		if cfg.MaxSize > 0 && len(members) > cfg.MaxSize {
+			members = members[:cfg.MaxSize]
+		}
+
+		tasks := make([]*queuex.Task, 0, len(members))
+		for _, t := range members {
+			tasks = append(tasks, t.GetTask())
+		}
+
+		for _, t := range members {
+			delete(newM, t.ID)
+		}
+
+		task := cfg.GetAggregate()(aggregateKey, tasks)
+		if task == nil || task.Key == "" {
+			return
+		}
+
+		first := members[0]
+
+		merged = fromTask(uuid.NewString(), task, timeNow, 0, first.MaxRetry, queuex.NewOptions(
+			queuex.QueueName(queue), queuex.WithPriority(first.Priority), queuex.Timeout(first.Timeout),
+			queuex.Retention(first.Retention)))
+		newM[merged.ID] = merged
+
+		return
+	})
+	if err != nil {
+		impl.logger.WithFields(logx.StringField("group", aggregateKey), logx.ErrorField(err)).Error("aggregate failed")
+	}
+
+	if merged != nil {
+		if err = impl.taskPool.AddTask(merged.ID, timeNow, impl.taskCallback); err != nil {
+			impl.logger.WithFields(logx.ErrorField(err)).Error("taskPool AddTask failed")
+		}
+	}
+
+	impl.scheduleAggregation(queue, aggregateKey)
+}
@@ -6,11 +6,48 @@ import (
 	"github.com/GizmoVault/gotools/queuex"
 )
 
+const (
+	// taskVersionNano stores the timestamps as Unix nanoseconds, the tasks written before it used seconds.
+	taskVersionNano = 1
+
+	currentTaskVersion = taskVersionNano
+)
+
+// innerTask is a task in the queue files, its timestamps are Unix nanoseconds.
 type innerTask struct {
+	Version int
+
 	ID      string
 	Key     string
 	Payload []byte
 	At      int64
+
+	MaxRetry     int
+	Retried      int
+	LastErr      string
+	LastFailedAt int64
+
+	Queue       string
+	Priority    queuex.Priority
+	UniqueKey   string
+	UniqueUntil int64
+	Deadline    int64
+	Timeout     time.Duration
+	Retention   time.Duration
+	CompletedAt int64
+	Result      []byte
+
+	// Seq is the enqueue order, it breaks the ties between tasks due at the same time.
+	Seq int64
+
+	GroupKey     string
+	AggregateKey string
+	// GroupSeq orders the tasks of a group or an aggregation group.
+	GroupSeq int64
+
+	// LeaseOwner is the worker handling the task in a shared queue, until LeaseUntil.
+	LeaseOwner string
+	LeaseUntil int64
 }
 
 func (it *innerTask) GetTask() *queuex.Task {
@@ -30,16 +67,83 @@ func (it *innerTask) GetTask() *queuex.Task {
 	return task
 }
 
-func fromTask(id string, task *queuex.Task, delay time.Duration) *innerTask {
-	at := time.Now()
+// leased reports whether a worker other than owner holds the lease of the task at now.
+func (it *innerTask) leased(owner string, now time.Time) bool {
+	return it.LeaseOwner != "" && it.LeaseOwner != owner && it.LeaseUntil > now.UnixNano()
+}
+
+// groupOf is the ordering group of the task, empty if it has none.
+func (it *innerTask) groupOf() string {
+	switch {
+	case it.GroupKey != "":
+		return "g:" + it.Queue + ":" + it.GroupKey
+	case it.AggregateKey != "":
+		return "a:" + it.Queue + ":" + it.AggregateKey
+	default:
+		return ""
+	}
+}
+
+// migrate converts a task written by an older version.
+func (it *innerTask) migrate() {
+	if it.Version < taskVersionNano {
+		for _, ts := range []*int64{&it.At, &it.LastFailedAt, &it.UniqueUntil, &it.Deadline, &it.CompletedAt,
+			&it.LeaseUntil} {
+			*ts *= int64(time.Second)
+		}
+	}
+
+	it.Version = currentTaskVersion
+}
+
+func (it *innerTask) clone() *innerTask {
+	newTask := *it
+
+	return &newTask
+}
+
+// deadline is the earliest of the task deadline and its timeout counted from start, zero if neither is set.
+func (it *innerTask) deadline(start time.Time) (deadline time.Time) {
+	if it.Deadline > 0 {
+		deadline = time.Unix(0, it.Deadline)
+	}
+
+	if it.Timeout > 0 {
+		if t := start.Add(it.Timeout); deadline.IsZero() || t.Before(deadline) {
+			deadline = t
+		}
+	}
+
+	return
+}
+
+func fromTask(id string, task *queuex.Task, now time.Time, delay time.Duration, maxRetry int, opts *queuex.Options) *innerTask {
+	at := now
 	if delay > 0 {
 		at = at.Add(delay)
 	}
 
+	if n, ok := opts.GetMaxRetry(); ok {
+		maxRetry = n
+	}
+
 	newTask := &innerTask{
-		ID:  id,
-		Key: task.Key,
-		At:  at.Unix(),
+		Version:   currentTaskVersion,
+		ID:        id,
+		Key:       task.Key,
+		At:        at.UnixNano(),
+		MaxRetry:  maxRetry,
+		Queue:     opts.Queue,
+		Priority:  opts.Priority,
+		Timeout:   opts.Timeout,
+		Retention: opts.Retention,
+
+		GroupKey:     opts.GroupKey,
+		AggregateKey: opts.AggregateKey,
+	}
+
+	if !opts.Deadline.IsZero() {
+		newTask.Deadline = opts.Deadline.UnixNano()
 	}
 
 	if task.Payload != nil {
@@ -47,5 +151,10 @@ func fromTask(id string, task *queuex.Task, delay time.Duration) *innerTask {
 		copy(newTask.Payload, task.Payload)
 	}
 
+	if opts.UniqueTTL > 0 {
+		newTask.UniqueKey = queuex.UniqueKey(newTask.Queue, newTask.Key, newTask.Payload)
+		newTask.UniqueUntil = now.Add(opts.UniqueTTL).UnixNano()
+	}
+
 	return newTask
 }
@@ -0,0 +1,357 @@
+package fs
+
+import (
+	"errors"
+	"time"
+
+	"github.com/GizmoVault/gotools/base/errorx"
+	"github.com/GizmoVault/gotools/base/logx"
+	"github.com/GizmoVault/gotools/queuex"
+)
+
+func NewInspector(q queuex.Queue) (queuex.Inspector, error) {
+	impl, ok := q.(*queueImpl)
+	if !ok {
+		return nil, errorx.ErrInvalidArgs
+	}
+
+	return impl, nil
+}
+
+func (it *innerTask) toTaskInfo(state queuex.TaskState) *queuex.TaskInfo {
+	info := &queuex.TaskInfo{
+		ID:            it.ID,
+		Key:           it.Key,
+		Payload:       it.GetTask().Payload,
+		Queue:         it.Queue,
+		Priority:      it.Priority,
+		State:         state,
+		MaxRetry:      it.MaxRetry,
+		Retried:       it.Retried,
+		LastErr:       it.LastErr,
+		NextProcessAt: time.Unix(0, it.At),
+		Result:        it.Result,
+	}
+
+	if it.LastFailedAt > 0 {
+		info.LastFailedAt = time.Unix(0, it.LastFailedAt)
+	}
+
+	if it.CompletedAt > 0 {
+		info.CompletedAt = time.Unix(0, it.CompletedAt)
+		info.NextProcessAt = time.Time{}
+	}
+
+	return info
+}
+
+func (impl *queueImpl) taskState(task *innerTask, now time.Time) queuex.TaskState {
+	if impl.dispatcher.isActive(task.ID) || task.leased("", now) {
+		return queuex.TaskStateActive
+	}
+
+	if task.At > now.UnixNano() {
+		if task.Retried > 0 {
+			return queuex.TaskStateRetry
+		}
+
+		return queuex.TaskStateScheduled
+	}
+
+	return queuex.TaskStatePending
+}
+
+func (impl *queueImpl) GetTaskInfo(id string) (info *queuex.TaskInfo, err error) {
+	timeNow := impl.now()
+
+	err = impl.stg.Read(func(m map[string]*innerTask) {
+		if task, ok := m[id]; ok {
+			info = task.toTaskInfo(impl.taskState(task, timeNow))
+		}
+	})
+
+	if info != nil || err != nil {
+		return
+	}
+
+	for stg, state := range map[*taskStorage]queuex.TaskState{
+		impl.expiredStg:   queuex.TaskStatePending,
+		impl.deadStg:      queuex.TaskStateDead,
+		impl.completedStg: queuex.TaskStateCompleted,
+	} {
+		err = stg.Read(func(m map[string]*innerTask) {
+			if task, ok := m[id]; ok {
+				info = task.toTaskInfo(state)
+			}
+		})
+
+		if info != nil || err != nil {
+			return
+		}
+	}
+
+	err = errorx.ErrNotExists
+
+	return
+}
+
+func (impl *queueImpl) listTasks(state queuex.TaskState) (infos []*queuex.TaskInfo, err error) {
+	timeNow := impl.now()
+
+	switch state {
+	case queuex.TaskStateDead:
+		err = impl.deadStg.Read(func(m map[string]*innerTask) {
+			for _, task := range m {
+				infos = append(infos, task.toTaskInfo(state))
+			}
+		})
+	case queuex.TaskStateCompleted:
+		err = impl.completedStg.Read(func(m map[string]*innerTask) {
+			for _, task := range m {
+				infos = append(infos, task.toTaskInfo(state))
+			}
+		})
+	default:
+		err = impl.stg.Read(func(m map[string]*innerTask) {
+			for _, task := range m {
+				if impl.taskState(task, timeNow) == state {
+					infos = append(infos, task.toTaskInfo(state))
+				}
+			}
+		})
+
+		if err == nil && state == queuex.TaskStatePending {
+			err = impl.expiredStg.Read(func(m map[string]*innerTask) {
+				for _, task := range m {
+					infos = append(infos, task.toTaskInfo(state))
+				}
+			})
+		}
+	}
+
+	return
+}
+
+func (impl *queueImpl) ListPending() ([]*queuex.TaskInfo, error) {
+	return impl.listTasks(queuex.TaskStatePending)
+}
+
+func (impl *queueImpl) ListScheduled() ([]*queuex.TaskInfo, error) {
+	return impl.listTasks(queuex.TaskStateScheduled)
+}
+
+func (impl *queueImpl) ListRetry() ([]*queuex.TaskInfo, error) {
+	return impl.listTasks(queuex.TaskStateRetry)
+}
+
+func (impl *queueImpl) ListDead() ([]*queuex.TaskInfo, error) {
+	return impl.listTasks(queuex.TaskStateDead)
+}
+
+func (impl *queueImpl) Cancel(id string) error {
+	if impl.dispatcher.isActive(id) {
+		return errorx.ErrConflict
+	}
+
+	for _, stg := range []*taskStorage{impl.stg, impl.expiredStg} {
+		if deleteTask(stg, id) {
+			_ = impl.taskPool.RemoveTask(id)
+
+			return nil
+		}
+	}
+
+	return errorx.ErrNotExists
+}
+
+func (impl *queueImpl) Requeue(id string) error {
+	if impl.dispatcher.isActive(id) {
+		return errorx.ErrConflict
+	}
+
+	timeNow := impl.now()
+
+	err := impl.stg.Change(func(oldM map[string]*innerTask) (newM map[string]*innerTask, err error) {
+		newM = oldM
+
+		task, ok := newM[id]
+		if !ok {
+			err = errorx.ErrNotExists
+
+			return
+		}
+
+		if state := impl.taskState(task, timeNow); state != queuex.TaskStateScheduled &&
+			state != queuex.TaskStateRetry {
+			err = errorx.ErrConflict
+
+			return
+		}
+
+		task = task.clone()
+		task.At = timeNow.UnixNano()
+		newM[id] = task
+
+		return
+	})
+	if err == nil {
+		return impl.taskPool.AddTask(id, timeNow, impl.taskCallback)
+	}
+
+	if !errors.Is(err, errorx.ErrNotExists) {
+		return err
+	}
+
+	var task *innerTask
+
+	if err = impl.deadStg.Read(func(m map[string]*innerTask) {
+		task = m[id]
+	}); err != nil {
+		return err
+	}
+
+	if task == nil {
+		if _, e := impl.GetTaskInfo(id); e == nil {
+			return errorx.ErrConflict
+		}
+
+		return errorx.ErrNotExists
+	}
+
+	task = task.clone()
+	task.At = timeNow.UnixNano()
+	task.Retried = 0
+
+	err = impl.stg.Change(func(oldM map[string]*innerTask) (newM map[string]*innerTask, err error) {
+		newM = oldM
+		if len(newM) == 0 {
+			newM = make(map[string]*innerTask)
+		}
+
+		newM[id] = task
+
+		return
+	})
+	if err != nil {
+		return err
+	}
+
+	deleteTask(impl.deadStg, id)
+
+	return impl.taskPool.AddTask(id, timeNow, impl.taskCallback)
+}
+
+func (impl *queueImpl) Purge(state queuex.TaskState) (n int, err error) {
+	switch state {
+	case queuex.TaskStateDead:
+		return purgeTasks(impl.deadStg, nil), nil
+	case queuex.TaskStateCompleted:
+		return purgeTasks(impl.completedStg, nil), nil
+	case queuex.TaskStatePending, queuex.TaskStateScheduled, queuex.TaskStateRetry:
+	default:
+		return 0, errorx.ErrInvalidArgs
+	}
+
+	timeNow := impl.now()
+
+	var ids []string
+
+	n = purgeTasks(impl.stg, func(task *innerTask) bool {
+		if impl.taskState(task, timeNow) != state {
+			return false
+		}
+
+		ids = append(ids, task.ID)
+
+		return true
+	})
+
+	for _, id := range ids {
+		_ = impl.taskPool.RemoveTask(id)
+	}
+
+	if state == queuex.TaskStatePending {
+		n += purgeTasks(impl.expiredStg, nil)
+	}
+
+	impl.logger.WithFields(logx.StringField("state", state.String()), logx.IntField("count", n)).Info("tasks purged")
+
+	return
+}
+
+func (impl *queueImpl) Stats() (*queuex.QueueStats, error) {
+	stats := &queuex.QueueStats{}
+	timeNow := impl.now()
+
+	err := impl.stg.Read(func(m map[string]*innerTask) {
+		for _, task := range m {
+			switch impl.taskState(task, timeNow) {
+			case queuex.TaskStateActive:
+				stats.Active++
+			case queuex.TaskStateScheduled:
+				stats.Scheduled++
+			case queuex.TaskStateRetry:
+				stats.Retry++
+			default:
+				stats.Pending++
+			}
+		}
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	for stg, n := range map[*taskStorage]*int{
+		impl.expiredStg:   &stats.Pending,
+		impl.deadStg:      &stats.Dead,
+		impl.completedStg: &stats.Completed,
+	} {
+		if err = stg.Read(func(m map[string]*innerTask) {
+			*n += len(m)
+		}); err != nil {
+			return nil, err
+		}
+	}
+
+	return stats, nil
+}
+
+func deleteTask(stg *taskStorage, id string) (deleted bool) {
+	_ = stg.Change(func(oldM map[string]*innerTask) (newM map[string]*innerTask, err error) {
+		newM = oldM
+		if _, deleted = newM[id]; !deleted {
+			err = errorx.NoErrSkip
+
+			return
+		}
+
+		delete(newM, id)
+
+		return
+	})
+
+	return
+}
+
+// purgeTasks deletes the tasks matched by match, or all of them if match is nil.
+func purgeTasks(stg *taskStorage, match func(task *innerTask) bool) (n int) {
+	_ = stg.Change(func(oldM map[string]*innerTask) (newM map[string]*innerTask, err error) {
+		newM = oldM
+
+		for id, task := range newM {
+			if match == nil || match(task) {
+				delete(newM, id)
+
+				n++
+			}
+		}
+
+		if n == 0 {
+			err = errorx.NoErrSkip
+		}
+
+		return
+	})
+
+	return
+}
@@ -0,0 +1,148 @@
+package fs
+
+import (
+	"context"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/GizmoVault/gotools/base/errorx"
+	"github.com/GizmoVault/gotools/base/logx"
+	"github.com/GizmoVault/gotools/queuex"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestInspector(t *testing.T) {
+	queue, err := NewFsQueueWithConfig(t.Context(), filepath.Join(t.TempDir(), "ut_inspector.dat"), Config{},
+		logx.NewNopLoggerWrapper())
+	require.NoError(t, err)
+
+	defer queue.Stop()
+
+	inspector, err := NewInspector(queue)
+	require.NoError(t, err)
+
+	pendingID, err := queue.Enqueue(&queuex.Task{Key: "insp:pending"}, 0)
+	require.NoError(t, err)
+
+	scheduledID, err := queue.Enqueue(&queuex.Task{Key: "insp:scheduled"}, time.Hour)
+	require.NoError(t, err)
+
+	_, err = queue.Enqueue(&queuex.Task{Key: "insp:scheduled"}, time.Hour)
+	require.NoError(t, err)
+
+	stats, err := inspector.Stats()
+	require.NoError(t, err)
+	assert.Equal(t, 1, stats.Pending)
+	assert.Equal(t, 2, stats.Scheduled)
+
+	require.ErrorIs(t, inspector.Requeue(pendingID), errorx.ErrConflict)
+
+	scheduled, err := inspector.ListScheduled()
+	require.NoError(t, err)
+	assert.Len(t, scheduled, 2)
+
+	require.NoError(t, inspector.Cancel(scheduledID))
+	require.ErrorIs(t, inspector.Cancel(scheduledID), errorx.ErrNotExists)
+
+	n, err := inspector.Purge(queuex.TaskStateScheduled)
+	require.NoError(t, err)
+	assert.Equal(t, 1, n)
+
+	failed := make(chan struct{}, 2)
+
+	queue.HandleFunc("insp:", func(context.Context, string, *queuex.Task) error {
+		failed <- struct{}{}
+
+		return queuex.ErrorSkipRetry
+	})
+
+	go func() {
+		_ = queue.Run(t.Context())
+	}()
+
+	<-failed
+
+	assert.Eventually(t, func() bool {
+		info, e := inspector.GetTaskInfo(pendingID)
+
+		return e == nil && info.State == queuex.TaskStateDead
+	}, 5*time.Second, 20*time.Millisecond)
+
+	dead, err := inspector.ListDead()
+	require.NoError(t, err)
+	require.Len(t, dead, 1)
+	assert.Equal(t, queuex.ErrorSkipRetry.Error(), dead[0].LastErr)
+
+	require.NoError(t, inspector.Requeue(pendingID))
+
+	<-failed
+
+	assert.Eventually(t, func() bool {
+		stats, err = inspector.Stats()
+
+		return err == nil && stats.Dead == 1 && stats.Pending == 0
+	}, 5*time.Second, 20*time.Millisecond)
+
+	n, err = inspector.Purge(queuex.TaskStateDead)
+	require.NoError(t, err)
+	assert.Equal(t, 1, n)
+
+	_, err = inspector.GetTaskInfo(pendingID)
+	require.ErrorIs(t, err, errorx.ErrNotExists)
+}
+
+func TestTaskHandle(t *testing.T) {
+	queue, err := NewFsQueueWithConfig(t.Context(), filepath.Join(t.TempDir(), "ut_handle.dat"), Config{},
+		logx.NewNopLoggerWrapper())
+	require.NoError(t, err)
+
+	defer queue.Stop()
+
+	inspector, err := NewInspector(queue)
+	require.NoError(t, err)
+
+	queue.HandleFunc("echo", func(ctx context.Context, _ string, task *queuex.Task) error {
+		return queuex.SetResult(ctx, append([]byte("echo:"), task.Payload...))
+	})
+	queue.HandleFunc("broken", func(context.Context, string, *queuex.Task) error {
+		return queuex.ErrorSkipRetry
+	})
+
+	go func() {
+		_ = queue.Run(t.Context())
+	}()
+
+	h, err := queuex.EnqueueWithHandle(queue, inspector, &queuex.Task{Key: "echo", Payload: []byte("hi")}, 0)
+	require.NoError(t, err)
+
+	ctx, cancel := context.WithTimeout(t.Context(), 5*time.Second)
+	defer cancel()
+
+	result, err := h.WithPollInterval(20 * time.Millisecond).Wait(ctx)
+	require.NoError(t, err)
+	assert.Equal(t, []byte("echo:hi"), result)
+
+	state, err := h.State()
+	require.NoError(t, err)
+	assert.Equal(t, queuex.TaskStateCompleted, state)
+
+	h, err = queuex.EnqueueWithHandle(queue, inspector, &queuex.Task{Key: "broken"}, 0)
+	require.NoError(t, err)
+
+	_, err = h.WithPollInterval(20 * time.Millisecond).Wait(ctx)
+	require.ErrorIs(t, err, queuex.ErrorTaskFailed)
+
+	h, err = queuex.EnqueueWithHandle(queue, inspector, &queuex.Task{Key: "echo"}, time.Hour)
+	require.NoError(t, err)
+
+	_, err = h.Result()
+	require.ErrorIs(t, err, errorx.ErrConflict)
+
+	shortCtx, shortCancel := context.WithTimeout(t.Context(), 50*time.Millisecond)
+	defer shortCancel()
+
+	_, err = h.Wait(shortCtx)
+	require.ErrorIs(t, err, context.DeadlineExceeded)
+}
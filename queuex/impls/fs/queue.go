@@ -2,6 +2,7 @@ package fs
 
 import (
 	"context"
+	"errors"
 	"strings"
 	"sync"
 	"time"
@@ -9,66 +10,174 @@ import (
 	"github.com/GizmoVault/gotools/base"
 	"github.com/GizmoVault/gotools/base/errorx"
 	"github.com/GizmoVault/gotools/base/logx"
-	"github.com/GizmoVault/gotools/base/syncx"
 	"github.com/GizmoVault/gotools/queuex"
 	"github.com/GizmoVault/gotools/schedulex"
-	"github.com/GizmoVault/gotools/storagex"
 	"github.com/google/uuid"
 )
 
+const (
+	retentionKeyPrefix = "retention:"
+)
+
 func NewFsQueue(ctx context.Context, fileName string, logger logx.Wrapper) (queuex.Queue, error) {
-	return NewFsQueueWithFNNow(ctx, fileName, nil, logger)
+	return NewFsQueueWithConfig(ctx, fileName, Config{Clock: base.SystemClock}, logger)
 }
 
+// NewFsQueueWithFNNow compares the tasks to now, a non-nil now is polled for due tasks.
+//
+// Deprecated: use NewFsQueueWithConfig with a Config.Clock, a base.FakeClock for a virtual time.
 func NewFsQueueWithFNNow(ctx context.Context, fileName string, now base.FNNow, logger logx.Wrapper) (queuex.Queue, error) {
+	return NewFsQueueWithConfig(ctx, fileName, Config{Now: now}, logger)
+}
+
+//nolint:gocritic // config is copied on purpose
+func NewFsQueueWithConfig(ctx context.Context, fileName string, cfg Config, logger logx.Wrapper) (queuex.Queue, error) {
 	if logger == nil {
 		logger = logx.NewConsoleLoggerWrapper()
 	}
 
 	logger = logger.WithFields(logx.StringField(logx.ClsKey, "queueImpl"))
 
-	expiredStg, err := storagex.NewMemWithFile[map[string]*innerTask, storagex.Serial, syncx.RWLocker](
-		make(map[string]*innerTask), &storagex.JSONSerial{}, &sync.RWMutex{}, fileName+".expired", nil)
+	if cfg.Mux == nil {
+		cfg.Mux = queuex.NewServeMux()
+	}
+
+	var (
+		flock *fileLock
+		err   error
+	)
+
+	if cfg.Shared {
+		if flock, err = newFileLock(fileName + ".lock"); err != nil {
+			return nil, err
+		}
+	}
+
+	expiredStg, err := newTaskStorage(fileName+".expired", flock, nil)
+	if err != nil {
+		return nil, err
+	}
+
+	deadStg, err := newTaskStorage(fileName+".dead", flock, nil)
+	if err != nil {
+		return nil, err
+	}
+
+	completedStg, err := newTaskStorage(fileName+".completed", flock, nil)
 	if err != nil {
 		return nil, err
 	}
 
 	impl := &queueImpl{
-		logger:     logger,
-		ctx:        ctx,
-		expiredStg: expiredStg,
-		taskPool:   schedulex.NewHeapTaskPool(now),
-		m:          make(map[string]queuex.Handler),
+		logger:       logger,
+		ctx:          ctx,
+		cfg:          cfg,
+		fileName:     fileName,
+		expiredStg:   expiredStg,
+		deadStg:      deadStg,
+		completedStg: completedStg,
+		taskPool:     newTaskPool(&cfg),
+		mux:          cfg.Mux,
+		owner:        uuid.NewString(),
+		stopCh:       make(chan struct{}),
 	}
 
-	impl.stg, err = storagex.NewMemWithFileEx[map[string]*innerTask, storagex.Serial, syncx.RWLocker](
-		make(map[string]*innerTask), &storagex.JSONSerial{}, &sync.RWMutex{}, fileName, nil, impl)
+	impl.handlerCtx, impl.cancelHandlers = context.WithCancel(ctx)
+	impl.dispatcher = newDispatcher(cfg.concurrency(), base.GetClock(cfg.Clock), impl.processTask)
+
+	impl.stg, err = newTaskStorage(fileName, flock, impl)
 	if err != nil {
 		return nil, err
 	}
 
+	impl.scheduleLoadedTasks()
+
 	return impl, nil
 }
 
+// newTaskPool waits on the clock of the queue, it only polls a Now given without a Clock.
+func newTaskPool(cfg *Config) schedulex.ScheduleTaskPool {
+	return schedulex.NewHeapTaskPoolWithConfig(schedulex.HeapConfig{Now: cfg.Now, Clock: cfg.Clock})
+}
+
 type queueImpl struct {
 	logger     logx.Wrapper
 	ctx        context.Context
-	stg        *storagex.MemWithFile[map[string]*innerTask, storagex.Serial, syncx.RWLocker]
-	expiredStg *storagex.MemWithFile[map[string]*innerTask, storagex.Serial, syncx.RWLocker]
-	taskPool   schedulex.ScheduleTaskPool
-
-	mLock sync.Mutex
-	m     map[string]queuex.Handler
+	cfg        Config
+	fileName   string
+	stg        *taskStorage
+	expiredStg *taskStorage
+	deadStg    *taskStorage
+	// completedStg keeps the tasks that asked for retention after they succeeded
+	completedStg *taskStorage
+	taskPool     schedulex.ScheduleTaskPool
+	dispatcher   *dispatcher
+
+	handlerCtx     context.Context
+	cancelHandlers context.CancelFunc
+
+	runLock  sync.Mutex
+	running  bool
+	stopOnce sync.Once
+	stopCh   chan struct{}
+
+	mux *queuex.ServeMux
+
+	// owner identifies the worker in the leases of a shared queue
+	owner string
 }
 
-func (*queueImpl) Run() error {
-	<-make(chan any)
+// Run starts handling due tasks and blocks until ctx is done or Stop is called.
+func (impl *queueImpl) Run(ctx context.Context) error {
+	impl.runLock.Lock()
+
+	if impl.running || impl.dispatcher.isStopped() {
+		impl.runLock.Unlock()
+
+		return errorx.ErrLogic
+	}
+
+	impl.running = true
+	impl.runLock.Unlock()
+
+	impl.requeueExpired()
+	impl.dispatcher.start()
+
+	if impl.cfg.Shared {
+		go impl.heartbeat()
+		go impl.poll()
+	}
+
+	select {
+	case <-ctx.Done():
+		impl.Stop()
+	case <-impl.stopCh:
+	}
 
-	return errorx.ErrLogic
+	return nil
 }
 
+// Stop waits for running handlers up to the shutdown timeout, then cancels their context.
+// Tasks that have not been acknowledged stay in the data file.
 func (impl *queueImpl) Stop() {
-	impl.taskPool.Stop()
+	impl.stopOnce.Do(func() {
+		impl.taskPool.Stop()
+
+		if !impl.dispatcher.stop(impl.cfg.shutdownTimeout()) {
+			impl.logger.Warn("shutdown timeout, cancel running handlers")
+		}
+
+		impl.cancelHandlers()
+
+		close(impl.stopCh)
+	})
+}
+
+func (impl *queueImpl) isRunning() bool {
+	impl.runLock.Lock()
+	defer impl.runLock.Unlock()
+
+	return impl.running
 }
 
 func (*queueImpl) BeforeLoad() {
@@ -82,11 +191,51 @@ func (impl *queueImpl) AfterLoad(m map[string]*innerTask, err error) {
 		return
 	}
 
-	for _, task := range m {
-		if e := impl.taskPool.AddTask(task.Key, time.Unix(task.At, 0), impl.taskCallback); e != nil {
+	impl.logger.Debugf("%d tasks loaded", len(m))
+}
+
+func (impl *queueImpl) scheduleLoadedTasks() {
+	var tasks []*innerTask
+
+	if !impl.read(impl.stg, func(m map[string]*innerTask) {
+		for _, task := range m {
+			tasks = append(tasks, task)
+		}
+	}) {
+		return
+	}
+
+	aggregations := make(map[[2]string]bool)
+
+	for _, task := range tasks {
+		if task.AggregateKey != "" {
+			aggregations[[2]string{task.Queue, task.AggregateKey}] = true
+
+			continue
+		}
+
+		if err := impl.taskPool.AddTask(task.ID, time.Unix(0, task.At), impl.taskCallback); err != nil {
 			impl.logger.WithFields(logx.ErrorField(err)).Errorf("taskPool AddTask failed")
 		}
 	}
+
+	for group := range aggregations {
+		impl.scheduleAggregation(group[0], group[1])
+	}
+
+	var completedTasks []*innerTask
+
+	if !impl.read(impl.completedStg, func(m map[string]*innerTask) {
+		for _, task := range m {
+			completedTasks = append(completedTasks, task)
+		}
+	}) {
+		return
+	}
+
+	for _, task := range completedTasks {
+		impl.scheduleRetention(task)
+	}
 }
 
 func (*queueImpl) BeforeSave() {
@@ -101,16 +250,22 @@ func (*queueImpl) AfterSave(_ map[string]*innerTask, _ error) {
 //
 //
 
-func (impl *queueImpl) Enqueue(task *queuex.Task, delay time.Duration) (id string, err error) {
+func (impl *queueImpl) Enqueue(task *queuex.Task, delay time.Duration, opts ...queuex.Option) (id string, err error) {
 	if task == nil || task.Key == "" {
 		err = errorx.ErrInvalidArgs
 
 		return
 	}
 
-	id = uuid.NewString()
+	options := queuex.NewOptions(opts...)
+
+	id = options.TaskID
+	if id == "" {
+		id = uuid.NewString()
+	}
 
-	var at int64
+	timeNow := impl.now()
+	newTask := fromTask(id, task, timeNow, delay, impl.cfg.maxRetry(), options)
 
 	err = impl.stg.Change(func(oldM map[string]*innerTask) (newM map[string]*innerTask, err error) {
 		newM = oldM
@@ -120,14 +275,49 @@ func (impl *queueImpl) Enqueue(task *queuex.Task, delay time.Duration) (id strin
 		}
 
 		if _, ok := newM[id]; ok {
-			err = errorx.ErrExists
+			err = queuex.ErrorTaskIDConflict
 
 			return
 		}
 
-		newM[id] = fromTask(id, task, delay)
+		// the other files are checked under the lock of the live one, a task moved out of it is in them already
+		if options.TaskID != "" {
+			var used bool
 
-		at = newM[id].At
+			if used, err = impl.taskIDUsed(id); err != nil {
+				return
+			}
+
+			if used {
+				err = queuex.ErrorTaskIDConflict
+
+				return
+			}
+		}
+
+		if newTask.UniqueKey != "" {
+			for _, t := range newM {
+				if t.UniqueKey == newTask.UniqueKey && t.UniqueUntil > timeNow.UnixNano() {
+					err = queuex.ErrorDuplicateTask
+
+					return
+				}
+			}
+		}
+
+		for _, t := range newM {
+			newTask.Seq = max(newTask.Seq, t.Seq+1)
+		}
+
+		if group := newTask.groupOf(); group != "" {
+			for _, t := range newM {
+				if t.groupOf() == group && t.GroupSeq >= newTask.GroupSeq {
+					newTask.GroupSeq = t.GroupSeq + 1
+				}
+			}
+		}
+
+		newM[id] = newTask
 
 		return
 	})
@@ -136,94 +326,148 @@ func (impl *queueImpl) Enqueue(task *queuex.Task, delay time.Duration) (id strin
 		return
 	}
 
-	err = impl.taskPool.AddTask(id, time.Unix(at, 0), impl.taskCallback)
+	if newTask.AggregateKey != "" {
+		impl.scheduleAggregation(newTask.Queue, newTask.AggregateKey)
+
+		return
+	}
+
+	err = impl.taskPool.AddTask(id, time.Unix(0, newTask.At), impl.taskCallback)
 
 	return
 }
 
-func (impl *queueImpl) HandleFunc(key string, h queuex.Handler) {
-	impl.mLock.Lock()
-	defer impl.mLock.Unlock()
+// taskIDUsed reports whether a task that left the live file keeps id, the live file must be locked.
+func (impl *queueImpl) taskIDUsed(id string) (used bool, err error) {
+	for _, stg := range []*taskStorage{impl.expiredStg, impl.deadStg, impl.completedStg} {
+		err = stg.readHeld(func(m map[string]*innerTask) {
+			_, used = m[id]
+		})
 
-	if h == nil {
-		delete(impl.m, key)
+		if used || err != nil {
+			return
+		}
+	}
 
-		return
+	return
+}
+
+func (impl *queueImpl) HandleFunc(key string, h queuex.Handler) {
+	impl.mux.HandleFunc(key, h)
+
+	if h != nil && impl.isRunning() {
+		go impl.requeueExpired()
 	}
+}
 
-	impl.m[key] = h
+func (impl *queueImpl) Use(mws ...queuex.Middleware) {
+	impl.mux.Use(mws...)
+}
 
-	go func() {
-		time.Sleep(time.Second * 5)
+func (impl *queueImpl) ServeMux() *queuex.ServeMux {
+	return impl.mux
+}
 
-		for {
-			var task *innerTask
-			var handler queuex.Handler
+// requeueExpired moves the tasks that were due while no handler matched them back into the queue.
+func (impl *queueImpl) requeueExpired() {
+	var tasks []*innerTask
 
-			impl.expiredStg.Read(func(m map[string]*innerTask) {
-				for _, task = range m {
-					handler = impl.getHandler(task.Key)
-					if handler == nil {
-						continue
-					}
+	if !impl.read(impl.expiredStg, func(m map[string]*innerTask) {
+		for _, task := range m {
+			if impl.getHandler(task.Key) != nil {
+				tasks = append(tasks, task)
+			}
+		}
+	}) {
+		return
+	}
 
-					break
-				}
-			})
+	for _, task := range tasks {
+		newTask := task.clone()
+		newTask.At = impl.now().UnixNano()
 
-			if handler == nil {
-				break
+		err := impl.stg.Change(func(oldM map[string]*innerTask) (newM map[string]*innerTask, err error) {
+			newM = oldM
+			if len(newM) == 0 {
+				newM = make(map[string]*innerTask)
 			}
 
-			_ = h(impl.ctx, task.ID, task.GetTask())
+			newM[newTask.ID] = newTask
 
-			_ = impl.expiredStg.Change(func(oldM map[string]*innerTask) (newM map[string]*innerTask, err error) {
-				newM = oldM
-				if len(newM) == 0 {
-					err = errorx.ErrSkip
+			return
+		})
+		if err != nil {
+			impl.logger.WithFields(logx.StringField("id", task.ID), logx.ErrorField(err)).Error("requeue expired task failed")
 
-					return
-				}
+			continue
+		}
 
-				delete(newM, task.ID)
+		_ = impl.expiredStg.Change(func(oldM map[string]*innerTask) (newM map[string]*innerTask, err error) {
+			newM = oldM
+			if len(newM) == 0 {
+				err = errorx.NoErrSkip
 
 				return
-			})
+			}
+
+			delete(newM, newTask.ID)
+
+			return
+		})
+
+		if err = impl.taskPool.AddTask(newTask.ID, time.Unix(0, newTask.At), impl.taskCallback); err != nil {
+			impl.logger.WithFields(logx.ErrorField(err)).Error("taskPool AddTask failed")
 		}
-	}()
+	}
 }
 
-func (impl *queueImpl) getHandler(key string) queuex.Handler {
-	impl.mLock.Lock()
-	defer impl.mLock.Unlock()
+// read reads stg and logs why it could not.
+func (impl *queueImpl) read(stg *taskStorage, proc func(m map[string]*innerTask)) bool {
+	if err := stg.Read(proc); err != nil {
+		impl.logger.WithFields(logx.ErrorField(err)).Error("read tasks failed")
 
-	h, ok := impl.m[key]
-	if ok {
-		return h
+		return false
 	}
 
-	for s, handler := range impl.m {
-		if strings.HasPrefix(key, s) {
-			return handler
-		}
-	}
+	return true
+}
 
-	return nil
+func (impl *queueImpl) getHandler(key string) queuex.Handler {
+	return impl.mux.Handler(key)
 }
 
 //
 //
 //
 
+func (impl *queueImpl) now() time.Time {
+	if impl.cfg.Now != nil {
+		return impl.cfg.Now()
+	}
+
+	return base.GetClock(impl.cfg.Clock).Now()
+}
+
 func (impl *queueImpl) taskCallback(key string, _ ...any) {
 	var task *innerTask
 	var ok bool
 
-	impl.stg.Read(func(m map[string]*innerTask) {
+	if !impl.read(impl.stg, func(m map[string]*innerTask) {
 		task, ok = m[key]
-	})
+	}) {
+		return
+	}
+
+	if !ok || task.AggregateKey != "" {
+		return
+	}
 
-	if !ok {
+	impl.dispatcher.push(task, impl.cfg.keyWeight(task.Key))
+}
+
+func (impl *queueImpl) processTask(id string) {
+	task := impl.claim(id)
+	if task == nil {
 		return
 	}
 
@@ -239,18 +483,397 @@ func (impl *queueImpl) taskCallback(key string, _ ...any) {
 
 			return
 		})
-	} else {
-		_ = h(impl.ctx, task.ID, task.GetTask())
+
+		impl.removeTask(task)
+
+		return
 	}
 
-	_ = impl.stg.Change(func(oldM map[string]*innerTask) (newM map[string]*innerTask, err error) {
+	timeNow := impl.now()
+
+	deadline := task.deadline(timeNow)
+	if !deadline.IsZero() && !deadline.After(timeNow) {
+		impl.killTask(task, context.DeadlineExceeded)
+
+		return
+	}
+
+	ctx := queuex.WithTaskMeta(impl.handlerCtx, queuex.TaskMeta{
+		ID:       task.ID,
+		Queue:    task.Queue,
+		Retried:  task.Retried,
+		MaxRetry: task.MaxRetry,
+	})
+
+	ctx, w := queuex.WithResultWriter(ctx)
+
+	if !deadline.IsZero() {
+		var cancel context.CancelFunc
+
+		ctx, cancel = context.WithTimeout(ctx, deadline.Sub(timeNow))
+		defer cancel()
+	}
+
+	err := h(ctx, task.ID, task.GetTask())
+	if err == nil && errors.Is(ctx.Err(), context.DeadlineExceeded) {
+		err = context.DeadlineExceeded
+	}
+
+	if err != nil {
+		if impl.interrupted(err) {
+			impl.logger.WithFields(logx.StringField("id", task.ID), logx.ErrorField(err)).Warn(
+				"task interrupted by shutdown, keep it for next run")
+
+			impl.releaseLease(task.ID)
+
+			return
+		}
+
+		impl.failTask(task, err)
+
+		return
+	}
+
+	impl.completeTask(task, w.Result())
+}
+
+// interrupted tells whether the handler gave up because the shutdown cancelled its context, other errors are
+// failures even while the queue stops.
+func (impl *queueImpl) interrupted(err error) bool {
+	return impl.handlerCtx.Err() != nil &&
+		(errors.Is(err, context.Canceled) || errors.Is(err, context.DeadlineExceeded))
+}
+
+// completeTask keeps the task and its result for the retention period of the task, if any.
+func (impl *queueImpl) completeTask(task *innerTask, result []byte) {
+	if task.Retention > 0 {
+		completedTask := task.clone()
+		completedTask.CompletedAt = impl.now().UnixNano()
+		completedTask.Result = result
+
+		err := impl.completedStg.Change(func(oldM map[string]*innerTask) (newM map[string]*innerTask, err error) {
+			newM = oldM
+			if len(newM) == 0 {
+				newM = make(map[string]*innerTask)
+			}
+
+			newM[completedTask.ID] = completedTask
+
+			return
+		})
+		if err != nil {
+			impl.logger.WithFields(logx.StringField("id", task.ID), logx.ErrorField(err)).Error("save completed task failed")
+		} else {
+			impl.scheduleRetention(completedTask)
+		}
+	}
+
+	impl.removeTask(task)
+}
+
+func (impl *queueImpl) scheduleRetention(task *innerTask) {
+	at := time.Unix(0, task.CompletedAt).Add(task.Retention)
+
+	if err := impl.taskPool.AddTask(retentionKeyPrefix+task.ID, at, impl.retentionCallback); err != nil {
+		impl.logger.WithFields(logx.ErrorField(err)).Error("taskPool AddTask failed")
+	}
+}
+
+func (impl *queueImpl) retentionCallback(key string, _ ...any) {
+	deleteTask(impl.completedStg, strings.TrimPrefix(key, retentionKeyPrefix))
+}
+
+func (impl *queueImpl) removeTask(task *innerTask) {
+	deleteTask(impl.stg, task.ID)
+
+	if task.GroupKey != "" {
+		impl.dispatchGroupHead(task.groupOf())
+	}
+}
+
+func (impl *queueImpl) failTask(task *innerTask, taskErr error) {
+	logger := impl.logger.WithFields(logx.StringField("id", task.ID), logx.StringField("key", task.Key),
+		logx.IntField("retried", task.Retried), logx.ErrorField(taskErr))
+
+	if delay, ok := queuex.IsRateLimited(taskErr); ok {
+		impl.postponeTask(task, delay)
+
+		return
+	}
+
+	if errors.Is(taskErr, queuex.ErrorSkipRetry) || task.Retried >= task.MaxRetry {
+		logger.Warn("task failed, move to dead letter")
+
+		impl.killTask(task, taskErr)
+
+		return
+	}
+
+	timeNow := impl.now()
+	at := timeNow.Add(impl.cfg.retryDelayFunc()(task.Retried+1, taskErr, task.GetTask()))
+
+	err := impl.stg.Change(func(oldM map[string]*innerTask) (newM map[string]*innerTask, err error) {
+		newM = oldM
+
+		t, ok := newM[task.ID]
+		if !ok {
+			err = errorx.ErrNotExists
+
+			return
+		}
+
+		t = t.clone()
+		t.Retried++
+		t.LastErr = taskErr.Error()
+		t.LastFailedAt = timeNow.UnixNano()
+		t.At = at.UnixNano()
+		t.LeaseOwner = ""
+		t.LeaseUntil = 0
+
+		newM[task.ID] = t
+
+		return
+	})
+	if err != nil {
+		logger.WithFields(logx.ErrorField(err)).Error("update failed task")
+
+		return
+	}
+
+	logger.Infof("task failed, retry at %s", at.Format(time.RFC3339))
+
+	if err = impl.taskPool.AddTask(task.ID, at, impl.taskCallback); err != nil {
+		logger.WithFields(logx.ErrorField(err)).Error("taskPool AddTask failed")
+	}
+}
+
+// postponeTask runs a throttled task again after delay, it does not count as a retry.
+func (impl *queueImpl) postponeTask(task *innerTask, delay time.Duration) {
+	at := impl.now().Add(delay)
+
+	err := impl.stg.Change(func(oldM map[string]*innerTask) (newM map[string]*innerTask, err error) {
+		newM = oldM
+
+		t, ok := newM[task.ID]
+		if !ok {
+			err = errorx.ErrNotExists
+
+			return
+		}
+
+		t = t.clone()
+		t.At = at.UnixNano()
+		t.LeaseOwner = ""
+		t.LeaseUntil = 0
+
+		newM[task.ID] = t
+
+		return
+	})
+	if err != nil {
+		impl.logger.WithFields(logx.StringField("id", task.ID), logx.ErrorField(err)).Error("postpone task failed")
+
+		return
+	}
+
+	if err = impl.taskPool.AddTask(task.ID, at, impl.taskCallback); err != nil {
+		impl.logger.WithFields(logx.ErrorField(err)).Error("taskPool AddTask failed")
+	}
+}
+
+func (impl *queueImpl) killTask(task *innerTask, taskErr error) {
+	deadTask := task.clone()
+	deadTask.LastErr = taskErr.Error()
+	deadTask.LastFailedAt = impl.now().UnixNano()
+
+	err := impl.deadStg.Change(func(oldM map[string]*innerTask) (newM map[string]*innerTask, err error) {
 		newM = oldM
 		if len(newM) == 0 {
 			newM = make(map[string]*innerTask)
 		}
 
-		delete(newM, task.ID)
+		newM[deadTask.ID] = deadTask
 
 		return
 	})
+	if err != nil {
+		impl.logger.WithFields(logx.StringField("id", task.ID), logx.ErrorField(err)).Error("save dead task failed")
+
+		return
+	}
+
+	impl.removeTask(task)
+}
+
+//
+//
+//
+
+// claim returns the task to handle. In a shared queue it takes the lease of the task, and returns nil if the
+// task is not due or another worker holds its lease.
+func (impl *queueImpl) claim(id string) (task *innerTask) {
+	if !impl.cfg.Shared {
+		impl.read(impl.stg, func(m map[string]*innerTask) {
+			if t, ok := m[id]; ok && isGroupHead(m, t) {
+				task = t
+			}
+		})
+
+		return
+	}
+
+	timeNow := impl.now()
+
+	err := impl.stg.Change(func(oldM map[string]*innerTask) (newM map[string]*innerTask, err error) {
+		newM = oldM
+
+		t, ok := newM[id]
+		if !ok || t.At > timeNow.UnixNano() || t.leased(impl.owner, timeNow) || !isGroupHead(newM, t) {
+			err = errorx.NoErrSkip
+
+			return
+		}
+
+		t = t.clone()
+		t.LeaseOwner = impl.owner
+		t.LeaseUntil = timeNow.Add(impl.cfg.leaseTimeout()).UnixNano()
+		newM[id] = t
+
+		task = t
+
+		return
+	})
+	if err != nil {
+		impl.logger.WithFields(logx.StringField("id", id), logx.ErrorField(err)).Error("claim task failed")
+
+		return nil
+	}
+
+	return
+}
+
+func (impl *queueImpl) releaseLease(id string) {
+	if !impl.cfg.Shared {
+		return
+	}
+
+	_ = impl.stg.Change(func(oldM map[string]*innerTask) (newM map[string]*innerTask, err error) {
+		newM = oldM
+
+		t, ok := newM[id]
+		if !ok || t.LeaseOwner != impl.owner {
+			err = errorx.NoErrSkip
+
+			return
+		}
+
+		t = t.clone()
+		t.LeaseOwner = ""
+		t.LeaseUntil = 0
+		newM[id] = t
+
+		return
+	})
+}
+
+// heartbeat renews the leases of the running tasks until the queue stopped.
+func (impl *queueImpl) heartbeat() {
+	interval := impl.cfg.leaseTimeout() / 3
+
+	timer := base.GetClock(impl.cfg.Clock).NewTimer(interval)
+	defer timer.Stop()
+
+	for {
+		select {
+		case <-impl.stopCh:
+			return
+		case <-timer.C():
+		}
+
+		timer.Reset(interval)
+
+		impl.renewLeases()
+	}
+}
+
+func (impl *queueImpl) renewLeases() {
+	ids := impl.dispatcher.activeIDs()
+	if len(ids) == 0 {
+		return
+	}
+
+	until := impl.now().Add(impl.cfg.leaseTimeout()).UnixNano()
+
+	err := impl.stg.Change(func(oldM map[string]*innerTask) (newM map[string]*innerTask, err error) {
+		newM = oldM
+
+		for _, id := range ids {
+			t, ok := newM[id]
+			if !ok || t.LeaseOwner != impl.owner {
+				continue
+			}
+
+			t = t.clone()
+			t.LeaseUntil = until
+			newM[id] = t
+		}
+
+		return
+	})
+	if err != nil {
+		impl.logger.WithFields(logx.ErrorField(err)).Error("renew leases failed")
+	}
+}
+
+// poll dispatches the due tasks that other processes enqueued or whose lease expired, until the queue stopped.
+func (impl *queueImpl) poll() {
+	interval := impl.cfg.pollInterval()
+
+	timer := base.GetClock(impl.cfg.Clock).NewTimer(interval)
+	defer timer.Stop()
+
+	for {
+		select {
+		case <-impl.stopCh:
+			return
+		case <-timer.C():
+		}
+
+		timer.Reset(interval)
+
+		impl.dispatchDueTasks()
+		impl.requeueExpired()
+	}
+}
+
+func (impl *queueImpl) dispatchDueTasks() {
+	timeNow := impl.now()
+
+	var tasks []*innerTask
+
+	aggregations := make(map[[2]string]bool)
+
+	if !impl.read(impl.stg, func(m map[string]*innerTask) {
+		for _, task := range m {
+			if task.AggregateKey != "" {
+				aggregations[[2]string{task.Queue, task.AggregateKey}] = true
+
+				continue
+			}
+
+			if task.At <= timeNow.UnixNano() && !task.leased(impl.owner, timeNow) && isGroupHead(m, task) {
+				tasks = append(tasks, task)
+			}
+		}
+	}) {
+		return
+	}
+
+	for _, task := range tasks {
+		impl.dispatcher.push(task, impl.cfg.keyWeight(task.Key))
+	}
+
+	for group := range aggregations {
+		impl.scheduleAggregation(group[0], group[1])
+	}
 }
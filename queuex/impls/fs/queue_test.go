@@ -2,13 +2,21 @@ package fs
 
 import (
 	"context"
+	"errors"
+	"fmt"
 	"os"
+	"path/filepath"
+	"sync"
+	"sync/atomic"
 	"testing"
 	"time"
 
+	"github.com/GizmoVault/gotools/base"
 	"github.com/GizmoVault/gotools/base/logx"
 	"github.com/GizmoVault/gotools/queuex"
+	"github.com/GizmoVault/gotools/queuex/queuextest"
 	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
 )
 
 func TestQueue(t *testing.T) {
@@ -24,7 +32,7 @@ func TestQueue(t *testing.T) {
 	})
 
 	go func() {
-		_ = queue.Run()
+		_ = queue.Run(t.Context())
 	}()
 
 	t.Log(time.Now(), "start enqueue")
@@ -71,8 +79,848 @@ func TestQueue2(t *testing.T) {
 	})
 
 	go func() {
-		_ = queue.Run()
+		_ = queue.Run(t.Context())
 	}()
 
 	time.Sleep(time.Second * 10)
 }
+
+func TestQueueRetry(t *testing.T) {
+	fileName := filepath.Join(t.TempDir(), "ut_retry.dat")
+
+	queue, err := NewFsQueueWithConfig(t.Context(), fileName, Config{
+		MaxRetry:       2,
+		RetryDelayFunc: func(int, error, *queuex.Task) time.Duration { return 0 },
+	}, logx.NewConsoleLoggerWrapper())
+	require.NoError(t, err)
+
+	defer queue.Stop()
+
+	var calls atomic.Int32
+
+	done := make(chan struct{})
+
+	queue.HandleFunc("retry:ok", func(ctx context.Context, _ string, _ *queuex.Task) error {
+		retried, _ := queuex.GetRetryCount(ctx)
+		if calls.Add(1) <= 2 {
+			return errors.New("temporary failure")
+		}
+
+		assert.Equal(t, 2, retried)
+
+		close(done)
+
+		return nil
+	})
+
+	queue.HandleFunc("retry:skip", func(context.Context, string, *queuex.Task) error {
+		return fmt.Errorf("bad payload: %w", queuex.ErrorSkipRetry)
+	})
+
+	go func() {
+		_ = queue.Run(t.Context())
+	}()
+
+	_, err = queue.Enqueue(&queuex.Task{Key: "retry:ok"}, 0)
+	require.NoError(t, err)
+
+	skipID, err := queue.Enqueue(&queuex.Task{Key: "retry:skip"}, 0)
+	require.NoError(t, err)
+
+	select {
+	case <-done:
+	case <-time.After(5 * time.Second):
+		t.Fatal("task was not retried")
+	}
+
+	assert.Eventually(t, func() bool {
+		var ok bool
+
+		queue.(*queueImpl).deadStg.Read(func(m map[string]*innerTask) {
+			_, ok = m[skipID]
+		})
+
+		return ok
+	}, 5*time.Second, 50*time.Millisecond)
+
+	assert.EqualValues(t, 3, calls.Load())
+}
+
+func TestQueueConcurrency(t *testing.T) {
+	fileName := filepath.Join(t.TempDir(), "ut_concurrency.dat")
+
+	queue, err := NewFsQueueWithConfig(t.Context(), fileName, Config{
+		Concurrency: 4,
+		KeyWeights: map[string]int64{
+			"heavy:": 2,
+		},
+	}, logx.NewNopLoggerWrapper())
+	require.NoError(t, err)
+
+	defer queue.Stop()
+
+	var running, maxRunning, finished atomic.Int64
+
+	queue.HandleFunc("heavy:", func(context.Context, string, *queuex.Task) error {
+		n := running.Add(2)
+		for {
+			m := maxRunning.Load()
+			if n <= m || maxRunning.CompareAndSwap(m, n) {
+				break
+			}
+		}
+
+		time.Sleep(100 * time.Millisecond)
+		running.Add(-2)
+		finished.Add(1)
+
+		return nil
+	})
+
+	for range 6 {
+		_, err = queue.Enqueue(&queuex.Task{Key: "heavy:job"}, 0)
+		require.NoError(t, err)
+	}
+
+	go func() {
+		_ = queue.Run(t.Context())
+	}()
+
+	assert.Eventually(t, func() bool {
+		return finished.Load() == 6
+	}, 5*time.Second, 20*time.Millisecond)
+	assert.EqualValues(t, 4, maxRunning.Load())
+}
+
+func TestQueueStop(t *testing.T) {
+	fileName := filepath.Join(t.TempDir(), "ut_stop.dat")
+
+	queue, err := NewFsQueueWithConfig(t.Context(), fileName, Config{
+		ShutdownTimeout: 100 * time.Millisecond,
+	}, logx.NewNopLoggerWrapper())
+	require.NoError(t, err)
+
+	started := make(chan struct{})
+
+	queue.HandleFunc("stop:", func(ctx context.Context, _ string, _ *queuex.Task) error {
+		close(started)
+		<-ctx.Done()
+
+		return ctx.Err()
+	})
+
+	id, err := queue.Enqueue(&queuex.Task{Key: "stop:job"}, 0)
+	require.NoError(t, err)
+
+	ctx, cancel := context.WithCancel(t.Context())
+	runDone := make(chan error)
+
+	go func() {
+		runDone <- queue.Run(ctx)
+	}()
+
+	<-started
+	cancel()
+	require.NoError(t, <-runDone)
+
+	queue.Stop()
+
+	queue2, err := NewFsQueueWithConfig(t.Context(), fileName, Config{}, logx.NewNopLoggerWrapper())
+	require.NoError(t, err)
+
+	defer queue2.Stop()
+
+	done := make(chan string, 1)
+
+	queue2.HandleFunc("stop:", func(_ context.Context, id string, _ *queuex.Task) error {
+		done <- id
+
+		return nil
+	})
+
+	go func() {
+		_ = queue2.Run(t.Context())
+	}()
+
+	select {
+	case got := <-done:
+		assert.Equal(t, id, got)
+	case <-time.After(5 * time.Second):
+		t.Fatal("interrupted task was not run again")
+	}
+}
+
+func TestQueueStopFailure(t *testing.T) {
+	fileName := filepath.Join(t.TempDir(), "ut_stop_failure.dat")
+
+	queue, err := NewFsQueueWithConfig(t.Context(), fileName, Config{
+		ShutdownTimeout: 10 * time.Millisecond,
+	}, logx.NewNopLoggerWrapper())
+	require.NoError(t, err)
+
+	started := make(chan struct{})
+
+	queue.HandleFunc("stop:", func(ctx context.Context, _ string, _ *queuex.Task) error {
+		close(started)
+		<-ctx.Done()
+
+		return errors.New("broken")
+	})
+
+	id, err := queue.Enqueue(&queuex.Task{Key: "stop:job"}, 0)
+	require.NoError(t, err)
+
+	go func() {
+		_ = queue.Run(t.Context())
+	}()
+
+	<-started
+	queue.Stop()
+
+	// Stop cancels the handler past the timeout without waiting for it
+	require.Eventually(t, func() bool {
+		return len(queue.(*queueImpl).dispatcher.activeIDs()) == 0
+	}, 5*time.Second, time.Millisecond)
+
+	// a failure while the queue stops is still a failure
+	queue2, err := NewFsQueueWithConfig(t.Context(), fileName, Config{}, logx.NewNopLoggerWrapper())
+	require.NoError(t, err)
+
+	defer queue2.Stop()
+
+	inspector, err := NewInspector(queue2)
+	require.NoError(t, err)
+
+	info, err := inspector.GetTaskInfo(id)
+	require.NoError(t, err)
+	assert.Equal(t, 1, info.Retried)
+	assert.Equal(t, "broken", info.LastErr)
+}
+
+func TestQueueOptions(t *testing.T) {
+	fileName := filepath.Join(t.TempDir(), "ut_options.dat")
+
+	queue, err := NewFsQueueWithConfig(t.Context(), fileName, Config{
+		Concurrency: 1,
+	}, logx.NewNopLoggerWrapper())
+	require.NoError(t, err)
+
+	defer queue.Stop()
+
+	_, err = queue.Enqueue(&queuex.Task{Key: "opt:unique", Payload: []byte("1")}, 0, queuex.Unique(time.Minute))
+	require.NoError(t, err)
+
+	_, err = queue.Enqueue(&queuex.Task{Key: "opt:unique", Payload: []byte("1")}, 0, queuex.Unique(time.Minute))
+	require.ErrorIs(t, err, queuex.ErrorDuplicateTask)
+
+	_, err = queue.Enqueue(&queuex.Task{Key: "opt:unique", Payload: []byte("2")}, 0, queuex.Unique(time.Minute))
+	require.NoError(t, err)
+
+	_, err = queue.Enqueue(&queuex.Task{Key: "opt:id"}, 0, queuex.TaskID("my-id"), queuex.Retention(time.Hour))
+	require.NoError(t, err)
+
+	_, err = queue.Enqueue(&queuex.Task{Key: "opt:id"}, 0, queuex.TaskID("my-id"))
+	require.ErrorIs(t, err, queuex.ErrorTaskIDConflict)
+
+	timeoutID, err := queue.Enqueue(&queuex.Task{Key: "opt:timeout"}, 0, queuex.Timeout(50*time.Millisecond),
+		queuex.MaxRetry(0))
+	require.NoError(t, err)
+
+	_, err = queue.Enqueue(&queuex.Task{Key: "opt:prio", Payload: []byte("low")}, 0, queuex.WithPriority(queuex.PriorityLow))
+	require.NoError(t, err)
+
+	_, err = queue.Enqueue(&queuex.Task{Key: "opt:prio", Payload: []byte("critical")}, 0,
+		queuex.WithPriority(queuex.PriorityCritical))
+	require.NoError(t, err)
+
+	var orderLock sync.Mutex
+
+	var order []string
+
+	queue.HandleFunc("opt:", func(ctx context.Context, _ string, task *queuex.Task) error {
+		orderLock.Lock()
+		order = append(order, task.Key+"/"+string(task.Payload))
+		orderLock.Unlock()
+
+		if task.Key == "opt:timeout" {
+			time.Sleep(100 * time.Millisecond)
+		}
+
+		return nil
+	})
+
+	impl := queue.(*queueImpl)
+
+	// let every task reach the dispatcher so that the priorities decide the order
+	require.Eventually(t, func() bool {
+		impl.dispatcher.lock.Lock()
+		defer impl.dispatcher.lock.Unlock()
+
+		return impl.dispatcher.ready.Len() == 6
+	}, time.Second, 10*time.Millisecond)
+
+	go func() {
+		_ = queue.Run(t.Context())
+	}()
+
+	assert.Eventually(t, func() bool {
+		var ok bool
+
+		impl.deadStg.Read(func(m map[string]*innerTask) {
+			_, ok = m[timeoutID]
+		})
+
+		return ok
+	}, 5*time.Second, 20*time.Millisecond)
+
+	assert.Eventually(t, func() bool {
+		var ok bool
+
+		impl.completedStg.Read(func(m map[string]*innerTask) {
+			_, ok = m["my-id"]
+		})
+
+		return ok
+	}, 5*time.Second, 20*time.Millisecond)
+
+	orderLock.Lock()
+	defer orderLock.Unlock()
+
+	assert.Equal(t, "opt:prio/critical", order[0])
+	assert.Equal(t, "opt:prio/low", order[len(order)-1])
+}
+
+func TestQueueTaskIDRace(t *testing.T) {
+	fileName := filepath.Join(t.TempDir(), "ut_task_id.dat")
+
+	queue, err := NewFsQueueWithConfig(t.Context(), fileName, Config{Shared: true}, logx.NewNopLoggerWrapper())
+	require.NoError(t, err)
+
+	defer queue.Stop()
+
+	var (
+		succeeded atomic.Int32
+		conflicts atomic.Int32
+		done      sync.WaitGroup
+	)
+
+	start := make(chan struct{})
+
+	for range 8 {
+		done.Add(1)
+
+		go func() {
+			defer done.Done()
+
+			<-start
+
+			_, err := queue.Enqueue(&queuex.Task{Key: "race"}, time.Hour, queuex.TaskID("race"))
+
+			switch {
+			case err == nil:
+				succeeded.Add(1)
+			case errors.Is(err, queuex.ErrorTaskIDConflict):
+				conflicts.Add(1)
+			default:
+				assert.NoError(t, err)
+			}
+		}()
+	}
+
+	close(start)
+	done.Wait()
+
+	assert.Equal(t, int32(1), succeeded.Load())
+	assert.Equal(t, int32(7), conflicts.Load())
+}
+
+func TestQueueShared(t *testing.T) {
+	fileName := filepath.Join(t.TempDir(), "ut_shared.dat")
+	cfg := Config{
+		Shared:       true,
+		LeaseTimeout: 2 * time.Second,
+		PollInterval: 50 * time.Millisecond,
+	}
+
+	producer, err := NewFsQueueWithConfig(t.Context(), fileName, cfg, logx.NewNopLoggerWrapper())
+	require.NoError(t, err)
+
+	var lock sync.Mutex
+
+	handled := make(map[string]int)
+
+	var workers []queuex.Queue
+
+	for range 2 {
+		worker, e := NewFsQueueWithConfig(t.Context(), fileName, cfg, logx.NewNopLoggerWrapper())
+		require.NoError(t, e)
+
+		worker.HandleFunc("shared:", func(_ context.Context, id string, _ *queuex.Task) error {
+			lock.Lock()
+			handled[id]++
+			lock.Unlock()
+
+			return nil
+		})
+
+		workers = append(workers, worker)
+	}
+
+	// a task claimed by a worker that crashed before it acknowledged it
+	crashedID, err := producer.Enqueue(&queuex.Task{Key: "shared:crashed"}, 0)
+	require.NoError(t, err)
+	require.NotNil(t, producer.(*queueImpl).claim(crashedID))
+
+	const n = 20
+
+	for i := range n {
+		_, err = producer.Enqueue(&queuex.Task{Key: "shared:job", Payload: []byte{byte(i)}}, 0)
+		require.NoError(t, err)
+	}
+
+	for _, worker := range workers {
+		go func() {
+			_ = worker.Run(t.Context())
+		}()
+
+		defer worker.Stop()
+	}
+
+	count := func() int {
+		lock.Lock()
+		defer lock.Unlock()
+
+		return len(handled)
+	}
+
+	assert.Eventually(t, func() bool {
+		return count() == n
+	}, 5*time.Second, 20*time.Millisecond)
+
+	lock.Lock()
+	assert.Zero(t, handled[crashedID])
+	lock.Unlock()
+
+	assert.Eventually(t, func() bool {
+		return count() == n+1
+	}, 5*time.Second, 20*time.Millisecond)
+
+	lock.Lock()
+	for id, times := range handled {
+		assert.Equal(t, 1, times, id)
+	}
+	lock.Unlock()
+
+	inspector, err := NewInspector(producer)
+	require.NoError(t, err)
+
+	stats, err := inspector.Stats()
+	require.NoError(t, err)
+	assert.Zero(t, stats.Pending+stats.Active)
+}
+
+func TestQueueSharedLockFailure(t *testing.T) {
+	queue, err := NewFsQueueWithConfig(t.Context(), filepath.Join(t.TempDir(), "ut_lock.dat"), Config{Shared: true},
+		logx.NewNopLoggerWrapper())
+	require.NoError(t, err)
+
+	defer queue.Stop()
+
+	_, err = queue.Enqueue(&queuex.Task{Key: "lock"}, time.Hour)
+	require.NoError(t, err)
+
+	impl := queue.(*queueImpl)
+	require.NoError(t, impl.stg.flock.f.Close())
+
+	// no read without the lock, another process may have changed the files
+	called := false
+	require.Error(t, impl.stg.Read(func(map[string]*innerTask) { called = true }))
+	assert.False(t, called)
+
+	_, err = impl.Stats()
+	require.Error(t, err)
+
+	_, err = impl.ListScheduled()
+	require.Error(t, err)
+}
+
+func TestQueueGroups(t *testing.T) {
+	fileName := filepath.Join(t.TempDir(), "ut_groups.dat")
+
+	queue, err := NewFsQueueWithConfig(t.Context(), fileName, Config{
+		RetryDelayFunc: func(int, error, *queuex.Task) time.Duration {
+			return 0
+		},
+		Aggregation: queuex.AggregationConfig{
+			GracePeriod: time.Second,
+			MaxSize:     3,
+		},
+	}, logx.NewNopLoggerWrapper())
+	require.NoError(t, err)
+
+	defer queue.Stop()
+
+	var (
+		lock    sync.Mutex
+		order   = make(map[string][]byte)
+		running = make(map[string]bool)
+		batches [][][]byte
+		failed  bool
+	)
+
+	queue.HandleFunc("group:", func(_ context.Context, _ string, task *queuex.Task) error {
+		group := task.Key
+
+		lock.Lock()
+		assert.False(t, running[group])
+		running[group] = true
+
+		if group == "group:u1" && !failed {
+			failed = true
+			running[group] = false
+			lock.Unlock()
+
+			return errors.New("first attempt fails")
+		}
+		lock.Unlock()
+
+		time.Sleep(5 * time.Millisecond)
+
+		lock.Lock()
+		order[group] = append(order[group], task.Payload[0])
+		running[group] = false
+		lock.Unlock()
+
+		return nil
+	})
+
+	queue.HandleFunc("batch", func(_ context.Context, _ string, task *queuex.Task) error {
+		payloads, e := queuex.AggregatedPayloads(task)
+		assert.NoError(t, e)
+
+		lock.Lock()
+		batches = append(batches, payloads)
+		lock.Unlock()
+
+		return nil
+	})
+
+	for i := range 5 {
+		for _, group := range []string{"u1", "u2"} {
+			_, err = queue.Enqueue(&queuex.Task{Key: "group:" + group, Payload: []byte{byte(i)}}, 0,
+				queuex.GroupKey(group))
+			require.NoError(t, err)
+		}
+	}
+
+	for i := range 4 {
+		_, err = queue.Enqueue(&queuex.Task{Key: "batch", Payload: []byte{byte(i)}}, 0, queuex.AggregateGroup("b"))
+		require.NoError(t, err)
+	}
+
+	go func() {
+		_ = queue.Run(t.Context())
+	}()
+
+	assert.Eventually(t, func() bool {
+		lock.Lock()
+		defer lock.Unlock()
+
+		return len(order["group:u1"]) == 5 && len(order["group:u2"]) == 5 && len(batches) == 2
+	}, 5*time.Second, 20*time.Millisecond)
+
+	lock.Lock()
+	defer lock.Unlock()
+
+	assert.Equal(t, []byte{0, 1, 2, 3, 4}, order["group:u1"])
+	assert.Equal(t, []byte{0, 1, 2, 3, 4}, order["group:u2"])
+	assert.Equal(t, [][][]byte{{{0}, {1}, {2}}, {{3}}}, batches)
+}
+
+func TestQueueFlowControl(t *testing.T) {
+	fileName := filepath.Join(t.TempDir(), "ut_flow.dat")
+
+	queue, err := NewFsQueueWithConfig(t.Context(), fileName, Config{
+		MaxRetry: -1,
+	}, logx.NewNopLoggerWrapper())
+	require.NoError(t, err)
+
+	defer queue.Stop()
+
+	fc := queuex.NewFlowControl()
+	fc.SetPausedDelay(100 * time.Millisecond)
+	fc.PauseQueue("slow")
+	queue.Use(fc.Middleware())
+
+	done := make(chan struct{})
+
+	queue.HandleFunc("flow", func(context.Context, string, *queuex.Task) error {
+		close(done)
+
+		return nil
+	})
+
+	id, err := queue.Enqueue(&queuex.Task{Key: "flow"}, 0, queuex.QueueName("slow"), queuex.Retention(time.Hour))
+	require.NoError(t, err)
+
+	go func() {
+		_ = queue.Run(t.Context())
+	}()
+
+	inspector, err := NewInspector(queue)
+	require.NoError(t, err)
+
+	assert.Eventually(t, func() bool {
+		info, e := inspector.GetTaskInfo(id)
+
+		return e == nil && info.State == queuex.TaskStateScheduled
+	}, 3*time.Second, 10*time.Millisecond)
+
+	info, err := inspector.GetTaskInfo(id)
+	require.NoError(t, err)
+	assert.Zero(t, info.Retried)
+
+	fc.ResumeQueue("slow")
+
+	select {
+	case <-done:
+	case <-time.After(5 * time.Second):
+		require.Fail(t, "paused task never ran")
+	}
+}
+
+func TestConformance(t *testing.T) {
+	dir := t.TempDir()
+
+	queuextest.RunConformance(t, queuextest.Factory{
+		New: func(t *testing.T, name string) queuex.Queue {
+			t.Helper()
+
+			q, err := NewFsQueueWithConfig(t.Context(), filepath.Join(dir, name+".dat"), Config{
+				RetryDelayFunc: func(int, error, *queuex.Task) time.Duration { return 0 },
+			}, logx.NewConsoleLoggerWrapper())
+			require.NoError(t, err)
+
+			return q
+		},
+	})
+}
+
+func TestQueueVirtualTime(t *testing.T) {
+	fileName := filepath.Join(t.TempDir(), "ut_virtual.dat")
+
+	var lock sync.Mutex
+
+	timeNow := time.Unix(1000, 0)
+
+	now := func() time.Time {
+		lock.Lock()
+		defer lock.Unlock()
+
+		return timeNow
+	}
+
+	queue, err := NewFsQueueWithConfig(t.Context(), fileName, Config{
+		Now:         now,
+		Concurrency: 1,
+	}, logx.NewConsoleLoggerWrapper())
+	require.NoError(t, err)
+
+	defer queue.Stop()
+
+	got := make(chan string, 8)
+
+	queue.HandleFunc("vt", func(_ context.Context, _ string, task *queuex.Task) error {
+		got <- string(task.Payload)
+
+		return nil
+	})
+
+	for _, p := range []string{"a", "b", "c", "d"} {
+		_, err = queue.Enqueue(&queuex.Task{Key: "vt", Payload: []byte(p)}, 0)
+		require.NoError(t, err)
+	}
+
+	lateID, err := queue.Enqueue(&queuex.Task{Key: "vt", Payload: []byte("late")}, 300*time.Millisecond)
+	require.NoError(t, err)
+
+	info, err := queue.(*queueImpl).GetTaskInfo(lateID)
+	require.NoError(t, err)
+	assert.Equal(t, time.Unix(1000, 0).Add(300*time.Millisecond), info.NextProcessAt)
+
+	d := queue.(*queueImpl).dispatcher
+
+	require.Eventually(t, func() bool {
+		d.lock.Lock()
+		defer d.lock.Unlock()
+
+		return d.ready.Len() == 4
+	}, time.Second, 10*time.Millisecond)
+
+	go func() {
+		_ = queue.Run(t.Context())
+	}()
+
+	var order string
+
+	for range 4 {
+		select {
+		case p := <-got:
+			order += p
+		case <-time.After(time.Second):
+			require.FailNow(t, "task not handled")
+		}
+	}
+
+	assert.Equal(t, "abcd", order)
+
+	select {
+	case p := <-got:
+		require.FailNow(t, "delayed task handled early", p)
+	case <-time.After(100 * time.Millisecond):
+	}
+
+	lock.Lock()
+	timeNow = timeNow.Add(300 * time.Millisecond)
+	lock.Unlock()
+
+	select {
+	case p := <-got:
+		assert.Equal(t, "late", p)
+	case <-time.After(time.Second):
+		require.FailNow(t, "delayed task not handled")
+	}
+}
+
+func TestQueueMigrateSeconds(t *testing.T) {
+	fileName := filepath.Join(t.TempDir(), "ut_migrate.dat")
+
+	at := time.Now().Add(time.Hour).Truncate(time.Second)
+
+	require.NoError(t, os.WriteFile(fileName, fmt.Appendf(nil,
+		`{"old":{"ID":"old","Key":"migrate","At":%d,"MaxRetry":3,"UniqueUntil":%d}}`, at.Unix(), at.Unix()), 0o600))
+
+	for range 2 {
+		queue, err := NewFsQueue(t.Context(), fileName, logx.NewConsoleLoggerWrapper())
+		require.NoError(t, err)
+
+		info, err := queue.(*queueImpl).GetTaskInfo("old")
+		require.NoError(t, err)
+		assert.True(t, at.Equal(info.NextProcessAt))
+		assert.Equal(t, queuex.TaskStateScheduled, info.State)
+
+		// any change rewrites the file with the migrated task
+		_, err = queue.Enqueue(&queuex.Task{Key: "migrate"}, time.Hour)
+		require.NoError(t, err)
+
+		queue.Stop()
+	}
+
+	data, err := os.ReadFile(fileName)
+	require.NoError(t, err)
+	assert.Contains(t, string(data), fmt.Sprintf(`"At":%d`, at.UnixNano()))
+}
+
+func TestSchedulerFakeClock(t *testing.T) {
+	fileName := filepath.Join(t.TempDir(), "ut_scheduler.dat")
+	clock := base.NewFakeClock(time.Unix(1000, 0))
+
+	queue, err := NewFsQueueWithConfig(t.Context(), fileName, Config{Clock: clock}, logx.NewNopLoggerWrapper())
+	require.NoError(t, err)
+
+	defer queue.Stop()
+
+	calls := make(chan time.Time, 1)
+
+	queue.HandleFunc("report", func(context.Context, string, *queuex.Task) error {
+		calls <- clock.Now()
+
+		return nil
+	})
+
+	go func() {
+		_ = queue.Run(t.Context())
+	}()
+
+	s, err := NewScheduler(queue, time.UTC, nil)
+	require.NoError(t, err)
+
+	defer s.Stop()
+
+	_, err = s.Register("@every 1m", &queuex.Task{Key: "report"})
+	require.NoError(t, err)
+
+	// the scheduler waits on the clock of the queue
+	clock.BlockUntil(1)
+	clock.Advance(time.Minute)
+	assert.Equal(t, time.Unix(1060, 0), <-calls)
+}
+
+func TestQueueFakeClock(t *testing.T) {
+	fileName := filepath.Join(t.TempDir(), "ut_fake_clock.dat")
+	clock := base.NewFakeClock(time.Unix(1000, 0))
+
+	queue, err := NewFsQueueWithConfig(t.Context(), fileName, Config{
+		Clock:          clock,
+		RetryDelayFunc: func(int, error, *queuex.Task) time.Duration { return time.Minute },
+	}, logx.NewNopLoggerWrapper())
+	require.NoError(t, err)
+
+	defer queue.Stop()
+
+	calls := make(chan time.Time, 2)
+
+	queue.HandleFunc("fake", func(ctx context.Context, _ string, _ *queuex.Task) error {
+		calls <- clock.Now()
+
+		if retried, _ := queuex.GetRetryCount(ctx); retried == 0 {
+			return errors.New("first attempt fails")
+		}
+
+		return nil
+	})
+
+	go func() {
+		_ = queue.Run(t.Context())
+	}()
+
+	_, err = queue.Enqueue(&queuex.Task{Key: "fake"}, time.Hour)
+	require.NoError(t, err)
+
+	// the pool waits on the clock for the delayed task, then for its retry
+	clock.BlockUntil(1)
+	clock.Advance(time.Hour)
+	assert.Equal(t, time.Unix(1000, 0).Add(time.Hour), <-calls)
+
+	clock.BlockUntil(1)
+	clock.Advance(time.Minute)
+	assert.Equal(t, time.Unix(1000, 0).Add(time.Hour+time.Minute), <-calls)
+}
+
+func TestDispatcherStopTimeout(t *testing.T) {
+	clock := base.NewFakeClock(time.Unix(1000, 0))
+	release := make(chan struct{})
+	started := make(chan struct{})
+
+	d := newDispatcher(1, clock, func(string) {
+		close(started)
+		<-release
+	})
+	d.start()
+	d.push(&innerTask{ID: "1"}, 1)
+
+	<-started
+
+	stopped := make(chan bool)
+
+	go func() {
+		stopped <- d.stop(time.Minute)
+	}()
+
+	// the grace runs on the clock of the queue
+	clock.BlockUntil(1)
+	clock.Advance(time.Minute)
+	assert.False(t, <-stopped)
+
+	close(release)
+}
@@ -0,0 +1,30 @@
+package fs
+
+import (
+	"time"
+
+	"github.com/GizmoVault/gotools/base/errorx"
+	"github.com/GizmoVault/gotools/base/logx"
+	"github.com/GizmoVault/gotools/queuex"
+)
+
+// NewScheduler creates a queuex.Scheduler for an fs queue, persisted next to the queue data file. It fires on
+// the timers of the queue clock, a Now set in the config is polled as the queue does.
+func NewScheduler(q queuex.Queue, loc *time.Location, logger logx.Wrapper) (*queuex.Scheduler, error) {
+	impl, ok := q.(*queueImpl)
+	if !ok {
+		return nil, errorx.ErrInvalidArgs
+	}
+
+	if logger == nil {
+		logger = impl.logger
+	}
+
+	fileName := impl.fileName + ".schedule"
+
+	if impl.cfg.Clock != nil && impl.cfg.Now == nil {
+		return queuex.NewSchedulerWithClock(q, fileName, loc, impl.cfg.Clock, logger)
+	}
+
+	return queuex.NewSchedulerWithFNNow(q, fileName, loc, impl.cfg.Now, logger)
+}
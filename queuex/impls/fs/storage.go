@@ -0,0 +1,233 @@
+package fs
+
+import (
+	"encoding/binary"
+	"errors"
+	"io"
+	"os"
+	"sync"
+
+	"github.com/GizmoVault/gotools/base/errorx"
+	"github.com/GizmoVault/gotools/base/syncx"
+	"github.com/GizmoVault/gotools/pathx"
+	"github.com/GizmoVault/gotools/storagex"
+)
+
+// fileLock serializes the access to the queue files across the goroutines and the processes sharing them.
+type fileLock struct {
+	lock sync.Mutex
+	f    *os.File
+}
+
+func newFileLock(fileName string) (*fileLock, error) {
+	_ = pathx.MustDirOfFileExists(fileName)
+
+	f, err := os.OpenFile(fileName, os.O_CREATE|os.O_RDWR, 0o600)
+	if err != nil {
+		return nil, err
+	}
+
+	return &fileLock{f: f}, nil
+}
+
+func (l *fileLock) Lock() error {
+	l.lock.Lock()
+
+	if err := syncx.LockFile(l.f); err != nil {
+		l.lock.Unlock()
+
+		return err
+	}
+
+	return nil
+}
+
+func (l *fileLock) Unlock() {
+	_ = syncx.UnlockFile(l.f)
+
+	l.lock.Unlock()
+}
+
+// generation returns the change counter kept in the lock file, the lock must be held.
+func (l *fileLock) generation() (uint64, error) {
+	var b [8]byte
+
+	n, err := l.f.ReadAt(b[:], 0)
+	if err != nil && !errors.Is(err, io.EOF) {
+		return 0, err
+	}
+
+	if n < len(b) {
+		return 0, nil
+	}
+
+	return binary.BigEndian.Uint64(b[:]), nil
+}
+
+// bump increases the change counter kept in the lock file, the lock must be held.
+func (l *fileLock) bump() (uint64, error) {
+	gen, err := l.generation()
+	if err != nil {
+		return 0, err
+	}
+
+	gen++
+
+	var b [8]byte
+
+	binary.BigEndian.PutUint64(b[:], gen)
+
+	if _, err = l.f.WriteAt(b[:], 0); err != nil {
+		return 0, err
+	}
+
+	return gen, nil
+}
+
+// taskStorage is a task file. A shared one takes the file lock before every access, and reloads the file if
+// the change counter in the lock file moved since it last saw it.
+type taskStorage struct {
+	mwf   *storagex.MemWithFile[map[string]*innerTask, storagex.Serial, syncx.RWLocker]
+	flock *fileLock
+	gen   uint64
+}
+
+func newTaskStorage(fileName string, flock *fileLock,
+	ob storagex.EventObserver[map[string]*innerTask]) (stg *taskStorage, err error) {
+	if flock != nil {
+		if err = flock.Lock(); err != nil {
+			return
+		}
+
+		defer flock.Unlock()
+	}
+
+	stg = &taskStorage{
+		flock: flock,
+	}
+
+	if flock != nil {
+		if stg.gen, err = flock.generation(); err != nil {
+			return
+		}
+	}
+
+	stg.mwf, err = storagex.NewMemWithFileEx[map[string]*innerTask, storagex.Serial, syncx.RWLocker](
+		make(map[string]*innerTask), &storagex.JSONSerial{}, &sync.RWMutex{}, fileName, nil, ob)
+	if err != nil {
+		return
+	}
+
+	stg.migrate()
+
+	return
+}
+
+// migrate converts the loaded tasks written by older versions in memory, the file is rewritten by the next change.
+func (stg *taskStorage) migrate() {
+	_ = stg.mwf.Change(func(m map[string]*innerTask) (map[string]*innerTask, error) {
+		for id, t := range m {
+			if t.Version < currentTaskVersion {
+				t = t.clone()
+				t.migrate()
+				m[id] = t
+			}
+		}
+
+		return m, errorx.NoErrSkip
+	})
+}
+
+// Read fails rather than read a shared file without its lock, another process may have changed it.
+func (stg *taskStorage) Read(proc func(m map[string]*innerTask)) error {
+	if stg.flock != nil {
+		if err := stg.lock(); err != nil {
+			return err
+		}
+
+		defer stg.flock.Unlock()
+	}
+
+	stg.mwf.Read(proc)
+
+	return nil
+}
+
+func (stg *taskStorage) Change(proc func(oldM map[string]*innerTask) (newM map[string]*innerTask, err error)) error {
+	if stg.flock == nil {
+		return stg.mwf.Change(proc)
+	}
+
+	if err := stg.lock(); err != nil {
+		return err
+	}
+
+	defer stg.flock.Unlock()
+
+	changed := false
+
+	err := stg.mwf.Change(func(oldM map[string]*innerTask) (newM map[string]*innerTask, err error) {
+		newM, err = proc(oldM)
+		changed = err == nil
+
+		return
+	})
+
+	if changed {
+		gen, e := stg.flock.bump()
+		if e != nil {
+			return e
+		}
+
+		stg.gen = gen
+	}
+
+	return err
+}
+
+// readHeld reads the storage inside the Change of another storage of the queue, which holds the file lock
+// they share.
+func (stg *taskStorage) readHeld(proc func(m map[string]*innerTask)) error {
+	if stg.flock != nil {
+		if err := stg.refresh(); err != nil {
+			return err
+		}
+	}
+
+	stg.mwf.Read(proc)
+
+	return nil
+}
+
+// lock takes the file lock and reloads the file if another storage changed the files since the last access.
+func (stg *taskStorage) lock() error {
+	if err := stg.flock.Lock(); err != nil {
+		return err
+	}
+
+	if err := stg.refresh(); err != nil {
+		stg.flock.Unlock()
+
+		return err
+	}
+
+	return nil
+}
+
+// refresh reloads the file if the change counter moved, the file lock must be held.
+func (stg *taskStorage) refresh() error {
+	gen, err := stg.flock.generation()
+	if err != nil || gen == stg.gen {
+		return err
+	}
+
+	if err = stg.mwf.Reload(); err != nil {
+		return err
+	}
+
+	stg.migrate()
+
+	stg.gen = gen
+
+	return nil
+}
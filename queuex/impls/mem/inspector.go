@@ -0,0 +1,253 @@
+package mem
+
+import (
+	"time"
+
+	"github.com/GizmoVault/gotools/base/errorx"
+	"github.com/GizmoVault/gotools/queuex"
+)
+
+var _ queuex.Inspector = (*Queue)(nil)
+
+func (t *memTask) toTaskInfo(state queuex.TaskState) *queuex.TaskInfo {
+	info := &queuex.TaskInfo{
+		ID:            t.id,
+		Key:           t.key,
+		Payload:       append([]byte(nil), t.payload...),
+		Queue:         t.opts.Queue,
+		Priority:      t.opts.Priority,
+		State:         state,
+		MaxRetry:      t.maxRetry,
+		Retried:       t.retried,
+		LastErr:       t.lastErr,
+		LastFailedAt:  t.lastFailedAt,
+		NextProcessAt: t.at,
+		CompletedAt:   t.completedAt,
+		Result:        t.result,
+	}
+
+	if !t.completedAt.IsZero() {
+		info.NextProcessAt = time.Time{}
+	}
+
+	return info
+}
+
+func (*Queue) taskState(t *memTask, timeNow time.Time) queuex.TaskState {
+	if t.active {
+		return queuex.TaskStateActive
+	}
+
+	if t.at.After(timeNow) {
+		if t.retried > 0 {
+			return queuex.TaskStateRetry
+		}
+
+		return queuex.TaskStateScheduled
+	}
+
+	return queuex.TaskStatePending
+}
+
+func (q *Queue) GetTaskInfo(id string) (*queuex.TaskInfo, error) {
+	timeNow := q.now()
+
+	q.lock.Lock()
+	defer q.lock.Unlock()
+
+	q.purgeCompletedLocked(timeNow)
+
+	if t, ok := q.tasks[id]; ok {
+		return t.toTaskInfo(q.taskState(t, timeNow)), nil
+	}
+
+	if t, ok := q.expired[id]; ok {
+		return t.toTaskInfo(queuex.TaskStatePending), nil
+	}
+
+	if t, ok := q.dead[id]; ok {
+		return t.toTaskInfo(queuex.TaskStateDead), nil
+	}
+
+	if t, ok := q.completed[id]; ok {
+		return t.toTaskInfo(queuex.TaskStateCompleted), nil
+	}
+
+	return nil, errorx.ErrNotExists
+}
+
+func (q *Queue) listTasks(state queuex.TaskState) (infos []*queuex.TaskInfo) {
+	timeNow := q.now()
+
+	q.lock.Lock()
+	defer q.lock.Unlock()
+
+	switch state {
+	case queuex.TaskStateDead:
+		for _, t := range q.dead {
+			infos = append(infos, t.toTaskInfo(state))
+		}
+	case queuex.TaskStateCompleted:
+		q.purgeCompletedLocked(timeNow)
+
+		for _, t := range q.completed {
+			infos = append(infos, t.toTaskInfo(state))
+		}
+	default:
+		for _, t := range q.tasks {
+			if q.taskState(t, timeNow) == state {
+				infos = append(infos, t.toTaskInfo(state))
+			}
+		}
+
+		if state == queuex.TaskStatePending {
+			for _, t := range q.expired {
+				infos = append(infos, t.toTaskInfo(state))
+			}
+		}
+	}
+
+	return
+}
+
+func (q *Queue) ListPending() ([]*queuex.TaskInfo, error) {
+	return q.listTasks(queuex.TaskStatePending), nil
+}
+
+func (q *Queue) ListScheduled() ([]*queuex.TaskInfo, error) {
+	return q.listTasks(queuex.TaskStateScheduled), nil
+}
+
+func (q *Queue) ListRetry() ([]*queuex.TaskInfo, error) {
+	return q.listTasks(queuex.TaskStateRetry), nil
+}
+
+func (q *Queue) ListDead() ([]*queuex.TaskInfo, error) {
+	return q.listTasks(queuex.TaskStateDead), nil
+}
+
+func (q *Queue) Cancel(id string) error {
+	q.lock.Lock()
+	defer q.lock.Unlock()
+
+	if t, ok := q.tasks[id]; ok {
+		if t.active {
+			return errorx.ErrConflict
+		}
+
+		q.removeLocked(t)
+
+		return nil
+	}
+
+	if _, ok := q.expired[id]; ok {
+		delete(q.expired, id)
+
+		return nil
+	}
+
+	return errorx.ErrNotExists
+}
+
+func (q *Queue) Requeue(id string) error {
+	timeNow := q.now()
+
+	q.lock.Lock()
+	defer q.lock.Unlock()
+
+	if t, ok := q.tasks[id]; ok {
+		if state := q.taskState(t, timeNow); state != queuex.TaskStateScheduled && state != queuex.TaskStateRetry {
+			return errorx.ErrConflict
+		}
+
+		t.at = timeNow
+		q.scheduleLocked(t)
+		q.notify()
+
+		return nil
+	}
+
+	if t, ok := q.dead[id]; ok {
+		delete(q.dead, id)
+
+		t.at = timeNow
+		t.retried = 0
+		q.addLocked(t)
+		q.notify()
+
+		return nil
+	}
+
+	if _, ok := q.expired[id]; ok {
+		return errorx.ErrConflict
+	}
+
+	if _, ok := q.completed[id]; ok {
+		return errorx.ErrConflict
+	}
+
+	return errorx.ErrNotExists
+}
+
+func (q *Queue) Purge(state queuex.TaskState) (n int, err error) {
+	timeNow := q.now()
+
+	q.lock.Lock()
+	defer q.lock.Unlock()
+
+	switch state {
+	case queuex.TaskStateDead:
+		n = len(q.dead)
+		q.dead = make(map[string]*memTask)
+	case queuex.TaskStateCompleted:
+		n = len(q.completed)
+		q.completed = make(map[string]*memTask)
+		q.expiries.refs = nil
+	case queuex.TaskStatePending, queuex.TaskStateScheduled, queuex.TaskStateRetry:
+		for _, t := range q.tasks {
+			if q.taskState(t, timeNow) == state {
+				q.removeLocked(t)
+
+				n++
+			}
+		}
+
+		if state == queuex.TaskStatePending {
+			n += len(q.expired)
+			q.expired = make(map[string]*memTask)
+		}
+	default:
+		err = errorx.ErrInvalidArgs
+	}
+
+	return
+}
+
+func (q *Queue) Stats() (*queuex.QueueStats, error) {
+	stats := &queuex.QueueStats{}
+	timeNow := q.now()
+
+	q.lock.Lock()
+	defer q.lock.Unlock()
+
+	q.purgeCompletedLocked(timeNow)
+
+	for _, t := range q.tasks {
+		switch q.taskState(t, timeNow) {
+		case queuex.TaskStateActive:
+			stats.Active++
+		case queuex.TaskStateScheduled:
+			stats.Scheduled++
+		case queuex.TaskStateRetry:
+			stats.Retry++
+		default:
+			stats.Pending++
+		}
+	}
+
+	stats.Pending += len(q.expired)
+	stats.Dead = len(q.dead)
+	stats.Completed = len(q.completed)
+
+	return stats, nil
+}
@@ -0,0 +1,824 @@
+package mem
+
+import (
+	"container/heap"
+	"context"
+	"errors"
+	"sync"
+	"time"
+
+	"github.com/GizmoVault/gotools/base"
+	"github.com/GizmoVault/gotools/base/errorx"
+	"github.com/GizmoVault/gotools/queuex"
+	"github.com/google/uuid"
+)
+
+const (
+	DefaultConcurrency  = 10
+	DefaultPollInterval = 10 * time.Millisecond
+)
+
+type Config struct {
+	// Now is the clock of the queue. With an injected clock, advance it and call ProcessDue to run the tasks
+	// that became due at once, or let Run notice it within PollInterval.
+	Now base.FNNow
+
+	// MaxRetry is used for tasks that do not set their own limit. 0 means queuex.DefaultMaxRetry,
+	// a negative value disables retries.
+	MaxRetry       int
+	RetryDelayFunc queuex.RetryDelayFunc
+
+	// Concurrency is how many handlers Run may run at the same time.
+	Concurrency int
+	// PollInterval is how often Run looks at the clock when no task wakes it up.
+	PollInterval time.Duration
+
+	// Mux routes the tasks to handlers, a new one is created if nil.
+	Mux *queuex.ServeMux
+
+	// Aggregation decides when the tasks enqueued with queuex.AggregateGroup are merged.
+	Aggregation queuex.AggregationConfig
+}
+
+func (cfg *Config) maxRetry() int {
+	return queuex.MaxRetryOrDefault(cfg.MaxRetry)
+}
+
+func (cfg *Config) retryDelayFunc() queuex.RetryDelayFunc {
+	return queuex.RetryDelayOrDefault(cfg.RetryDelayFunc)
+}
+
+func (cfg *Config) concurrency() int {
+	if cfg.Concurrency <= 0 {
+		return DefaultConcurrency
+	}
+
+	return cfg.Concurrency
+}
+
+func (cfg *Config) pollInterval() time.Duration {
+	if cfg.PollInterval <= 0 {
+		return DefaultPollInterval
+	}
+
+	return cfg.PollInterval
+}
+
+type memTask struct {
+	id      string
+	key     string
+	payload []byte
+	opts    queuex.Options
+	at      time.Time
+	seq     uint64
+
+	maxRetry     int
+	retried      int
+	lastErr      string
+	lastFailedAt time.Time
+
+	uniqueKey   string
+	uniqueUntil time.Time
+
+	active      bool
+	completedAt time.Time
+	result      []byte
+
+	// gen tells the latest heap entry of the task from the stale ones.
+	gen uint64
+}
+
+// taskRef is a heap entry of a task, with the order it was pushed in.
+type taskRef struct {
+	t        *memTask
+	gen      uint64
+	at       time.Time
+	priority queuex.Priority
+}
+
+// taskHeap orders the task entries by less. The entries go stale instead of being removed, they are skipped
+// when they come up.
+type taskHeap struct {
+	refs []taskRef
+	less func(a, b *taskRef) bool
+}
+
+func (h *taskHeap) Len() int {
+	return len(h.refs)
+}
+
+func (h *taskHeap) Less(i, j int) bool {
+	return h.less(&h.refs[i], &h.refs[j])
+}
+
+func (h *taskHeap) Swap(i, j int) {
+	h.refs[i], h.refs[j] = h.refs[j], h.refs[i]
+}
+
+func (h *taskHeap) Push(x any) {
+	h.refs = append(h.refs, x.(taskRef))
+}
+
+func (h *taskHeap) Pop() any {
+	old := h.refs
+	n := len(old)
+	x := old[n-1]
+	old[n-1] = taskRef{}
+	h.refs = old[0 : n-1]
+
+	return x
+}
+
+// byTime puts the earliest first, then the ones enqueued first.
+func byTime(a, b *taskRef) bool {
+	if !a.at.Equal(b.at) {
+		return a.at.Before(b.at)
+	}
+
+	return a.t.seq < b.t.seq
+}
+
+// byPriority puts the highest priority first, then the earliest, then the ones enqueued first.
+func byPriority(a, b *taskRef) bool {
+	if a.priority != b.priority {
+		return a.priority > b.priority
+	}
+
+	return byTime(a, b)
+}
+
+type groupID struct {
+	queue string
+	key   string
+}
+
+func (t *memTask) getTask() *queuex.Task {
+	return &queuex.Task{
+		Key:     t.key,
+		Payload: append([]byte(nil), t.payload...),
+	}
+}
+
+// deadline is the earliest of the task deadline and its timeout counted from start, zero if neither is set.
+func (t *memTask) deadline(start time.Time) (deadline time.Time) {
+	deadline = t.opts.Deadline
+
+	if t.opts.Timeout > 0 {
+		if d := start.Add(t.opts.Timeout); deadline.IsZero() || d.Before(deadline) {
+			deadline = d
+		}
+	}
+
+	return
+}
+
+var _ queuex.Queue = (*Queue)(nil)
+
+// Queue keeps the tasks in memory, it has the semantics of the fs queue without its files: delays, retries,
+// dead letters, retention, prefix routing through the mux, unique tasks, ordered groups and aggregation groups.
+type Queue struct {
+	cfg Config
+	mux *queuex.ServeMux
+
+	lock      sync.Mutex
+	seq       uint64
+	tasks     map[string]*memTask
+	expired   map[string]*memTask
+	dead      map[string]*memTask
+	completed map[string]*memTask
+
+	// waiting holds the tasks until they are due, ready the due ones. Only the head of a group is in them.
+	waiting taskHeap
+	ready   taskHeap
+	// groups holds the tasks of each ordered group by enqueue order.
+	groups map[groupID][]*memTask
+	// aggregations holds the tasks of each aggregation group by enqueue order, merges when they are merged.
+	aggregations map[groupID][]*memTask
+	merges       taskHeap
+	// expiries holds the completed tasks until their retention ends.
+	expiries taskHeap
+
+	wake     chan struct{}
+	wg       sync.WaitGroup
+	running  bool
+	stopped  bool
+	stopOnce sync.Once
+	stopCh   chan struct{}
+
+	handlerCtx     context.Context
+	cancelHandlers context.CancelFunc
+}
+
+//nolint:gocritic // config is copied on purpose
+func NewMemQueue(ctx context.Context, cfg Config) *Queue {
+	if cfg.Mux == nil {
+		cfg.Mux = queuex.NewServeMux()
+	}
+
+	q := &Queue{
+		cfg:          cfg,
+		mux:          cfg.Mux,
+		tasks:        make(map[string]*memTask),
+		expired:      make(map[string]*memTask),
+		dead:         make(map[string]*memTask),
+		completed:    make(map[string]*memTask),
+		waiting:      taskHeap{less: byTime},
+		ready:        taskHeap{less: byPriority},
+		groups:       make(map[groupID][]*memTask),
+		aggregations: make(map[groupID][]*memTask),
+		merges:       taskHeap{less: byTime},
+		expiries:     taskHeap{less: byTime},
+		wake:         make(chan struct{}, 1),
+		stopCh:       make(chan struct{}),
+	}
+
+	q.handlerCtx, q.cancelHandlers = context.WithCancel(ctx)
+
+	return q
+}
+
+func (q *Queue) now() time.Time {
+	return base.GetNow(q.cfg.Now)
+}
+
+func (q *Queue) notify() {
+	select {
+	case q.wake <- struct{}{}:
+	default:
+	}
+}
+
+func (q *Queue) Enqueue(task *queuex.Task, delay time.Duration, opts ...queuex.Option) (id string, err error) {
+	if task == nil || task.Key == "" {
+		err = errorx.ErrInvalidArgs
+
+		return
+	}
+
+	options := queuex.NewOptions(opts...)
+	timeNow := q.now()
+
+	q.lock.Lock()
+	defer q.lock.Unlock()
+
+	id = options.TaskID
+	if id == "" {
+		id = uuid.NewString()
+	} else if q.taskIDUsedLocked(id) {
+		err = queuex.ErrorTaskIDConflict
+
+		return
+	}
+
+	t := &memTask{
+		id:       id,
+		key:      task.Key,
+		payload:  append([]byte(nil), task.Payload...),
+		opts:     *options,
+		at:       timeNow,
+		maxRetry: q.cfg.maxRetry(),
+	}
+
+	if delay > 0 {
+		t.at = t.at.Add(delay)
+	}
+
+	if n, ok := options.GetMaxRetry(); ok {
+		t.maxRetry = n
+	}
+
+	if options.UniqueTTL > 0 {
+		t.uniqueKey = queuex.UniqueKey(options.Queue, task.Key, task.Payload)
+		t.uniqueUntil = timeNow.Add(options.UniqueTTL)
+
+		for _, other := range q.tasks {
+			if other.uniqueKey == t.uniqueKey && other.uniqueUntil.After(timeNow) {
+				err = queuex.ErrorDuplicateTask
+
+				return
+			}
+		}
+	}
+
+	q.seq++
+	t.seq = q.seq
+	q.addLocked(t)
+
+	q.notify()
+
+	return
+}
+
+func (t *memTask) groupID() groupID {
+	return groupID{queue: t.opts.Queue, key: t.opts.GroupKey}
+}
+
+func (t *memTask) aggregationID() groupID {
+	return groupID{queue: t.opts.Queue, key: t.opts.AggregateKey}
+}
+
+// addLocked puts t in the queue, after the tasks of its group.
+func (q *Queue) addLocked(t *memTask) {
+	q.tasks[t.id] = t
+
+	switch {
+	case t.opts.AggregateKey != "":
+		aid := t.aggregationID()
+		q.aggregations[aid] = append(q.aggregations[aid], t)
+	case t.opts.GroupKey != "":
+		gid := t.groupID()
+		q.groups[gid] = append(q.groups[gid], t)
+	}
+
+	q.scheduleLocked(t)
+}
+
+// removeLocked takes t out of the queue, the next task of its group is scheduled.
+func (q *Queue) removeLocked(t *memTask) {
+	delete(q.tasks, t.id)
+
+	if t.opts.AggregateKey != "" {
+		aid := t.aggregationID()
+		members := q.aggregations[aid]
+
+		for i, other := range members {
+			if other == t {
+				members = append(members[:i], members[i+1:]...)
+
+				break
+			}
+		}
+
+		if len(members) == 0 {
+			delete(q.aggregations, aid)
+		} else {
+			q.aggregations[aid] = members
+		}
+
+		return
+	}
+
+	if t.opts.GroupKey == "" {
+		return
+	}
+
+	gid := t.groupID()
+	tasks := q.groups[gid]
+
+	for i, other := range tasks {
+		if other != t {
+			continue
+		}
+
+		tasks = append(tasks[:i], tasks[i+1:]...)
+		if len(tasks) == 0 {
+			delete(q.groups, gid)
+
+			return
+		}
+
+		q.groups[gid] = tasks
+
+		if i == 0 {
+			q.scheduleLocked(tasks[0])
+		}
+
+		return
+	}
+}
+
+// scheduleLocked waits for t to be due at t.at, unless it is behind another task of its group. The tasks of an
+// aggregation group only run merged, their group waits for the time to merge them instead.
+func (q *Queue) scheduleLocked(t *memTask) {
+	if t.opts.AggregateKey != "" {
+		if at, ok := q.mergeAtLocked(t.aggregationID()); ok {
+			heap.Push(&q.merges, taskRef{t: t, at: at})
+		}
+
+		return
+	}
+
+	if t.opts.GroupKey != "" && q.groups[t.groupID()][0] != t {
+		return
+	}
+
+	t.gen++
+
+	heap.Push(&q.waiting, taskRef{t: t, gen: t.gen, at: t.at, priority: t.opts.Priority})
+}
+
+func (q *Queue) isCurrentLocked(ref *taskRef) bool {
+	return !ref.t.active && ref.gen == ref.t.gen && q.tasks[ref.t.id] == ref.t
+}
+
+// mergeAtLocked is when the tasks of the aggregation group aid are merged, false if it has none.
+func (q *Queue) mergeAtLocked(aid groupID) (time.Time, bool) {
+	members := q.aggregations[aid]
+	if len(members) == 0 {
+		return time.Time{}, false
+	}
+
+	first, last := members[0].at, members[0].at
+
+	for _, t := range members {
+		if t.at.Before(first) {
+			first = t.at
+		}
+
+		if t.at.After(last) {
+			last = t.at
+		}
+	}
+
+	return q.cfg.Aggregation.MergeAt(first, last, len(members)), true
+}
+
+// mergeDueLocked replaces the members of the aggregation groups due by timeNow by the tasks they merge into.
+// A group has an entry in merges for every change, those that are not due any more are skipped.
+func (q *Queue) mergeDueLocked(timeNow time.Time) {
+	cfg := &q.cfg.Aggregation
+
+	for q.merges.Len() > 0 && !q.merges.refs[0].at.After(timeNow) {
+		ref := heap.Pop(&q.merges).(taskRef)
+		aid := ref.t.aggregationID()
+
+		if at, ok := q.mergeAtLocked(aid); !ok || at.After(timeNow) {
+			continue
+		}
+
+		members := q.aggregations[aid]
+		if cfg.MaxSize > 0 && len(members) > cfg.MaxSize {
+			members = members[:cfg.MaxSize]
+		}
+
+		members = append([]*memTask(nil), members...)
+		tasks := make([]*queuex.Task, 0, len(members))
+
+		for _, t := range members {
+			tasks = append(tasks, t.getTask())
+			q.removeLocked(t)
+		}
+
+		// the rest of an overflowing group waits for its own time
+		if rest := q.aggregations[aid]; len(rest) > 0 {
+			q.scheduleLocked(rest[0])
+		}
+
+		task := cfg.GetAggregate()(aid.key, tasks)
+		if task == nil || task.Key == "" {
+			continue
+		}
+
+		first := members[0]
+
+		q.seq++
+		q.addLocked(&memTask{
+			id:      uuid.NewString(),
+			key:     task.Key,
+			payload: task.Payload,
+			opts: *queuex.NewOptions(queuex.QueueName(aid.queue), queuex.WithPriority(first.opts.Priority),
+				queuex.Timeout(first.opts.Timeout), queuex.Retention(first.opts.Retention)),
+			at:       timeNow,
+			seq:      q.seq,
+			maxRetry: first.maxRetry,
+		})
+	}
+}
+
+func (q *Queue) taskIDUsedLocked(id string) bool {
+	for _, m := range []map[string]*memTask{q.tasks, q.expired, q.dead, q.completed} {
+		if _, ok := m[id]; ok {
+			return true
+		}
+	}
+
+	return false
+}
+
+func (q *Queue) HandleFunc(key string, h queuex.Handler) {
+	q.mux.HandleFunc(key, h)
+
+	if h != nil {
+		q.requeueExpired()
+	}
+}
+
+func (q *Queue) Use(mws ...queuex.Middleware) {
+	q.mux.Use(mws...)
+}
+
+func (q *Queue) ServeMux() *queuex.ServeMux {
+	return q.mux
+}
+
+// requeueExpired moves the tasks that were due while no handler matched them back into the queue.
+func (q *Queue) requeueExpired() {
+	timeNow := q.now()
+
+	q.lock.Lock()
+	defer q.lock.Unlock()
+
+	for id, t := range q.expired {
+		if q.mux.Handler(t.key) == nil {
+			continue
+		}
+
+		delete(q.expired, id)
+
+		t.at = timeNow
+		q.addLocked(t)
+	}
+
+	q.notify()
+}
+
+// Run handles the due tasks and blocks until ctx is done or Stop is called.
+func (q *Queue) Run(ctx context.Context) error {
+	q.lock.Lock()
+
+	if q.running || q.stopped {
+		q.lock.Unlock()
+
+		return errorx.ErrLogic
+	}
+
+	q.running = true
+	q.lock.Unlock()
+
+	sem := make(chan struct{}, q.cfg.concurrency())
+
+	for {
+		for {
+			select {
+			case sem <- struct{}{}:
+			case <-q.stopCh:
+				return nil
+			case <-ctx.Done():
+				q.Stop()
+
+				return nil
+			}
+
+			t := q.takeDue()
+			if t == nil {
+				<-sem
+
+				break
+			}
+
+			q.wg.Add(1)
+
+			go func() {
+				defer func() {
+					<-sem
+					q.wg.Done()
+					q.notify()
+				}()
+
+				q.process(q.handlerCtx, t)
+			}()
+		}
+
+		timer := time.NewTimer(q.waitDuration())
+
+		select {
+		case <-q.stopCh:
+			timer.Stop()
+
+			return nil
+		case <-ctx.Done():
+			timer.Stop()
+			q.Stop()
+
+			return nil
+		case <-q.wake:
+		case <-timer.C:
+		}
+
+		timer.Stop()
+	}
+}
+
+// ProcessDue runs the due tasks one by one in the calling goroutine, including those that become due while it
+// runs, and returns how many handler calls it made. Together with an injected clock it makes tests instant.
+func (q *Queue) ProcessDue(ctx context.Context) (n int) {
+	for {
+		t := q.takeDue()
+		if t == nil {
+			return
+		}
+
+		if q.process(ctx, t) {
+			n++
+		}
+	}
+}
+
+// Stop waits for the running handlers, then cancels their context. The tasks stay in the queue.
+func (q *Queue) Stop() {
+	q.stopOnce.Do(func() {
+		q.lock.Lock()
+		q.stopped = true
+		q.lock.Unlock()
+
+		close(q.stopCh)
+
+		q.wg.Wait()
+		q.cancelHandlers()
+	})
+}
+
+func (q *Queue) isStopped() bool {
+	q.lock.Lock()
+	defer q.lock.Unlock()
+
+	return q.stopped
+}
+
+func (q *Queue) waitDuration() time.Duration {
+	d := q.cfg.pollInterval()
+	timeNow := q.now()
+
+	q.lock.Lock()
+	defer q.lock.Unlock()
+
+	if q.merges.Len() > 0 {
+		d = min(d, max(q.merges.refs[0].at.Sub(timeNow), 0))
+	}
+
+	for q.waiting.Len() > 0 {
+		if ref := &q.waiting.refs[0]; q.isCurrentLocked(ref) {
+			return min(d, max(ref.at.Sub(timeNow), 0))
+		}
+
+		heap.Pop(&q.waiting)
+	}
+
+	return d
+}
+
+// takeDue marks the next due task active and returns it: the highest priority first, then the earliest.
+func (q *Queue) takeDue() *memTask {
+	timeNow := q.now()
+
+	q.lock.Lock()
+	defer q.lock.Unlock()
+
+	q.purgeCompletedLocked(timeNow)
+	q.mergeDueLocked(timeNow)
+
+	for q.waiting.Len() > 0 && !q.waiting.refs[0].at.After(timeNow) {
+		ref := heap.Pop(&q.waiting).(taskRef)
+		if q.isCurrentLocked(&ref) {
+			heap.Push(&q.ready, ref)
+		}
+	}
+
+	for q.ready.Len() > 0 {
+		ref := heap.Pop(&q.ready).(taskRef)
+		if q.isCurrentLocked(&ref) {
+			ref.t.active = true
+
+			return ref.t
+		}
+	}
+
+	return nil
+}
+
+// purgeCompletedLocked drops the completed tasks whose retention ended, the earliest expiry first.
+func (q *Queue) purgeCompletedLocked(timeNow time.Time) {
+	for q.expiries.Len() > 0 && !q.expiries.refs[0].at.After(timeNow) {
+		ref := heap.Pop(&q.expiries).(taskRef)
+
+		if q.completed[ref.t.id] == ref.t {
+			delete(q.completed, ref.t.id)
+		}
+	}
+}
+
+// process runs the handler of t, it returns false if no handler matched and t was set aside.
+func (q *Queue) process(ctx context.Context, t *memTask) bool {
+	h := q.mux.Handler(t.key)
+	if h == nil {
+		q.lock.Lock()
+		t.active = false
+		q.removeLocked(t)
+		q.expired[t.id] = t
+		q.lock.Unlock()
+
+		return false
+	}
+
+	timeNow := q.now()
+
+	deadline := t.deadline(timeNow)
+	if !deadline.IsZero() && !deadline.After(timeNow) {
+		q.kill(t, context.DeadlineExceeded)
+
+		return true
+	}
+
+	ctx = queuex.WithTaskMeta(ctx, queuex.TaskMeta{
+		ID:       t.id,
+		Queue:    t.opts.Queue,
+		Retried:  t.retried,
+		MaxRetry: t.maxRetry,
+	})
+	ctx, w := queuex.WithResultWriter(ctx)
+
+	if !deadline.IsZero() {
+		var cancel context.CancelFunc
+
+		ctx, cancel = context.WithTimeout(ctx, deadline.Sub(timeNow))
+		defer cancel()
+	}
+
+	err := h(ctx, t.id, t.getTask())
+	if err == nil && errors.Is(ctx.Err(), context.DeadlineExceeded) {
+		err = context.DeadlineExceeded
+	}
+
+	if err == nil {
+		q.complete(t, w.Result())
+
+		return true
+	}
+
+	if q.isStopped() {
+		q.lock.Lock()
+		t.active = false
+		q.scheduleLocked(t)
+		q.lock.Unlock()
+
+		return true
+	}
+
+	q.fail(t, err)
+
+	return true
+}
+
+func (q *Queue) complete(t *memTask, result []byte) {
+	timeNow := q.now()
+
+	q.lock.Lock()
+	defer q.lock.Unlock()
+
+	t.active = false
+	q.removeLocked(t)
+
+	if t.opts.Retention > 0 {
+		t.completedAt = timeNow
+		t.result = result
+		q.completed[t.id] = t
+
+		heap.Push(&q.expiries, taskRef{t: t, at: timeNow.Add(t.opts.Retention)})
+	}
+}
+
+func (q *Queue) fail(t *memTask, taskErr error) {
+	timeNow := q.now()
+
+	if delay, ok := queuex.IsRateLimited(taskErr); ok {
+		q.lock.Lock()
+		t.active = false
+		t.at = timeNow.Add(delay)
+		q.scheduleLocked(t)
+		q.lock.Unlock()
+
+		return
+	}
+
+	if errors.Is(taskErr, queuex.ErrorSkipRetry) || t.retried >= t.maxRetry {
+		q.kill(t, taskErr)
+
+		return
+	}
+
+	delay := q.cfg.retryDelayFunc()(t.retried+1, taskErr, t.getTask())
+
+	q.lock.Lock()
+	defer q.lock.Unlock()
+
+	t.active = false
+	t.retried++
+	t.lastErr = taskErr.Error()
+	t.lastFailedAt = timeNow
+	t.at = timeNow.Add(delay)
+	q.scheduleLocked(t)
+}
+
+func (q *Queue) kill(t *memTask, taskErr error) {
+	timeNow := q.now()
+
+	q.lock.Lock()
+	defer q.lock.Unlock()
+
+	t.active = false
+	t.lastErr = taskErr.Error()
+	t.lastFailedAt = timeNow
+
+	q.removeLocked(t)
+	q.dead[t.id] = t
+}
@@ -0,0 +1,270 @@
+package mem
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/GizmoVault/gotools/base/errorx"
+	"github.com/GizmoVault/gotools/queuex"
+	"github.com/GizmoVault/gotools/queuex/queuextest"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+type utClock struct {
+	lock sync.Mutex
+	now  time.Time
+}
+
+func (c *utClock) Now() time.Time {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	return c.now
+}
+
+func (c *utClock) Advance(d time.Duration) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	c.now = c.now.Add(d)
+}
+
+func TestQueueProcessDue(t *testing.T) {
+	clock := &utClock{now: time.Unix(1000, 0)}
+
+	q := NewMemQueue(t.Context(), Config{
+		Now: clock.Now,
+		RetryDelayFunc: func(n int, _ error, _ *queuex.Task) time.Duration {
+			return time.Duration(n) * time.Minute
+		},
+	})
+
+	var handled []string
+
+	q.HandleFunc("email:", func(ctx context.Context, _ string, task *queuex.Task) error {
+		handled = append(handled, task.Key)
+
+		return queuex.SetResult(ctx, []byte("sent"))
+	})
+
+	attempts := 0
+
+	q.HandleFunc("flaky", func(context.Context, string, *queuex.Task) error {
+		attempts++
+		if attempts < 3 {
+			return errors.New("try again")
+		}
+
+		return nil
+	})
+
+	q.HandleFunc("broken", func(context.Context, string, *queuex.Task) error {
+		return queuex.ErrorSkipRetry
+	})
+
+	delayedID, err := q.Enqueue(&queuex.Task{Key: "email:welcome"}, time.Hour, queuex.Retention(time.Hour))
+	require.NoError(t, err)
+
+	_, err = q.Enqueue(&queuex.Task{Key: "email:now"}, 0)
+	require.NoError(t, err)
+
+	flakyID, err := q.Enqueue(&queuex.Task{Key: "flaky"}, 0)
+	require.NoError(t, err)
+
+	brokenID, err := q.Enqueue(&queuex.Task{Key: "broken"}, 0)
+	require.NoError(t, err)
+
+	orphanID, err := q.Enqueue(&queuex.Task{Key: "orphan"}, 0)
+	require.NoError(t, err)
+
+	_, err = q.Enqueue(&queuex.Task{Key: "email:x"}, 0, queuex.TaskID(delayedID))
+	require.ErrorIs(t, err, queuex.ErrorTaskIDConflict)
+
+	// due already
+	require.ErrorIs(t, q.Requeue(flakyID), errorx.ErrConflict)
+
+	assert.Equal(t, 3, q.ProcessDue(t.Context()))
+	assert.Equal(t, []string{"email:now"}, handled)
+
+	info, err := q.GetTaskInfo(flakyID)
+	require.NoError(t, err)
+	assert.Equal(t, queuex.TaskStateRetry, info.State)
+	assert.Equal(t, 1, info.Retried)
+
+	info, err = q.GetTaskInfo(brokenID)
+	require.NoError(t, err)
+	assert.Equal(t, queuex.TaskStateDead, info.State)
+
+	info, err = q.GetTaskInfo(orphanID)
+	require.NoError(t, err)
+	assert.Equal(t, queuex.TaskStatePending, info.State)
+
+	clock.Advance(time.Minute)
+	assert.Equal(t, 1, q.ProcessDue(t.Context()))
+
+	clock.Advance(2 * time.Minute)
+	assert.Equal(t, 1, q.ProcessDue(t.Context()))
+	assert.Equal(t, 3, attempts)
+
+	clock.Advance(time.Hour)
+	assert.Equal(t, 1, q.ProcessDue(t.Context()))
+	assert.Equal(t, []string{"email:now", "email:welcome"}, handled)
+
+	result, err := queuex.NewTaskHandle(delayedID, q).Result()
+	require.NoError(t, err)
+	assert.Equal(t, []byte("sent"), result)
+
+	q.HandleFunc("orphan", func(context.Context, string, *queuex.Task) error {
+		return nil
+	})
+	assert.Equal(t, 1, q.ProcessDue(t.Context()))
+
+	stats, err := q.Stats()
+	require.NoError(t, err)
+	assert.Equal(t, queuex.QueueStats{Dead: 1, Completed: 1}, *stats)
+
+	clock.Advance(time.Hour)
+
+	stats, err = q.Stats()
+	require.NoError(t, err)
+	assert.Zero(t, stats.Completed)
+}
+
+func TestQueueOrder(t *testing.T) {
+	clock := &utClock{now: time.Unix(1000, 0)}
+
+	q := NewMemQueue(t.Context(), Config{Now: clock.Now})
+
+	var handled []string
+
+	q.HandleFunc("", func(_ context.Context, _ string, task *queuex.Task) error {
+		handled = append(handled, string(task.Payload))
+
+		return nil
+	})
+
+	enqueue := func(payload string, delay time.Duration, opts ...queuex.Option) string {
+		id, err := q.Enqueue(&queuex.Task{Key: "k", Payload: []byte(payload)}, delay, opts...)
+		require.NoError(t, err)
+
+		return id
+	}
+
+	enqueue("late", time.Minute, queuex.WithPriority(queuex.PriorityCritical))
+	enqueue("low", 0, queuex.WithPriority(queuex.PriorityLow))
+	g1 := enqueue("g1", time.Second, queuex.GroupKey("g"))
+	enqueue("g2", 0, queuex.GroupKey("g"))
+	enqueue("high", 0, queuex.WithPriority(queuex.PriorityHigh))
+	enqueue("default", 0)
+
+	// g2 waits behind g1 although it is due
+	assert.Equal(t, 3, q.ProcessDue(t.Context()))
+	assert.Equal(t, []string{"high", "default", "low"}, handled)
+
+	// cancelling the head of a group lets the next one run
+	require.NoError(t, q.Cancel(g1))
+	assert.Equal(t, 1, q.ProcessDue(t.Context()))
+
+	clock.Advance(time.Minute)
+	assert.Equal(t, 1, q.ProcessDue(t.Context()))
+	assert.Equal(t, []string{"high", "default", "low", "g2", "late"}, handled)
+}
+
+func TestQueueAggregation(t *testing.T) {
+	clock := &utClock{now: time.Unix(1000, 0)}
+
+	q := NewMemQueue(t.Context(), Config{
+		Now: clock.Now,
+		Aggregation: queuex.AggregationConfig{
+			GracePeriod: time.Second,
+			MaxSize:     3,
+		},
+	})
+
+	var batches [][][]byte
+
+	q.HandleFunc("batch", func(_ context.Context, _ string, task *queuex.Task) error {
+		payloads, err := queuex.AggregatedPayloads(task)
+		require.NoError(t, err)
+
+		batches = append(batches, payloads)
+
+		return nil
+	})
+
+	for i := range 4 {
+		_, err := q.Enqueue(&queuex.Task{Key: "batch", Payload: []byte{byte(i)}}, 0, queuex.AggregateGroup("b"))
+		require.NoError(t, err)
+	}
+
+	// a full batch is merged at once, the rest waits for the grace period
+	assert.Equal(t, 1, q.ProcessDue(t.Context()))
+	assert.Equal(t, [][][]byte{{{0}, {1}, {2}}}, batches)
+
+	stats, err := q.Stats()
+	require.NoError(t, err)
+	assert.Equal(t, 1, stats.Pending)
+
+	clock.Advance(time.Second)
+	assert.Equal(t, 1, q.ProcessDue(t.Context()))
+	assert.Equal(t, [][][]byte{{{0}, {1}, {2}}, {{3}}}, batches)
+}
+
+func TestQueueRun(t *testing.T) {
+	q := NewMemQueue(t.Context(), Config{})
+
+	done := make(chan string, 2)
+
+	q.HandleFunc("job", func(_ context.Context, id string, _ *queuex.Task) error {
+		done <- id
+
+		return nil
+	})
+
+	id, err := q.Enqueue(&queuex.Task{Key: "job"}, 0)
+	require.NoError(t, err)
+
+	runDone := make(chan error)
+
+	go func() {
+		runDone <- q.Run(t.Context())
+	}()
+
+	select {
+	case got := <-done:
+		assert.Equal(t, id, got)
+	case <-time.After(time.Second):
+		require.Fail(t, "task not handled")
+	}
+
+	id, err = q.Enqueue(&queuex.Task{Key: "job"}, 50*time.Millisecond)
+	require.NoError(t, err)
+
+	select {
+	case got := <-done:
+		assert.Equal(t, id, got)
+	case <-time.After(time.Second):
+		require.Fail(t, "delayed task not handled")
+	}
+
+	q.Stop()
+	require.NoError(t, <-runDone)
+	require.Error(t, q.Run(t.Context()))
+}
+
+func TestConformance(t *testing.T) {
+	queuextest.RunConformance(t, queuextest.Factory{
+		New: func(t *testing.T, _ string) queuex.Queue {
+			t.Helper()
+
+			return NewMemQueue(t.Context(), Config{
+				RetryDelayFunc: func(int, error, *queuex.Task) time.Duration { return 0 },
+			})
+		},
+		Volatile: true,
+	})
+}
@@ -0,0 +1,82 @@
+package queuex
+
+import "time"
+
+type TaskState int
+
+const (
+	TaskStatePending TaskState = iota + 1
+	TaskStateActive
+	TaskStateScheduled
+	TaskStateRetry
+	TaskStateDead
+	TaskStateCompleted
+)
+
+func (s TaskState) String() string {
+	switch s {
+	case TaskStatePending:
+		return "pending"
+	case TaskStateActive:
+		return "active"
+	case TaskStateScheduled:
+		return "scheduled"
+	case TaskStateRetry:
+		return "retry"
+	case TaskStateDead:
+		return "dead"
+	case TaskStateCompleted:
+		return "completed"
+	default:
+		return "unknown"
+	}
+}
+
+type TaskInfo struct {
+	ID       string
+	Key      string
+	Payload  []byte
+	Queue    string
+	Priority Priority
+	State    TaskState
+
+	MaxRetry     int
+	Retried      int
+	LastErr      string
+	LastFailedAt time.Time
+
+	NextProcessAt time.Time
+	CompletedAt   time.Time
+	// Result is what the handler wrote with SetResult, kept for the retention period of the task.
+	Result []byte
+}
+
+type QueueStats struct {
+	Pending   int
+	Active    int
+	Scheduled int
+	Retry     int
+	Dead      int
+	Completed int
+}
+
+// Inspector looks into a queue without consuming it. Cancel and Requeue return errorx.ErrNotExists for
+// unknown ids and errorx.ErrConflict if the task is in a state that does not allow the operation.
+type Inspector interface {
+	GetTaskInfo(id string) (*TaskInfo, error)
+
+	ListPending() ([]*TaskInfo, error)
+	ListScheduled() ([]*TaskInfo, error)
+	ListRetry() ([]*TaskInfo, error)
+	ListDead() ([]*TaskInfo, error)
+
+	// Cancel deletes a task that is not running.
+	Cancel(id string) error
+	// Requeue runs a scheduled, retry or dead task as soon as possible. A pending, active or completed task
+	// cannot be requeued, it returns errorx.ErrConflict.
+	Requeue(id string) error
+	// Purge deletes all tasks in state and reports how many were deleted.
+	Purge(state TaskState) (int, error)
+
+	Stats() (*QueueStats, error)
+}
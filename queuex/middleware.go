@@ -0,0 +1,147 @@
+package queuex
+
+import (
+	"context"
+	"fmt"
+	"runtime/debug"
+	"sync"
+	"time"
+
+	"github.com/GizmoVault/gotools/base/errorx"
+	"github.com/GizmoVault/gotools/base/logx"
+)
+
+// Recover turns a panic in the handler into an error matching errorx.ErrCrashed.
+func Recover(logger logx.Wrapper) Middleware {
+	if logger == nil {
+		logger = logx.NewNopLoggerWrapper()
+	}
+
+	return func(next Handler) Handler {
+		return func(ctx context.Context, id string, task *Task) (err error) {
+			defer func() {
+				if r := recover(); r != nil {
+					logger.WithFields(logx.StringField("id", id), logx.StringField("key", task.Key)).Errorf(
+						"task panic: %v\n%s", r, debug.Stack())
+
+					err = errorx.ErrCrashed.WithMsg(fmt.Sprintf("task panic: %v", r))
+				}
+			}()
+
+			return next(ctx, id, task)
+		}
+	}
+}
+
+func Logging(logger logx.Wrapper) Middleware {
+	if logger == nil {
+		logger = logx.NewNopLoggerWrapper()
+	}
+
+	return func(next Handler) Handler {
+		return func(ctx context.Context, id string, task *Task) error {
+			l := logger.WithFields(logx.StringField("id", id), logx.StringField("key", task.Key))
+
+			l.Debug("task start")
+
+			start := time.Now()
+			err := next(ctx, id, task)
+
+			l = l.WithFields(logx.DurationField("cost", time.Since(start)))
+
+			if err != nil {
+				l.WithFields(logx.ErrorField(err)).Warn("task failed")
+			} else {
+				l.Info("task done")
+			}
+
+			return err
+		}
+	}
+}
+
+// HandlerTimeout cancels the handler context after d.
+func HandlerTimeout(d time.Duration) Middleware {
+	return func(next Handler) Handler {
+		return func(ctx context.Context, id string, task *Task) error {
+			if d <= 0 {
+				return next(ctx, id, task)
+			}
+
+			ctx, cancel := context.WithTimeout(ctx, d)
+			defer cancel()
+
+			return next(ctx, id, task)
+		}
+	}
+}
+
+type MetricsRecorder interface {
+	ObserveTask(key string, cost time.Duration, err error)
+}
+
+func Metrics(recorder MetricsRecorder) Middleware {
+	return func(next Handler) Handler {
+		return func(ctx context.Context, id string, task *Task) error {
+			start := time.Now()
+			err := next(ctx, id, task)
+
+			recorder.ObserveTask(task.Key, time.Since(start), err)
+
+			return err
+		}
+	}
+}
+
+type KeyMetrics struct {
+	Processed int64
+	Failed    int64
+	TotalCost time.Duration
+	MaxCost   time.Duration
+}
+
+// TaskMetrics is an in-memory MetricsRecorder keeping counters per task key.
+type TaskMetrics struct {
+	lock sync.Mutex
+	m    map[string]*KeyMetrics
+}
+
+func NewTaskMetrics() *TaskMetrics {
+	return &TaskMetrics{
+		m: make(map[string]*KeyMetrics),
+	}
+}
+
+func (tm *TaskMetrics) ObserveTask(key string, cost time.Duration, err error) {
+	tm.lock.Lock()
+	defer tm.lock.Unlock()
+
+	km, ok := tm.m[key]
+	if !ok {
+		km = &KeyMetrics{}
+		tm.m[key] = km
+	}
+
+	km.Processed++
+	km.TotalCost += cost
+
+	if cost > km.MaxCost {
+		km.MaxCost = cost
+	}
+
+	if err != nil {
+		km.Failed++
+	}
+}
+
+func (tm *TaskMetrics) Snapshot() map[string]KeyMetrics {
+	tm.lock.Lock()
+	defer tm.lock.Unlock()
+
+	m := make(map[string]KeyMetrics, len(tm.m))
+	for key, km := range tm.m {
+		m[key] = *km
+	}
+
+	return m
+}
@@ -0,0 +1,87 @@
+package queuex
+
+import (
+	"context"
+	"fmt"
+	"strings"
+	"sync"
+)
+
+type Middleware func(next Handler) Handler
+
+// ServeMux routes a task to the handler registered for its key. A key without an exact match goes to the
+// handler of the longest registered prefix of it.
+type ServeMux struct {
+	lock sync.RWMutex
+	m    map[string]Handler
+	mws  []Middleware
+}
+
+func NewServeMux() *ServeMux {
+	return &ServeMux{
+		m: make(map[string]Handler),
+	}
+}
+
+// HandleFunc registers h for key, a nil h removes the registration.
+func (mux *ServeMux) HandleFunc(key string, h Handler) {
+	mux.lock.Lock()
+	defer mux.lock.Unlock()
+
+	if h == nil {
+		delete(mux.m, key)
+
+		return
+	}
+
+	mux.m[key] = h
+}
+
+// Use appends middlewares, the first one is the outermost.
+func (mux *ServeMux) Use(mws ...Middleware) {
+	mux.lock.Lock()
+	defer mux.lock.Unlock()
+
+	for _, mw := range mws {
+		if mw != nil {
+			mux.mws = append(mux.mws, mw)
+		}
+	}
+}
+
+// Handler returns the handler for key wrapped by the middlewares, nil if no handler matches.
+func (mux *ServeMux) Handler(key string) Handler {
+	mux.lock.RLock()
+	defer mux.lock.RUnlock()
+
+	h, ok := mux.m[key]
+	if !ok {
+		matched := -1
+
+		for prefix, handler := range mux.m {
+			if strings.HasPrefix(key, prefix) && len(prefix) > matched {
+				matched = len(prefix)
+				h = handler
+			}
+		}
+	}
+
+	if h == nil {
+		return nil
+	}
+
+	for i := len(mux.mws) - 1; i >= 0; i-- {
+		h = mux.mws[i](h)
+	}
+
+	return h
+}
+
+func (mux *ServeMux) ProcessTask(ctx context.Context, id string, task *Task) error {
+	h := mux.Handler(task.Key)
+	if h == nil {
+		return fmt.Errorf("%w: %s", ErrorHandlerNotFound, task.Key)
+	}
+
+	return h(ctx, id, task)
+}
@@ -0,0 +1,79 @@
+package queuex
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/GizmoVault/gotools/base/errorx"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestServeMux(t *testing.T) {
+	mux := NewServeMux()
+
+	var trace []string
+
+	mw := func(name string) Middleware {
+		return func(next Handler) Handler {
+			return func(ctx context.Context, id string, task *Task) error {
+				trace = append(trace, name)
+
+				return next(ctx, id, task)
+			}
+		}
+	}
+
+	mux.Use(mw("outer"), mw("inner"))
+
+	mux.HandleFunc("email:", func(context.Context, string, *Task) error {
+		trace = append(trace, "email:")
+
+		return nil
+	})
+	mux.HandleFunc("email:vip", func(context.Context, string, *Task) error {
+		trace = append(trace, "email:vip")
+
+		return nil
+	})
+
+	require.NoError(t, mux.ProcessTask(t.Context(), "1", &Task{Key: "email:vip:1"}))
+	assert.Equal(t, []string{"outer", "inner", "email:vip"}, trace)
+
+	trace = nil
+
+	require.NoError(t, mux.ProcessTask(t.Context(), "2", &Task{Key: "email:user"}))
+	assert.Equal(t, []string{"outer", "inner", "email:"}, trace)
+
+	require.ErrorIs(t, mux.ProcessTask(t.Context(), "3", &Task{Key: "sms"}), ErrorHandlerNotFound)
+
+	mux.HandleFunc("email:vip", nil)
+	assert.NotNil(t, mux.Handler("email:vip"))
+}
+
+func TestMiddlewares(t *testing.T) {
+	metrics := NewTaskMetrics()
+
+	mux := NewServeMux()
+	mux.Use(Metrics(metrics), Recover(nil), Logging(nil), HandlerTimeout(20*time.Millisecond))
+
+	mux.HandleFunc("panic", func(context.Context, string, *Task) error {
+		panic("boom")
+	})
+	mux.HandleFunc("slow", func(ctx context.Context, _ string, _ *Task) error {
+		<-ctx.Done()
+
+		return ctx.Err()
+	})
+
+	err := mux.ProcessTask(t.Context(), "1", &Task{Key: "panic"})
+	require.ErrorIs(t, err, errorx.ErrCrashed)
+
+	err = mux.ProcessTask(t.Context(), "2", &Task{Key: "slow"})
+	require.ErrorIs(t, err, context.DeadlineExceeded)
+
+	snapshot := metrics.Snapshot()
+	assert.EqualValues(t, 1, snapshot["panic"].Failed)
+	assert.EqualValues(t, 1, snapshot["slow"].Processed)
+}
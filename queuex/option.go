@@ -0,0 +1,172 @@
+package queuex
+
+import (
+	"encoding/hex"
+	"strconv"
+	"time"
+
+	"github.com/GizmoVault/gotools/crypt/hash"
+)
+
+const (
+	DefaultQueueName = "default"
+)
+
+// Priority decides which due task runs first, the higher the sooner.
+type Priority int
+
+const (
+	PriorityLow Priority = iota + 1
+	PriorityDefault
+	PriorityHigh
+	PriorityCritical
+)
+
+func (p Priority) String() string {
+	switch p {
+	case PriorityLow:
+		return "low"
+	case PriorityDefault:
+		return "default"
+	case PriorityHigh:
+		return "high"
+	case PriorityCritical:
+		return "critical"
+	default:
+		return strconv.Itoa(int(p))
+	}
+}
+
+type Options struct {
+	TaskID    string
+	UniqueTTL time.Duration
+	Deadline  time.Time
+	Timeout   time.Duration
+	Queue     string
+	Priority  Priority
+	Retention time.Duration
+	// MaxRetry is nil if the backend default applies.
+	MaxRetry *int
+	// GroupKey runs the tasks of the group in the queue one at a time, in the order they were enqueued.
+	GroupKey string
+	// AggregateKey merges the tasks of the group in the queue into one, see AggregationConfig.
+	AggregateKey string
+}
+
+func (opts *Options) GetMaxRetry() (n int, ok bool) {
+	if opts.MaxRetry == nil {
+		return 0, false
+	}
+
+	return *opts.MaxRetry, true
+}
+
+// Option returns an Option that sets all of opts at once.
+func (opts *Options) Option() Option {
+	saved := *opts
+
+	return func(o *Options) {
+		*o = saved
+	}
+}
+
+type Option func(opts *Options)
+
+func NewOptions(opts ...Option) *Options {
+	options := &Options{
+		Queue:    DefaultQueueName,
+		Priority: PriorityDefault,
+	}
+
+	for _, opt := range opts {
+		if opt != nil {
+			opt(options)
+		}
+	}
+
+	return options
+}
+
+// Unique rejects the task with ErrorDuplicateTask while another task with the same queue, key and payload
+// is still waiting to be processed, for at most ttl.
+func Unique(ttl time.Duration) Option {
+	return func(opts *Options) {
+		opts.UniqueTTL = ttl
+	}
+}
+
+// UniqueKey is what Unique compares the tasks by.
+func UniqueKey(queue, key string, payload []byte) string {
+	sum := hash.MD5Sum(payload)
+
+	return queue + ":" + key + ":" + hex.EncodeToString(sum[:])
+}
+
+// TaskID uses id instead of a generated one, enqueueing fails with ErrorTaskIDConflict if it is taken.
+func TaskID(id string) Option {
+	return func(opts *Options) {
+		opts.TaskID = id
+	}
+}
+
+func Deadline(t time.Time) Option {
+	return func(opts *Options) {
+		opts.Deadline = t
+	}
+}
+
+func Timeout(d time.Duration) Option {
+	return func(opts *Options) {
+		opts.Timeout = d
+	}
+}
+
+func MaxRetry(n int) Option {
+	return func(opts *Options) {
+		if n < 0 {
+			n = 0
+		}
+
+		opts.MaxRetry = &n
+	}
+}
+
+// QueueName puts the task into the named queue, the name Queue is taken by the queue interface.
+func QueueName(name string) Option {
+	return func(opts *Options) {
+		if name == "" {
+			name = DefaultQueueName
+		}
+
+		opts.Queue = name
+	}
+}
+
+func WithPriority(p Priority) Option {
+	return func(opts *Options) {
+		opts.Priority = p
+	}
+}
+
+// Retention keeps the task for d after it completed successfully.
+func Retention(d time.Duration) Option {
+	return func(opts *Options) {
+		opts.Retention = d
+	}
+}
+
+// GroupKey runs the task after the tasks of the same group in the queue that were enqueued before it finished.
+// Different groups still run in parallel.
+func GroupKey(key string) Option {
+	return func(opts *Options) {
+		opts.GroupKey = key
+	}
+}
+
+// AggregateGroup merges the task with the other pending tasks of the group in the queue, the handler receives
+// the merged task once the backend aggregation config says so.
+func AggregateGroup(key string) Option {
+	return func(opts *Options) {
+		opts.AggregateKey = key
+	}
+}
@@ -3,6 +3,7 @@ package queuex
 import (
 	"context"
 	"errors"
+	"fmt"
 	"time"
 
 	"github.com/GizmoVault/gotools/storagex"
@@ -13,36 +14,51 @@ type Task struct {
 	Payload []byte
 }
 
-func MarshalTask[S storagex.Serial](key string, s storagex.Serial, d any) *Task {
+func MarshalTask(key string, s storagex.Serial, d any) (*Task, error) {
 	task := &Task{
 		Key:     key,
 		Payload: nil,
 	}
 
 	if d != nil {
-		data, _ := s.Marshal(d)
+		data, err := s.Marshal(d)
+		if err != nil {
+			return nil, fmt.Errorf("%w: %w", ErrorInvalidPayload, err)
+		}
+
 		task.Payload = data
 	}
 
-	return task
+	return task, nil
 }
 
-func UnMarshalTaskPayload[S storagex.Serial](s storagex.Serial, payload []byte, v any) error {
+func UnMarshalTaskPayload(s storagex.Serial, payload []byte, v any) error {
 	return s.Unmarshal(payload, v)
 }
 
 type ProducerQueue interface {
-	Enqueue(task *Task, delay time.Duration) (id string, err error)
+	Enqueue(task *Task, delay time.Duration, opts ...Option) (id string, err error)
 }
 
-var ErrorSkipRetry error = errors.New("skip retry")
+var (
+	ErrorSkipRetry       error = errors.New("skip retry")
+	ErrorDuplicateTask   error = errors.New("task already exists")
+	ErrorTaskIDConflict  error = errors.New("task id conflicts with another task")
+	ErrorHandlerNotFound error = errors.New("handler not found")
+	ErrorInvalidPayload  error = errors.New("invalid payload")
+	ErrorTaskFailed      error = errors.New("task failed")
+)
 
 type Handler func(ctx context.Context, id string, task *Task) error
 
 type ConsumerQueue interface {
 	HandleFunc(key string, h Handler)
+	// Use adds middlewares to every handler of the queue.
+	Use(mws ...Middleware)
+	ServeMux() *ServeMux
 
-	Run() error
+	// Run blocks until ctx is done or the queue is stopped.
+	Run(ctx context.Context) error
 }
 
 type Queue interface {
@@ -0,0 +1,350 @@
+// Package queuextest checks that a queuex.Queue implementation behaves like the others.
+package queuextest
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/GizmoVault/gotools/queuex"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+const (
+	// WaitTimeout is how long the suite waits for a task to be handled.
+	WaitTimeout = 5 * time.Second
+)
+
+// Factory opens the queues of the backend under test.
+type Factory struct {
+	// New opens the queue stored under name. A queue opened again with the same name must see the tasks left
+	// by the previous one, every subtest uses its own names. Failed tasks must be retried within a second,
+	// configure the retry delay of the backend for that.
+	New func(t *testing.T, name string) queuex.Queue
+	// Volatile backends lose their tasks when the queue stops, the persistence test is skipped for them.
+	Volatile bool
+	// Precision is the granularity of the task timestamps of the backend, a delayed task may run that much early.
+	Precision time.Duration
+}
+
+// RunConformance runs the behaviour every backend shares as subtests of t: delays, prefix routing, retries,
+// ordered groups, persistence across restart and Stop semantics.
+//
+//nolint:gocritic // factory is a small value
+func RunConformance(t *testing.T, factory Factory) {
+	t.Helper()
+
+	t.Run("Routing", func(t *testing.T) { testRouting(t, &factory) })
+	t.Run("Delay", func(t *testing.T) { testDelay(t, &factory) })
+	t.Run("Retry", func(t *testing.T) { testRetry(t, &factory) })
+	t.Run("Ordering", func(t *testing.T) { testOrdering(t, &factory) })
+	t.Run("Enqueue", func(t *testing.T) { testEnqueue(t, &factory) })
+	t.Run("Persistence", func(t *testing.T) { testPersistence(t, &factory) })
+	t.Run("Stop", func(t *testing.T) { testStop(t, &factory) })
+}
+
+func open(t *testing.T, factory *Factory, name string) queuex.Queue {
+	t.Helper()
+
+	q := factory.New(t, name)
+	require.NotNil(t, q)
+
+	t.Cleanup(q.Stop)
+
+	return q
+}
+
+// run starts q and returns the channel Run reports to.
+func run(t *testing.T, q queuex.Queue) <-chan error {
+	t.Helper()
+
+	done := make(chan error, 1)
+
+	go func() {
+		done <- q.Run(t.Context())
+	}()
+
+	return done
+}
+
+func receive[T any](t *testing.T, ch <-chan T) (v T) {
+	t.Helper()
+
+	select {
+	case v = <-ch:
+	case <-time.After(WaitTimeout):
+		require.FailNow(t, "timeout waiting for the queue")
+	}
+
+	return
+}
+
+// assertQuiet checks that nothing more arrives on ch for a while.
+func assertQuiet[T any](t *testing.T, ch <-chan T, d time.Duration) {
+	t.Helper()
+
+	select {
+	case v := <-ch:
+		assert.Fail(t, "unexpected handler call", "%v", v)
+	case <-time.After(d):
+	}
+}
+
+func enqueue(t *testing.T, q queuex.Queue, key string, payload []byte, delay time.Duration,
+	opts ...queuex.Option,
+) string {
+	t.Helper()
+
+	id, err := q.Enqueue(&queuex.Task{Key: key, Payload: payload}, delay, opts...)
+	require.NoError(t, err)
+	require.NotEmpty(t, id)
+
+	return id
+}
+
+type routed struct {
+	handler string
+	id      string
+	key     string
+	payload string
+}
+
+func testRouting(t *testing.T, factory *Factory) {
+	q := open(t, factory, "routing")
+
+	got := make(chan routed, 8)
+
+	record := func(handler string) queuex.Handler {
+		return func(_ context.Context, id string, task *queuex.Task) error {
+			got <- routed{handler: handler, id: id, key: task.Key, payload: string(task.Payload)}
+
+			return nil
+		}
+	}
+
+	q.HandleFunc("route:", record("prefix"))
+	q.HandleFunc("route:vip", record("vip"))
+	q.HandleFunc("route:vip:gold", record("gold"))
+
+	want := map[string]routed{}
+
+	for key, handler := range map[string]string{
+		"route:a":          "prefix",
+		"route:vip":        "vip",
+		"route:vip:silver": "vip",
+		"route:vip:gold":   "gold",
+	} {
+		id := enqueue(t, q, key, []byte("payload of "+key), 0)
+		want[id] = routed{handler: handler, id: id, key: key, payload: "payload of " + key}
+	}
+
+	run(t, q)
+
+	for range want {
+		r := receive(t, got)
+		assert.Equal(t, want[r.id], r)
+	}
+}
+
+func testDelay(t *testing.T, factory *Factory) {
+	q := open(t, factory, "delay")
+
+	got := make(chan string, 2)
+	at := make(chan time.Time, 2)
+
+	q.HandleFunc("delay", func(_ context.Context, id string, _ *queuex.Task) error {
+		at <- time.Now()
+		got <- id
+
+		return nil
+	})
+
+	const delay = 2 * time.Second
+
+	start := time.Now()
+	delayed := enqueue(t, q, "delay", nil, delay)
+	immediate := enqueue(t, q, "delay", nil, 0)
+
+	run(t, q)
+
+	assert.Less(t, receive(t, at).Sub(start), delay)
+	assert.Equal(t, immediate, receive(t, got))
+
+	assert.GreaterOrEqual(t, receive(t, at).Sub(start), delay-factory.Precision)
+	assert.Equal(t, delayed, receive(t, got))
+}
+
+type attempt struct {
+	key     string
+	retried int
+}
+
+func testRetry(t *testing.T, factory *Factory) {
+	q := open(t, factory, "retry")
+
+	got := make(chan attempt, 16)
+
+	q.HandleFunc("retry:", func(ctx context.Context, _ string, task *queuex.Task) error {
+		retried, _ := queuex.GetRetryCount(ctx)
+		got <- attempt{key: task.Key, retried: retried}
+
+		switch task.Key {
+		case "retry:flaky":
+			if retried < 2 {
+				return errors.New("flaky")
+			}
+
+			return nil
+		case "retry:skip":
+			return queuex.ErrorSkipRetry
+		default:
+			return errors.New("always")
+		}
+	})
+
+	enqueue(t, q, "retry:flaky", nil, 0, queuex.MaxRetry(3))
+	enqueue(t, q, "retry:skip", nil, 0, queuex.MaxRetry(3))
+	enqueue(t, q, "retry:exhausted", nil, 0, queuex.MaxRetry(1))
+
+	run(t, q)
+
+	attempts := map[string][]int{}
+
+	for range 6 {
+		a := receive(t, got)
+		attempts[a.key] = append(attempts[a.key], a.retried)
+	}
+
+	assertQuiet(t, got, 2*time.Second)
+
+	assert.Equal(t, map[string][]int{
+		"retry:flaky":     {0, 1, 2},
+		"retry:skip":      {0},
+		"retry:exhausted": {0, 1},
+	}, attempts)
+}
+
+func testOrdering(t *testing.T, factory *Factory) {
+	q := open(t, factory, "ordering")
+
+	const n = 5
+
+	got := make(chan string, n)
+
+	var running, overlapped atomic.Int32
+
+	q.HandleFunc("order", func(_ context.Context, _ string, task *queuex.Task) error {
+		if running.Add(1) > 1 {
+			overlapped.Add(1)
+		}
+
+		time.Sleep(20 * time.Millisecond)
+		running.Add(-1)
+
+		got <- string(task.Payload)
+
+		return nil
+	})
+
+	// the tasks waiting for their turn are not failures, those that must not be retried wait as well
+	for i := range n {
+		enqueue(t, q, "order", []byte{'0' + byte(i)}, 0, queuex.GroupKey("conformance"), queuex.MaxRetry(i%2))
+	}
+
+	run(t, q)
+
+	var order string
+
+	for range n {
+		order += receive(t, got)
+	}
+
+	assert.Equal(t, "01234", order)
+	assert.Zero(t, overlapped.Load())
+}
+
+func testEnqueue(t *testing.T, factory *Factory) {
+	q := open(t, factory, "enqueue")
+
+	_, err := q.Enqueue(nil, 0)
+	require.Error(t, err)
+
+	_, err = q.Enqueue(&queuex.Task{}, 0)
+	require.Error(t, err)
+
+	id := enqueue(t, q, "enqueue", nil, time.Hour, queuex.TaskID("conformance-id"))
+	assert.Equal(t, "conformance-id", id)
+
+	_, err = q.Enqueue(&queuex.Task{Key: "enqueue:other"}, time.Hour, queuex.TaskID("conformance-id"))
+	require.ErrorIs(t, err, queuex.ErrorTaskIDConflict)
+
+	enqueue(t, q, "enqueue", []byte("unique"), time.Hour, queuex.Unique(time.Hour))
+
+	_, err = q.Enqueue(&queuex.Task{Key: "enqueue", Payload: []byte("unique")}, time.Hour, queuex.Unique(time.Hour))
+	require.ErrorIs(t, err, queuex.ErrorDuplicateTask)
+
+	enqueue(t, q, "enqueue", []byte("other"), time.Hour, queuex.Unique(time.Hour))
+}
+
+func testPersistence(t *testing.T, factory *Factory) {
+	if factory.Volatile {
+		t.Skip("volatile backend")
+	}
+
+	q := open(t, factory, "persistence")
+	id := enqueue(t, q, "persist", []byte("kept"), 0)
+	q.Stop()
+
+	q = open(t, factory, "persistence")
+
+	got := make(chan routed, 1)
+
+	q.HandleFunc("persist", func(_ context.Context, id string, task *queuex.Task) error {
+		got <- routed{id: id, key: task.Key, payload: string(task.Payload)}
+
+		return nil
+	})
+
+	run(t, q)
+
+	assert.Equal(t, routed{id: id, key: "persist", payload: "kept"}, receive(t, got))
+}
+
+func testStop(t *testing.T, factory *Factory) {
+	q := open(t, factory, "stop")
+
+	started := make(chan struct{})
+
+	var (
+		once     sync.Once
+		finished atomic.Bool
+	)
+
+	q.HandleFunc("stop", func(context.Context, string, *queuex.Task) error {
+		once.Do(func() { close(started) })
+
+		time.Sleep(300 * time.Millisecond)
+		finished.Store(true)
+
+		return nil
+	})
+
+	enqueue(t, q, "stop", nil, 0)
+
+	done := run(t, q)
+
+	receive(t, started)
+
+	q.Stop()
+	assert.True(t, finished.Load(), "Stop returned before the running handler")
+
+	require.NoError(t, receive(t, done))
+
+	q.Stop()
+
+	require.Error(t, q.Run(t.Context()))
+}
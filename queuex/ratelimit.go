@@ -0,0 +1,310 @@
+package queuex
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/GizmoVault/gotools/base"
+)
+
+const (
+	// DefaultPausedDelay is how long FlowControl first postpones the tasks of a paused queue or key prefix.
+	DefaultPausedDelay = time.Second
+	// DefaultMaxPausedDelay caps the delay a task keeps doubling while it finds its queue or key prefix paused.
+	DefaultMaxPausedDelay = 30 * time.Second
+)
+
+// RateLimitError asks the backend to run the task again after Delay. It is not a failure: the retry counter
+// does not move and the task is never dead-lettered because of it.
+type RateLimitError struct {
+	Delay  time.Duration
+	Reason string
+}
+
+func (e *RateLimitError) Error() string {
+	return fmt.Sprintf("%s, retry in %s", e.Reason, e.Delay)
+}
+
+func NewRateLimitError(delay time.Duration, reason string) error {
+	return &RateLimitError{
+		Delay:  delay,
+		Reason: reason,
+	}
+}
+
+// IsRateLimited reports whether err asks to postpone the task, and for how long.
+func IsRateLimited(err error) (delay time.Duration, ok bool) {
+	var rle *RateLimitError
+	if !errors.As(err, &rle) {
+		return 0, false
+	}
+
+	return rle.Delay, true
+}
+
+// RateLimiter hands out permits, Allow returns how long to wait for one if there is none left.
+type RateLimiter interface {
+	Allow() (ok bool, wait time.Duration)
+}
+
+type tokenBucket struct {
+	lock   sync.Mutex
+	fnNow  base.FNNow
+	rate   float64
+	burst  float64
+	tokens float64
+	last   time.Time
+}
+
+// NewTokenBucket allows rate permits per second on average and bursts of up to burst permits.
+func NewTokenBucket(rate float64, burst int, now base.FNNow) RateLimiter {
+	if burst < 1 {
+		burst = 1
+	}
+
+	return &tokenBucket{
+		fnNow:  now,
+		rate:   rate,
+		burst:  float64(burst),
+		tokens: float64(burst),
+		last:   base.GetNow(now),
+	}
+}
+
+func (tb *tokenBucket) Allow() (bool, time.Duration) {
+	tb.lock.Lock()
+	defer tb.lock.Unlock()
+
+	timeNow := base.GetNow(tb.fnNow)
+
+	if elapsed := timeNow.Sub(tb.last); elapsed > 0 {
+		tb.tokens = min(tb.burst, tb.tokens+elapsed.Seconds()*tb.rate)
+		tb.last = timeNow
+	}
+
+	if tb.tokens >= 1 {
+		tb.tokens--
+
+		return true, 0
+	}
+
+	if tb.rate <= 0 {
+		return false, time.Hour
+	}
+
+	return false, time.Duration((1 - tb.tokens) / tb.rate * float64(time.Second))
+}
+
+type windowLimiter struct {
+	lock   sync.Mutex
+	fnNow  base.FNNow
+	n      int
+	window time.Duration
+	start  time.Time
+	count  int
+}
+
+// NewWindowLimiter allows n permits per fixed window.
+func NewWindowLimiter(n int, window time.Duration, now base.FNNow) RateLimiter {
+	return &windowLimiter{
+		fnNow:  now,
+		n:      n,
+		window: window,
+	}
+}
+
+func (wl *windowLimiter) Allow() (bool, time.Duration) {
+	wl.lock.Lock()
+	defer wl.lock.Unlock()
+
+	timeNow := base.GetNow(wl.fnNow)
+
+	if wl.start.IsZero() || !timeNow.Before(wl.start.Add(wl.window)) {
+		wl.start = timeNow
+		wl.count = 0
+	}
+
+	if wl.count < wl.n {
+		wl.count++
+
+		return true, 0
+	}
+
+	return false, wl.start.Add(wl.window).Sub(timeNow)
+}
+
+// FlowControl throttles and pauses the tasks of a consumer, install it with its Middleware. Rate limits and
+// pauses apply to task key prefixes, the longest matching prefix wins. Throttled and paused tasks fail with a
+// RateLimitError, so the backend keeps them and runs them again later. A task that keeps finding itself paused
+// is postponed twice as long each time up to the max paused delay, so a long pause does not spin the backend.
+type FlowControl struct {
+	lock           sync.RWMutex
+	limits         map[string]RateLimiter
+	pausedKeys     map[string]bool
+	pausedQueues   map[string]bool
+	pausedDelay    time.Duration
+	maxPausedDelay time.Duration
+	// pauses counts how many times in a row a task was postponed as paused, by task ID.
+	pauses map[string]int
+}
+
+func NewFlowControl() *FlowControl {
+	return &FlowControl{
+		limits:         make(map[string]RateLimiter),
+		pausedKeys:     make(map[string]bool),
+		pausedQueues:   make(map[string]bool),
+		pausedDelay:    DefaultPausedDelay,
+		maxPausedDelay: DefaultMaxPausedDelay,
+		pauses:         make(map[string]int),
+	}
+}
+
+// SetRateLimit limits the tasks whose key starts with prefix, a nil limiter removes the limit.
+func (fc *FlowControl) SetRateLimit(prefix string, limiter RateLimiter) {
+	fc.lock.Lock()
+	defer fc.lock.Unlock()
+
+	if limiter == nil {
+		delete(fc.limits, prefix)
+
+		return
+	}
+
+	fc.limits[prefix] = limiter
+}
+
+// SetPausedDelay sets how long the tasks of a paused queue or key prefix are first postponed.
+func (fc *FlowControl) SetPausedDelay(d time.Duration) {
+	fc.lock.Lock()
+	defer fc.lock.Unlock()
+
+	if d > 0 {
+		fc.pausedDelay = d
+	}
+}
+
+// SetMaxPausedDelay caps how long the tasks of a paused queue or key prefix are postponed.
+func (fc *FlowControl) SetMaxPausedDelay(d time.Duration) {
+	fc.lock.Lock()
+	defer fc.lock.Unlock()
+
+	if d > 0 {
+		fc.maxPausedDelay = d
+	}
+}
+
+func (fc *FlowControl) PauseKeys(prefix string) {
+	fc.lock.Lock()
+	defer fc.lock.Unlock()
+
+	fc.pausedKeys[prefix] = true
+}
+
+func (fc *FlowControl) ResumeKeys(prefix string) {
+	fc.lock.Lock()
+	defer fc.lock.Unlock()
+
+	delete(fc.pausedKeys, prefix)
+	clear(fc.pauses)
+}
+
+func (fc *FlowControl) PauseQueue(queue string) {
+	fc.lock.Lock()
+	defer fc.lock.Unlock()
+
+	fc.pausedQueues[queue] = true
+}
+
+func (fc *FlowControl) ResumeQueue(queue string) {
+	fc.lock.Lock()
+	defer fc.lock.Unlock()
+
+	delete(fc.pausedQueues, queue)
+	clear(fc.pauses)
+}
+
+func (fc *FlowControl) IsPaused(queue, key string) bool {
+	fc.lock.RLock()
+	defer fc.lock.RUnlock()
+
+	return fc.isPausedLocked(queue, key)
+}
+
+func (fc *FlowControl) isPausedLocked(queue, key string) bool {
+	if queue != "" && fc.pausedQueues[queue] {
+		return true
+	}
+
+	for prefix := range fc.pausedKeys {
+		if strings.HasPrefix(key, prefix) {
+			return true
+		}
+	}
+
+	return false
+}
+
+func (fc *FlowControl) limiter(key string) RateLimiter {
+	var limiter RateLimiter
+
+	matched := -1
+
+	for prefix, l := range fc.limits {
+		if strings.HasPrefix(key, prefix) && len(prefix) > matched {
+			matched = len(prefix)
+			limiter = l
+		}
+	}
+
+	return limiter
+}
+
+// pausedDelayLocked returns how long to postpone the task id, doubling for each pause in a row.
+func (fc *FlowControl) pausedDelayLocked(id string, paused bool) time.Duration {
+	if !paused {
+		delete(fc.pauses, id)
+
+		return 0
+	}
+
+	n := fc.pauses[id]
+	fc.pauses[id] = n + 1
+
+	delay := fc.pausedDelay
+	for ; n > 0 && delay < fc.maxPausedDelay; n-- {
+		delay *= 2
+	}
+
+	return min(delay, fc.maxPausedDelay)
+}
+
+// Middleware postpones the tasks that are paused or over their rate limit.
+func (fc *FlowControl) Middleware() Middleware {
+	return func(next Handler) Handler {
+		return func(ctx context.Context, id string, task *Task) error {
+			meta, _ := GetTaskMeta(ctx)
+
+			fc.lock.Lock()
+			paused := fc.isPausedLocked(meta.Queue, task.Key)
+			pausedDelay := fc.pausedDelayLocked(id, paused)
+			limiter := fc.limiter(task.Key)
+			fc.lock.Unlock()
+
+			if paused {
+				return NewRateLimitError(pausedDelay, "paused")
+			}
+
+			if limiter != nil {
+				if ok, wait := limiter.Allow(); !ok {
+					return NewRateLimitError(wait, "rate limited")
+				}
+			}
+
+			return next(ctx, id, task)
+		}
+	}
+}
@@ -0,0 +1,107 @@
+package queuex
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestRateLimiters(t *testing.T) {
+	timeNow := time.Unix(1000, 0)
+	now := func() time.Time {
+		return timeNow
+	}
+
+	tb := NewTokenBucket(2, 2, now)
+
+	ok, _ := tb.Allow()
+	assert.True(t, ok)
+	ok, _ = tb.Allow()
+	assert.True(t, ok)
+
+	ok, wait := tb.Allow()
+	assert.False(t, ok)
+	assert.Equal(t, 500*time.Millisecond, wait)
+
+	timeNow = timeNow.Add(wait)
+
+	ok, _ = tb.Allow()
+	assert.True(t, ok)
+
+	wl := NewWindowLimiter(1, time.Minute, now)
+
+	ok, _ = wl.Allow()
+	assert.True(t, ok)
+
+	timeNow = timeNow.Add(10 * time.Second)
+
+	ok, wait = wl.Allow()
+	assert.False(t, ok)
+	assert.Equal(t, 50*time.Second, wait)
+
+	timeNow = timeNow.Add(wait)
+
+	ok, _ = wl.Allow()
+	assert.True(t, ok)
+}
+
+func TestFlowControl(t *testing.T) {
+	timeNow := time.Unix(1000, 0)
+
+	fc := NewFlowControl()
+	fc.SetRateLimit("api:", NewWindowLimiter(1, time.Second, func() time.Time {
+		return timeNow
+	}))
+
+	mux := NewServeMux()
+	mux.Use(fc.Middleware())
+
+	var handled int
+
+	mux.HandleFunc("api:", func(context.Context, string, *Task) error {
+		handled++
+
+		return nil
+	})
+
+	ctx := WithTaskMeta(context.Background(), TaskMeta{Queue: "mail"})
+
+	require.NoError(t, mux.ProcessTask(ctx, "1", &Task{Key: "api:call"}))
+
+	err := mux.ProcessTask(ctx, "2", &Task{Key: "api:call"})
+	delay, ok := IsRateLimited(err)
+	require.True(t, ok)
+	assert.Equal(t, time.Second, delay)
+
+	timeNow = timeNow.Add(time.Second)
+
+	fc.PauseQueue("mail")
+	assert.True(t, fc.IsPaused("mail", "api:call"))
+
+	fc.SetMaxPausedDelay(3 * time.Second)
+
+	// the delay doubles while the task stays paused
+	for _, want := range []time.Duration{time.Second, 2 * time.Second, 3 * time.Second} {
+		delay, ok = IsRateLimited(mux.ProcessTask(ctx, "3", &Task{Key: "api:call"}))
+		require.True(t, ok)
+		assert.Equal(t, want, delay)
+	}
+
+	fc.ResumeQueue("mail")
+	fc.PauseKeys("api:")
+
+	_, ok = IsRateLimited(mux.ProcessTask(ctx, "4", &Task{Key: "api:call"}))
+	require.True(t, ok)
+
+	fc.ResumeKeys("api:")
+
+	require.NoError(t, mux.ProcessTask(ctx, "5", &Task{Key: "api:call"}))
+	assert.Equal(t, 2, handled)
+
+	_, ok = IsRateLimited(errors.New("other"))
+	assert.False(t, ok)
+}
@@ -0,0 +1,64 @@
+package queuex
+
+import (
+	"math/rand/v2"
+	"time"
+)
+
+const (
+	DefaultMaxRetry = 25
+)
+
+// RetryDelayFunc returns how long to wait before the n-th retry (n starts at 1) of a task that failed with err.
+type RetryDelayFunc func(n int, err error, task *Task) time.Duration
+
+func DefaultRetryDelay(n int, err error, task *Task) time.Duration {
+	return ExponentialBackoff(time.Second, time.Hour)(n, err, task)
+}
+
+// MaxRetryOrDefault reads the MaxRetry of a backend config: 0 means DefaultMaxRetry, a negative value disables
+// retries.
+func MaxRetryOrDefault(n int) int {
+	if n == 0 {
+		return DefaultMaxRetry
+	}
+
+	if n < 0 {
+		return 0
+	}
+
+	return n
+}
+
+// RetryDelayOrDefault returns fn, DefaultRetryDelay if it is nil.
+func RetryDelayOrDefault(fn RetryDelayFunc) RetryDelayFunc {
+	if fn == nil {
+		return DefaultRetryDelay
+	}
+
+	return fn
+}
+
+// ExponentialBackoff doubles the delay for every attempt, caps it at maxDelay and
+// randomizes the upper half of it so that failed tasks do not retry in lockstep.
+func ExponentialBackoff(base, maxDelay time.Duration) RetryDelayFunc {
+	return func(n int, _ error, _ *Task) time.Duration {
+		if base <= 0 {
+			return 0
+		}
+
+		d := base
+
+		for i := 1; i < n && d < maxDelay; i++ {
+			d *= 2
+		}
+
+		if maxDelay > 0 && d > maxDelay {
+			d = maxDelay
+		}
+
+		half := d / 2
+
+		return half + time.Duration(rand.Int64N(int64(d-half)+1)) //nolint:gosec // jitter only
+	}
+}
@@ -0,0 +1,329 @@
+package queuex
+
+import (
+	"errors"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/GizmoVault/gotools/base"
+	"github.com/GizmoVault/gotools/base/errorx"
+	"github.com/GizmoVault/gotools/base/logx"
+	"github.com/GizmoVault/gotools/base/syncx"
+	"github.com/GizmoVault/gotools/hashx"
+	"github.com/GizmoVault/gotools/schedulex"
+	"github.com/GizmoVault/gotools/storagex"
+)
+
+const (
+	// entryVersionNano stores LastFireAt as Unix nanoseconds, the entries written before it used seconds.
+	entryVersionNano = 1
+
+	currentEntryVersion = entryVersionNano
+)
+
+type schedulerEntry struct {
+	Version    int
+	ID         string
+	Spec       string
+	Key        string
+	Payload    []byte
+	Options    Options
+	LastFireAt int64
+}
+
+// migrate converts an entry written by an older version.
+func (e *schedulerEntry) migrate() {
+	if e.Version < entryVersionNano {
+		e.LastFireAt *= int64(time.Second)
+	}
+
+	e.Version = currentEntryVersion
+}
+
+func (e *schedulerEntry) clone() *schedulerEntry {
+	c := *e
+
+	return &c
+}
+
+// Scheduler enqueues tasks periodically. Entries are persisted together with the time they last fired, so
+// a restarted scheduler neither loses them nor fires a run again. Every run is enqueued with the task id
+// "<entry id>:<fire unix nano time>", which lets the backend reject a run that another scheduler already
+// enqueued.
+type Scheduler struct {
+	logger   logx.Wrapper
+	producer ProducerQueue
+	loc      *time.Location
+	fnNow    base.FNNow
+	pool     schedulex.ScheduleTaskPool
+	stg      *storagex.MemWithFile[map[string]*schedulerEntry, storagex.Serial, syncx.RWLocker]
+
+	lock      sync.Mutex
+	schedules map[string]schedulex.Schedule
+}
+
+// NewScheduler creates a scheduler persisted to fileName, an empty fileName keeps the entries in memory.
+// loc is the time zone of the specs without a CRON_TZ= prefix, nil for time.Local.
+func NewScheduler(producer ProducerQueue, fileName string, loc *time.Location, logger logx.Wrapper) (*Scheduler, error) {
+	return NewSchedulerWithFNNow(producer, fileName, loc, nil, logger)
+}
+
+func NewSchedulerWithFNNow(producer ProducerQueue, fileName string, loc *time.Location, now base.FNNow,
+	logger logx.Wrapper) (*Scheduler, error) {
+	return newScheduler(producer, fileName, loc, now, schedulex.NewHeapTaskPool(now), logger)
+}
+
+// NewSchedulerWithClock fires the entries on the timers of clock, a base.FakeClock makes the tests deterministic.
+func NewSchedulerWithClock(producer ProducerQueue, fileName string, loc *time.Location, clock base.Clock,
+	logger logx.Wrapper) (*Scheduler, error) {
+	clock = base.GetClock(clock)
+
+	return newScheduler(producer, fileName, loc, clock.Now, schedulex.NewHeapTaskPoolWithClock(clock), logger)
+}
+
+func newScheduler(producer ProducerQueue, fileName string, loc *time.Location, now base.FNNow,
+	pool schedulex.ScheduleTaskPool, logger logx.Wrapper) (*Scheduler, error) {
+	if producer == nil {
+		pool.Stop()
+
+		return nil, errorx.ErrInvalidArgs
+	}
+
+	if logger == nil {
+		logger = logx.NewNopLoggerWrapper()
+	}
+
+	if loc == nil {
+		loc = time.Local
+	}
+
+	stg, err := storagex.NewMemWithFile[map[string]*schedulerEntry, storagex.Serial, syncx.RWLocker](
+		make(map[string]*schedulerEntry), &storagex.JSONSerial{}, &sync.RWMutex{}, fileName, nil)
+	if err != nil {
+		pool.Stop()
+
+		return nil, err
+	}
+
+	s := &Scheduler{
+		logger:    logger.WithFields(logx.StringField(logx.ClsKey, "Scheduler")),
+		producer:  producer,
+		loc:       loc,
+		fnNow:     now,
+		pool:      pool,
+		stg:       stg,
+		schedules: make(map[string]schedulex.Schedule),
+	}
+
+	var entries []*schedulerEntry
+
+	err = stg.Change(func(m map[string]*schedulerEntry) (map[string]*schedulerEntry, error) {
+		migrated := false
+
+		for id, entry := range m {
+			if entry.Version < currentEntryVersion {
+				entry = entry.clone()
+				entry.migrate()
+				m[id] = entry
+				migrated = true
+			}
+
+			entries = append(entries, entry)
+		}
+
+		if !migrated {
+			return m, errorx.NoErrSkip
+		}
+
+		return m, nil
+	})
+	if err != nil {
+		s.logger.WithFields(logx.ErrorField(err)).Error("migrate entries failed")
+	}
+
+	for _, entry := range entries {
+		if err = s.start(entry); err != nil {
+			s.logger.WithFields(logx.StringField("spec", entry.Spec), logx.ErrorField(err)).Error("restore entry failed")
+		}
+	}
+
+	return s, nil
+}
+
+func entryID(spec string, task *Task) string {
+	return hashx.MD5(spec + "\x00" + task.Key + "\x00" + string(task.Payload))
+}
+
+// Register enqueues task on every fire time of cronSpec and returns the id of the entry. Registering the same
+// spec and task again returns the same id and only updates the options.
+func (s *Scheduler) Register(cronSpec string, task *Task, opts ...Option) (id string, err error) {
+	if task == nil || task.Key == "" {
+		err = errorx.ErrInvalidArgs
+
+		return
+	}
+
+	if _, err = schedulex.ParseCronInLocation(cronSpec, s.loc); err != nil {
+		return
+	}
+
+	options := NewOptions(opts...)
+	options.TaskID = ""
+
+	id = entryID(cronSpec, task)
+
+	var entry *schedulerEntry
+
+	err = s.stg.Change(func(oldM map[string]*schedulerEntry) (newM map[string]*schedulerEntry, err error) {
+		newM = oldM
+		if len(newM) == 0 {
+			newM = make(map[string]*schedulerEntry)
+		}
+
+		entry = &schedulerEntry{
+			Version: currentEntryVersion,
+			ID:      id,
+			Spec:    cronSpec,
+			Key:     task.Key,
+			Payload: task.Payload,
+			Options: *options,
+		}
+
+		if old, ok := newM[id]; ok {
+			entry.LastFireAt = old.LastFireAt
+		}
+
+		newM[id] = entry
+
+		return
+	})
+	if err != nil {
+		return
+	}
+
+	err = s.start(entry)
+
+	return
+}
+
+func (s *Scheduler) Unregister(id string) error {
+	var found bool
+
+	err := s.stg.Change(func(oldM map[string]*schedulerEntry) (newM map[string]*schedulerEntry, err error) {
+		newM = oldM
+
+		if _, found = newM[id]; !found {
+			err = errorx.ErrNotExists
+
+			return
+		}
+
+		delete(newM, id)
+
+		return
+	})
+	if err != nil {
+		return err
+	}
+
+	s.lock.Lock()
+	delete(s.schedules, id)
+	s.lock.Unlock()
+
+	// the entry may be between two runs, it has no task then
+	if err = s.pool.RemoveTask(id); err != nil && !errors.Is(err, errorx.ErrNotExists) {
+		return err
+	}
+
+	return nil
+}
+
+func (s *Scheduler) Stop() {
+	s.pool.Stop()
+}
+
+func (s *Scheduler) start(entry *schedulerEntry) error {
+	schedule, err := schedulex.ParseCronInLocation(entry.Spec, s.loc)
+	if err != nil {
+		return err
+	}
+
+	s.lock.Lock()
+	s.schedules[entry.ID] = schedule
+	s.lock.Unlock()
+
+	return s.scheduleNext(entry.ID, schedule, entry.LastFireAt)
+}
+
+func (s *Scheduler) scheduleNext(id string, schedule schedulex.Schedule, lastFireAt int64) error {
+	after := base.GetNow(s.fnNow)
+	if t := time.Unix(0, lastFireAt); t.After(after) {
+		after = t
+	}
+
+	next := schedule.Next(after)
+	if next.IsZero() {
+		return nil
+	}
+
+	return s.pool.AddTask(id, next, s.fire, next)
+}
+
+func (s *Scheduler) fire(id string, args ...any) {
+	fireAt, _ := args[0].(time.Time)
+
+	s.lock.Lock()
+	schedule, ok := s.schedules[id]
+	s.lock.Unlock()
+
+	if !ok {
+		return
+	}
+
+	var entry *schedulerEntry
+
+	err := s.stg.Change(func(oldM map[string]*schedulerEntry) (newM map[string]*schedulerEntry, err error) {
+		newM = oldM
+
+		old, ok := newM[id]
+		if !ok {
+			err = errorx.ErrNotExists
+
+			return
+		}
+
+		if old.LastFireAt >= fireAt.UnixNano() {
+			err = errorx.ErrExists
+
+			return
+		}
+
+		entry = old.clone()
+		entry.LastFireAt = fireAt.UnixNano()
+		newM[id] = entry
+
+		return
+	})
+	if err != nil {
+		if errors.Is(err, errorx.ErrExists) {
+			_ = s.scheduleNext(id, schedule, fireAt.UnixNano())
+		}
+
+		return
+	}
+
+	logger := s.logger.WithFields(logx.StringField("entry", id), logx.StringField("key", entry.Key))
+
+	_, err = s.producer.Enqueue(&Task{
+		Key:     entry.Key,
+		Payload: entry.Payload,
+	}, 0, entry.Options.Option(), TaskID(id+":"+strconv.FormatInt(fireAt.UnixNano(), 10)))
+	if err != nil && !errors.Is(err, ErrorTaskIDConflict) && !errors.Is(err, ErrorDuplicateTask) {
+		logger.WithFields(logx.ErrorField(err)).Error("enqueue periodic task failed")
+	}
+
+	if err = s.scheduleNext(id, schedule, entry.LastFireAt); err != nil {
+		logger.WithFields(logx.ErrorField(err)).Error("schedule next run failed")
+	}
+}
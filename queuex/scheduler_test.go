@@ -0,0 +1,116 @@
+package queuex
+
+import (
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/GizmoVault/gotools/base"
+	"github.com/GizmoVault/gotools/base/errorx"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestScheduler(t *testing.T) {
+	fileName := filepath.Join(t.TempDir(), "ut.schedule")
+	clock := base.NewFakeClock(time.Unix(1000, 0))
+	producer := &utProducer{}
+
+	s, err := NewSchedulerWithClock(producer, fileName, time.UTC, clock, nil)
+	require.NoError(t, err)
+
+	_, err = s.Register("bad spec", &Task{Key: "report"})
+	require.Error(t, err)
+
+	id, err := s.Register("@every 1s", &Task{Key: "report"}, MaxRetry(1))
+	require.NoError(t, err)
+
+	id2, err := s.Register("@every 1s", &Task{Key: "report"})
+	require.NoError(t, err)
+	assert.Equal(t, id, id2)
+
+	clock.BlockUntil(1)
+	clock.Advance(time.Second)
+	clock.BlockUntil(1)
+	assert.Equal(t, 1, producer.count())
+
+	s.Stop()
+
+	// the restarted scheduler goes on after the last run instead of firing it again
+	s2, err := NewSchedulerWithClock(producer, fileName, time.UTC, clock, nil)
+	require.NoError(t, err)
+
+	defer s2.Stop()
+
+	clock.BlockUntil(1)
+	clock.Advance(time.Second)
+	clock.BlockUntil(1)
+
+	require.NoError(t, s2.Unregister(id))
+	require.ErrorIs(t, s2.Unregister(id), errorx.ErrNotExists)
+
+	producer.lock.Lock()
+	defer producer.lock.Unlock()
+
+	assert.Equal(t, []string{id + ":1001000000000", id + ":1002000000000"}, producer.ids)
+}
+
+func TestSchedulerSubSecond(t *testing.T) {
+	clock := base.NewFakeClock(time.Unix(1000, 0))
+	producer := &utProducer{}
+
+	s, err := NewSchedulerWithClock(producer, "", time.UTC, clock, nil)
+	require.NoError(t, err)
+
+	defer s.Stop()
+
+	id, err := s.Register("@every 500ms", &Task{Key: "tick"})
+	require.NoError(t, err)
+
+	// the two runs of a second are told apart
+	for range 4 {
+		clock.BlockUntil(1)
+		clock.Advance(500 * time.Millisecond)
+	}
+
+	clock.BlockUntil(1)
+
+	producer.lock.Lock()
+	defer producer.lock.Unlock()
+
+	assert.Equal(t, []string{
+		id + ":1000500000000",
+		id + ":1001000000000",
+		id + ":1001500000000",
+		id + ":1002000000000",
+	}, producer.ids)
+}
+
+func TestSchedulerMigrateSeconds(t *testing.T) {
+	fileName := filepath.Join(t.TempDir(), "ut.schedule")
+	id := entryID("@every 1m", &Task{Key: "report"})
+
+	// an entry written when LastFireAt was in seconds
+	d, err := json.Marshal(map[string]*schedulerEntry{id: {ID: id, Spec: "@every 1m", Key: "report", LastFireAt: 2000}})
+	require.NoError(t, err)
+	require.NoError(t, os.WriteFile(fileName, d, 0o600))
+
+	clock := base.NewFakeClock(time.Unix(1000, 0))
+	producer := &utProducer{}
+
+	s, err := NewSchedulerWithClock(producer, fileName, time.UTC, clock, nil)
+	require.NoError(t, err)
+
+	defer s.Stop()
+
+	clock.BlockUntil(1)
+	clock.Advance(1060 * time.Second)
+	clock.BlockUntil(1)
+
+	producer.lock.Lock()
+	defer producer.lock.Unlock()
+
+	assert.Equal(t, []string{id + ":2060000000000"}, producer.ids)
+}
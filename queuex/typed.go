@@ -0,0 +1,130 @@
+package queuex
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	"github.com/GizmoVault/gotools/storagex"
+)
+
+type TypedHandler[T any] func(ctx context.Context, id string, payload T) error
+
+// Codec encodes typed payloads. With Version > 0 the payload is stored together with its version, and
+// Migrate upgrades the data of older versions (0 for payloads written without a version) before decoding.
+type Codec struct {
+	Serial  storagex.Serial
+	Version int
+	Migrate func(version int, data []byte) ([]byte, error)
+}
+
+var DefaultCodec = &Codec{
+	Serial: &storagex.JSONSerial{},
+}
+
+type versionedPayload struct {
+	V int
+	D []byte
+}
+
+func (c *Codec) Encode(v any) ([]byte, error) {
+	data, err := c.Serial.Marshal(v)
+	if err != nil {
+		return nil, fmt.Errorf("%w: %w", ErrorInvalidPayload, err)
+	}
+
+	if c.Version <= 0 {
+		return data, nil
+	}
+
+	data, err = c.Serial.Marshal(&versionedPayload{
+		V: c.Version,
+		D: data,
+	})
+	if err != nil {
+		return nil, fmt.Errorf("%w: %w", ErrorInvalidPayload, err)
+	}
+
+	return data, nil
+}
+
+// Decode reports failures wrapping both ErrorInvalidPayload and ErrorSkipRetry, retrying can not fix them.
+func (c *Codec) Decode(payload []byte, v any) error {
+	data := payload
+
+	if c.Version > 0 {
+		var vp versionedPayload
+
+		version := 0
+
+		if err := c.Serial.Unmarshal(payload, &vp); err == nil && vp.V > 0 {
+			version = vp.V
+			data = vp.D
+		}
+
+		if version > c.Version {
+			return fmt.Errorf("%w: %w: unsupported payload version %d", ErrorSkipRetry, ErrorInvalidPayload, version)
+		}
+
+		if version < c.Version {
+			if c.Migrate == nil {
+				return fmt.Errorf("%w: %w: no migration from payload version %d", ErrorSkipRetry, ErrorInvalidPayload,
+					version)
+			}
+
+			var err error
+
+			data, err = c.Migrate(version, data)
+			if err != nil {
+				return fmt.Errorf("%w: %w: migrate payload version %d: %w", ErrorSkipRetry, ErrorInvalidPayload, version, err)
+			}
+		}
+	}
+
+	if err := c.Serial.Unmarshal(data, v); err != nil {
+		return fmt.Errorf("%w: %w: %w", ErrorSkipRetry, ErrorInvalidPayload, err)
+	}
+
+	return nil
+}
+
+func Register[T any](mux *ServeMux, key string, fn TypedHandler[T]) {
+	RegisterWithCodec(mux, key, DefaultCodec, fn)
+}
+
+func RegisterWithCodec[T any](mux *ServeMux, key string, codec *Codec, fn TypedHandler[T]) {
+	if codec == nil {
+		codec = DefaultCodec
+	}
+
+	mux.HandleFunc(key, func(ctx context.Context, id string, task *Task) error {
+		var payload T
+
+		if err := codec.Decode(task.Payload, &payload); err != nil {
+			return err
+		}
+
+		return fn(ctx, id, payload)
+	})
+}
+
+func EnqueueTyped[T any](q ProducerQueue, key string, payload T, opts ...Option) (string, error) {
+	return EnqueueTypedWithCodec(q, DefaultCodec, key, payload, 0, opts...)
+}
+
+func EnqueueTypedWithCodec[T any](q ProducerQueue, codec *Codec, key string, payload T, delay time.Duration,
+	opts ...Option) (string, error) {
+	if codec == nil {
+		codec = DefaultCodec
+	}
+
+	data, err := codec.Encode(payload)
+	if err != nil {
+		return "", err
+	}
+
+	return q.Enqueue(&Task{
+		Key:     key,
+		Payload: data,
+	}, delay, opts...)
+}
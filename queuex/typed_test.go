@@ -0,0 +1,121 @@
+package queuex
+
+import (
+	"context"
+	"encoding/json"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/GizmoVault/gotools/storagex"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+type utProducer struct {
+	lock  sync.Mutex
+	tasks []*Task
+	ids   []string
+}
+
+func (p *utProducer) Enqueue(task *Task, _ time.Duration, opts ...Option) (string, error) {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+
+	id := NewOptions(opts...).TaskID
+	for _, s := range p.ids {
+		if id != "" && s == id {
+			return "", ErrorTaskIDConflict
+		}
+	}
+
+	p.tasks = append(p.tasks, task)
+	p.ids = append(p.ids, id)
+
+	return id, nil
+}
+
+func (p *utProducer) count() int {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+
+	return len(p.tasks)
+}
+
+type utEmailV1 struct {
+	To string
+}
+
+type utEmailV2 struct {
+	To      []string
+	Subject string
+}
+
+func TestTyped(t *testing.T) {
+	producer := &utProducer{}
+	mux := NewServeMux()
+
+	var got utEmailV1
+
+	Register(mux, "email", func(_ context.Context, _ string, payload utEmailV1) error {
+		got = payload
+
+		return nil
+	})
+
+	_, err := EnqueueTyped(producer, "email", utEmailV1{To: "a@b.c"})
+	require.NoError(t, err)
+	require.NoError(t, mux.ProcessTask(t.Context(), "1", producer.tasks[0]))
+	assert.Equal(t, "a@b.c", got.To)
+
+	err = mux.ProcessTask(t.Context(), "2", &Task{Key: "email", Payload: []byte("{")})
+	require.ErrorIs(t, err, ErrorSkipRetry)
+	require.ErrorIs(t, err, ErrorInvalidPayload)
+
+	_, err = EnqueueTyped(producer, "email", func() {})
+	require.ErrorIs(t, err, ErrorInvalidPayload)
+}
+
+func TestTypedVersion(t *testing.T) {
+	producer := &utProducer{}
+	mux := NewServeMux()
+
+	codecV2 := &Codec{
+		Serial:  &storagex.JSONSerial{},
+		Version: 2,
+		Migrate: func(version int, data []byte) ([]byte, error) {
+			var v1 utEmailV1
+			if err := json.Unmarshal(data, &v1); err != nil {
+				return nil, err
+			}
+
+			return json.Marshal(&utEmailV2{To: []string{v1.To}})
+		},
+	}
+
+	var got utEmailV2
+
+	RegisterWithCodec(mux, "email", codecV2, func(_ context.Context, _ string, payload utEmailV2) error {
+		got = payload
+
+		return nil
+	})
+
+	_, err := EnqueueTyped(producer, "email", utEmailV1{To: "old@b.c"})
+	require.NoError(t, err)
+
+	_, err = EnqueueTypedWithCodec(producer, codecV2, "email", utEmailV2{To: []string{"new@b.c"}, Subject: "hi"}, 0)
+	require.NoError(t, err)
+
+	_, err = EnqueueTypedWithCodec(producer, &Codec{Serial: &storagex.JSONSerial{}, Version: 3}, "email",
+		utEmailV2{}, 0)
+	require.NoError(t, err)
+
+	require.NoError(t, mux.ProcessTask(t.Context(), "1", producer.tasks[0]))
+	assert.Equal(t, []string{"old@b.c"}, got.To)
+
+	require.NoError(t, mux.ProcessTask(t.Context(), "2", producer.tasks[1]))
+	assert.Equal(t, "hi", got.Subject)
+
+	require.ErrorIs(t, mux.ProcessTask(t.Context(), "3", producer.tasks[2]), ErrorSkipRetry)
+}
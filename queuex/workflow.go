@@ -0,0 +1,688 @@
+package queuex
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/GizmoVault/gotools/base/errorx"
+	"github.com/GizmoVault/gotools/base/logx"
+	"github.com/GizmoVault/gotools/base/syncx"
+	"github.com/GizmoVault/gotools/storagex"
+	"github.com/google/uuid"
+)
+
+// FailurePolicy decides what a workflow does when one of its tasks fails for good, that is it returned
+// ErrorSkipRetry or ran out of retries.
+type FailurePolicy int
+
+const (
+	// FailureAbort stops the workflow, the following steps never run.
+	FailureAbort FailurePolicy = iota
+	// FailureContinue treats the failed task as done with an empty result.
+	FailureContinue
+	// FailureCompensate stops the workflow and runs the compensation tasks of the started steps in reverse order.
+	FailureCompensate
+)
+
+func (p FailurePolicy) String() string {
+	switch p {
+	case FailureAbort:
+		return "abort"
+	case FailureContinue:
+		return "continue"
+	case FailureCompensate:
+		return "compensate"
+	default:
+		return "unknown"
+	}
+}
+
+type WorkflowStatus int
+
+const (
+	WorkflowRunning WorkflowStatus = iota + 1
+	WorkflowSucceeded
+	WorkflowFailed
+	WorkflowCompensating
+	WorkflowCompensated
+)
+
+func (s WorkflowStatus) String() string {
+	switch s {
+	case WorkflowRunning:
+		return "running"
+	case WorkflowSucceeded:
+		return "succeeded"
+	case WorkflowFailed:
+		return "failed"
+	case WorkflowCompensating:
+		return "compensating"
+	case WorkflowCompensated:
+		return "compensated"
+	default:
+		return "unknown"
+	}
+}
+
+// WorkflowStep is a set of tasks running in parallel. A step starts when all tasks of the previous one are done.
+type WorkflowStep struct {
+	Tasks      []*Task
+	Compensate []*Task
+}
+
+// Workflow is a sequence of steps, build it with Chain or Group.
+type Workflow struct {
+	Steps  []WorkflowStep
+	Policy FailurePolicy
+}
+
+// Chain runs tasks one after another, every task receives the result of the previous one as its input.
+func Chain(tasks ...*Task) *Workflow {
+	return (&Workflow{}).Then(tasks...)
+}
+
+// TaskGroup is a set of tasks running in parallel, see Group.
+type TaskGroup struct {
+	tasks []*Task
+}
+
+// Group runs tasks in parallel, Then adds a callback receiving all their results.
+func Group(tasks ...*Task) *TaskGroup {
+	return &TaskGroup{tasks: tasks}
+}
+
+func (g *TaskGroup) Then(callback ...*Task) *Workflow {
+	return (&Workflow{}).ThenGroup(g.tasks...).Then(callback...)
+}
+
+// Then appends one step per task.
+func (wf *Workflow) Then(tasks ...*Task) *Workflow {
+	for _, task := range tasks {
+		wf.Steps = append(wf.Steps, WorkflowStep{Tasks: []*Task{task}})
+	}
+
+	return wf
+}
+
+// ThenGroup appends one step running tasks in parallel.
+func (wf *Workflow) ThenGroup(tasks ...*Task) *Workflow {
+	if len(tasks) > 0 {
+		wf.Steps = append(wf.Steps, WorkflowStep{Tasks: tasks})
+	}
+
+	return wf
+}
+
+// WithCompensation sets the tasks undoing the last step, they only run with FailureCompensate.
+func (wf *Workflow) WithCompensation(tasks ...*Task) *Workflow {
+	if len(wf.Steps) > 0 {
+		wf.Steps[len(wf.Steps)-1].Compensate = tasks
+	}
+
+	return wf
+}
+
+func (wf *Workflow) OnFailure(policy FailurePolicy) *Workflow {
+	wf.Policy = policy
+
+	return wf
+}
+
+type workflowInputsCtxKey struct{}
+
+// StepInputs returns the results of the previous step, in the order of its tasks, to a task of a workflow.
+func StepInputs(ctx context.Context) [][]byte {
+	inputs, _ := ctx.Value(workflowInputsCtxKey{}).([][]byte)
+
+	return inputs
+}
+
+// StepInput returns the result of the previous step when it has a single task.
+func StepInput(ctx context.Context) []byte {
+	inputs := StepInputs(ctx)
+	if len(inputs) == 0 {
+		return nil
+	}
+
+	return inputs[0]
+}
+
+type workflowStepState struct {
+	Results [][]byte
+	Done    []bool
+	Failed  []bool
+}
+
+func (s *workflowStepState) finished() bool {
+	for _, done := range s.Done {
+		if !done {
+			return false
+		}
+	}
+
+	return true
+}
+
+type workflowState struct {
+	ID      string
+	Steps   []WorkflowStep
+	Policy  FailurePolicy
+	Options Options
+	Status  WorkflowStatus
+	Current int
+	States  []*workflowStepState
+	// Compensating is the step whose compensation tasks are running.
+	Compensating int
+	CompDone     []bool
+	LastErr      string
+}
+
+func (s *workflowState) clone() *workflowState {
+	n := &workflowState{}
+	*n = *s
+
+	n.States = make([]*workflowStepState, len(s.States))
+
+	for i, st := range s.States {
+		n.States[i] = &workflowStepState{
+			Results: append([][]byte(nil), st.Results...),
+			Done:    append([]bool(nil), st.Done...),
+			Failed:  append([]bool(nil), st.Failed...),
+		}
+	}
+
+	n.CompDone = append([]bool(nil), s.CompDone...)
+
+	return n
+}
+
+// WorkflowInfo describes a workflow, Results holds the results of its last step once it succeeded.
+type WorkflowInfo struct {
+	ID      string
+	Status  WorkflowStatus
+	Policy  FailurePolicy
+	Step    int
+	Steps   int
+	Results [][]byte
+	LastErr string
+}
+
+const workflowIDPrefix = "wf:"
+
+type workflowTaskRef struct {
+	wfID       string
+	step       int
+	idx        int
+	compensate bool
+}
+
+// workflowTaskID is "wf:<workflow id>:<step>:<index>" for a step task and "wf:<workflow id>:c<step>:<index>" for
+// a compensation task.
+func workflowTaskID(ref workflowTaskRef) string {
+	step := strconv.Itoa(ref.step)
+	if ref.compensate {
+		step = "c" + step
+	}
+
+	return workflowIDPrefix + ref.wfID + ":" + step + ":" + strconv.Itoa(ref.idx)
+}
+
+func parseWorkflowTaskID(id string) (ref workflowTaskRef, ok bool) {
+	if !strings.HasPrefix(id, workflowIDPrefix) {
+		return
+	}
+
+	parts := strings.Split(strings.TrimPrefix(id, workflowIDPrefix), ":")
+	if len(parts) != 3 {
+		return
+	}
+
+	ref.wfID = parts[0]
+
+	step := parts[1]
+	if strings.HasPrefix(step, "c") {
+		ref.compensate = true
+		step = step[1:]
+	}
+
+	var err error
+
+	if ref.step, err = strconv.Atoi(step); err != nil {
+		return
+	}
+
+	if ref.idx, err = strconv.Atoi(parts[2]); err != nil {
+		return
+	}
+
+	ok = true
+
+	return
+}
+
+type workflowEnqueue struct {
+	ref  workflowTaskRef
+	task *Task
+}
+
+// WorkflowEngine runs workflows on top of a queue. Submit enqueues the first step, the middleware returned by
+// Middleware records the results and enqueues the following steps, so it has to be installed on the consumer.
+// The state of the workflows is persisted, a restarted engine continues them where they stopped.
+type WorkflowEngine struct {
+	logger   logx.Wrapper
+	producer ProducerQueue
+	stg      *storagex.MemWithFile[map[string]*workflowState, storagex.Serial, syncx.RWLocker]
+}
+
+// NewWorkflowEngine creates an engine persisted to fileName, an empty fileName keeps the workflows in memory.
+func NewWorkflowEngine(producer ProducerQueue, fileName string, logger logx.Wrapper) (*WorkflowEngine, error) {
+	if producer == nil {
+		return nil, errorx.ErrInvalidArgs
+	}
+
+	if logger == nil {
+		logger = logx.NewNopLoggerWrapper()
+	}
+
+	stg, err := storagex.NewMemWithFile[map[string]*workflowState, storagex.Serial, syncx.RWLocker](
+		make(map[string]*workflowState), &storagex.JSONSerial{}, &sync.RWMutex{}, fileName, nil)
+	if err != nil {
+		return nil, err
+	}
+
+	e := &WorkflowEngine{
+		logger:   logger.WithFields(logx.StringField(logx.ClsKey, "WorkflowEngine")),
+		producer: producer,
+		stg:      stg,
+	}
+
+	e.resume()
+
+	return e, nil
+}
+
+// resume enqueues again the unfinished tasks of the running workflows, in case the engine stopped between
+// recording a step and enqueuing the next one. The tasks still in the queue are rejected by their task id.
+func (e *WorkflowEngine) resume() {
+	type pending struct {
+		options  Options
+		enqueues []workflowEnqueue
+	}
+
+	var items []pending
+
+	e.stg.Read(func(m map[string]*workflowState) {
+		for _, state := range m {
+			var enqueues []workflowEnqueue
+
+			switch state.Status {
+			case WorkflowRunning:
+				for _, item := range stepEnqueues(state, state.Current, false) {
+					if !state.States[state.Current].Done[item.ref.idx] {
+						enqueues = append(enqueues, item)
+					}
+				}
+			case WorkflowCompensating:
+				for _, item := range stepEnqueues(state, state.Compensating, true) {
+					if !state.CompDone[item.ref.idx] {
+						enqueues = append(enqueues, item)
+					}
+				}
+			default:
+			}
+
+			if len(enqueues) > 0 {
+				items = append(items, pending{options: state.Options, enqueues: enqueues})
+			}
+		}
+	})
+
+	for _, item := range items {
+		if err := e.enqueue(item.options, item.enqueues); err != nil {
+			e.logger.WithFields(logx.ErrorField(err)).Error("resume workflow failed")
+		}
+	}
+}
+
+// Submit starts wf and returns its id. opts apply to every task of the workflow, except TaskID.
+func (e *WorkflowEngine) Submit(wf *Workflow, opts ...Option) (id string, err error) {
+	if wf == nil || len(wf.Steps) == 0 {
+		err = errorx.ErrInvalidArgs
+
+		return
+	}
+
+	for _, step := range wf.Steps {
+		if len(step.Tasks) == 0 {
+			err = errorx.ErrInvalidArgs
+
+			return
+		}
+
+		for _, task := range append(append([]*Task(nil), step.Tasks...), step.Compensate...) {
+			if task == nil || task.Key == "" {
+				err = errorx.ErrInvalidArgs
+
+				return
+			}
+		}
+	}
+
+	options := NewOptions(opts...)
+	options.TaskID = ""
+
+	state := &workflowState{
+		ID:      strings.ReplaceAll(uuid.NewString(), "-", ""),
+		Steps:   wf.Steps,
+		Policy:  wf.Policy,
+		Options: *options,
+		Status:  WorkflowRunning,
+		States:  make([]*workflowStepState, len(wf.Steps)),
+	}
+
+	for i, step := range wf.Steps {
+		state.States[i] = &workflowStepState{
+			Results: make([][]byte, len(step.Tasks)),
+			Done:    make([]bool, len(step.Tasks)),
+			Failed:  make([]bool, len(step.Tasks)),
+		}
+	}
+
+	err = e.stg.Change(func(oldM map[string]*workflowState) (newM map[string]*workflowState, err error) {
+		newM = oldM
+		if len(newM) == 0 {
+			newM = make(map[string]*workflowState)
+		}
+
+		newM[state.ID] = state
+
+		return
+	})
+	if err != nil {
+		return
+	}
+
+	id = state.ID
+
+	err = e.enqueue(state.Options, stepEnqueues(state, 0, false))
+
+	return
+}
+
+// Get returns the workflow id, errorx.ErrNotExists if it is unknown.
+func (e *WorkflowEngine) Get(id string) (info *WorkflowInfo, err error) {
+	e.stg.Read(func(m map[string]*workflowState) {
+		state, ok := m[id]
+		if !ok {
+			err = errorx.ErrNotExists
+
+			return
+		}
+
+		info = &WorkflowInfo{
+			ID:      state.ID,
+			Status:  state.Status,
+			Policy:  state.Policy,
+			Step:    state.Current,
+			Steps:   len(state.Steps),
+			LastErr: state.LastErr,
+		}
+
+		if state.Status == WorkflowSucceeded {
+			info.Results = append([][]byte(nil), state.States[len(state.States)-1].Results...)
+		}
+	})
+
+	return
+}
+
+// Remove forgets the workflow id, its tasks already enqueued still run but do not start further steps.
+func (e *WorkflowEngine) Remove(id string) error {
+	return e.stg.Change(func(oldM map[string]*workflowState) (newM map[string]*workflowState, err error) {
+		newM = oldM
+
+		if _, ok := newM[id]; !ok {
+			err = errorx.ErrNotExists
+
+			return
+		}
+
+		delete(newM, id)
+
+		return
+	})
+}
+
+// Middleware drives the workflows, tasks that do not belong to a workflow pass through untouched.
+func (e *WorkflowEngine) Middleware() Middleware {
+	return func(next Handler) Handler {
+		return func(ctx context.Context, id string, task *Task) error {
+			ref, ok := parseWorkflowTaskID(id)
+			if !ok {
+				return next(ctx, id, task)
+			}
+
+			var inputs [][]byte
+
+			var found bool
+
+			e.stg.Read(func(m map[string]*workflowState) {
+				state, exists := m[ref.wfID]
+				if !exists {
+					return
+				}
+
+				found = true
+
+				if !ref.compensate && ref.step > 0 && ref.step < len(state.States) {
+					inputs = append([][]byte(nil), state.States[ref.step-1].Results...)
+				}
+			})
+
+			if !found {
+				return next(ctx, id, task)
+			}
+
+			ctx = context.WithValue(ctx, workflowInputsCtxKey{}, inputs)
+			ctx, w := WithResultWriter(ctx)
+
+			err := next(ctx, id, task)
+			if err != nil && !isFinalFailure(ctx, err) {
+				return err
+			}
+
+			if e2 := e.advance(ref, w.Result(), err); e2 != nil {
+				e.logger.WithFields(logx.StringField("task", id), logx.ErrorField(e2)).Error("advance workflow failed")
+			}
+
+			return err
+		}
+	}
+}
+
+func isFinalFailure(ctx context.Context, err error) bool {
+	if errors.Is(err, ErrorSkipRetry) {
+		return true
+	}
+
+	if _, ok := IsRateLimited(err); ok {
+		return false
+	}
+
+	meta, ok := GetTaskMeta(ctx)
+
+	return ok && meta.Retried >= meta.MaxRetry
+}
+
+func (e *WorkflowEngine) advance(ref workflowTaskRef, result []byte, taskErr error) error {
+	var (
+		options  Options
+		enqueues []workflowEnqueue
+	)
+
+	err := e.stg.Change(func(oldM map[string]*workflowState) (newM map[string]*workflowState, err error) {
+		newM = oldM
+
+		old, ok := newM[ref.wfID]
+		if !ok {
+			err = errorx.ErrNotExists
+
+			return
+		}
+
+		state := old.clone()
+		options = state.Options
+
+		if ref.compensate {
+			enqueues, err = state.compensated(ref, taskErr)
+		} else {
+			enqueues, err = state.stepped(ref, result, taskErr)
+		}
+
+		if err != nil {
+			return
+		}
+
+		newM[ref.wfID] = state
+
+		return
+	})
+	if err != nil {
+		return err
+	}
+
+	return e.enqueue(options, enqueues)
+}
+
+func (s *workflowState) stepped(ref workflowTaskRef, result []byte, taskErr error) ([]workflowEnqueue, error) {
+	// the siblings of a failed task still finish after the workflow stopped, nothing waits for them
+	if s.Status != WorkflowRunning {
+		return nil, errorx.NoErrSkip
+	}
+
+	if ref.step != s.Current || ref.step >= len(s.States) ||
+		ref.idx >= len(s.States[ref.step].Done) || s.States[ref.step].Done[ref.idx] {
+		return nil, errorx.ErrConflict
+	}
+
+	st := s.States[ref.step]
+
+	if taskErr != nil {
+		s.LastErr = taskErr.Error()
+
+		switch s.Policy {
+		case FailureContinue:
+			st.Failed[ref.idx] = true
+			result = nil
+		case FailureCompensate:
+			s.Status = WorkflowCompensating
+			st.Done[ref.idx] = true
+			st.Failed[ref.idx] = true
+
+			return s.nextCompensation(ref.step), nil
+		default:
+			s.Status = WorkflowFailed
+			st.Done[ref.idx] = true
+			st.Failed[ref.idx] = true
+
+			return nil, nil
+		}
+	}
+
+	st.Done[ref.idx] = true
+	st.Results[ref.idx] = result
+
+	if !st.finished() {
+		return nil, nil
+	}
+
+	if s.Current == len(s.Steps)-1 {
+		s.Status = WorkflowSucceeded
+
+		return nil, nil
+	}
+
+	s.Current++
+
+	return stepEnqueues(s, s.Current, false), nil
+}
+
+// nextCompensation finds the first step at or before from having compensation tasks and returns them.
+func (s *workflowState) nextCompensation(from int) []workflowEnqueue {
+	for step := from; step >= 0; step-- {
+		if len(s.Steps[step].Compensate) > 0 {
+			s.Compensating = step
+			s.CompDone = make([]bool, len(s.Steps[step].Compensate))
+
+			return stepEnqueues(s, step, true)
+		}
+	}
+
+	s.Status = WorkflowCompensated
+
+	return nil
+}
+
+func (s *workflowState) compensated(ref workflowTaskRef, taskErr error) ([]workflowEnqueue, error) {
+	if s.Status != WorkflowCompensating || ref.step != s.Compensating || ref.idx >= len(s.CompDone) ||
+		s.CompDone[ref.idx] {
+		return nil, errorx.ErrConflict
+	}
+
+	if taskErr != nil {
+		s.Status = WorkflowFailed
+		s.LastErr = fmt.Sprintf("compensation failed: %v", taskErr)
+
+		return nil, nil
+	}
+
+	s.CompDone[ref.idx] = true
+
+	for _, done := range s.CompDone {
+		if !done {
+			return nil, nil
+		}
+	}
+
+	return s.nextCompensation(ref.step - 1), nil
+}
+
+func stepEnqueues(s *workflowState, step int, compensate bool) []workflowEnqueue {
+	tasks := s.Steps[step].Tasks
+	if compensate {
+		tasks = s.Steps[step].Compensate
+	}
+
+	enqueues := make([]workflowEnqueue, 0, len(tasks))
+
+	for idx, task := range tasks {
+		enqueues = append(enqueues, workflowEnqueue{
+			ref: workflowTaskRef{
+				wfID:       s.ID,
+				step:       step,
+				idx:        idx,
+				compensate: compensate,
+			},
+			task: task,
+		})
+	}
+
+	return enqueues
+}
+
+func (e *WorkflowEngine) enqueue(options Options, enqueues []workflowEnqueue) error {
+	var errs []error
+
+	for _, item := range enqueues {
+		_, err := e.producer.Enqueue(item.task, 0, options.Option(), TaskID(workflowTaskID(item.ref)))
+		if err != nil && !errors.Is(err, ErrorTaskIDConflict) {
+			errs = append(errs, err)
+		}
+	}
+
+	return errors.Join(errs...)
+}
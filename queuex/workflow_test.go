@@ -0,0 +1,148 @@
+package queuex
+
+import (
+	"context"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// utDrain processes the tasks the producer received from the n-th one on, until no new task shows up.
+func utDrain(t *testing.T, producer *utProducer, mux *ServeMux, n int) int {
+	t.Helper()
+
+	for {
+		producer.lock.Lock()
+		if n >= len(producer.tasks) {
+			producer.lock.Unlock()
+
+			return n
+		}
+
+		task, id := producer.tasks[n], producer.ids[n]
+		producer.lock.Unlock()
+
+		ctx := WithTaskMeta(context.Background(), TaskMeta{ID: id})
+		_ = mux.ProcessTask(ctx, id, task)
+
+		n++
+	}
+}
+
+func TestWorkflow(t *testing.T) {
+	fileName := filepath.Join(t.TempDir(), "ut.workflow")
+	producer := &utProducer{}
+
+	e, err := NewWorkflowEngine(producer, fileName, nil)
+	require.NoError(t, err)
+
+	mux := NewServeMux()
+	mux.Use(e.Middleware())
+
+	var undone []string
+
+	mux.HandleFunc("upper", func(ctx context.Context, _ string, task *Task) error {
+		return SetResult(ctx, []byte(strings.ToUpper(string(task.Payload))))
+	})
+	mux.HandleFunc("suffix", func(ctx context.Context, _ string, task *Task) error {
+		return SetResult(ctx, append(StepInput(ctx), task.Payload...))
+	})
+	mux.HandleFunc("join", func(ctx context.Context, _ string, _ *Task) error {
+		var parts []string
+		for _, input := range StepInputs(ctx) {
+			parts = append(parts, string(input))
+		}
+
+		return SetResult(ctx, []byte(strings.Join(parts, ",")))
+	})
+	mux.HandleFunc("fail", func(context.Context, string, *Task) error {
+		return ErrorSkipRetry
+	})
+	mux.HandleFunc("undo", func(_ context.Context, _ string, task *Task) error {
+		undone = append(undone, string(task.Payload))
+
+		return nil
+	})
+
+	_, err = e.Submit(&Workflow{})
+	require.Error(t, err)
+
+	chainID, err := e.Submit(Chain(&Task{Key: "upper", Payload: []byte("a")}, &Task{Key: "suffix", Payload: []byte("!")}))
+	require.NoError(t, err)
+
+	groupID, err := e.Submit(Group(&Task{Key: "upper", Payload: []byte("x")},
+		&Task{Key: "upper", Payload: []byte("y")}).Then(&Task{Key: "join"}))
+	require.NoError(t, err)
+
+	n := utDrain(t, producer, mux, 0)
+
+	info, err := e.Get(chainID)
+	require.NoError(t, err)
+	assert.Equal(t, WorkflowSucceeded, info.Status)
+	assert.Equal(t, [][]byte{[]byte("A!")}, info.Results)
+
+	info, err = e.Get(groupID)
+	require.NoError(t, err)
+	assert.Equal(t, WorkflowSucceeded, info.Status)
+	assert.Equal(t, [][]byte{[]byte("X,Y")}, info.Results)
+
+	abortID, err := e.Submit(Chain(&Task{Key: "fail"}, &Task{Key: "upper"}))
+	require.NoError(t, err)
+
+	continueID, err := e.Submit(Group(&Task{Key: "fail"}, &Task{Key: "upper", Payload: []byte("b")}).
+		Then(&Task{Key: "join"}).OnFailure(FailureContinue))
+	require.NoError(t, err)
+
+	compensateID, err := e.Submit(Chain(&Task{Key: "upper"}).WithCompensation(&Task{Key: "undo", Payload: []byte("1")}).
+		Then(&Task{Key: "upper"}).WithCompensation(&Task{Key: "undo", Payload: []byte("2")}).
+		Then(&Task{Key: "fail"}).OnFailure(FailureCompensate))
+	require.NoError(t, err)
+
+	// restarted engines continue from the persisted state
+	e, err = NewWorkflowEngine(producer, fileName, nil)
+	require.NoError(t, err)
+
+	mux.mws = nil
+	mux.Use(e.Middleware())
+
+	n = utDrain(t, producer, mux, n)
+
+	info, err = e.Get(abortID)
+	require.NoError(t, err)
+	assert.Equal(t, WorkflowFailed, info.Status)
+	assert.Equal(t, 0, info.Step)
+
+	info, err = e.Get(continueID)
+	require.NoError(t, err)
+	assert.Equal(t, WorkflowSucceeded, info.Status)
+	assert.Equal(t, [][]byte{[]byte(",B")}, info.Results)
+
+	info, err = e.Get(compensateID)
+	require.NoError(t, err)
+	assert.Equal(t, WorkflowCompensated, info.Status)
+	assert.Equal(t, []string{"2", "1"}, undone)
+
+	siblingID, err := e.Submit(Group(&Task{Key: "fail"}, &Task{Key: "upper"}).Then(&Task{Key: "join"}).
+		OnFailure(FailureCompensate))
+	require.NoError(t, err)
+
+	utDrain(t, producer, mux, n)
+
+	// the sibling that finishes after the failure is ignored
+	require.NoError(t, e.advance(workflowTaskRef{wfID: siblingID, idx: 1}, nil, nil))
+
+	info, err = e.Get(siblingID)
+	require.NoError(t, err)
+	assert.Equal(t, WorkflowCompensated, info.Status)
+
+	require.NoError(t, e.Remove(compensateID))
+
+	_, err = e.Get(compensateID)
+	require.Error(t, err)
+
+	// tasks outside workflows pass through
+	require.ErrorIs(t, mux.ProcessTask(context.Background(), "plain", &Task{Key: "fail"}), ErrorSkipRetry)
+}
@@ -0,0 +1,70 @@
+package schedulex
+
+import (
+	"math/rand/v2"
+	"strings"
+	"time"
+
+	"github.com/GizmoVault/gotools/base/errorx"
+	"github.com/robfig/cron/v3"
+)
+
+// Schedule returns the next fire time after t, the zero time if there is none.
+type Schedule interface {
+	Next(t time.Time) time.Time
+}
+
+var cronParser = cron.NewParser(cron.SecondOptional | cron.Minute | cron.Hour | cron.Dom | cron.Month | cron.Dow |
+	cron.Descriptor)
+
+// ParseCron parses a standard 5 field cron spec, a 6 field one starting with seconds, or a descriptor such as
+// @hourly and @every 1m30s. @every takes any time.ParseDuration, 500ms included, and counts from the previous
+// fire. A CRON_TZ= or TZ= prefix selects the time zone of the spec.
+func ParseCron(spec string) (Schedule, error) {
+	return ParseCronInLocation(spec, nil)
+}
+
+// ParseCronInLocation is ParseCron with loc used for specs without a time zone prefix.
+func ParseCronInLocation(spec string, loc *time.Location) (Schedule, error) {
+	// cron rounds @every up to whole seconds
+	if every, ok := strings.CutPrefix(strings.TrimSpace(spec), "@every "); ok {
+		d, err := time.ParseDuration(strings.TrimSpace(every))
+		if err != nil || d <= 0 {
+			return nil, errorx.ErrInvalidArgs.WithMsg("invalid interval " + every)
+		}
+
+		return &intervalSchedule{every: d}, nil
+	}
+
+	schedule, err := cronParser.Parse(spec)
+	if err != nil {
+		return nil, err
+	}
+
+	if specSchedule, ok := schedule.(*cron.SpecSchedule); ok && loc != nil && !hasTimeZone(spec) {
+		specSchedule.Location = loc
+	}
+
+	return schedule, nil
+}
+
+func hasTimeZone(spec string) bool {
+	spec = strings.TrimSpace(spec)
+
+	return strings.HasPrefix(spec, "CRON_TZ=") || strings.HasPrefix(spec, "TZ=")
+}
+
+type intervalSchedule struct {
+	every  time.Duration
+	jitter time.Duration
+}
+
+func (s *intervalSchedule) Next(t time.Time) time.Time {
+	d := s.every
+
+	if s.jitter > 0 {
+		d += time.Duration(rand.Int64N(int64(s.jitter) + 1)) //nolint:gosec // jitter only
+	}
+
+	return t.Add(d)
+}
@@ -0,0 +1,40 @@
+package schedulex
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestParseCron(t *testing.T) {
+	shanghai := time.FixedZone("CST", 8*3600)
+	base := time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)
+
+	s, err := ParseCronInLocation("30 9 * * *", shanghai)
+	require.NoError(t, err)
+	assert.Equal(t, time.Date(2024, 1, 1, 1, 30, 0, 0, time.UTC), s.Next(base).UTC())
+
+	s, err = ParseCronInLocation("CRON_TZ=UTC 30 9 * * *", shanghai)
+	require.NoError(t, err)
+	assert.Equal(t, time.Date(2024, 1, 1, 9, 30, 0, 0, time.UTC), s.Next(base).UTC())
+
+	s, err = ParseCron("*/10 * * * * *")
+	require.NoError(t, err)
+	assert.Equal(t, base.Add(10*time.Second), s.Next(base))
+
+	s, err = ParseCron("@every 90s")
+	require.NoError(t, err)
+	assert.Equal(t, base.Add(90*time.Second), s.Next(base))
+
+	s, err = ParseCron("@every 500ms")
+	require.NoError(t, err)
+	assert.Equal(t, base.Add(1500*time.Millisecond), s.Next(base.Add(time.Second)))
+
+	_, err = ParseCron("@every 0s")
+	require.Error(t, err)
+
+	_, err = ParseCron("* * *")
+	require.Error(t, err)
+}
@@ -0,0 +1,719 @@
+package schedulex
+
+import (
+	"context"
+	"errors"
+	"runtime/debug"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/GizmoVault/gotools/base"
+	"github.com/GizmoVault/gotools/base/errorx"
+	"github.com/GizmoVault/gotools/base/logx"
+	"github.com/GizmoVault/gotools/base/syncx"
+	"github.com/GizmoVault/gotools/storagex"
+	"github.com/google/uuid"
+)
+
+const (
+	DefaultDAGParallelism  = 4
+	DefaultDAGHistoryLimit = 100
+)
+
+// JobFunc runs a job of a graph run, an error fails the attempt.
+type JobFunc func(ctx context.Context, runID string) error
+
+type Job struct {
+	Name      string
+	DependsOn []string
+	Exec      JobFunc
+	// MaxRetry is how many times a failed job is attempted again, RetryDelay the wait before each attempt.
+	MaxRetry   int
+	RetryDelay time.Duration
+}
+
+type JobStatus string
+
+const (
+	JobPending   JobStatus = "pending"
+	JobRunning   JobStatus = "running"
+	JobSucceeded JobStatus = "succeeded"
+	JobFailed    JobStatus = "failed"
+	// JobSkipped is the status of the jobs whose dependency failed.
+	JobSkipped JobStatus = "skipped"
+)
+
+func (s JobStatus) done() bool {
+	return s == JobSucceeded || s == JobFailed || s == JobSkipped
+}
+
+type JobState struct {
+	Status   JobStatus
+	Attempts int
+	LastErr  string
+	// StartedAt and FinishedAt are Unix nanoseconds.
+	StartedAt  int64
+	FinishedAt int64
+}
+
+// DAGRun is a run of a graph. Its status is JobRunning until every job is done, then JobSucceeded or JobFailed.
+type DAGRun struct {
+	ID         string
+	Graph      string
+	Status     JobStatus
+	StartedAt  int64
+	FinishedAt int64
+	Jobs       map[string]*JobState
+}
+
+func (r *DAGRun) clone() *DAGRun {
+	c := *r
+	c.Jobs = make(map[string]*JobState, len(r.Jobs))
+
+	for name, state := range r.Jobs {
+		s := *state
+		c.Jobs[name] = &s
+	}
+
+	return &c
+}
+
+type DAGConfig struct {
+	// Parallelism bounds the jobs that run at once, across all the runs.
+	Parallelism int
+	// HistoryLimit is how many finished runs of a graph are kept.
+	HistoryLimit int
+	Clock        base.Clock
+	// Pool fires the triggers of the graphs, a HeapTaskPool on Clock by default. The scheduler stops the pool it
+	// created only, it removes its triggers from a pool it was given.
+	Pool ScheduleTaskPool
+}
+
+type dagGraph struct {
+	name     string
+	jobs     map[string]*Job
+	order    []string
+	schedule Schedule
+}
+
+// DAGScheduler runs graphs of jobs: a job starts once the jobs it depends on succeeded, and is skipped if one
+// of them failed. The runs and the state of their jobs are persisted, so the runs a stop interrupted resume when
+// their graph is added again; the jobs that were running then start over.
+type DAGScheduler struct {
+	logger   logx.Wrapper
+	cfg      DAGConfig
+	clock    base.Clock
+	pool     ScheduleTaskPool
+	ownPool  bool
+	slots    chan struct{}
+	stg      *storagex.MemWithFile[map[string]*DAGRun, storagex.Serial, syncx.RWLocker]
+	ctx      context.Context
+	cancel   context.CancelFunc
+	stopOnce sync.Once
+	wg       sync.WaitGroup
+	// stopLock orders start against Stop: no run starts once Stop waits for them.
+	stopLock    sync.Mutex
+	stopped     bool
+	graphsLock  sync.Mutex
+	graphs      map[string]*dagGraph
+	triggerLock sync.Mutex
+}
+
+// NewDAGScheduler persists the runs to fileName, an empty fileName keeps them in memory.
+//
+//nolint:gocritic // config is copied on purpose
+func NewDAGScheduler(fileName string, cfg DAGConfig, logger logx.Wrapper) (*DAGScheduler, error) {
+	if logger == nil {
+		logger = logx.NewNopLoggerWrapper()
+	}
+
+	if cfg.Parallelism <= 0 {
+		cfg.Parallelism = DefaultDAGParallelism
+	}
+
+	if cfg.HistoryLimit <= 0 {
+		cfg.HistoryLimit = DefaultDAGHistoryLimit
+	}
+
+	s := &DAGScheduler{
+		logger: logger.WithFields(logx.StringField(logx.ClsKey, "DAGScheduler")),
+		cfg:    cfg,
+		clock:  base.GetClock(cfg.Clock),
+		pool:   cfg.Pool,
+		slots:  make(chan struct{}, cfg.Parallelism),
+		graphs: make(map[string]*dagGraph),
+	}
+
+	var err error
+
+	s.stg, err = storagex.NewMemWithFile[map[string]*DAGRun, storagex.Serial, syncx.RWLocker](
+		make(map[string]*DAGRun), &storagex.JSONSerial{}, &sync.RWMutex{}, fileName, nil)
+	if err != nil {
+		return nil, err
+	}
+
+	if s.pool == nil {
+		s.pool = NewHeapTaskPoolWithClock(s.clock)
+		s.ownPool = true
+	}
+
+	s.ctx, s.cancel = context.WithCancel(context.Background())
+
+	return s, nil
+}
+
+// AddGraph registers the jobs of a graph under name, and triggers a run at every time of schedule unless it is
+// nil. It fails on a cycle or an unknown dependency. The unfinished runs of the graph resume.
+func (s *DAGScheduler) AddGraph(name string, schedule Schedule, jobs ...*Job) error {
+	if name == "" {
+		return errorx.ErrInvalidArgs
+	}
+
+	order, err := sortJobs(jobs)
+	if err != nil {
+		return err
+	}
+
+	g := &dagGraph{
+		name:     name,
+		jobs:     make(map[string]*Job, len(jobs)),
+		order:    order,
+		schedule: schedule,
+	}
+
+	for _, job := range jobs {
+		g.jobs[job.Name] = job
+	}
+
+	if s.ctx.Err() != nil {
+		return ErrPoolStopped
+	}
+
+	s.graphsLock.Lock()
+	_, exists := s.graphs[name]
+
+	if !exists {
+		s.graphs[name] = g
+	}
+	s.graphsLock.Unlock()
+
+	if exists {
+		return errorx.ErrExists
+	}
+
+	for _, run := range s.ListRuns(name) {
+		if !run.Status.done() {
+			s.logger.WithFields(logx.StringField("graph", name), logx.StringField("run", run.ID)).Info("resume run")
+
+			if err = s.start(g, run.ID); err != nil {
+				return err
+			}
+		}
+	}
+
+	if schedule != nil {
+		return s.scheduleTrigger(g, s.clock.Now())
+	}
+
+	return nil
+}
+
+// sortJobs checks the jobs and returns their names in an order that runs every job after its dependencies.
+func sortJobs(jobs []*Job) ([]string, error) {
+	byName := make(map[string]*Job, len(jobs))
+
+	for _, job := range jobs {
+		if job == nil || job.Name == "" || job.Exec == nil || job.MaxRetry < 0 {
+			return nil, errorx.ErrInvalidArgs
+		}
+
+		if _, ok := byName[job.Name]; ok {
+			return nil, errorx.ErrInvalidArgs.WithMsg("duplicated job " + job.Name)
+		}
+
+		byName[job.Name] = job
+	}
+
+	const (
+		unvisited = iota
+		visiting
+		visited
+	)
+
+	marks := make(map[string]int, len(jobs))
+	order := make([]string, 0, len(jobs))
+
+	var path []string
+
+	var visit func(name string) error
+
+	visit = func(name string) error {
+		switch marks[name] {
+		case visited:
+			return nil
+		case visiting:
+			i := 0
+			for path[i] != name {
+				i++
+			}
+
+			return errorx.ErrInvalidArgs.WithMsg("job cycle " + strings.Join(append(path[i:], name), " -> "))
+		}
+
+		marks[name] = visiting
+		path = append(path, name)
+
+		for _, dep := range byName[name].DependsOn {
+			if _, ok := byName[dep]; !ok {
+				return errorx.ErrInvalidArgs.WithMsg("job " + name + " depends on unknown job " + dep)
+			}
+
+			if err := visit(dep); err != nil {
+				return err
+			}
+		}
+
+		path = path[:len(path)-1]
+		marks[name] = visited
+		order = append(order, name)
+
+		return nil
+	}
+
+	for _, job := range jobs {
+		if err := visit(job.Name); err != nil {
+			return nil, err
+		}
+	}
+
+	return order, nil
+}
+
+func triggerKey(name string) string {
+	return "dag:" + name
+}
+
+// scheduleTrigger adds the next trigger of g, it fails once the scheduler is stopped: Stop removes the triggers
+// it finds, a trigger added after them would fire on forever in a pool the scheduler does not own.
+func (s *DAGScheduler) scheduleTrigger(g *dagGraph, after time.Time) error {
+	next := g.schedule.Next(after)
+	if next.IsZero() {
+		return nil
+	}
+
+	s.stopLock.Lock()
+	defer s.stopLock.Unlock()
+
+	if s.stopped {
+		return ErrPoolStopped
+	}
+
+	return s.pool.AddTask(triggerKey(g.name), next, func(string, ...any) {
+		if s.ctx.Err() != nil {
+			return
+		}
+
+		if _, err := s.Trigger(g.name); err != nil {
+			s.logger.WithFields(logx.StringField("graph", g.name), logx.ErrorField(err)).Warn("trigger skipped")
+		}
+
+		if err := s.scheduleTrigger(g, next); err != nil && !errors.Is(err, ErrPoolStopped) {
+			s.logger.WithFields(logx.StringField("graph", g.name), logx.ErrorField(err)).Error("schedule failed")
+		}
+	})
+}
+
+// Trigger starts a run of the graph name now. It returns errorx.ErrConflict while a run of the graph is
+// unfinished.
+func (s *DAGScheduler) Trigger(name string) (string, error) {
+	s.graphsLock.Lock()
+	g, ok := s.graphs[name]
+	s.graphsLock.Unlock()
+
+	if !ok {
+		return "", errorx.ErrNotExists
+	}
+
+	if s.ctx.Err() != nil {
+		return "", ErrPoolStopped
+	}
+
+	s.triggerLock.Lock()
+	defer s.triggerLock.Unlock()
+
+	run := &DAGRun{
+		ID:        uuid.NewString(),
+		Graph:     name,
+		Status:    JobRunning,
+		StartedAt: s.clock.Now().UnixNano(),
+		Jobs:      make(map[string]*JobState, len(g.order)),
+	}
+
+	for _, jobName := range g.order {
+		run.Jobs[jobName] = &JobState{Status: JobPending}
+	}
+
+	err := s.stg.Change(func(m map[string]*DAGRun) (map[string]*DAGRun, error) {
+		for _, r := range m {
+			if r.Graph == name && !r.Status.done() {
+				return m, errorx.ErrConflict.WithMsg("run " + r.ID + " is unfinished")
+			}
+		}
+
+		m[run.ID] = run
+
+		return m, nil
+	})
+	if err != nil {
+		return "", err
+	}
+
+	// a run stored but not started resumes when its graph is added again
+	if err = s.start(g, run.ID); err != nil {
+		return "", err
+	}
+
+	return run.ID, nil
+}
+
+func (s *DAGScheduler) GetRun(id string) (run DAGRun, err error) {
+	s.stg.Read(func(m map[string]*DAGRun) {
+		r, ok := m[id]
+		if !ok {
+			err = errorx.ErrNotExists
+
+			return
+		}
+
+		run = *r.clone()
+	})
+
+	return
+}
+
+// ListRuns returns the runs of the graph name, the latest first.
+func (s *DAGScheduler) ListRuns(name string) []DAGRun {
+	var runs []DAGRun
+
+	s.stg.Read(func(m map[string]*DAGRun) {
+		for _, r := range m {
+			if r.Graph == name {
+				runs = append(runs, *r.clone())
+			}
+		}
+	})
+
+	sort.Slice(runs, func(i, j int) bool {
+		return runs[i].StartedAt > runs[j].StartedAt
+	})
+
+	return runs
+}
+
+// Stop cancels the context of the running jobs and waits for them, their runs resume after a restart.
+func (s *DAGScheduler) Stop() {
+	s.stopOnce.Do(func() {
+		s.stopLock.Lock()
+		s.stopped = true
+		s.stopLock.Unlock()
+
+		s.cancel()
+
+		if s.ownPool {
+			s.pool.Stop()
+		} else {
+			s.removeTriggers()
+		}
+
+		s.wg.Wait()
+	})
+}
+
+// removeTriggers takes the triggers of the graphs out of a pool the scheduler does not own.
+func (s *DAGScheduler) removeTriggers() {
+	s.graphsLock.Lock()
+	defer s.graphsLock.Unlock()
+
+	for name, g := range s.graphs {
+		if g.schedule == nil {
+			continue
+		}
+
+		// a graph whose schedule ended has no trigger
+		if err := s.pool.RemoveTask(triggerKey(name)); err != nil && !errors.Is(err, errorx.ErrNotExists) {
+			s.logger.WithFields(logx.StringField("graph", name), logx.ErrorField(err)).Error("remove trigger failed")
+		}
+	}
+}
+
+type jobResult struct {
+	name string
+	err  error
+}
+
+// start runs the jobs of the run in the background, it fails once the scheduler is stopped.
+func (s *DAGScheduler) start(g *dagGraph, runID string) error {
+	s.stopLock.Lock()
+	defer s.stopLock.Unlock()
+
+	if s.stopped {
+		return ErrPoolStopped
+	}
+
+	s.wg.Add(1)
+
+	go func() {
+		defer s.wg.Done()
+
+		s.execute(g, runID)
+	}()
+
+	return nil
+}
+
+// execute starts the jobs whose dependencies succeeded until every job is done.
+func (s *DAGScheduler) execute(g *dagGraph, runID string) {
+	run, err := s.GetRun(runID)
+	if err != nil {
+		return
+	}
+
+	statuses := make(map[string]JobStatus, len(g.order))
+
+	for _, name := range g.order {
+		status := JobPending
+		if state, ok := run.Jobs[name]; ok && state.Status.done() {
+			status = state.Status
+		}
+
+		statuses[name] = status
+	}
+
+	results := make(chan jobResult)
+	running := 0
+
+	for {
+		for _, name := range g.order {
+			if statuses[name] != JobPending {
+				continue
+			}
+
+			ready, skip := true, false
+
+			for _, dep := range g.jobs[name].DependsOn {
+				switch statuses[dep] {
+				case JobSucceeded:
+				case JobFailed, JobSkipped:
+					skip = true
+				default:
+					ready = false
+				}
+			}
+
+			switch {
+			case skip:
+				statuses[name] = JobSkipped
+				s.setJob(runID, name, func(state *JobState) { state.Status = JobSkipped })
+			case ready:
+				statuses[name] = JobRunning
+				running++
+
+				go func() {
+					results <- jobResult{name: name, err: s.runJob(g.jobs[name], runID)}
+				}()
+			}
+		}
+
+		if running == 0 {
+			break
+		}
+
+		r := <-results
+		running--
+
+		switch {
+		case r.err == nil:
+			statuses[r.name] = JobSucceeded
+		case s.ctx.Err() != nil:
+			// interrupted by Stop, wait for the other jobs and leave the run to resume
+			statuses[r.name] = JobPending
+		default:
+			statuses[r.name] = JobFailed
+		}
+
+		if s.ctx.Err() != nil {
+			for running > 0 {
+				<-results
+				running--
+			}
+
+			return
+		}
+	}
+
+	s.finish(runID, statuses)
+}
+
+// runJob runs a job with its retries, waiting for a slot for every attempt.
+func (s *DAGScheduler) runJob(job *Job, runID string) error {
+	logger := s.logger.WithFields(logx.StringField("run", runID), logx.StringField("job", job.Name))
+
+	for attempt := 0; ; attempt++ {
+		select {
+		case s.slots <- struct{}{}:
+		case <-s.ctx.Done():
+			return s.ctx.Err()
+		}
+
+		s.setJob(runID, job.Name, func(state *JobState) {
+			state.Status = JobRunning
+			state.Attempts++
+			state.StartedAt = s.clock.Now().UnixNano()
+		})
+
+		err := s.call(job, runID)
+
+		<-s.slots
+
+		if s.ctx.Err() != nil {
+			s.setJob(runID, job.Name, func(state *JobState) { state.Status = JobPending })
+
+			return s.ctx.Err()
+		}
+
+		s.setJob(runID, job.Name, func(state *JobState) {
+			state.FinishedAt = s.clock.Now().UnixNano()
+			state.LastErr = ""
+
+			switch {
+			case err == nil:
+				state.Status = JobSucceeded
+			case attempt < job.MaxRetry:
+				state.Status = JobPending
+				state.LastErr = err.Error()
+			default:
+				state.Status = JobFailed
+				state.LastErr = err.Error()
+			}
+		})
+
+		if err == nil {
+			return nil
+		}
+
+		if attempt >= job.MaxRetry {
+			logger.WithFields(logx.ErrorField(err)).Error("job failed")
+
+			return err
+		}
+
+		logger.WithFields(logx.ErrorField(err)).Warnf("job failed, retry in %s", job.RetryDelay)
+
+		if job.RetryDelay > 0 {
+			timer := s.clock.NewTimer(job.RetryDelay)
+
+			select {
+			case <-timer.C():
+			case <-s.ctx.Done():
+				timer.Stop()
+
+				return s.ctx.Err()
+			}
+		}
+	}
+}
+
+func (s *DAGScheduler) call(job *Job, runID string) (err error) {
+	defer func() {
+		if p := recover(); p != nil {
+			s.logger.WithFields(logx.StringField("run", runID), logx.StringField("job", job.Name)).Errorf(
+				"job panic: %v\n%s", p, debug.Stack())
+
+			err = errorx.ErrCrashed
+		}
+	}()
+
+	return job.Exec(s.ctx, runID)
+}
+
+func (s *DAGScheduler) setJob(runID, name string, fn func(state *JobState)) {
+	s.changeRun(runID, func(run *DAGRun) {
+		state, ok := run.Jobs[name]
+		if !ok {
+			state = &JobState{}
+			run.Jobs[name] = state
+		}
+
+		fn(state)
+	})
+}
+
+func (s *DAGScheduler) changeRun(runID string, fn func(run *DAGRun)) {
+	err := s.stg.Change(func(m map[string]*DAGRun) (map[string]*DAGRun, error) {
+		run, ok := m[runID]
+		if !ok {
+			return m, errorx.NoErrSkip
+		}
+
+		run = run.clone()
+		fn(run)
+		m[runID] = run
+
+		return m, nil
+	})
+	if err != nil {
+		s.logger.WithFields(logx.StringField("run", runID), logx.ErrorField(err)).Error("save run failed")
+	}
+}
+
+// finish records the status of the run and drops the oldest runs of its graph past the history limit.
+func (s *DAGScheduler) finish(runID string, statuses map[string]JobStatus) {
+	status := JobSucceeded
+
+	for _, jobStatus := range statuses {
+		if jobStatus != JobSucceeded {
+			status = JobFailed
+		}
+	}
+
+	s.changeRun(runID, func(run *DAGRun) {
+		run.Status = status
+		run.FinishedAt = s.clock.Now().UnixNano()
+	})
+
+	s.logger.WithFields(logx.StringField("run", runID)).Infof("run %s", status)
+
+	err := s.stg.Change(func(m map[string]*DAGRun) (map[string]*DAGRun, error) {
+		run, ok := m[runID]
+		if !ok {
+			return m, errorx.NoErrSkip
+		}
+
+		var finished []*DAGRun
+
+		for _, r := range m {
+			if r.Graph == run.Graph && r.Status.done() {
+				finished = append(finished, r)
+			}
+		}
+
+		if len(finished) <= s.cfg.HistoryLimit {
+			return m, errorx.NoErrSkip
+		}
+
+		sort.Slice(finished, func(i, j int) bool {
+			return finished[i].StartedAt > finished[j].StartedAt
+		})
+
+		for _, r := range finished[s.cfg.HistoryLimit:] {
+			delete(m, r.ID)
+		}
+
+		return m, nil
+	})
+	if err != nil {
+		s.logger.WithFields(logx.StringField("run", runID), logx.ErrorField(err)).Error("trim history failed")
+	}
+}
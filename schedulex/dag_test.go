@@ -0,0 +1,328 @@
+package schedulex
+
+import (
+	"context"
+	"errors"
+	"path/filepath"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/GizmoVault/gotools/base"
+	"github.com/GizmoVault/gotools/base/errorx"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func waitRun(t *testing.T, s *DAGScheduler, id string) DAGRun {
+	t.Helper()
+
+	require.Eventually(t, func() bool {
+		run, err := s.GetRun(id)
+
+		return err == nil && run.Status.done()
+	}, 5*time.Second, time.Millisecond)
+
+	run, _ := s.GetRun(id)
+
+	return run
+}
+
+func TestSortJobs(t *testing.T) {
+	nop := func(context.Context, string) error { return nil }
+
+	order, err := sortJobs([]*Job{
+		{Name: "c", DependsOn: []string{"a", "b"}, Exec: nop},
+		{Name: "b", DependsOn: []string{"a"}, Exec: nop},
+		{Name: "a", Exec: nop},
+	})
+	require.NoError(t, err)
+	assert.Equal(t, []string{"a", "b", "c"}, order)
+
+	_, err = sortJobs([]*Job{
+		{Name: "a", DependsOn: []string{"c"}, Exec: nop},
+		{Name: "b", DependsOn: []string{"a"}, Exec: nop},
+		{Name: "c", DependsOn: []string{"b"}, Exec: nop},
+	})
+	require.ErrorIs(t, err, errorx.ErrInvalidArgs)
+	assert.Contains(t, err.Error(), "a -> c -> b -> a")
+
+	_, err = sortJobs([]*Job{{Name: "a", DependsOn: []string{"x"}, Exec: nop}})
+	require.ErrorIs(t, err, errorx.ErrInvalidArgs)
+
+	_, err = sortJobs([]*Job{{Name: "a", Exec: nop}, {Name: "a", Exec: nop}})
+	require.ErrorIs(t, err, errorx.ErrInvalidArgs)
+}
+
+func TestDAGScheduler(t *testing.T) {
+	s, err := NewDAGScheduler("", DAGConfig{Parallelism: 2}, nil)
+	require.NoError(t, err)
+
+	defer s.Stop()
+
+	var (
+		lock    sync.Mutex
+		order   []string
+		running atomic.Int32
+		peak    atomic.Int32
+		flaky   atomic.Int32
+	)
+
+	job := func(name string, deps ...string) *Job {
+		return &Job{Name: name, DependsOn: deps, Exec: func(context.Context, string) error {
+			n := running.Add(1)
+			defer running.Add(-1)
+
+			for {
+				p := peak.Load()
+				if n <= p || peak.CompareAndSwap(p, n) {
+					break
+				}
+			}
+
+			time.Sleep(10 * time.Millisecond)
+
+			lock.Lock()
+			order = append(order, name)
+			lock.Unlock()
+
+			return nil
+		}}
+	}
+
+	retried := &Job{Name: "retried", DependsOn: []string{"b1", "b2", "b3"}, MaxRetry: 2,
+		RetryDelay: time.Millisecond, Exec: func(context.Context, string) error {
+			if flaky.Add(1) < 3 {
+				return errors.New("flaky")
+			}
+
+			return nil
+		}}
+
+	require.NoError(t, s.AddGraph("g", nil, job("a"), job("b1", "a"), job("b2", "a"), job("b3", "a"), retried))
+	require.ErrorIs(t, s.AddGraph("g", nil, job("a")), errorx.ErrExists)
+
+	_, err = s.Trigger("unknown")
+	require.ErrorIs(t, err, errorx.ErrNotExists)
+
+	id, err := s.Trigger("g")
+	require.NoError(t, err)
+
+	_, err = s.Trigger("g")
+	require.ErrorIs(t, err, errorx.ErrConflict)
+
+	run := waitRun(t, s, id)
+	assert.Equal(t, JobSucceeded, run.Status)
+	assert.Equal(t, 3, run.Jobs["retried"].Attempts)
+	assert.Empty(t, run.Jobs["retried"].LastErr)
+
+	assert.Equal(t, "a", order[0])
+	assert.ElementsMatch(t, []string{"b1", "b2", "b3"}, order[1:])
+	assert.Equal(t, int32(2), peak.Load())
+}
+
+func TestDAGSchedulerFailure(t *testing.T) {
+	s, err := NewDAGScheduler("", DAGConfig{HistoryLimit: 2}, nil)
+	require.NoError(t, err)
+
+	defer s.Stop()
+
+	var ran atomic.Int32
+
+	nop := func(context.Context, string) error {
+		ran.Add(1)
+
+		return nil
+	}
+
+	require.NoError(t, s.AddGraph("g", nil,
+		&Job{Name: "fail", MaxRetry: 1, Exec: func(context.Context, string) error { panic("boom") }},
+		&Job{Name: "child", DependsOn: []string{"fail"}, Exec: nop},
+		&Job{Name: "grandchild", DependsOn: []string{"child"}, Exec: nop},
+		&Job{Name: "other", Exec: nop},
+	))
+
+	var ids []string
+
+	for range 3 {
+		id, err := s.Trigger("g")
+		require.NoError(t, err)
+
+		run := waitRun(t, s, id)
+		assert.Equal(t, JobFailed, run.Status)
+		assert.Equal(t, JobFailed, run.Jobs["fail"].Status)
+		assert.Equal(t, 2, run.Jobs["fail"].Attempts)
+		assert.Equal(t, JobSkipped, run.Jobs["child"].Status)
+		assert.Equal(t, JobSkipped, run.Jobs["grandchild"].Status)
+		assert.Equal(t, JobSucceeded, run.Jobs["other"].Status)
+
+		ids = append(ids, id)
+
+		time.Sleep(time.Millisecond)
+	}
+
+	assert.Equal(t, int32(3), ran.Load())
+
+	// the oldest run is dropped past the history limit
+	runs := s.ListRuns("g")
+	require.Len(t, runs, 2)
+	assert.Equal(t, ids[2], runs[0].ID)
+	assert.Equal(t, ids[1], runs[1].ID)
+
+	_, err = s.GetRun(ids[0])
+	require.ErrorIs(t, err, errorx.ErrNotExists)
+}
+
+func TestDAGSchedulerResume(t *testing.T) {
+	fileName := filepath.Join(t.TempDir(), "dag.json")
+
+	s, err := NewDAGScheduler(fileName, DAGConfig{}, nil)
+	require.NoError(t, err)
+
+	var firstRuns atomic.Int32
+
+	started := make(chan struct{})
+
+	first := &Job{Name: "first", Exec: func(context.Context, string) error {
+		firstRuns.Add(1)
+
+		return nil
+	}}
+
+	require.NoError(t, s.AddGraph("g", nil, first, &Job{Name: "second", DependsOn: []string{"first"},
+		Exec: func(ctx context.Context, _ string) error {
+			close(started)
+			<-ctx.Done()
+
+			return ctx.Err()
+		}}))
+
+	id, err := s.Trigger("g")
+	require.NoError(t, err)
+
+	<-started
+	s.Stop()
+
+	run, err := s.GetRun(id)
+	require.NoError(t, err)
+	assert.Equal(t, JobRunning, run.Status)
+	assert.Equal(t, JobSucceeded, run.Jobs["first"].Status)
+	assert.Equal(t, JobPending, run.Jobs["second"].Status)
+
+	s, err = NewDAGScheduler(fileName, DAGConfig{}, nil)
+	require.NoError(t, err)
+
+	defer s.Stop()
+
+	// the run resumes with the jobs that did not succeed
+	require.NoError(t, s.AddGraph("g", nil, first, &Job{Name: "second", DependsOn: []string{"first"},
+		Exec: func(context.Context, string) error { return nil }}))
+
+	run = waitRun(t, s, id)
+	assert.Equal(t, JobSucceeded, run.Status)
+	assert.Equal(t, 2, run.Jobs["second"].Attempts)
+	assert.Equal(t, int32(1), firstRuns.Load())
+}
+
+func TestDAGSchedulerSchedule(t *testing.T) {
+	s, err := NewDAGScheduler("", DAGConfig{}, nil)
+	require.NoError(t, err)
+
+	defer s.Stop()
+
+	schedule, err := ParseCron("@every 1s")
+	require.NoError(t, err)
+
+	ran := make(chan string, 4)
+
+	require.NoError(t, s.AddGraph("g", schedule, &Job{Name: "a", Exec: func(_ context.Context, runID string) error {
+		ran <- runID
+
+		return nil
+	}}))
+
+	ids := map[string]bool{}
+
+	for range 2 {
+		select {
+		case id := <-ran:
+			ids[id] = true
+		case <-time.After(5 * time.Second):
+			require.FailNow(t, "timeout waiting for the schedule")
+		}
+	}
+
+	assert.Len(t, ids, 2)
+}
+
+func TestDAGSchedulerExternalPool(t *testing.T) {
+	clock := base.NewFakeClock(time.Unix(1000, 0))
+	pool := NewHeapTaskPoolWithClock(clock)
+
+	defer pool.Stop()
+
+	s, err := NewDAGScheduler("", DAGConfig{Clock: clock, Pool: pool}, nil)
+	require.NoError(t, err)
+
+	schedule, err := ParseCron("@every 1m")
+	require.NoError(t, err)
+
+	ran := make(chan string, 4)
+
+	require.NoError(t, s.AddGraph("g", schedule, &Job{Name: "a", Exec: func(_ context.Context, runID string) error {
+		ran <- runID
+
+		return nil
+	}}))
+
+	clock.BlockUntil(1)
+	clock.Advance(time.Minute)
+
+	select {
+	case <-ran:
+	case <-time.After(5 * time.Second):
+		require.FailNow(t, "timeout waiting for the schedule")
+	}
+
+	clock.BlockUntil(1)
+	s.Stop()
+
+	// the pool outlives the scheduler, the trigger is gone from it
+	n, err := pool.Len(t.Context())
+	require.NoError(t, err)
+	assert.Zero(t, n)
+
+	clock.Advance(time.Hour)
+
+	select {
+	case id := <-ran:
+		assert.Fail(t, "run after stop", id)
+	case <-time.After(100 * time.Millisecond):
+	}
+}
+
+func TestDAGSchedulerStopRace(t *testing.T) {
+	for range 20 {
+		s, err := NewDAGScheduler("", DAGConfig{}, nil)
+		require.NoError(t, err)
+
+		require.NoError(t, s.AddGraph("g", nil, &Job{Name: "a", Exec: func(context.Context, string) error {
+			return nil
+		}}))
+
+		triggered := make(chan error, 1)
+
+		go func() {
+			_, err := s.Trigger("g")
+			triggered <- err
+		}()
+
+		// a trigger that loses the race to Stop does not start the run
+		s.Stop()
+
+		if err = <-triggered; err != nil {
+			require.ErrorIs(t, err, ErrPoolStopped)
+		}
+	}
+}
@@ -0,0 +1,336 @@
+package schedulex
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"runtime/debug"
+	"sync"
+	"time"
+
+	"github.com/GizmoVault/gotools/base"
+	"github.com/GizmoVault/gotools/base/errorx"
+	"github.com/GizmoVault/gotools/base/logx"
+)
+
+// Run is a fired task handed to an Executor.
+type Run struct {
+	Key string
+	// At is the time the task was scheduled for.
+	At   time.Time
+	Exec TaskFunc
+	// ExecContext replaces Exec if set.
+	ExecContext ContextTaskFunc
+	Params      []any
+}
+
+// newRun fires exec, Exec is set too for the executors that do not know ExecContext.
+func newRun(key string, at time.Time, exec ContextTaskFunc, params []any) *Run {
+	return &Run{
+		Key: key,
+		At:  at,
+		Exec: func(key string, args ...any) {
+			exec(context.Background(), key, args...)
+		},
+		ExecContext: exec,
+		Params:      params,
+	}
+}
+
+// Executor runs the fired tasks of a pool. Execute must not run the task on the calling goroutine, it may block
+// to push back on the pool; the pools call it apart from the goroutine that takes their operations, so a task
+// may still add tasks meanwhile. Stop rejects the runs after it, the accepted ones still run.
+type Executor interface {
+	Execute(run *Run)
+	Stop()
+}
+
+// RunRecorder observes the runs: lateness is how long after its scheduled time a run started, err is
+// errorx.ErrCrashed for a panic and errorx.ErrTimeout for a run past the timeout.
+type RunRecorder interface {
+	ObserveRun(key string, lateness, cost time.Duration, err error)
+}
+
+type ExecutorConfig struct {
+	Logger logx.Wrapper
+	// Timeout bounds a run: a run past it is reported, and the context of a ContextTaskFunc is cancelled. The
+	// run keeps its worker until it returns, a TaskFunc has no context and goes on to its end.
+	Timeout  time.Duration
+	Recorder RunRecorder
+	// Clock measures the lateness and the cost of the runs.
+	Clock base.Clock
+}
+
+// runner runs a task with the panic recovery, the timeout and the recording every executor applies.
+type runner struct {
+	logger   logx.Wrapper
+	timeout  time.Duration
+	recorder RunRecorder
+	clock    base.Clock
+}
+
+//nolint:gocritic // config is copied on purpose
+func newRunner(cfg ExecutorConfig, cls string) runner {
+	if cfg.Logger == nil {
+		cfg.Logger = logx.NewNopLoggerWrapper()
+	}
+
+	return runner{
+		logger:   cfg.Logger.WithFields(logx.StringField(logx.ClsKey, cls)),
+		timeout:  cfg.Timeout,
+		recorder: cfg.Recorder,
+		clock:    base.GetClock(cfg.Clock),
+	}
+}
+
+func (r *runner) run(run *Run) {
+	start := r.clock.Now()
+
+	ctx, cancel := context.WithCancelCause(context.Background())
+
+	if r.timeout > 0 {
+		timer := r.clock.NewTimer(r.timeout)
+
+		go func() {
+			defer timer.Stop()
+
+			select {
+			case <-timer.C():
+				r.logger.WithFields(logx.StringField("key", run.Key)).Warnf("task run past %s, cancel it", r.timeout)
+
+				cancel(errorx.ErrTimeout)
+			case <-ctx.Done():
+			}
+		}()
+	}
+
+	err := r.call(ctx, run)
+	if err == nil && errors.Is(context.Cause(ctx), errorx.ErrTimeout) {
+		err = errorx.ErrTimeout
+	}
+
+	cancel(nil)
+
+	if r.recorder != nil {
+		r.recorder.ObserveRun(run.Key, start.Sub(run.At), r.clock.Now().Sub(start), err)
+	}
+}
+
+func (r *runner) call(ctx context.Context, run *Run) (err error) {
+	defer func() {
+		if p := recover(); p != nil {
+			r.logger.WithFields(logx.StringField("key", run.Key)).Errorf("task panic: %v\n%s", p, debug.Stack())
+
+			err = errorx.ErrCrashed.WithMsg(fmt.Sprintf("task panic: %v", p))
+		}
+	}()
+
+	if run.ExecContext != nil {
+		run.ExecContext(ctx, run.Key, run.Params...)
+	} else {
+		run.Exec(run.Key, run.Params...)
+	}
+
+	return nil
+}
+
+type goExecutor struct {
+	runner
+}
+
+// NewGoExecutor runs every task on a goroutine of its own, without bound.
+//
+//nolint:gocritic // config is copied on purpose
+func NewGoExecutor(cfg ExecutorConfig) Executor {
+	return &goExecutor{
+		runner: newRunner(cfg, "GoExecutor"),
+	}
+}
+
+func (e *goExecutor) Execute(run *Run) {
+	go e.run(run)
+}
+
+func (e *goExecutor) Stop() {}
+
+type poolExecutor struct {
+	runner
+
+	lock    sync.RWMutex
+	stopped bool
+	runs    chan *Run
+}
+
+// NewPoolExecutor runs the tasks on workers goroutines. Up to queueSize runs wait for a worker, then Execute
+// blocks.
+//
+//nolint:gocritic // config is copied on purpose
+func NewPoolExecutor(workers, queueSize int, cfg ExecutorConfig) Executor {
+	e := &poolExecutor{
+		runner: newRunner(cfg, "PoolExecutor"),
+		runs:   make(chan *Run, max(queueSize, 0)),
+	}
+
+	for range max(workers, 1) {
+		go e.work()
+	}
+
+	return e
+}
+
+func (e *poolExecutor) Execute(run *Run) {
+	e.lock.RLock()
+	defer e.lock.RUnlock()
+
+	if e.stopped {
+		e.logger.WithFields(logx.StringField("key", run.Key)).Warn("executor stopped, run dropped")
+
+		return
+	}
+
+	e.runs <- run
+}
+
+// Stop lets the workers exit once they ran the queued tasks.
+func (e *poolExecutor) Stop() {
+	e.lock.Lock()
+	defer e.lock.Unlock()
+
+	if !e.stopped {
+		e.stopped = true
+		close(e.runs)
+	}
+}
+
+func (e *poolExecutor) work() {
+	for run := range e.runs {
+		e.run(run)
+	}
+}
+
+type serialExecutor struct {
+	runner
+
+	lock    sync.Mutex
+	stopped bool
+	// waiting holds the runs of the keys that have one running, in the order they came.
+	waiting map[string][]*Run
+}
+
+// NewSerialExecutor runs the tasks of a key one after another in the order they fired, the keys in parallel.
+// A run past the timeout holds back the next one until it returns, a ContextTaskFunc is told to.
+//
+//nolint:gocritic // config is copied on purpose
+func NewSerialExecutor(cfg ExecutorConfig) Executor {
+	return &serialExecutor{
+		runner:  newRunner(cfg, "SerialExecutor"),
+		waiting: make(map[string][]*Run),
+	}
+}
+
+func (e *serialExecutor) Execute(run *Run) {
+	e.lock.Lock()
+	defer e.lock.Unlock()
+
+	if e.stopped {
+		e.logger.WithFields(logx.StringField("key", run.Key)).Warn("executor stopped, run dropped")
+
+		return
+	}
+
+	if waiting, ok := e.waiting[run.Key]; ok {
+		e.waiting[run.Key] = append(waiting, run)
+
+		return
+	}
+
+	e.waiting[run.Key] = nil
+
+	go e.drain(run)
+}
+
+// drain runs run and then the ones of its key that came meanwhile.
+func (e *serialExecutor) drain(run *Run) {
+	for run != nil {
+		e.run(run)
+
+		e.lock.Lock()
+
+		if waiting := e.waiting[run.Key]; len(waiting) > 0 {
+			e.waiting[run.Key] = waiting[1:]
+			run = waiting[0]
+		} else {
+			delete(e.waiting, run.Key)
+			run = nil
+		}
+
+		e.lock.Unlock()
+	}
+}
+
+// Stop drops the runs after it, the ones already waiting still run.
+func (e *serialExecutor) Stop() {
+	e.lock.Lock()
+	defer e.lock.Unlock()
+
+	e.stopped = true
+}
+
+type KeyRunMetrics struct {
+	Runs     int64
+	Panics   int64
+	Timeouts int64
+
+	TotalLateness time.Duration
+	MaxLateness   time.Duration
+	TotalCost     time.Duration
+	MaxCost       time.Duration
+}
+
+// RunMetrics is an in-memory RunRecorder keeping counters per task key.
+type RunMetrics struct {
+	lock sync.Mutex
+	m    map[string]*KeyRunMetrics
+}
+
+func NewRunMetrics() *RunMetrics {
+	return &RunMetrics{
+		m: make(map[string]*KeyRunMetrics),
+	}
+}
+
+func (rm *RunMetrics) ObserveRun(key string, lateness, cost time.Duration, err error) {
+	rm.lock.Lock()
+	defer rm.lock.Unlock()
+
+	km, ok := rm.m[key]
+	if !ok {
+		km = &KeyRunMetrics{}
+		rm.m[key] = km
+	}
+
+	km.Runs++
+	km.TotalLateness += lateness
+	km.MaxLateness = max(km.MaxLateness, lateness)
+	km.TotalCost += cost
+	km.MaxCost = max(km.MaxCost, cost)
+
+	switch {
+	case errors.Is(err, errorx.ErrCrashed):
+		km.Panics++
+	case errors.Is(err, errorx.ErrTimeout):
+		km.Timeouts++
+	}
+}
+
+func (rm *RunMetrics) Snapshot() map[string]KeyRunMetrics {
+	rm.lock.Lock()
+	defer rm.lock.Unlock()
+
+	m := make(map[string]KeyRunMetrics, len(rm.m))
+	for key, km := range rm.m {
+		m[key] = *km
+	}
+
+	return m
+}
@@ -0,0 +1,220 @@
+package schedulex
+
+import (
+	"context"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/GizmoVault/gotools/base"
+	"github.com/GizmoVault/gotools/base/errorx"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func waitRuns(t *testing.T, metrics *RunMetrics, key string, runs int64) KeyRunMetrics {
+	t.Helper()
+
+	require.Eventually(t, func() bool {
+		return metrics.Snapshot()[key].Runs >= runs
+	}, 5*time.Second, time.Millisecond)
+
+	return metrics.Snapshot()[key]
+}
+
+func TestExecutorRecover(t *testing.T) {
+	clock := base.NewFakeClock(time.Unix(1000, 0))
+	metrics := NewRunMetrics()
+
+	for name, e := range map[string]Executor{
+		"go":     NewGoExecutor(ExecutorConfig{Recorder: metrics, Clock: clock}),
+		"pool":   NewPoolExecutor(1, 1, ExecutorConfig{Recorder: metrics, Clock: clock}),
+		"serial": NewSerialExecutor(ExecutorConfig{Recorder: metrics, Clock: clock}),
+	} {
+		e.Execute(&Run{
+			Key: name,
+			At:  clock.Now().Add(-5 * time.Second),
+			Exec: func(string, ...any) {
+				panic("boom")
+			},
+		})
+
+		km := waitRuns(t, metrics, name, 1)
+		assert.Equal(t, int64(1), km.Panics, name)
+		assert.Equal(t, 5*time.Second, km.MaxLateness, name)
+
+		e.Stop()
+	}
+}
+
+func TestExecutorTimeout(t *testing.T) {
+	metrics := NewRunMetrics()
+	e := NewSerialExecutor(ExecutorConfig{Timeout: 20 * time.Millisecond, Recorder: metrics})
+
+	var cancelled atomic.Bool
+
+	e.Execute(&Run{Key: "slow", At: time.Now(), ExecContext: func(ctx context.Context, _ string, _ ...any) {
+		<-ctx.Done()
+		cancelled.Store(true)
+	}})
+	e.Execute(&Run{Key: "slow", At: time.Now(), Exec: func(string, ...any) {}})
+
+	// the second run goes once the first one gave up
+	km := waitRuns(t, metrics, "slow", 2)
+	assert.True(t, cancelled.Load())
+	assert.Equal(t, int64(1), km.Timeouts)
+	assert.GreaterOrEqual(t, km.MaxCost, 20*time.Millisecond)
+}
+
+func TestPoolExecutorTimeout(t *testing.T) {
+	metrics := NewRunMetrics()
+	e := NewPoolExecutor(1, 1, ExecutorConfig{Timeout: 10 * time.Millisecond, Recorder: metrics})
+
+	defer e.Stop()
+
+	release := make(chan struct{})
+	second := make(chan struct{})
+
+	e.Execute(&Run{Key: "stuck", At: time.Now(), Exec: func(string, ...any) { <-release }})
+	e.Execute(&Run{Key: "next", At: time.Now(), Exec: func(string, ...any) { close(second) }})
+
+	// a TaskFunc past the timeout keeps the only worker until it returns
+	select {
+	case <-second:
+		require.FailNow(t, "run started while the worker was busy")
+	case <-time.After(50 * time.Millisecond):
+	}
+
+	close(release)
+	<-second
+
+	assert.Equal(t, int64(1), waitRuns(t, metrics, "stuck", 1).Timeouts)
+}
+
+func TestSerialExecutor(t *testing.T) {
+	e := NewSerialExecutor(ExecutorConfig{})
+
+	const n = 10
+
+	var (
+		lock    sync.Mutex
+		order   = map[string][]int{}
+		running sync.Map
+		overlap atomic.Int32
+		wg      sync.WaitGroup
+	)
+
+	wg.Add(2 * n)
+
+	for i := range n {
+		for _, key := range []string{"a", "b"} {
+			e.Execute(&Run{Key: key, Exec: func(key string, _ ...any) {
+				defer wg.Done()
+
+				if _, loaded := running.LoadOrStore(key, true); loaded {
+					overlap.Add(1)
+				}
+
+				time.Sleep(time.Millisecond)
+
+				lock.Lock()
+				order[key] = append(order[key], i)
+				lock.Unlock()
+
+				running.Delete(key)
+			}})
+		}
+	}
+
+	wg.Wait()
+
+	assert.Zero(t, overlap.Load())
+	assert.Equal(t, []int{0, 1, 2, 3, 4, 5, 6, 7, 8, 9}, order["a"])
+	assert.Equal(t, order["a"], order["b"])
+
+	e.Stop()
+	e.Execute(&Run{Key: "a", Exec: func(string, ...any) { assert.Fail(t, "run after stop") }})
+}
+
+func Test_HeapTaskPoolExecutor(t *testing.T) {
+	metrics := NewRunMetrics()
+
+	hp := NewHeapTaskPoolWithConfig(HeapConfig{
+		Executor: NewPoolExecutor(1, 4, ExecutorConfig{Recorder: metrics}),
+	})
+	defer hp.Stop()
+
+	fired := make(chan string, 1)
+
+	require.NoError(t, hp.AddTask("panic", time.Now(), func(string, ...any) { panic("boom") }))
+	require.NoError(t, hp.AddTask("ok", time.Now().Add(10*time.Millisecond), func(key string, _ ...any) {
+		fired <- key
+	}))
+
+	assert.Equal(t, "ok", <-fired)
+	assert.Equal(t, int64(1), waitRuns(t, metrics, "panic", 1).Panics)
+}
+
+func Test_HeapTaskPoolBusyExecutor(t *testing.T) {
+	hp := NewHeapTaskPoolWithConfig(HeapConfig{
+		Executor: NewPoolExecutor(1, 0, ExecutorConfig{}),
+	})
+	defer hp.Stop()
+
+	fired := make(chan string, 4)
+
+	// the only worker adds tasks while the executor has no room for their runs
+	require.NoError(t, hp.AddTask("parent", time.Now(), func(key string, _ ...any) {
+		for _, child := range []string{"a", "b"} {
+			require.NoError(t, hp.AddTask(child, time.Now(), func(key string, _ ...any) {
+				fired <- key
+			}))
+		}
+
+		time.Sleep(20 * time.Millisecond)
+
+		fired <- key
+	}))
+
+	got := map[string]bool{}
+
+	for range 3 {
+		select {
+		case key := <-fired:
+			got[key] = true
+		case <-time.After(5 * time.Second):
+			require.FailNow(t, "pool blocked")
+		}
+	}
+
+	assert.Equal(t, map[string]bool{"parent": true, "a": true, "b": true}, got)
+}
+
+func TestContextTask(t *testing.T) {
+	for name, tp := range map[string]ContextTaskPool{
+		"heap": NewHeapTaskPoolWithConfig(HeapConfig{
+			Executor: NewGoExecutor(ExecutorConfig{Timeout: 10 * time.Millisecond}),
+		}),
+		"wheel": NewTimingWheelTaskPool(WheelConfig{
+			Tick:     time.Millisecond,
+			Executor: NewGoExecutor(ExecutorConfig{Timeout: 10 * time.Millisecond}),
+		}),
+	} {
+		cause := make(chan error, 1)
+
+		require.NoError(t, tp.AddContextTask("k", time.Now(), func(ctx context.Context, _ string, _ ...any) {
+			<-ctx.Done()
+			cause <- context.Cause(ctx)
+		}), name)
+
+		select {
+		case err := <-cause:
+			require.ErrorIs(t, err, errorx.ErrTimeout, name)
+		case <-time.After(5 * time.Second):
+			require.FailNow(t, "not cancelled", name)
+		}
+
+		tp.Stop()
+	}
+}
@@ -2,6 +2,8 @@ package schedulex
 
 import (
 	"container/heap"
+	"context"
+	"sort"
 	"sync"
 	"time"
 
@@ -16,23 +18,48 @@ const (
 	taskOpAdd OpType = iota
 	taskOpDel
 	taskOpUpdate
+	taskOpGet
+	taskOpList
+	taskOpLen
+	taskOpNext
 )
 
 type taskOpInfo struct {
-	opType OpType
-	key    string
-	at     time.Time
-	exec   TaskFunc
-	params []interface{}
+	opType   OpType
+	key      string
+	at       time.Time
+	exec     ContextTaskFunc
+	params   []interface{}
+	schedule Schedule
+	result   chan taskOpResult
+}
+
+type taskOpResult struct {
+	err   error
+	tasks []TaskInfo
+	n     int
+	at    time.Time
 }
 
 type taskItem struct {
 	at       time.Time
-	exec     TaskFunc
+	seq      uint64
+	exec     ContextTaskFunc
 	params   []any
 	canceled bool
 	key      string
 	version  string
+	// schedule gives the next fire time of a recurring task, nil for a one-shot one.
+	schedule Schedule
+}
+
+func (t *taskItem) info() TaskInfo {
+	return TaskInfo{
+		Key:       t.key,
+		At:        t.at,
+		Params:    t.params,
+		Recurring: t.schedule != nil,
+	}
 }
 
 type taskHeap []*taskItem
@@ -41,8 +68,13 @@ func (th *taskHeap) Len() int {
 	return len(*th)
 }
 
+// Less orders the tasks by fire time, the ones added first go first when the times are equal.
 func (th *taskHeap) Less(i, j int) bool {
-	return (*th)[i].at.Unix() < (*th)[j].at.Unix()
+	if !(*th)[i].at.Equal((*th)[j].at) {
+		return (*th)[i].at.Before((*th)[j].at)
+	}
+
+	return (*th)[i].seq < (*th)[j].seq
 }
 
 func (th *taskHeap) Swap(i, j int) {
@@ -61,19 +93,72 @@ func (th *taskHeap) Pop() any {
 	return x
 }
 
+const (
+	// FNNowPollInterval is how often a pool with an injected FNNow and no base.Clock looks at it, so that tasks
+	// fire soon after a virtual time moved forward. A pool with a base.Clock waits on the clock timers instead.
+	FNNowPollInterval = 10 * time.Millisecond
+)
+
+// HeapTaskPool keeps its tasks in a heap owned by one goroutine, the other methods hand their operation to it
+// and wait for the result. The fired runs go to the executor from another goroutine, so an executor that pushes
+// back never blocks the heap, and a task may add tasks to its pool whatever the executor.
 type HeapTaskPool struct {
 	sync.WaitGroup
-	fnNow  base.FNNow
-	closed chan bool
-	taskOp chan *taskOpInfo
-	keys   map[string]*taskItem
+	fnNow base.FNNow
+	clock base.Clock
+	// poll is set for an FNNow without a clock, nothing tells the pool when that time moves.
+	poll     bool
+	executor Executor
+	seq      uint64
+	closed   chan bool
+	stopOnce *sync.Once
+	taskOp   chan *taskOpInfo
+	keys     map[string]*taskItem
 
 	tasks *taskHeap
+
+	// fired holds the runs the loop fired until the dispatcher hands them to the executor.
+	firedLock sync.Mutex
+	fired     []*Run
+	firedCh   chan struct{}
+	loopDone  chan struct{}
 }
 
+type HeapConfig struct {
+	// Now replaces the time the tasks compare to. Without a Clock the pool polls it every FNNowPollInterval, with
+	// one it only waits on the clock timers. A base.FakeClock as Clock is the way to go for a virtual time.
+	Now base.FNNow
+	// Clock drives the timers of the pool. See NewHeapTaskPoolWithClock.
+	Clock base.Clock
+	// Executor runs the fired tasks, a NewGoExecutor without logger by default. The pool does not stop it.
+	Executor Executor
+}
+
+// NewHeapTaskPool compares the tasks to now, it polls a non-nil now, see HeapConfig.Now.
 func NewHeapTaskPool(now base.FNNow) *HeapTaskPool {
+	return NewHeapTaskPoolWithConfig(HeapConfig{Now: now})
+}
+
+// NewHeapTaskPoolWithClock waits on the timers of clock, a base.FakeClock fires the tasks as soon as it is
+// advanced past them.
+func NewHeapTaskPoolWithClock(clock base.Clock) *HeapTaskPool {
+	return NewHeapTaskPoolWithConfig(HeapConfig{Clock: clock})
+}
+
+func NewHeapTaskPoolWithConfig(cfg HeapConfig) *HeapTaskPool {
 	pool := &HeapTaskPool{
-		fnNow: now,
+		fnNow:    cfg.Now,
+		clock:    cfg.Clock,
+		poll:     cfg.Now != nil && cfg.Clock == nil,
+		executor: cfg.Executor,
+	}
+
+	if cfg.Now == nil {
+		pool.clock = base.GetClock(cfg.Clock)
+	}
+
+	if pool.executor == nil {
+		pool.executor = NewGoExecutor(ExecutorConfig{Clock: pool.clock})
 	}
 
 	pool.Start()
@@ -85,29 +170,83 @@ func (tp *HeapTaskPool) Start() {
 	tp.Wait()
 
 	tp.closed = make(chan bool)
-	tp.taskOp = make(chan *taskOpInfo, 100)
+	tp.stopOnce = &sync.Once{}
+	tp.taskOp = make(chan *taskOpInfo)
 	tp.keys = make(map[string]*taskItem)
 
 	tp.tasks = &taskHeap{}
 	heap.Init(tp.tasks)
 
-	tp.Add(1)
+	tp.fired = nil
+	tp.firedCh = make(chan struct{}, 1)
+	tp.loopDone = make(chan struct{})
+
+	tp.Add(2)
 
 	go func() {
 		defer tp.Done()
+		defer close(tp.loopDone)
 
 		tp.loop()
 	}()
+
+	go func() {
+		defer tp.Done()
+
+		tp.dispatch()
+	}()
 }
 
+// Stop stops the pool, the operations after it fail with ErrPoolStopped. It may be called more than once.
 func (tp *HeapTaskPool) Stop() {
-	close(tp.closed)
+	tp.stopOnce.Do(func() {
+		close(tp.closed)
+	})
 
 	tp.Wait()
 }
 
-func execTask(key string, exec TaskFunc, params []any) {
-	go exec(key, params...)
+// execute queues the run of t for the dispatcher, it does not block.
+func (tp *HeapTaskPool) execute(t *taskItem) {
+	tp.firedLock.Lock()
+	tp.fired = append(tp.fired, newRun(t.key, t.at, t.exec, t.params))
+	tp.firedLock.Unlock()
+
+	select {
+	case tp.firedCh <- struct{}{}:
+	default:
+	}
+}
+
+// dispatch hands the fired runs to the executor in order, those fired before Stop included.
+func (tp *HeapTaskPool) dispatch() {
+	for {
+		if tp.dispatchFired() {
+			continue
+		}
+
+		select {
+		case <-tp.firedCh:
+		case <-tp.loopDone:
+			tp.dispatchFired()
+
+			return
+		}
+	}
+}
+
+// dispatchFired hands the runs fired so far to the executor, it returns false if there was none.
+func (tp *HeapTaskPool) dispatchFired() bool {
+	tp.firedLock.Lock()
+	runs := tp.fired
+	tp.fired = nil
+	tp.firedLock.Unlock()
+
+	for _, run := range runs {
+		tp.executor.Execute(run)
+	}
+
+	return len(runs) > 0
 }
 
 func (tp *HeapTaskPool) now() time.Time {
@@ -115,24 +254,18 @@ func (tp *HeapTaskPool) now() time.Time {
 		return tp.fnNow()
 	}
 
-	return time.Now()
+	return base.GetClock(tp.clock).Now()
 }
 
 func (tp *HeapTaskPool) process() time.Duration {
 	for {
-		if tp.tasks.Len() <= 0 {
+		t := tp.peek()
+		if t == nil {
 			return 24 * time.Hour
 		}
 
 		timeNow := tp.now()
 
-		t := (*tp.tasks)[0]
-		if t.canceled {
-			heap.Pop(tp.tasks)
-
-			continue
-		}
-
 		if t.at.After(timeNow) {
 			return t.at.Sub(timeNow)
 		}
@@ -142,24 +275,35 @@ func (tp *HeapTaskPool) process() time.Duration {
 		if d, ok := tp.keys[t.key]; ok && d.version == t.version {
 			delete(tp.keys, t.key)
 
-			execTask(t.key, t.exec, t.params)
+			tp.execute(t)
+
+			if t.schedule != nil {
+				if next := t.schedule.Next(timeNow); !next.IsZero() {
+					tp.addOrUpdateTask(next, t.key, t.exec, t.params, t.schedule)
+				}
+			}
 		}
 	}
 }
 
-func (tp *HeapTaskPool) addOrUpdateTask(t time.Time, key string, exec TaskFunc, params []interface{}) {
+func (tp *HeapTaskPool) addOrUpdateTask(t time.Time, key string, exec ContextTaskFunc, params []interface{},
+	schedule Schedule) {
 	if key == "" {
 		key = uuid.NewString()
 	} else {
 		tp.cancelTask(key)
 	}
 
+	tp.seq++
+
 	ti := &taskItem{
-		at:      t,
-		exec:    exec,
-		params:  params,
-		key:     key,
-		version: uuid.NewString(),
+		at:       t,
+		seq:      tp.seq,
+		exec:     exec,
+		params:   params,
+		key:      key,
+		version:  uuid.NewString(),
+		schedule: schedule,
 	}
 
 	tp.keys[key] = ti
@@ -167,59 +311,251 @@ func (tp *HeapTaskPool) addOrUpdateTask(t time.Time, key string, exec TaskFunc,
 	heap.Push(tp.tasks, ti)
 }
 
-func (tp *HeapTaskPool) cancelTask(key string) {
-	if t, ok := tp.keys[key]; ok {
+func (tp *HeapTaskPool) cancelTask(key string) bool {
+	t, ok := tp.keys[key]
+	if ok {
 		t.canceled = true
+		delete(tp.keys, key)
+	}
+
+	return ok
+}
+
+// peek drops the canceled tasks at the top of the heap and returns the next one to fire, nil if there is none.
+func (tp *HeapTaskPool) peek() *taskItem {
+	for tp.tasks.Len() > 0 {
+		if t := (*tp.tasks)[0]; !t.canceled {
+			return t
+		}
+
+		heap.Pop(tp.tasks)
+	}
+
+	return nil
+}
+
+func (tp *HeapTaskPool) handleOp(op *taskOpInfo) (r taskOpResult) {
+	switch op.opType {
+	case taskOpAdd:
+		tp.addOrUpdateTask(op.at, op.key, op.exec, op.params, op.schedule)
+	case taskOpUpdate:
+		t, ok := tp.keys[op.key]
+		if !ok {
+			r.err = errorx.ErrNotExists
+
+			break
+		}
+
+		tp.addOrUpdateTask(op.at, op.key, t.exec, t.params, t.schedule)
+	case taskOpDel:
+		if !tp.cancelTask(op.key) {
+			r.err = errorx.ErrNotExists
+		}
+	case taskOpGet:
+		t, ok := tp.keys[op.key]
+		if !ok {
+			r.err = errorx.ErrNotExists
+
+			break
+		}
+
+		r.tasks = []TaskInfo{t.info()}
+	case taskOpList:
+		r.tasks = make([]TaskInfo, 0, len(tp.keys))
+
+		items := make([]*taskItem, 0, len(tp.keys))
+		for _, t := range tp.keys {
+			items = append(items, t)
+		}
+
+		sort.Slice(items, func(i, j int) bool {
+			return (*taskHeap)(&items).Less(i, j)
+		})
+
+		for _, t := range items {
+			r.tasks = append(r.tasks, t.info())
+		}
+	case taskOpLen:
+		r.n = len(tp.keys)
+	case taskOpNext:
+		t := tp.peek()
+		if t == nil {
+			r.err = errorx.ErrNotExists
+
+			break
+		}
+
+		r.at = t.at
 	}
+
+	return
 }
 
 func (tp *HeapTaskPool) loop() {
-	nextTaskInterval := time.Second
+	// the timer only runs while there are tasks, so a base.FakeClock sees the pool waiting once it has work
+	timer := base.GetClock(tp.clock).NewTimer(time.Hour)
+	timer.Stop()
+
+	defer timer.Stop()
 
 	for {
 		select {
 		case <-tp.closed:
 			return
 		case taskI := <-tp.taskOp:
-			switch taskI.opType {
-			case taskOpAdd, taskOpUpdate:
-				tp.addOrUpdateTask(taskI.at, taskI.key, taskI.exec, taskI.params)
-			case taskOpDel:
-				tp.cancelTask(taskI.key)
-			}
+			taskI.result <- tp.handleOp(taskI)
+		case <-timer.C():
+		}
 
-			nextTaskInterval = tp.process()
-		case <-time.After(nextTaskInterval):
-			nextTaskInterval = tp.process()
+		if d := tp.nextInterval(); tp.tasks.Len() > 0 {
+			timer.Reset(d)
+		} else {
+			timer.Stop()
 		}
 	}
 }
 
+// nextInterval fires the due tasks and returns how long to wait for the next one. The wait is on the clock
+// of the pool, so with an injected FNNow and no clock it is capped to notice the FNNow moving.
+func (tp *HeapTaskPool) nextInterval() time.Duration {
+	d := tp.process()
+
+	if tp.poll {
+		d = min(d, FNNowPollInterval)
+	}
+
+	return d
+}
+
+// do hands op to the loop and waits for its result. An operation the loop took is applied even if ctx ends
+// meanwhile, so the wait for the result ignores ctx; the loop answers without blocking.
+func (tp *HeapTaskPool) do(ctx context.Context, op *taskOpInfo) taskOpResult {
+	op.result = make(chan taskOpResult, 1)
+
+	select {
+	case tp.taskOp <- op:
+	case <-tp.closed:
+		return taskOpResult{err: ErrPoolStopped}
+	case <-ctx.Done():
+		return taskOpResult{err: ctx.Err()}
+	}
+
+	return <-op.result
+}
+
 func (tp *HeapTaskPool) AddTask(key string, t time.Time, exec TaskFunc, params ...interface{}) error {
 	if exec == nil {
 		return errorx.ErrInvalidArgs
 	}
 
-	tp.taskOp <- &taskOpInfo{
+	return tp.AddContextTask(key, t, withoutContext(exec), params...)
+}
+
+// AddContextTask adds a task that is told to give up past the timeout of the executor.
+func (tp *HeapTaskPool) AddContextTask(key string, t time.Time, exec ContextTaskFunc, params ...any) error {
+	if exec == nil {
+		return errorx.ErrInvalidArgs
+	}
+
+	return tp.do(context.Background(), &taskOpInfo{
 		opType: taskOpAdd,
 		key:    key,
 		at:     t,
 		exec:   exec,
 		params: params,
+	}).err
+}
+
+// AddCron fires exec at every time of the cron spec, see ParseCron for the syntax. Adding a task with the key
+// of another one replaces it, RemoveTask cancels the whole series.
+func (tp *HeapTaskPool) AddCron(key, spec string, exec TaskFunc, params ...any) error {
+	schedule, err := ParseCron(spec)
+	if err != nil {
+		return errorx.ErrInvalidArgs.WithCause(err)
 	}
 
-	return nil
+	return tp.AddSchedule(key, schedule, exec, params...)
 }
 
+// AddInterval fires exec every interval plus a random delay of up to jitter, counted from the previous fire.
+func (tp *HeapTaskPool) AddInterval(key string, every, jitter time.Duration, exec TaskFunc, params ...any) error {
+	if every <= 0 || jitter < 0 {
+		return errorx.ErrInvalidArgs
+	}
+
+	return tp.AddSchedule(key, &intervalSchedule{every: every, jitter: jitter}, exec, params...)
+}
+
+// AddSchedule fires exec at every time schedule gives, until it returns the zero time.
+func (tp *HeapTaskPool) AddSchedule(key string, schedule Schedule, exec TaskFunc, params ...any) error {
+	if exec == nil || schedule == nil {
+		return errorx.ErrInvalidArgs
+	}
+
+	at := schedule.Next(tp.now())
+	if at.IsZero() {
+		return errorx.ErrInvalidArgs.WithMsg("schedule never fires")
+	}
+
+	if key == "" {
+		key = uuid.NewString()
+	}
+
+	return tp.do(context.Background(), &taskOpInfo{
+		opType:   taskOpAdd,
+		key:      key,
+		at:       at,
+		exec:     withoutContext(exec),
+		params:   params,
+		schedule: schedule,
+	}).err
+}
+
+// RemoveTask returns errorx.ErrNotExists if no task has key, a one-shot task that already fired included.
 func (tp *HeapTaskPool) RemoveTask(key string) error {
 	if key == "" {
 		return errorx.ErrInvalidArgs
 	}
 
-	tp.taskOp <- &taskOpInfo{
+	return tp.do(context.Background(), &taskOpInfo{
 		opType: taskOpDel,
 		key:    key,
+	}).err
+}
+
+func (tp *HeapTaskPool) Get(ctx context.Context, key string) (TaskInfo, error) {
+	r := tp.do(ctx, &taskOpInfo{opType: taskOpGet, key: key})
+	if r.err != nil {
+		return TaskInfo{}, r.err
 	}
 
-	return nil
+	return r.tasks[0], nil
+}
+
+// List returns the pending tasks in the order they fire.
+func (tp *HeapTaskPool) List(ctx context.Context) ([]TaskInfo, error) {
+	r := tp.do(ctx, &taskOpInfo{opType: taskOpList})
+
+	return r.tasks, r.err
+}
+
+func (tp *HeapTaskPool) Len(ctx context.Context) (int, error) {
+	r := tp.do(ctx, &taskOpInfo{opType: taskOpLen})
+
+	return r.n, r.err
+}
+
+func (tp *HeapTaskPool) NextFireTime(ctx context.Context) (time.Time, error) {
+	r := tp.do(ctx, &taskOpInfo{opType: taskOpNext})
+
+	return r.at, r.err
+}
+
+// Reschedule moves the task of key to t, the next run only for a recurring one.
+func (tp *HeapTaskPool) Reschedule(ctx context.Context, key string, t time.Time) error {
+	if key == "" {
+		return errorx.ErrInvalidArgs
+	}
+
+	return tp.do(ctx, &taskOpInfo{opType: taskOpUpdate, key: key, at: t}).err
 }
@@ -1,11 +1,16 @@
 package schedulex
 
 import (
+	"sync"
 	"testing"
 	"time"
 
 	"container/heap"
+
+	"github.com/GizmoVault/gotools/base"
+	"github.com/GizmoVault/gotools/base/errorx"
 	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
 )
 
 func Test_taskHeap(t *testing.T) {
@@ -63,3 +68,255 @@ func Test_HeapTaskPool(t *testing.T) {
 
 	hp.Stop()
 }
+
+func Test_taskHeapTies(t *testing.T) {
+	h := &taskHeap{}
+	heap.Init(h)
+
+	at := time.Now()
+
+	heap.Push(h, &taskItem{at: at.Add(time.Millisecond), seq: 1, key: "later"})
+	heap.Push(h, &taskItem{at: at, seq: 3, key: "third"})
+	heap.Push(h, &taskItem{at: at, seq: 2, key: "second"})
+
+	var keys []string
+
+	for h.Len() > 0 {
+		keys = append(keys, heap.Pop(h).(*taskItem).key)
+	}
+
+	assert.Equal(t, []string{"second", "third", "later"}, keys)
+}
+
+func Test_HeapTaskPoolFNNow(t *testing.T) {
+	var lock sync.Mutex
+
+	timeNow := time.Unix(1000, 0)
+
+	hp := NewHeapTaskPool(func() time.Time {
+		lock.Lock()
+		defer lock.Unlock()
+
+		return timeNow
+	})
+	defer hp.Stop()
+
+	fired := make(chan string, 1)
+
+	err := hp.AddTask("1", time.Unix(1000, 0).Add(time.Hour), func(key string, _ ...any) {
+		fired <- key
+	})
+	assert.NoError(t, err)
+
+	select {
+	case <-fired:
+		assert.Fail(t, "fired before the clock moved")
+	case <-time.After(50 * time.Millisecond):
+	}
+
+	lock.Lock()
+	timeNow = timeNow.Add(time.Hour)
+	lock.Unlock()
+
+	select {
+	case key := <-fired:
+		assert.Equal(t, "1", key)
+	case <-time.After(time.Second):
+		assert.Fail(t, "not fired after the clock moved")
+	}
+}
+
+func Test_HeapTaskPoolRecurring(t *testing.T) {
+	var lock sync.Mutex
+
+	timeNow := time.Date(2024, 1, 1, 10, 59, 30, 0, time.UTC)
+
+	now := func() time.Time {
+		lock.Lock()
+		defer lock.Unlock()
+
+		return timeNow
+	}
+
+	advance := func(d time.Duration) {
+		lock.Lock()
+		defer lock.Unlock()
+
+		timeNow = timeNow.Add(d)
+	}
+
+	hp := NewHeapTaskPool(now)
+	defer hp.Stop()
+
+	fired := make(chan string, 16)
+
+	exec := func(key string, args ...any) {
+		fired <- key + ":" + args[0].(string)
+	}
+
+	expect := func(want string) {
+		t.Helper()
+
+		select {
+		case got := <-fired:
+			assert.Equal(t, want, got)
+		case <-time.After(time.Second):
+			assert.Fail(t, "not fired", want)
+		}
+	}
+
+	expectNone := func() {
+		t.Helper()
+
+		select {
+		case got := <-fired:
+			assert.Fail(t, "unexpected fire", got)
+		case <-time.After(50 * time.Millisecond):
+		}
+	}
+
+	assert.Error(t, hp.AddCron("bad", "not a spec", exec))
+	assert.Error(t, hp.AddInterval("bad", 0, 0, exec))
+
+	assert.NoError(t, hp.AddCron("hourly", "CRON_TZ=UTC @hourly", exec, "h"))
+	assert.NoError(t, hp.AddInterval("every", 20*time.Second, 0, exec, "e"))
+	expectNone()
+
+	advance(20 * time.Second)
+	expect("every:e")
+
+	advance(10 * time.Second)
+	expect("hourly:h")
+
+	advance(10 * time.Second)
+	expect("every:e")
+
+	assert.NoError(t, hp.RemoveTask("every"))
+	expectNone()
+
+	advance(time.Hour)
+	expect("hourly:h")
+	expectNone()
+}
+
+func Test_HeapTaskPoolClock(t *testing.T) {
+	clock := base.NewFakeClock(time.Unix(1000, 0))
+
+	hp := NewHeapTaskPoolWithClock(clock)
+	defer hp.Stop()
+
+	fired := make(chan string, 2)
+
+	exec := func(key string, _ ...any) {
+		fired <- key
+	}
+
+	// an idle pool has no timer, it waits on one as soon as it has a task
+	assert.NoError(t, hp.AddTask("soon", clock.Now().Add(time.Minute), exec))
+	clock.BlockUntil(1)
+
+	clock.Advance(time.Minute)
+	assert.Equal(t, "soon", <-fired)
+
+	assert.NoError(t, hp.AddTask("late", clock.Now().Add(time.Hour), exec))
+	clock.BlockUntil(1)
+
+	clock.Advance(time.Hour)
+	assert.Equal(t, "late", <-fired)
+}
+
+func Test_HeapTaskPoolPoll(t *testing.T) {
+	clock := base.NewFakeClock(time.Unix(1000, 0))
+
+	// only an FNNow without a clock is polled
+	for _, c := range []struct {
+		cfg  HeapConfig
+		poll bool
+	}{
+		{HeapConfig{}, false},
+		{HeapConfig{Clock: clock}, false},
+		{HeapConfig{Now: clock.Now, Clock: clock}, false},
+		{HeapConfig{Now: clock.Now}, true},
+	} {
+		hp := NewHeapTaskPoolWithConfig(c.cfg)
+		assert.Equal(t, c.poll, hp.poll)
+		hp.Stop()
+	}
+}
+
+// testInspectable checks the introspection of a pool that does not fire before the clock is advanced.
+func testInspectable(t *testing.T, tp InspectableTaskPool, now time.Time) {
+	t.Helper()
+
+	ctx := t.Context()
+	exec := func(string, ...any) {}
+
+	_, err := tp.NextFireTime(ctx)
+	require.ErrorIs(t, err, errorx.ErrNotExists)
+
+	require.NoError(t, tp.AddTask("b", now.Add(2*time.Hour), exec, "pb"))
+	require.NoError(t, tp.AddTask("a", now.Add(time.Hour), exec, "pa"))
+	require.NoError(t, tp.AddTask("c", now.Add(2*time.Hour), exec))
+
+	info, err := tp.Get(ctx, "a")
+	require.NoError(t, err)
+	assert.Equal(t, TaskInfo{Key: "a", At: now.Add(time.Hour), Params: []any{"pa"}}, info)
+
+	_, err = tp.Get(ctx, "x")
+	require.ErrorIs(t, err, errorx.ErrNotExists)
+
+	keys := func() (keys []string) {
+		tasks, err := tp.List(ctx)
+		require.NoError(t, err)
+
+		for _, task := range tasks {
+			keys = append(keys, task.Key)
+		}
+
+		return
+	}
+
+	assert.Equal(t, []string{"a", "b", "c"}, keys())
+
+	n, err := tp.Len(ctx)
+	require.NoError(t, err)
+	assert.Equal(t, 3, n)
+
+	at, err := tp.NextFireTime(ctx)
+	require.NoError(t, err)
+	assert.Equal(t, now.Add(time.Hour), at)
+
+	require.NoError(t, tp.Reschedule(ctx, "a", now.Add(3*time.Hour)))
+	require.ErrorIs(t, tp.Reschedule(ctx, "x", now), errorx.ErrNotExists)
+	assert.Equal(t, []string{"b", "c", "a"}, keys())
+
+	require.NoError(t, tp.RemoveTask("b"))
+	require.ErrorIs(t, tp.RemoveTask("b"), errorx.ErrNotExists)
+
+	at, err = tp.NextFireTime(ctx)
+	require.NoError(t, err)
+	assert.Equal(t, now.Add(2*time.Hour), at)
+
+	n, err = tp.Len(ctx)
+	require.NoError(t, err)
+	assert.Equal(t, 2, n)
+
+	tp.Stop()
+	tp.Stop()
+
+	require.ErrorIs(t, tp.AddTask("d", now, exec), ErrPoolStopped)
+	require.ErrorIs(t, tp.RemoveTask("a"), ErrPoolStopped)
+
+	_, err = tp.Len(ctx)
+	require.ErrorIs(t, err, ErrPoolStopped)
+
+	// a stopped pool is not mistaken for the other logic errors
+	assert.NotErrorIs(t, err, errorx.ErrLogic)
+	assert.NotErrorIs(t, errorx.ErrLogic, ErrPoolStopped)
+}
+
+func Test_HeapTaskPoolInspect(t *testing.T) {
+	clock := base.NewFakeClock(time.Unix(1000, 0))
+
+	testInspectable(t, NewHeapTaskPoolWithClock(clock), clock.Now())
+}
@@ -1,13 +1,28 @@
 package schedulex
 
 import (
+	"context"
+	"errors"
 	"time"
 
 	"github.com/GizmoVault/gotools/base"
 )
 
+// ErrPoolStopped is returned by the operations on a stopped pool.
+var ErrPoolStopped = errors.New("task pool stopped")
+
 type TaskFunc func(key string, args ...any)
 
+// ContextTaskFunc is a TaskFunc told when to give up: its ctx is cancelled once the run passes the timeout of
+// the executor.
+type ContextTaskFunc func(ctx context.Context, key string, args ...any)
+
+func withoutContext(exec TaskFunc) ContextTaskFunc {
+	return func(_ context.Context, key string, args ...any) {
+		exec(key, args...)
+	}
+}
+
 type ScheduleTaskPool interface {
 	AddTask(key string, t time.Time, exec TaskFunc, params ...any) error
 	RemoveTask(key string) error
@@ -15,10 +30,66 @@ type ScheduleTaskPool interface {
 	Stop()
 }
 
+// ContextTaskPool also adds the tasks that take a context.
+type ContextTaskPool interface {
+	ScheduleTaskPool
+
+	AddContextTask(key string, t time.Time, exec ContextTaskFunc, params ...any) error
+}
+
+// RecurringTaskPool also fires tasks repeatedly, RemoveTask cancels the whole series of a key.
+type RecurringTaskPool interface {
+	ScheduleTaskPool
+
+	AddCron(key, spec string, exec TaskFunc, params ...any) error
+	AddInterval(key string, every, jitter time.Duration, exec TaskFunc, params ...any) error
+	AddSchedule(key string, schedule Schedule, exec TaskFunc, params ...any) error
+}
+
+// TaskInfo describes a pending task.
+type TaskInfo struct {
+	Key string
+	// At is the next fire time.
+	At        time.Time
+	Params    []any
+	Recurring bool
+}
+
+// InspectableTaskPool tells what is scheduled. Its methods wait for the pool to apply them, or for ctx, and
+// return errorx.ErrNotExists for unknown keys.
+type InspectableTaskPool interface {
+	ScheduleTaskPool
+
+	Get(ctx context.Context, key string) (TaskInfo, error)
+	// List returns the pending tasks in the order they fire.
+	List(ctx context.Context) ([]TaskInfo, error)
+	Len(ctx context.Context) (int, error)
+	// NextFireTime is the time of the next task to fire, errorx.ErrNotExists if there is none.
+	NextFireTime(ctx context.Context) (time.Time, error)
+	Reschedule(ctx context.Context, key string, t time.Time) error
+}
+
+var (
+	_ RecurringTaskPool   = (*HeapTaskPool)(nil)
+	_ InspectableTaskPool = (*HeapTaskPool)(nil)
+	_ InspectableTaskPool = (*TimingWheelTaskPool)(nil)
+	_ ContextTaskPool     = (*HeapTaskPool)(nil)
+	_ ContextTaskPool     = (*TimingWheelTaskPool)(nil)
+)
+
 func CreateHeapTaskPool() ScheduleTaskPool {
 	return NewHeapTaskPool(nil)
 }
 
+// CreateHeapTaskPoolWithFNNow polls a non-nil now, see HeapConfig.Now.
 func CreateHeapTaskPoolWithFNNow(now base.FNNow) ScheduleTaskPool {
 	return NewHeapTaskPool(now)
 }
+
+func CreateHeapTaskPoolWithClock(clock base.Clock) ScheduleTaskPool {
+	return NewHeapTaskPoolWithClock(clock)
+}
+
+func CreateTimingWheelTaskPool(cfg WheelConfig) ScheduleTaskPool {
+	return NewTimingWheelTaskPool(cfg)
+}
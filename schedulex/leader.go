@@ -0,0 +1,345 @@
+package schedulex
+
+import (
+	"context"
+	"io"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/GizmoVault/gotools/base"
+	"github.com/GizmoVault/gotools/base/logx"
+	"github.com/GizmoVault/gotools/base/syncx"
+)
+
+const (
+	DefaultLeaderTTL           = 5 * time.Second
+	DefaultLeaderRetryInterval = 200 * time.Millisecond
+)
+
+// Leader tells whether this instance leads the ones that share its lease. The token is the fencing token of the
+// term: it grows with every new leader, so a resource that remembers the highest token it saw can reject the
+// writes of a leader that was deposed meanwhile.
+type Leader interface {
+	// Token returns the fencing token of the term this instance leads, false while it does not lead.
+	Token() (uint64, bool)
+	// Stop gives the lease up and stops campaigning. It may be called more than once.
+	Stop()
+}
+
+// Lease is what the instances campaign for, a Leader is the only one that calls it.
+type Lease interface {
+	// Acquire takes the lease for ttl if it is free and returns the fencing token of the new term.
+	Acquire(ctx context.Context, ttl time.Duration) (token uint64, ok bool, err error)
+	// Renew extends the lease by ttl, it reports false if the lease was lost.
+	Renew(ctx context.Context, ttl time.Duration) (bool, error)
+	Release(ctx context.Context) error
+}
+
+type LeaderConfig struct {
+	// TTL is how long a term lasts without renewal. The leader renews it every third of it and steps down once
+	// the TTL passed since the last renewal that succeeded.
+	TTL time.Duration
+	// RetryInterval is how often a follower tries to take the lease, it bounds the failover once the lease is
+	// given up or expired.
+	RetryInterval time.Duration
+	Clock         base.Clock
+}
+
+type leader struct {
+	logger logx.Wrapper
+	lease  Lease
+	ttl    time.Duration
+	retry  time.Duration
+	clock  base.Clock
+
+	lock    sync.Mutex
+	leading bool
+	token   uint64
+	until   time.Time
+
+	ctx      context.Context
+	cancel   context.CancelFunc
+	closed   chan struct{}
+	stopOnce sync.Once
+	wg       sync.WaitGroup
+}
+
+// NewLeader campaigns for lease until it is stopped.
+//
+//nolint:gocritic // config is copied on purpose
+func NewLeader(lease Lease, cfg LeaderConfig, logger logx.Wrapper) Leader {
+	if logger == nil {
+		logger = logx.NewNopLoggerWrapper()
+	}
+
+	if cfg.TTL <= 0 {
+		cfg.TTL = DefaultLeaderTTL
+	}
+
+	if cfg.RetryInterval <= 0 {
+		cfg.RetryInterval = DefaultLeaderRetryInterval
+	}
+
+	l := &leader{
+		logger: logger.WithFields(logx.StringField(logx.ClsKey, "Leader")),
+		lease:  lease,
+		ttl:    cfg.TTL,
+		retry:  cfg.RetryInterval,
+		clock:  base.GetClock(cfg.Clock),
+		closed: make(chan struct{}),
+	}
+
+	l.ctx, l.cancel = context.WithCancel(context.Background())
+
+	l.wg.Add(1)
+
+	go func() {
+		defer l.wg.Done()
+
+		l.loop()
+	}()
+
+	return l
+}
+
+func (l *leader) Token() (uint64, bool) {
+	l.lock.Lock()
+	defer l.lock.Unlock()
+
+	if !l.leading || !l.clock.Now().Before(l.until) {
+		return 0, false
+	}
+
+	return l.token, true
+}
+
+func (l *leader) Stop() {
+	l.stopOnce.Do(func() {
+		close(l.closed)
+		l.cancel()
+		l.wg.Wait()
+
+		l.lock.Lock()
+		leading := l.leading
+		l.leading = false
+		l.lock.Unlock()
+
+		if !leading {
+			return
+		}
+
+		ctx, cancel := context.WithTimeout(context.Background(), l.ttl)
+		defer cancel()
+
+		if err := l.lease.Release(ctx); err != nil {
+			l.logger.WithFields(logx.ErrorField(err)).Error("release lease failed")
+		}
+	})
+}
+
+func (l *leader) loop() {
+	timer := l.clock.NewTimer(time.Hour)
+	timer.Stop()
+
+	defer timer.Stop()
+
+	for {
+		timer.Reset(l.campaign())
+
+		select {
+		case <-l.closed:
+			return
+		case <-timer.C():
+		}
+	}
+}
+
+// campaign renews the lease of the leader or tries to take it, and returns when to do it again.
+func (l *leader) campaign() time.Duration {
+	start := l.clock.Now()
+
+	ctx, cancel := context.WithTimeout(l.ctx, l.ttl/3)
+	defer cancel()
+
+	l.lock.Lock()
+	leading, until := l.leading, l.until
+	l.lock.Unlock()
+
+	if leading {
+		ok, err := l.lease.Renew(ctx, l.ttl)
+
+		switch {
+		case err == nil && ok:
+			l.setTerm(true, 0, start.Add(l.ttl))
+
+			return l.ttl / 3
+		case err != nil && start.Before(until):
+			// the lease may still be ours, the term holds until it expires
+			l.logger.WithFields(logx.ErrorField(err)).Warn("renew lease failed")
+
+			return l.retry
+		}
+
+		l.logger.WithFields(logx.ErrorField(err)).Warn("lease lost, step down")
+		l.setTerm(false, 0, time.Time{})
+	}
+
+	token, ok, err := l.lease.Acquire(ctx, l.ttl)
+	if err != nil {
+		l.logger.WithFields(logx.ErrorField(err)).Warn("acquire lease failed")
+
+		return l.retry
+	}
+
+	if !ok {
+		return l.retry
+	}
+
+	l.logger.Infof("lead with token %d", token)
+	l.setTerm(true, token, start.Add(l.ttl))
+
+	return l.ttl / 3
+}
+
+// setTerm records the term, a zero token keeps the current one.
+func (l *leader) setTerm(leading bool, token uint64, until time.Time) {
+	l.lock.Lock()
+	defer l.lock.Unlock()
+
+	l.leading = leading
+	l.until = until
+
+	if token != 0 {
+		l.token = token
+	}
+}
+
+// FileLease is a Lease on a lock file, for the instances of a single host. The lock goes with the process that
+// holds it, so a follower takes over within a retry interval of the leader dying. The file keeps the last
+// fencing token.
+type FileLease struct {
+	fileName string
+	f        *os.File
+	locked   bool
+}
+
+func NewFileLease(fileName string) *FileLease {
+	return &FileLease{
+		fileName: fileName,
+	}
+}
+
+func (fl *FileLease) Acquire(context.Context, time.Duration) (token uint64, ok bool, err error) {
+	if fl.f == nil {
+		if fl.f, err = os.OpenFile(fl.fileName, os.O_RDWR|os.O_CREATE, 0o600); err != nil {
+			return
+		}
+	}
+
+	if ok, err = syncx.TryLockFile(fl.f); !ok || err != nil {
+		return
+	}
+
+	defer func() {
+		if err != nil {
+			ok = false
+			_ = syncx.UnlockFile(fl.f)
+		}
+	}()
+
+	if _, err = fl.f.Seek(0, io.SeekStart); err != nil {
+		return
+	}
+
+	d, err := io.ReadAll(fl.f)
+	if err != nil {
+		return
+	}
+
+	if s := strings.TrimSpace(string(d)); s != "" {
+		if token, err = strconv.ParseUint(s, 10, 64); err != nil {
+			return
+		}
+	}
+
+	token++
+
+	if err = fl.f.Truncate(0); err != nil {
+		return
+	}
+
+	if _, err = fl.f.WriteAt([]byte(strconv.FormatUint(token, 10)), 0); err != nil {
+		return
+	}
+
+	if err = fl.f.Sync(); err != nil {
+		return
+	}
+
+	fl.locked = true
+
+	return
+}
+
+// Renew reports whether the lock is still held, it does not expire.
+func (fl *FileLease) Renew(context.Context, time.Duration) (bool, error) {
+	return fl.locked, nil
+}
+
+func (fl *FileLease) Release(context.Context) error {
+	if fl.f == nil {
+		return nil
+	}
+
+	fl.locked = false
+
+	err := syncx.UnlockFile(fl.f)
+	_ = fl.f.Close()
+	fl.f = nil
+
+	return err
+}
+
+// FencedTaskFunc gets the fencing token of the term it runs in, to hand to the resources it writes.
+type FencedTaskFunc func(token uint64, key string, args ...any)
+
+// Fenced runs fn only while leader leads.
+func Fenced(leader Leader, fn FencedTaskFunc) TaskFunc {
+	return func(key string, args ...any) {
+		if token, ok := leader.Token(); ok {
+			fn(token, key, args...)
+		}
+	}
+}
+
+type leaderExecutor struct {
+	leader Leader
+	next   Executor
+}
+
+// NewLeaderExecutor hands the runs to next while leader leads and drops them otherwise, so that of the replicas
+// that schedule the same tasks only the leader fires them.
+//
+// A replica cannot tell a follower from a replica during a failover, so the runs due while no replica leads are
+// dropped by all of them: after the leader died that lasts up to the TTL and a retry interval, after it gave the
+// lease up up to a retry interval. Tasks that must not miss a run should catch up on what is due when they run
+// next, rather than count on every run to fire.
+func NewLeaderExecutor(leader Leader, next Executor) Executor {
+	return &leaderExecutor{
+		leader: leader,
+		next:   next,
+	}
+}
+
+func (e *leaderExecutor) Execute(run *Run) {
+	if _, ok := e.leader.Token(); ok {
+		e.next.Execute(run)
+	}
+}
+
+func (e *leaderExecutor) Stop() {
+	e.next.Stop()
+}
@@ -0,0 +1,93 @@
+package schedulex
+
+import (
+	"path/filepath"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/GizmoVault/gotools/base"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestFileLeader(t *testing.T) {
+	fileName := filepath.Join(t.TempDir(), "leader.lock")
+	clock := base.NewFakeClock(time.Unix(1000, 0))
+	cfg := LeaderConfig{TTL: time.Second, RetryInterval: 10 * time.Millisecond, Clock: clock}
+
+	a := NewLeader(NewFileLease(fileName), cfg, nil)
+	defer a.Stop()
+
+	clock.BlockUntil(1)
+
+	token, ok := a.Token()
+	require.True(t, ok)
+	assert.Equal(t, uint64(1), token)
+
+	b := NewLeader(NewFileLease(fileName), cfg, nil)
+	defer b.Stop()
+
+	clock.BlockUntil(2)
+
+	_, ok = b.Token()
+	assert.False(t, ok)
+
+	a.Stop()
+	a.Stop()
+
+	_, ok = a.Token()
+	assert.False(t, ok)
+
+	// b takes the lock on its next try, the token survives in the file
+	clock.Advance(cfg.RetryInterval)
+	clock.BlockUntil(1)
+
+	token, ok = b.Token()
+	require.True(t, ok)
+	assert.Equal(t, uint64(2), token)
+}
+
+type utLeader struct {
+	token atomic.Uint64
+}
+
+func (l *utLeader) Token() (uint64, bool) {
+	token := l.token.Load()
+
+	return token, token > 0
+}
+
+func (l *utLeader) Stop() {}
+
+type utExecutor struct{}
+
+func (utExecutor) Execute(run *Run) {
+	run.Exec(run.Key, run.Params...)
+}
+
+func (utExecutor) Stop() {}
+
+func TestLeaderExecutor(t *testing.T) {
+	leader := &utLeader{}
+	e := NewLeaderExecutor(leader, utExecutor{})
+
+	defer e.Stop()
+
+	var fired []uint64
+
+	run := &Run{
+		Key: "fenced",
+		Exec: Fenced(leader, func(token uint64, _ string, _ ...any) {
+			fired = append(fired, token)
+		}),
+	}
+
+	// a follower drops the run
+	e.Execute(run)
+	assert.Empty(t, fired)
+
+	leader.token.Store(3)
+	e.Execute(run)
+	assert.Equal(t, []uint64{3}, fired)
+}
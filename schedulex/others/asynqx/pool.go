@@ -0,0 +1,95 @@
+package asynqx
+
+import (
+	"errors"
+	"time"
+
+	"github.com/GizmoVault/gotools/base/errorx"
+	"github.com/GizmoVault/gotools/base/logx"
+	"github.com/GizmoVault/gotools/schedulex"
+	"github.com/hibiken/asynq"
+)
+
+type PayloadPoolConfig struct {
+	QueueName     string
+	ClearAllTasks bool
+	// CheckInterval is how often asynq moves the due tasks to the pending ones, it bounds how late a task fires.
+	// asynq checks every 5 seconds if it is zero.
+	CheckInterval time.Duration
+}
+
+// PayloadTaskPool is a schedulex.PayloadTaskPool kept in redis. The key of a task is its asynq task ID as well
+// as its type. asynq schedules in whole seconds, a task fires at the first second from its time on.
+type PayloadTaskPool struct {
+	st *ScheduleTask
+}
+
+var _ schedulex.PayloadTaskPool = (*PayloadTaskPool)(nil)
+
+//nolint:gocritic // follow asynq
+func NewPayloadTaskPool(opt asynq.RedisClientOpt, cfg PayloadPoolConfig, callback schedulex.PayloadFunc,
+	logger logx.Wrapper) (*PayloadTaskPool, error) {
+	if callback == nil {
+		return nil, errorx.ErrInvalidArgs
+	}
+
+	st, err := newScheduleTask(opt, cfg.QueueName, cfg.CheckInterval, func(_, key string, payload []byte) string {
+		callback(key, payload)
+
+		return ""
+	}, cfg.ClearAllTasks, logger)
+	if err != nil {
+		return nil, err
+	}
+
+	return &PayloadTaskPool{
+		st: st,
+	}, nil
+}
+
+// AddTask replaces the task of key. It fails while that task runs, asynq does not delete active tasks.
+func (tp *PayloadTaskPool) AddTask(key string, t time.Time, payload []byte) error {
+	if key == "" {
+		return errorx.ErrInvalidArgs
+	}
+
+	err := tp.enqueue(key, t, payload)
+	if !errors.Is(err, asynq.ErrTaskIDConflict) {
+		return err
+	}
+
+	if err = tp.st.RemoveTask(key); err != nil && !errors.Is(err, asynq.ErrTaskNotFound) {
+		return errorx.ErrConflict.WithCause(err)
+	}
+
+	return tp.enqueue(key, t, payload)
+}
+
+func (tp *PayloadTaskPool) enqueue(key string, t time.Time, payload []byte) error {
+	// asynq keeps the process time in whole seconds and drops the fraction, round it up not to fire early
+	if s := t.Truncate(time.Second); !s.Equal(t) {
+		t = s.Add(time.Second)
+	}
+
+	_, err := tp.st.client.Enqueue(asynq.NewTask(key, payload), asynq.Queue(tp.st.queueName), asynq.ProcessAt(t),
+		asynq.TaskID(key))
+
+	return err
+}
+
+func (tp *PayloadTaskPool) RemoveTask(key string) error {
+	if key == "" {
+		return errorx.ErrInvalidArgs
+	}
+
+	err := tp.st.RemoveTask(key)
+	if errors.Is(err, asynq.ErrTaskNotFound) || errors.Is(err, asynq.ErrQueueNotFound) {
+		return errorx.ErrNotExists
+	}
+
+	return err
+}
+
+func (tp *PayloadTaskPool) Stop() {
+	tp.st.Stop()
+}
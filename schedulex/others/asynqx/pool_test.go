@@ -0,0 +1,31 @@
+package asynqx
+
+import (
+	"testing"
+	"time"
+
+	"github.com/GizmoVault/gotools/schedulex"
+	"github.com/GizmoVault/gotools/schedulex/schedulextest"
+	"github.com/alicebob/miniredis/v2"
+	"github.com/hibiken/asynq"
+	"github.com/stretchr/testify/require"
+)
+
+func TestPayloadTaskPoolConformance(t *testing.T) {
+	const checkInterval = 100 * time.Millisecond
+
+	schedulextest.RunConformance(t, schedulextest.Factory{
+		New: func(t *testing.T, name string, callback schedulex.PayloadFunc) schedulex.PayloadTaskPool {
+			tp, err := NewPayloadTaskPool(asynq.RedisClientOpt{Addr: miniredis.RunT(t).Addr()}, PayloadPoolConfig{
+				QueueName:     name,
+				CheckInterval: checkInterval,
+			}, callback, nil)
+			require.NoError(t, err)
+
+			return tp
+		},
+		// the time is rounded up to a second, the forwarder moves the due tasks, then the processor polls the
+		// pending ones every second
+		Precision: checkInterval + 2*time.Second,
+	})
+}
@@ -16,6 +16,14 @@ type TaskFunc func(id, key string, payload []byte) string
 //nolint:gocritic // follow asynq
 func NewScheduleTaskPool(opt asynq.RedisClientOpt, queueName string, callback TaskFunc, clearAllTasks bool,
 	logger logx.Wrapper) (st *ScheduleTask, err error) {
+	return newScheduleTask(opt, queueName, 0, callback, clearAllTasks, logger)
+}
+
+// newScheduleTask moves the due tasks to the pending ones every checkInterval, asynq's default if it is zero.
+//
+//nolint:gocritic // follow asynq
+func newScheduleTask(opt asynq.RedisClientOpt, queueName string, checkInterval time.Duration, callback TaskFunc,
+	clearAllTasks bool, logger logx.Wrapper) (st *ScheduleTask, err error) {
 	if logger == nil {
 		logger = logx.NewNopLoggerWrapper()
 	}
@@ -35,6 +43,7 @@ func NewScheduleTaskPool(opt asynq.RedisClientOpt, queueName string, callback Ta
 			Queues: map[string]int{
 				queueName: 1,
 			},
+			DelayedTaskCheckInterval: checkInterval,
 		}),
 		client:    asynq.NewClient(opt),
 		inspector: asynq.NewInspector(opt),
@@ -100,21 +109,29 @@ func (impl *ScheduleTask) AddTask(key string, t time.Time, payload []byte) (id s
 	return
 }
 
-func (impl *ScheduleTask) RemoveTaskByKey(key string) {
+// RemoveTaskByKey deletes the pending, scheduled and retry tasks of key. It stops at the first list error, and
+// returns it or the first delete error.
+func (impl *ScheduleTask) RemoveTaskByKey(key string) error {
 	methods := []func(queue string, opts ...asynq.ListOption) ([]*asynq.TaskInfo, error){
 		impl.inspector.ListPendingTasks,
 		impl.inspector.ListScheduledTasks,
 		impl.inspector.ListRetryTasks,
 	}
 
+	// list everything before deleting, deleting while paging would shift the pages
+	var ids []string
+
 	for _, method := range methods {
-		page := 1
-		for {
+		for page := 1; ; page++ {
 			tasks, err := method(impl.queueName, asynq.Page(page), asynq.PageSize(100))
+			if errors.Is(err, asynq.ErrQueueNotFound) {
+				break
+			}
+
 			if err != nil {
 				impl.logger.WithFields(logx.ErrorField(err)).Error("fetch task list failed")
 
-				continue
+				return err
 			}
 
 			if len(tasks) == 0 {
@@ -123,16 +140,25 @@ func (impl *ScheduleTask) RemoveTaskByKey(key string) {
 
 			for _, task := range tasks {
 				if task.Type == key {
-					err = impl.inspector.DeleteTask(impl.queueName, task.ID)
-					if err != nil {
-						impl.logger.WithFields(logx.ErrorField(err)).Error("delete task failed")
-					}
+					ids = append(ids, task.ID)
 				}
 			}
+		}
+	}
+
+	var firstErr error
 
-			page++
+	for _, id := range ids {
+		if err := impl.inspector.DeleteTask(impl.queueName, id); err != nil && !errors.Is(err, asynq.ErrTaskNotFound) {
+			impl.logger.WithFields(logx.StringField("id", id), logx.ErrorField(err)).Error("delete task failed")
+
+			if firstErr == nil {
+				firstErr = err
+			}
 		}
 	}
+
+	return firstErr
 }
 
 func (impl *ScheduleTask) RemoveTask(id string) error {
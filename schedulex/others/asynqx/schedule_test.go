@@ -54,7 +54,7 @@ func TestSchedule(t *testing.T) {
 	err = s.RemoveTask(id21)
 	require.NoError(t, err)
 
-	s.RemoveTaskByKey("task3")
+	require.NoError(t, s.RemoveTaskByKey("task3"))
 
 	time.Sleep(time.Second * 20)
 }
@@ -0,0 +1,80 @@
+// Package redisx keeps schedulex state in redis.
+package redisx
+
+import (
+	"context"
+	"time"
+
+	"github.com/GizmoVault/gotools/base/errorx"
+	"github.com/GizmoVault/gotools/schedulex"
+	"github.com/google/uuid"
+	"github.com/redis/go-redis/v9"
+)
+
+// acquireScript takes the lease with SET NX PX and counts the terms in a second key, the fencing token.
+var acquireScript = redis.NewScript(`
+if redis.call('SET', KEYS[1], ARGV[1], 'NX', 'PX', ARGV[2]) then
+	return redis.call('INCR', KEYS[2])
+end
+return 0
+`)
+
+var renewScript = redis.NewScript(`
+if redis.call('GET', KEYS[1]) == ARGV[1] then
+	return redis.call('PEXPIRE', KEYS[1], ARGV[2])
+end
+return 0
+`)
+
+var releaseScript = redis.NewScript(`
+if redis.call('GET', KEYS[1]) == ARGV[1] then
+	return redis.call('DEL', KEYS[1])
+end
+return 0
+`)
+
+// Lease is a schedulex.Lease on a redis key that expires unless the leader renews it. A follower takes over
+// within a retry interval of the leader giving it up, or of the TTL once the leader died.
+type Lease struct {
+	client redis.UniversalClient
+	key    string
+	id     string
+}
+
+var _ schedulex.Lease = (*Lease)(nil)
+
+// NewLease campaigns for key, the fencing token is kept in key + ":token".
+func NewLease(client redis.UniversalClient, key string) (*Lease, error) {
+	if client == nil || key == "" {
+		return nil, errorx.ErrInvalidArgs
+	}
+
+	return &Lease{
+		client: client,
+		key:    key,
+		id:     uuid.NewString(),
+	}, nil
+}
+
+func (l *Lease) Acquire(ctx context.Context, ttl time.Duration) (uint64, bool, error) {
+	token, err := acquireScript.Run(ctx, l.client, []string{l.key, l.key + ":token"}, l.id,
+		ttl.Milliseconds()).Uint64()
+	if err != nil {
+		return 0, false, err
+	}
+
+	return token, token > 0, nil
+}
+
+func (l *Lease) Renew(ctx context.Context, ttl time.Duration) (bool, error) {
+	n, err := renewScript.Run(ctx, l.client, []string{l.key}, l.id, ttl.Milliseconds()).Int()
+	if err != nil {
+		return false, err
+	}
+
+	return n == 1, nil
+}
+
+func (l *Lease) Release(ctx context.Context) error {
+	return releaseScript.Run(ctx, l.client, []string{l.key}, l.id).Err()
+}
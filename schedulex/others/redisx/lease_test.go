@@ -0,0 +1,94 @@
+package redisx
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/GizmoVault/gotools/base"
+	"github.com/GizmoVault/gotools/schedulex"
+	"github.com/alicebob/miniredis/v2"
+	"github.com/redis/go-redis/v9"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// crashedLease does not give the lease up, as a leader that dies.
+type crashedLease struct {
+	*Lease
+}
+
+func (crashedLease) Release(context.Context) error {
+	return nil
+}
+
+func TestLease(t *testing.T) {
+	mr := miniredis.RunT(t)
+	clock := base.NewFakeClock(time.Unix(1000, 0))
+
+	cfg := schedulex.LeaderConfig{TTL: time.Second, RetryInterval: 10 * time.Millisecond, Clock: clock}
+
+	newLeader := func(crash bool) schedulex.Leader {
+		client := redis.NewClient(&redis.Options{Addr: mr.Addr()})
+		t.Cleanup(func() { _ = client.Close() })
+
+		lease, err := NewLease(client, "ut:leader")
+		require.NoError(t, err)
+
+		var l schedulex.Leader
+		if crash {
+			l = schedulex.NewLeader(crashedLease{lease}, cfg, nil)
+		} else {
+			l = schedulex.NewLeader(lease, cfg, nil)
+		}
+
+		t.Cleanup(l.Stop)
+
+		return l
+	}
+
+	requireToken := func(l schedulex.Leader, token uint64) {
+		got, ok := l.Token()
+		require.True(t, ok)
+		assert.Equal(t, token, got)
+	}
+
+	a := newLeader(false)
+	clock.BlockUntil(1)
+	requireToken(a, 1)
+
+	b := newLeader(true)
+	clock.BlockUntil(2)
+
+	_, ok := b.Token()
+	assert.False(t, ok)
+
+	// a gives the lease up, b takes it over on its next try
+	a.Stop()
+	clock.Advance(cfg.RetryInterval)
+	clock.BlockUntil(1)
+	requireToken(b, 2)
+
+	// b dies, c takes over once the lease expired
+	b.Stop()
+
+	c := newLeader(false)
+	clock.BlockUntil(1)
+
+	_, ok = c.Token()
+	assert.False(t, ok)
+
+	mr.FastForward(cfg.TTL)
+	clock.Advance(cfg.RetryInterval)
+	clock.BlockUntil(1)
+	requireToken(c, 3)
+
+	// c loses its key, it steps down when it fails to renew it and starts a new term
+	mr.Del("ut:leader")
+	clock.Advance(cfg.TTL / 3)
+	clock.BlockUntil(1)
+	requireToken(c, 4)
+
+	_, err := NewLease(nil, "key")
+	require.Error(t, err)
+}
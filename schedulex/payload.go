@@ -0,0 +1,56 @@
+package schedulex
+
+import (
+	"time"
+
+	"github.com/GizmoVault/gotools/base/errorx"
+)
+
+// PayloadFunc runs a task of a PayloadTaskPool.
+type PayloadFunc func(key string, payload []byte)
+
+// PayloadTaskPool schedules tasks whose payload is serialized, so a pool may keep them out of the process, in
+// redis for example. The pool gets its callback when it is created. A key names one task: adding it again
+// replaces the task, and RemoveTask returns errorx.ErrNotExists once it fired.
+type PayloadTaskPool interface {
+	AddTask(key string, t time.Time, payload []byte) error
+	RemoveTask(key string) error
+
+	Stop()
+}
+
+type payloadTaskPool struct {
+	pool     ScheduleTaskPool
+	callback PayloadFunc
+}
+
+// NewPayloadTaskPool runs the payload tasks on pool, which it stops with them.
+func NewPayloadTaskPool(pool ScheduleTaskPool, callback PayloadFunc) PayloadTaskPool {
+	return &payloadTaskPool{
+		pool:     pool,
+		callback: callback,
+	}
+}
+
+func (tp *payloadTaskPool) AddTask(key string, t time.Time, payload []byte) error {
+	if key == "" || tp.callback == nil {
+		return errorx.ErrInvalidArgs
+	}
+
+	// the task keeps its own copy, as a pool that serializes it would
+	return tp.pool.AddTask(key, t, tp.fire, append([]byte(nil), payload...))
+}
+
+func (tp *payloadTaskPool) RemoveTask(key string) error {
+	return tp.pool.RemoveTask(key)
+}
+
+func (tp *payloadTaskPool) Stop() {
+	tp.pool.Stop()
+}
+
+func (tp *payloadTaskPool) fire(key string, params ...any) {
+	payload, _ := params[0].([]byte)
+
+	tp.callback(key, payload)
+}
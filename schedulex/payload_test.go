@@ -0,0 +1,65 @@
+package schedulex_test
+
+import (
+	"encoding/base64"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/GizmoVault/gotools/schedulex"
+	"github.com/GizmoVault/gotools/schedulex/schedulextest"
+	"github.com/stretchr/testify/require"
+)
+
+func TestPayloadTaskPoolConformance(t *testing.T) {
+	t.Run("Heap", func(t *testing.T) {
+		schedulextest.RunConformance(t, schedulextest.Factory{
+			New: func(_ *testing.T, _ string, callback schedulex.PayloadFunc) schedulex.PayloadTaskPool {
+				return schedulex.NewPayloadTaskPool(schedulex.CreateHeapTaskPool(), callback)
+			},
+		})
+	})
+
+	t.Run("Wheel", func(t *testing.T) {
+		schedulextest.RunConformance(t, schedulextest.Factory{
+			New: func(_ *testing.T, _ string, callback schedulex.PayloadFunc) schedulex.PayloadTaskPool {
+				return schedulex.NewPayloadTaskPool(schedulex.CreateTimingWheelTaskPool(schedulex.WheelConfig{
+					Tick: time.Millisecond,
+				}), callback)
+			},
+			Precision: time.Millisecond,
+		})
+	})
+	t.Run("Persistent", func(t *testing.T) {
+		schedulextest.RunConformance(t, schedulextest.Factory{
+			New: func(t *testing.T, name string, callback schedulex.PayloadFunc) schedulex.PayloadTaskPool {
+				t.Helper()
+
+				tp, err := schedulex.NewPersistentTaskPool(filepath.Join(t.TempDir(), name+".dat"),
+					schedulex.PersistentConfig{
+						Callbacks: map[string]schedulex.TaskFunc{
+							// the payload comes back from the file as base64
+							"payload": func(key string, params ...any) {
+								encoded, _ := params[0].(string)
+								payload, _ := base64.StdEncoding.DecodeString(encoded)
+
+								callback(key, payload)
+							},
+						},
+					}, nil)
+				require.NoError(t, err)
+
+				return &persistentPayloadPool{PersistentTaskPool: tp}
+			},
+		})
+	})
+}
+
+// persistentPayloadPool stores the payloads as the params of a registered callback.
+type persistentPayloadPool struct {
+	*schedulex.PersistentTaskPool
+}
+
+func (tp *persistentPayloadPool) AddTask(key string, t time.Time, payload []byte) error {
+	return tp.PersistentTaskPool.AddTask(key, t, "payload", payload)
+}
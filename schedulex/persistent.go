@@ -0,0 +1,441 @@
+package schedulex
+
+import (
+	"errors"
+	"sync"
+	"time"
+
+	"github.com/GizmoVault/gotools/base"
+	"github.com/GizmoVault/gotools/base/errorx"
+	"github.com/GizmoVault/gotools/base/logx"
+	"github.com/GizmoVault/gotools/base/syncx"
+	"github.com/GizmoVault/gotools/storagex"
+)
+
+// MisfirePolicy decides what happens to the runs that were due while the pool was not running.
+type MisfirePolicy int
+
+const (
+	// MisfireFireNow fires every missed run at once, a series catches up on all its runs.
+	MisfireFireNow MisfirePolicy = iota
+	// MisfireSkip drops the missed runs, a series goes on with its next run.
+	MisfireSkip
+	// MisfireFireOnce fires a task once however many runs it missed.
+	MisfireFireOnce
+)
+
+const (
+	// MaxCatchUpRuns bounds how many missed runs of a series MisfireFireNow fires.
+	MaxCatchUpRuns = 1000
+)
+
+type PersistentConfig struct {
+	// Clock drives the timers, Now only replaces the time they compare to. See NewHeapTaskPoolWithClock.
+	Clock   base.Clock
+	Now     base.FNNow
+	Misfire MisfirePolicy
+	// Executor runs the callbacks, see HeapConfig.
+	Executor Executor
+	// Callbacks maps the callback names stored with the tasks to the functions they run. Tasks whose callback
+	// is not registered stay in the file and are scheduled once it is.
+	Callbacks map[string]TaskFunc
+}
+
+type persistentTask struct {
+	Key string
+	// At is the next fire time in Unix nanoseconds.
+	At       int64
+	Callback string
+	Params   []byte
+
+	// Spec is the cron spec of a series, Every and Jitter the interval of one.
+	Spec   string
+	Every  time.Duration
+	Jitter time.Duration
+}
+
+func (pt *persistentTask) schedule() (Schedule, error) {
+	switch {
+	case pt.Spec != "":
+		return ParseCron(pt.Spec)
+	case pt.Every > 0:
+		return &intervalSchedule{every: pt.Every, jitter: pt.Jitter}, nil
+	default:
+		return nil, nil
+	}
+}
+
+// PersistentTaskPool keeps its tasks in a file, so they survive a restart. A task names a registered callback
+// instead of holding a function, and its params are stored serialized: callbacks always get them back after a
+// round trip through the serial, before and after a restart alike. A run is removed from the file before its
+// callback is called, so a crash loses it rather than firing it twice.
+type PersistentTaskPool struct {
+	logger logx.Wrapper
+	cfg    PersistentConfig
+	serial storagex.Serial
+	stg    *storagex.MemWithFile[map[string]*persistentTask, storagex.Serial, syncx.RWLocker]
+	pool   *HeapTaskPool
+
+	lock      sync.RWMutex
+	callbacks map[string]TaskFunc
+}
+
+//nolint:gocritic // config is copied on purpose
+func NewPersistentTaskPool(fileName string, cfg PersistentConfig, logger logx.Wrapper) (*PersistentTaskPool, error) {
+	if logger == nil {
+		logger = logx.NewNopLoggerWrapper()
+	}
+
+	tp := &PersistentTaskPool{
+		logger:    logger.WithFields(logx.StringField(logx.ClsKey, "PersistentTaskPool")),
+		cfg:       cfg,
+		serial:    &storagex.JSONSerial{},
+		callbacks: make(map[string]TaskFunc),
+	}
+
+	for name, exec := range cfg.Callbacks {
+		tp.callbacks[name] = exec
+	}
+
+	var err error
+
+	tp.stg, err = storagex.NewMemWithFile[map[string]*persistentTask, storagex.Serial, syncx.RWLocker](
+		make(map[string]*persistentTask), tp.serial, &sync.RWMutex{}, fileName, nil)
+	if err != nil {
+		return nil, err
+	}
+
+	tp.pool = NewHeapTaskPoolWithConfig(HeapConfig{
+		Now:      cfg.Now,
+		Clock:    cfg.Clock,
+		Executor: cfg.Executor,
+	})
+
+	tp.reschedule("")
+
+	return tp, nil
+}
+
+func (tp *PersistentTaskPool) now() time.Time {
+	return tp.pool.now()
+}
+
+// Register adds a callback and schedules the loaded tasks that were waiting for it.
+func (tp *PersistentTaskPool) Register(name string, exec TaskFunc) {
+	if name == "" || exec == nil {
+		return
+	}
+
+	tp.lock.Lock()
+	tp.callbacks[name] = exec
+	tp.lock.Unlock()
+
+	tp.reschedule(name)
+}
+
+func (tp *PersistentTaskPool) callback(name string) TaskFunc {
+	tp.lock.RLock()
+	defer tp.lock.RUnlock()
+
+	return tp.callbacks[name]
+}
+
+// AddTask fires the callback registered as callback at t, with params serialized.
+func (tp *PersistentTaskPool) AddTask(key string, t time.Time, callback string, params ...any) error {
+	return tp.add(&persistentTask{Key: key, At: t.UnixNano(), Callback: callback}, params)
+}
+
+// AddCron fires the callback at every time of the cron spec, see ParseCron for the syntax.
+func (tp *PersistentTaskPool) AddCron(key, spec, callback string, params ...any) error {
+	return tp.add(&persistentTask{Key: key, Callback: callback, Spec: spec}, params)
+}
+
+// AddInterval fires the callback every interval plus a random delay of up to jitter.
+func (tp *PersistentTaskPool) AddInterval(key string, every, jitter time.Duration, callback string,
+	params ...any) error {
+	if every <= 0 || jitter < 0 {
+		return errorx.ErrInvalidArgs
+	}
+
+	return tp.add(&persistentTask{Key: key, Callback: callback, Every: every, Jitter: jitter}, params)
+}
+
+func (tp *PersistentTaskPool) add(task *persistentTask, params []any) error {
+	if task.Key == "" || tp.callback(task.Callback) == nil {
+		return errorx.ErrInvalidArgs
+	}
+
+	schedule, err := task.schedule()
+	if err != nil {
+		return errorx.ErrInvalidArgs.WithCause(err)
+	}
+
+	if schedule != nil {
+		at := schedule.Next(tp.now())
+		if at.IsZero() {
+			return errorx.ErrInvalidArgs.WithMsg("schedule never fires")
+		}
+
+		task.At = at.UnixNano()
+	}
+
+	if len(params) > 0 {
+		if task.Params, err = tp.serial.Marshal(params); err != nil {
+			return errorx.ErrInvalidArgs.WithCause(err)
+		}
+	}
+
+	err = tp.stg.Change(func(m map[string]*persistentTask) (map[string]*persistentTask, error) {
+		m[task.Key] = task
+
+		return m, nil
+	})
+	if err != nil {
+		return err
+	}
+
+	return tp.pool.AddTask(task.Key, time.Unix(0, task.At), tp.fire)
+}
+
+// RemoveTask removes the task of key, or the whole series. It returns errorx.ErrNotExists if there is none, a
+// one-shot task is gone once it fired.
+func (tp *PersistentTaskPool) RemoveTask(key string) error {
+	if key == "" {
+		return errorx.ErrInvalidArgs
+	}
+
+	err := tp.stg.Change(func(m map[string]*persistentTask) (map[string]*persistentTask, error) {
+		if _, ok := m[key]; !ok {
+			return m, errorx.ErrNotExists
+		}
+
+		delete(m, key)
+
+		return m, nil
+	})
+	if err != nil {
+		return err
+	}
+
+	// the task has no timer while its callback is not registered or it fires
+	if err = tp.pool.RemoveTask(key); err != nil && !errors.Is(err, errorx.ErrNotExists) {
+		return err
+	}
+
+	return nil
+}
+
+func (tp *PersistentTaskPool) Stop() {
+	tp.pool.Stop()
+}
+
+// reschedule applies the misfire policy to the stored tasks of callback, all of them if it is empty, and adds
+// them to the timers.
+func (tp *PersistentTaskPool) reschedule(callback string) {
+	var tasks []*persistentTask
+
+	tp.stg.Read(func(m map[string]*persistentTask) {
+		for _, task := range m {
+			if callback == "" || task.Callback == callback {
+				tasks = append(tasks, task)
+			}
+		}
+	})
+
+	timeNow := tp.now()
+
+	for _, task := range tasks {
+		exec := tp.callback(task.Callback)
+		if exec == nil {
+			tp.logger.WithFields(logx.StringField("key", task.Key), logx.StringField("callback", task.Callback)).
+				Warn("callback not registered, task not scheduled")
+
+			continue
+		}
+
+		if time.Unix(0, task.At).After(timeNow) {
+			tp.addTimer(task.Key, time.Unix(0, task.At))
+
+			continue
+		}
+
+		tp.misfire(task, exec, timeNow)
+	}
+}
+
+func (tp *PersistentTaskPool) misfire(task *persistentTask, exec TaskFunc, timeNow time.Time) {
+	logger := tp.logger.WithFields(logx.StringField("key", task.Key))
+
+	schedule, err := task.schedule()
+	if err != nil {
+		logger.WithFields(logx.ErrorField(err)).Error("invalid schedule")
+
+		return
+	}
+
+	if schedule == nil {
+		if tp.cfg.Misfire == MisfireSkip {
+			logger.Info("misfired task skipped")
+
+			_ = tp.RemoveTask(task.Key)
+
+			return
+		}
+
+		tp.addTimer(task.Key, timeNow)
+
+		return
+	}
+
+	// the times of the missed runs, the first MaxCatchUpRuns of them
+	var missedAt []time.Time
+
+	missed := 0
+
+	next := time.Unix(0, task.At)
+	for !next.After(timeNow) && !next.IsZero() {
+		if missed < MaxCatchUpRuns {
+			missedAt = append(missedAt, next)
+		}
+
+		missed++
+		next = schedule.Next(next)
+	}
+
+	var runs int
+
+	switch tp.cfg.Misfire {
+	case MisfireSkip:
+		runs = 0
+	case MisfireFireOnce:
+		runs = 1
+	default:
+		runs = len(missedAt)
+	}
+
+	logger.Infof("series missed %d runs, fire %d of them", missed, runs)
+
+	if next.IsZero() {
+		_ = tp.RemoveTask(task.Key)
+	} else if !tp.moveTask(task.Key, task.At, next) {
+		return
+	}
+
+	params := tp.params(task)
+
+	for _, at := range missedAt[:runs] {
+		tp.pool.executor.Execute(&Run{
+			Key:    task.Key,
+			At:     at,
+			Exec:   exec,
+			Params: params,
+		})
+	}
+
+	if !next.IsZero() {
+		tp.addTimer(task.Key, next)
+	}
+}
+
+func (tp *PersistentTaskPool) addTimer(key string, at time.Time) {
+	if err := tp.pool.AddTask(key, at, tp.fire); err != nil {
+		tp.logger.WithFields(logx.StringField("key", key), logx.ErrorField(err)).Error("add timer failed")
+	}
+}
+
+// moveTask sets the next fire time of a series if it still fires at from, it reports whether it did.
+func (tp *PersistentTaskPool) moveTask(key string, from int64, next time.Time) (moved bool) {
+	err := tp.stg.Change(func(m map[string]*persistentTask) (map[string]*persistentTask, error) {
+		task, ok := m[key]
+		if !ok || task.At != from {
+			return m, errorx.NoErrSkip
+		}
+
+		newTask := *task
+		newTask.At = next.UnixNano()
+		m[key] = &newTask
+		moved = true
+
+		return m, nil
+	})
+	if err != nil {
+		tp.logger.WithFields(logx.StringField("key", key), logx.ErrorField(err)).Error("save task failed")
+	}
+
+	return
+}
+
+func (tp *PersistentTaskPool) params(task *persistentTask) (params []any) {
+	if len(task.Params) == 0 {
+		return nil
+	}
+
+	if err := tp.serial.Unmarshal(task.Params, &params); err != nil {
+		tp.logger.WithFields(logx.StringField("key", task.Key), logx.ErrorField(err)).Error("decode params failed")
+	}
+
+	return
+}
+
+// fire runs a due task, a one-shot task is removed and a series moves to its next run before the callback.
+func (tp *PersistentTaskPool) fire(key string, _ ...any) {
+	var task *persistentTask
+
+	tp.stg.Read(func(m map[string]*persistentTask) {
+		task = m[key]
+	})
+
+	timeNow := tp.now()
+
+	// the task was removed or replaced by one due later, which has its own timer
+	if task == nil || time.Unix(0, task.At).After(timeNow) {
+		return
+	}
+
+	exec := tp.callback(task.Callback)
+	if exec == nil {
+		return
+	}
+
+	schedule, err := task.schedule()
+	if err != nil {
+		tp.logger.WithFields(logx.StringField("key", key), logx.ErrorField(err)).Error("invalid schedule")
+
+		return
+	}
+
+	var next time.Time
+	if schedule != nil {
+		next = schedule.Next(timeNow)
+	}
+
+	if next.IsZero() {
+		removed := false
+
+		err = tp.stg.Change(func(m map[string]*persistentTask) (map[string]*persistentTask, error) {
+			if m[key] != task {
+				return m, errorx.NoErrSkip
+			}
+
+			delete(m, key)
+			removed = true
+
+			return m, nil
+		})
+		if err != nil {
+			tp.logger.WithFields(logx.StringField("key", key), logx.ErrorField(err)).Error("remove task failed")
+		}
+
+		if !removed {
+			return
+		}
+	} else {
+		if !tp.moveTask(key, task.At, next) {
+			return
+		}
+
+		tp.addTimer(key, next)
+	}
+
+	exec(key, tp.params(task)...)
+}
@@ -0,0 +1,159 @@
+package schedulex
+
+import (
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/GizmoVault/gotools/base/errorx"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestPersistentTaskPool(t *testing.T) {
+	for _, c := range []struct {
+		name     string
+		misfire  MisfirePolicy
+		series   int
+		oneShots int
+	}{
+		{name: "fire now", misfire: MisfireFireNow, series: 3, oneShots: 1},
+		{name: "fire once", misfire: MisfireFireOnce, series: 1, oneShots: 1},
+		{name: "skip", misfire: MisfireSkip},
+	} {
+		t.Run(c.name, func(t *testing.T) {
+			fileName := filepath.Join(t.TempDir(), "ut_timers.dat")
+
+			var lock sync.Mutex
+
+			timeNow := time.Unix(1000, 0)
+
+			now := func() time.Time {
+				lock.Lock()
+				defer lock.Unlock()
+
+				return timeNow
+			}
+
+			advance := func(d time.Duration) {
+				lock.Lock()
+				defer lock.Unlock()
+
+				timeNow = timeNow.Add(d)
+			}
+
+			fired := make(chan []any, 16)
+
+			callbacks := map[string]TaskFunc{
+				"record": func(key string, args ...any) {
+					fired <- append([]any{key}, args...)
+				},
+			}
+
+			count := func() map[string]int {
+				counts := map[string]int{}
+
+				for {
+					select {
+					case args := <-fired:
+						counts[args[0].(string)]++
+					case <-time.After(100 * time.Millisecond):
+						return counts
+					}
+				}
+			}
+
+			tp, err := NewPersistentTaskPool(fileName, PersistentConfig{Now: now, Callbacks: callbacks}, nil)
+			require.NoError(t, err)
+
+			require.Error(t, tp.AddTask("unknown", now(), "missing"))
+			require.Error(t, tp.AddCron("bad", "not a spec", "record"))
+
+			require.NoError(t, tp.AddTask("params", now().Add(time.Minute), "record", "a", 1))
+			require.NoError(t, tp.AddTask("once", now().Add(5*time.Minute), "record"))
+			require.NoError(t, tp.AddInterval("series", 10*time.Minute, 0, "record"))
+
+			advance(time.Minute)
+
+			select {
+			case args := <-fired:
+				assert.Equal(t, []any{"params", "a", float64(1)}, args)
+			case <-time.After(time.Second):
+				require.FailNow(t, "task not fired")
+			}
+
+			tp.Stop()
+
+			// the pool is down while once and three runs of series are due
+			advance(34 * time.Minute)
+
+			tp, err = NewPersistentTaskPool(fileName, PersistentConfig{Now: now, Misfire: c.misfire}, nil)
+			require.NoError(t, err)
+
+			defer tp.Stop()
+
+			assert.Empty(t, count())
+
+			tp.Register("record", callbacks["record"])
+
+			counts := count()
+			assert.Equal(t, c.series, counts["series"])
+			assert.Equal(t, c.oneShots, counts["once"])
+
+			advance(5 * time.Minute)
+			assert.Equal(t, map[string]int{"series": 1}, count())
+
+			require.NoError(t, tp.RemoveTask("series"))
+
+			advance(10 * time.Minute)
+			assert.Empty(t, count())
+		})
+	}
+}
+
+type runRecorder struct {
+	runs chan *Run
+}
+
+func (e *runRecorder) Execute(run *Run) {
+	e.runs <- run
+}
+
+func (*runRecorder) Stop() {}
+
+func TestPersistentTaskPoolMisfireAt(t *testing.T) {
+	fileName := filepath.Join(t.TempDir(), "ut_misfire.dat")
+	timeNow := time.Unix(1000, 0)
+
+	now := func() time.Time {
+		return timeNow
+	}
+
+	callbacks := map[string]TaskFunc{
+		"noop": func(string, ...any) {},
+	}
+
+	tp, err := NewPersistentTaskPool(fileName, PersistentConfig{Now: now, Callbacks: callbacks}, nil)
+	require.NoError(t, err)
+	require.NoError(t, tp.AddInterval("series", 10*time.Minute, 0, "noop"))
+	tp.Stop()
+
+	timeNow = timeNow.Add(34 * time.Minute)
+
+	executor := &runRecorder{runs: make(chan *Run, 16)}
+
+	tp, err = NewPersistentTaskPool(fileName, PersistentConfig{Now: now, Executor: executor, Callbacks: callbacks}, nil)
+	require.NoError(t, err)
+
+	defer tp.Stop()
+
+	// every catch-up run carries the time it missed
+	for _, at := range []int64{1600, 2200, 2800} {
+		run := <-executor.runs
+		assert.Equal(t, time.Unix(at, 0), run.At)
+	}
+
+	require.NoError(t, tp.RemoveTask("series"))
+	require.ErrorIs(t, tp.RemoveTask("series"), errorx.ErrNotExists)
+}
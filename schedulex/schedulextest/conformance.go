@@ -0,0 +1,154 @@
+// Package schedulextest checks that a schedulex.PayloadTaskPool implementation behaves like the others.
+package schedulextest
+
+import (
+	"testing"
+	"time"
+
+	"github.com/GizmoVault/gotools/base/errorx"
+	"github.com/GizmoVault/gotools/schedulex"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+const (
+	// WaitTimeout is how long the suite waits for a task to fire.
+	WaitTimeout = 10 * time.Second
+)
+
+// Factory creates the pools of the backend under test.
+type Factory struct {
+	// New creates a pool that calls callback, every subtest uses its own name.
+	New func(t *testing.T, name string, callback schedulex.PayloadFunc) schedulex.PayloadTaskPool
+	// Precision is how late the backend may fire a task, the suite waits that much longer to tell that a task
+	// did not fire.
+	Precision time.Duration
+}
+
+// RunConformance runs the behaviour every backend shares as subtests of t: fire times and payloads, replacing
+// and removing tasks by key, and Stop.
+//
+//nolint:gocritic // factory is a small value
+func RunConformance(t *testing.T, factory Factory) {
+	t.Helper()
+
+	t.Run("Fire", func(t *testing.T) { testFire(t, &factory) })
+	t.Run("Replace", func(t *testing.T) { testReplace(t, &factory) })
+	t.Run("Remove", func(t *testing.T) { testRemove(t, &factory) })
+	t.Run("Stop", func(t *testing.T) { testStop(t, &factory) })
+}
+
+type fired struct {
+	key     string
+	payload string
+	at      time.Time
+}
+
+func open(t *testing.T, factory *Factory, name string) (schedulex.PayloadTaskPool, <-chan fired) {
+	t.Helper()
+
+	got := make(chan fired, 16)
+
+	tp := factory.New(t, name, func(key string, payload []byte) {
+		got <- fired{key: key, payload: string(payload), at: time.Now()}
+	})
+	require.NotNil(t, tp)
+
+	t.Cleanup(tp.Stop)
+
+	return tp, got
+}
+
+func receive(t *testing.T, got <-chan fired) (f fired) {
+	t.Helper()
+
+	select {
+	case f = <-got:
+	case <-time.After(WaitTimeout):
+		require.FailNow(t, "timeout waiting for the pool")
+	}
+
+	return
+}
+
+// assertQuiet checks that nothing more fires for a while.
+func assertQuiet(t *testing.T, factory *Factory, got <-chan fired) {
+	t.Helper()
+
+	select {
+	case f := <-got:
+		assert.Fail(t, "unexpected task", "%v", f)
+	case <-time.After(factory.Precision + 500*time.Millisecond):
+	}
+}
+
+func testFire(t *testing.T, factory *Factory) {
+	tp, got := open(t, factory, "fire")
+
+	start := time.Now()
+
+	payload := []byte("later")
+	require.NoError(t, tp.AddTask("fire:later", start.Add(time.Second), payload))
+	require.NoError(t, tp.AddTask("fire:now", start, []byte("now")))
+
+	// the pool keeps what it was given
+	copy(payload, "xxxxx")
+
+	f := receive(t, got)
+	assert.Equal(t, "fire:now", f.key)
+	assert.Equal(t, "now", f.payload)
+
+	f = receive(t, got)
+	assert.Equal(t, "fire:later", f.key)
+	assert.Equal(t, "later", f.payload)
+	assert.GreaterOrEqual(t, f.at.Sub(start), time.Second)
+
+	require.Error(t, tp.AddTask("", start, nil))
+}
+
+func testReplace(t *testing.T, factory *Factory) {
+	tp, got := open(t, factory, "replace")
+
+	at := time.Now().Add(300 * time.Millisecond)
+
+	require.NoError(t, tp.AddTask("replace", at, []byte("old")))
+	require.NoError(t, tp.AddTask("replace", at.Add(200*time.Millisecond), []byte("new")))
+
+	f := receive(t, got)
+	assert.Equal(t, "replace", f.key)
+	assert.Equal(t, "new", f.payload)
+
+	assertQuiet(t, factory, got)
+
+	// a key that fired may be used again
+	require.NoError(t, tp.AddTask("replace", time.Now(), []byte("again")))
+	assert.Equal(t, "again", receive(t, got).payload)
+}
+
+func testRemove(t *testing.T, factory *Factory) {
+	tp, got := open(t, factory, "remove")
+
+	at := time.Now().Add(300 * time.Millisecond)
+
+	require.NoError(t, tp.AddTask("remove:gone", at, []byte("gone")))
+	require.NoError(t, tp.AddTask("remove:kept", at, []byte("kept")))
+	require.NoError(t, tp.RemoveTask("remove:gone"))
+
+	require.ErrorIs(t, tp.RemoveTask("remove:gone"), errorx.ErrNotExists)
+	require.ErrorIs(t, tp.RemoveTask("remove:unknown"), errorx.ErrNotExists)
+
+	assert.Equal(t, "remove:kept", receive(t, got).key)
+	assertQuiet(t, factory, got)
+
+	require.ErrorIs(t, tp.RemoveTask("remove:kept"), errorx.ErrNotExists)
+}
+
+func testStop(t *testing.T, factory *Factory) {
+	tp, got := open(t, factory, "stop")
+
+	require.NoError(t, tp.AddTask("stop", time.Now().Add(300*time.Millisecond), []byte("stop")))
+
+	tp.Stop()
+
+	assertQuiet(t, factory, got)
+}
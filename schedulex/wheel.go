@@ -0,0 +1,529 @@
+package schedulex
+
+import (
+	"context"
+	"math"
+	"math/bits"
+	"runtime"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/GizmoVault/gotools/base"
+	"github.com/GizmoVault/gotools/base/errorx"
+	"github.com/google/uuid"
+)
+
+const (
+	DefaultWheelTick      = 10 * time.Millisecond
+	DefaultWheelSlots     = 256
+	DefaultWheelLevels    = 4
+	DefaultWheelQueueSize = 1024
+)
+
+type WheelConfig struct {
+	// Tick is the resolution of the wheel: a task fires on the first tick at or after its time.
+	Tick time.Duration
+	// Slots is the number of slots of a level, rounded up to a power of two. The wheel holds Tick*Slots^Levels
+	// ahead, tasks further away go round the top level until they get close.
+	Slots  int
+	Levels int
+	// Workers run the fired tasks, runtime.NumCPU() of them by default. QueueSize fired tasks wait for a worker,
+	// past that the wheel waits too.
+	Workers   int
+	QueueSize int
+	Clock     base.Clock
+	// Executor replaces the workers, the pool does not stop it.
+	Executor Executor
+}
+
+type wheelTask struct {
+	key string
+	at  time.Time
+	seq uint64
+	// exp is the tick the task fires at.
+	exp    int64
+	exec   ContextTaskFunc
+	params []any
+
+	bucket     *wheelBucket
+	prev, next *wheelTask
+}
+
+func (t *wheelTask) info() TaskInfo {
+	return TaskInfo{
+		Key:    t.key,
+		At:     t.at,
+		Params: t.params,
+	}
+}
+
+// wheelBucket is a slot of the wheel, a doubly linked list so that a task leaves it in O(1).
+type wheelBucket struct {
+	head, tail *wheelTask
+}
+
+func (b *wheelBucket) push(t *wheelTask) {
+	t.bucket = b
+	t.prev = b.tail
+	t.next = nil
+
+	if b.tail != nil {
+		b.tail.next = t
+	} else {
+		b.head = t
+	}
+
+	b.tail = t
+}
+
+func (b *wheelBucket) remove(t *wheelTask) {
+	if t.prev != nil {
+		t.prev.next = t.next
+	} else {
+		b.head = t.next
+	}
+
+	if t.next != nil {
+		t.next.prev = t.prev
+	} else {
+		b.tail = t.prev
+	}
+
+	t.bucket, t.prev, t.next = nil, nil, nil
+}
+
+// take empties the bucket and returns its tasks, still linked by next.
+func (b *wheelBucket) take() *wheelTask {
+	head := b.head
+	b.head, b.tail = nil, nil
+
+	return head
+}
+
+// TimingWheelTaskPool is a hashed hierarchical timing wheel: adding and removing a task is O(1) whatever the
+// number of tasks, at the cost of firing on Tick boundaries. Fired tasks run on a bounded set of workers instead
+// of a goroutine each, it suits many short timeouts that are mostly removed before they fire.
+type TimingWheelTaskPool struct {
+	clock base.Clock
+	tick  int64
+	bits  int
+	mask  int64
+
+	lock sync.Mutex
+	// current is the last tick the wheel processed, next the tick its timer waits for, math.MaxInt64 if none.
+	current int64
+	next    int64
+	seq     uint64
+	levels  [][]wheelBucket
+	keys    map[string]*wheelTask
+
+	executor Executor
+	// ownExecutor is true for the workers the pool started, it stops them.
+	ownExecutor bool
+
+	wake     chan struct{}
+	closed   chan struct{}
+	stopOnce sync.Once
+	wg       sync.WaitGroup
+}
+
+func NewTimingWheelTaskPool(cfg WheelConfig) *TimingWheelTaskPool {
+	if cfg.Tick <= 0 {
+		cfg.Tick = DefaultWheelTick
+	}
+
+	if cfg.Slots <= 0 {
+		cfg.Slots = DefaultWheelSlots
+	}
+
+	if cfg.Levels <= 0 {
+		cfg.Levels = DefaultWheelLevels
+	}
+
+	if cfg.Workers <= 0 {
+		cfg.Workers = runtime.NumCPU()
+	}
+
+	if cfg.QueueSize <= 0 {
+		cfg.QueueSize = DefaultWheelQueueSize
+	}
+
+	slotBits := max(bits.Len(uint(cfg.Slots-1)), 1)
+
+	tp := &TimingWheelTaskPool{
+		clock:  base.GetClock(cfg.Clock),
+		tick:   int64(cfg.Tick),
+		bits:   slotBits,
+		mask:   int64(1)<<slotBits - 1,
+		next:   math.MaxInt64,
+		levels: make([][]wheelBucket, cfg.Levels),
+		keys:   make(map[string]*wheelTask),
+		wake:   make(chan struct{}, 1),
+		closed: make(chan struct{}),
+	}
+
+	tp.executor = cfg.Executor
+	if tp.executor == nil {
+		tp.executor = NewPoolExecutor(cfg.Workers, cfg.QueueSize, ExecutorConfig{Clock: tp.clock})
+		tp.ownExecutor = true
+	}
+
+	for i := range tp.levels {
+		tp.levels[i] = make([]wheelBucket, 1<<slotBits)
+	}
+
+	tp.current = tp.clock.Now().UnixNano() / tp.tick
+
+	tp.wg.Add(1)
+
+	go func() {
+		defer tp.wg.Done()
+
+		tp.loop()
+	}()
+
+	return tp
+}
+
+// Stop stops the wheel, the tasks already fired still run and the workers exit once they are done.
+func (tp *TimingWheelTaskPool) Stop() {
+	tp.stopOnce.Do(func() {
+		close(tp.closed)
+		tp.wg.Wait()
+
+		if tp.ownExecutor {
+			tp.executor.Stop()
+		}
+	})
+}
+
+func (tp *TimingWheelTaskPool) AddTask(key string, t time.Time, exec TaskFunc, params ...any) error {
+	if exec == nil {
+		return errorx.ErrInvalidArgs
+	}
+
+	return tp.AddContextTask(key, t, withoutContext(exec), params...)
+}
+
+// AddContextTask adds a task that is told to give up past the timeout of the executor.
+func (tp *TimingWheelTaskPool) AddContextTask(key string, t time.Time, exec ContextTaskFunc, params ...any) error {
+	if exec == nil {
+		return errorx.ErrInvalidArgs
+	}
+
+	if key == "" {
+		key = uuid.NewString()
+	}
+
+	tp.lock.Lock()
+	defer tp.lock.Unlock()
+
+	if tp.stopped() {
+		return ErrPoolStopped
+	}
+
+	if old, ok := tp.keys[key]; ok {
+		old.bucket.remove(old)
+		delete(tp.keys, key)
+	}
+
+	tp.schedule(&wheelTask{
+		key:    key,
+		exec:   exec,
+		params: params,
+	}, t)
+
+	return nil
+}
+
+// RemoveTask returns errorx.ErrNotExists if no task has key, a task that already fired included.
+func (tp *TimingWheelTaskPool) RemoveTask(key string) error {
+	if key == "" {
+		return errorx.ErrInvalidArgs
+	}
+
+	tp.lock.Lock()
+	defer tp.lock.Unlock()
+
+	if tp.stopped() {
+		return ErrPoolStopped
+	}
+
+	task, ok := tp.keys[key]
+	if !ok {
+		return errorx.ErrNotExists
+	}
+
+	task.bucket.remove(task)
+	delete(tp.keys, key)
+
+	return nil
+}
+
+func (tp *TimingWheelTaskPool) Get(ctx context.Context, key string) (TaskInfo, error) {
+	tp.lock.Lock()
+	defer tp.lock.Unlock()
+
+	if err := tp.check(ctx); err != nil {
+		return TaskInfo{}, err
+	}
+
+	task, ok := tp.keys[key]
+	if !ok {
+		return TaskInfo{}, errorx.ErrNotExists
+	}
+
+	return task.info(), nil
+}
+
+// List returns the pending tasks in the order they fire, it sorts them all.
+func (tp *TimingWheelTaskPool) List(ctx context.Context) ([]TaskInfo, error) {
+	tp.lock.Lock()
+	defer tp.lock.Unlock()
+
+	if err := tp.check(ctx); err != nil {
+		return nil, err
+	}
+
+	tasks := make([]*wheelTask, 0, len(tp.keys))
+	for _, task := range tp.keys {
+		tasks = append(tasks, task)
+	}
+
+	sort.Slice(tasks, func(i, j int) bool {
+		if !tasks[i].at.Equal(tasks[j].at) {
+			return tasks[i].at.Before(tasks[j].at)
+		}
+
+		return tasks[i].seq < tasks[j].seq
+	})
+
+	infos := make([]TaskInfo, 0, len(tasks))
+	for _, task := range tasks {
+		infos = append(infos, task.info())
+	}
+
+	return infos, nil
+}
+
+func (tp *TimingWheelTaskPool) Len(ctx context.Context) (int, error) {
+	tp.lock.Lock()
+	defer tp.lock.Unlock()
+
+	if err := tp.check(ctx); err != nil {
+		return 0, err
+	}
+
+	return len(tp.keys), nil
+}
+
+// NextFireTime scans all the tasks, the wheel does not keep them in order.
+func (tp *TimingWheelTaskPool) NextFireTime(ctx context.Context) (time.Time, error) {
+	tp.lock.Lock()
+	defer tp.lock.Unlock()
+
+	if err := tp.check(ctx); err != nil {
+		return time.Time{}, err
+	}
+
+	var next *wheelTask
+
+	for _, task := range tp.keys {
+		if next == nil || task.at.Before(next.at) {
+			next = task
+		}
+	}
+
+	if next == nil {
+		return time.Time{}, errorx.ErrNotExists
+	}
+
+	return next.at, nil
+}
+
+func (tp *TimingWheelTaskPool) Reschedule(ctx context.Context, key string, t time.Time) error {
+	if key == "" {
+		return errorx.ErrInvalidArgs
+	}
+
+	tp.lock.Lock()
+	defer tp.lock.Unlock()
+
+	if err := tp.check(ctx); err != nil {
+		return err
+	}
+
+	task, ok := tp.keys[key]
+	if !ok {
+		return errorx.ErrNotExists
+	}
+
+	task.bucket.remove(task)
+	delete(tp.keys, key)
+
+	tp.schedule(task, t)
+
+	return nil
+}
+
+func (tp *TimingWheelTaskPool) stopped() bool {
+	select {
+	case <-tp.closed:
+		return true
+	default:
+		return false
+	}
+}
+
+func (tp *TimingWheelTaskPool) check(ctx context.Context) error {
+	if tp.stopped() {
+		return ErrPoolStopped
+	}
+
+	return ctx.Err()
+}
+
+// schedule places task to fire at t and wakes the loop if it fires before the tick the loop waits for.
+func (tp *TimingWheelTaskPool) schedule(task *wheelTask, t time.Time) {
+	// an idle wheel does not tick, catch up with the time before placing the task
+	if len(tp.keys) == 0 {
+		tp.current = max(tp.current, tp.clock.Now().UnixNano()/tp.tick)
+	}
+
+	tp.seq++
+
+	task.at = t
+	task.seq = tp.seq
+	// round up, a task never fires before its time
+	task.exp = max((t.UnixNano()+tp.tick-1)/tp.tick, tp.current+1)
+
+	tp.keys[task.key] = task
+	tp.place(task)
+
+	if task.exp < tp.next {
+		select {
+		case tp.wake <- struct{}{}:
+		default:
+		}
+	}
+}
+
+// place puts a task in the level of the highest digit its tick differs from the current one in, so that it
+// cascades to the lower levels as the wheel turns.
+func (tp *TimingWheelTaskPool) place(task *wheelTask) {
+	level := 0
+	if diff := uint64(task.exp ^ tp.current); diff != 0 { //nolint:gosec // ticks are positive
+		level = min((bits.Len64(diff)-1)/tp.bits, len(tp.levels)-1)
+	}
+
+	tp.levels[level][(task.exp>>(level*tp.bits))&tp.mask].push(task)
+}
+
+func (tp *TimingWheelTaskPool) loop() {
+	timer := tp.clock.NewTimer(time.Hour)
+	timer.Stop()
+
+	defer timer.Stop()
+
+	for {
+		select {
+		case <-tp.closed:
+			return
+		case <-tp.wake:
+		case <-timer.C():
+		}
+
+		due, wait, ok := tp.advance()
+
+		for _, task := range due {
+			tp.executor.Execute(newRun(task.key, task.at, task.exec, task.params))
+		}
+
+		if ok {
+			timer.Reset(wait)
+		} else {
+			timer.Stop()
+		}
+	}
+}
+
+// advance processes the ticks up to now and returns the due tasks and how long to wait for the next tick that
+// has work, false if the wheel is empty.
+func (tp *TimingWheelTaskPool) advance() (due []*wheelTask, wait time.Duration, ok bool) {
+	timeNow := tp.clock.Now()
+	target := timeNow.UnixNano() / tp.tick
+
+	tp.lock.Lock()
+	defer tp.lock.Unlock()
+
+	for tp.current < target && len(tp.keys) > 0 {
+		tp.current++
+
+		// the levels whose slot turns over at this tick cascade, the highest first as their tasks may land in
+		// the slots of the lower ones
+		level := 0
+		for level+1 < len(tp.levels) && tp.current&(int64(1)<<((level+1)*tp.bits)-1) == 0 {
+			level++
+		}
+
+		for ; level > 0; level-- {
+			tp.cascade(level)
+		}
+
+		due = tp.expire(due)
+	}
+
+	if len(tp.keys) == 0 {
+		tp.current = max(tp.current, target)
+		tp.next = math.MaxInt64
+
+		return due, 0, false
+	}
+
+	tp.next = tp.nextTick()
+
+	return due, time.Unix(0, tp.next*tp.tick).Sub(timeNow), true
+}
+
+func (tp *TimingWheelTaskPool) cascade(level int) {
+	bucket := &tp.levels[level][(tp.current>>(level*tp.bits))&tp.mask]
+
+	for task := bucket.take(); task != nil; {
+		next := task.next
+		tp.place(task)
+		task = next
+	}
+}
+
+func (tp *TimingWheelTaskPool) expire(due []*wheelTask) []*wheelTask {
+	bucket := &tp.levels[0][tp.current&tp.mask]
+
+	for task := bucket.take(); task != nil; {
+		next := task.next
+
+		if task.exp <= tp.current {
+			task.bucket, task.prev, task.next = nil, nil, nil
+			delete(tp.keys, task.key)
+
+			due = append(due, task)
+		} else {
+			// a task beyond the top level going round
+			tp.place(task)
+		}
+
+		task = next
+	}
+
+	return due
+}
+
+// nextTick is the next tick with tasks in its slot, or the one the lowest level turns over at and the upper
+// ones cascade.
+func (tp *TimingWheelTaskPool) nextTick() int64 {
+	for t := tp.current + 1; ; t++ {
+		if t&tp.mask == 0 || tp.levels[0][t&tp.mask].head != nil {
+			return t
+		}
+	}
+}
@@ -0,0 +1,202 @@
+package schedulex
+
+import (
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/GizmoVault/gotools/base"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func Test_TimingWheelTaskPool(t *testing.T) {
+	start := time.Unix(1000, 0)
+	clock := base.NewFakeClock(start)
+
+	// 3 slots round up to 4, on 2 levels they hold 160ms and the task a second away goes round the top level
+	tp := NewTimingWheelTaskPool(WheelConfig{
+		Tick:    10 * time.Millisecond,
+		Slots:   3,
+		Levels:  2,
+		Workers: 1,
+		Clock:   clock,
+	})
+	defer tp.Stop()
+
+	fired := make(chan string, 8)
+
+	exec := func(key string, _ ...any) {
+		fired <- key
+	}
+
+	expect := func(key string) {
+		select {
+		case got := <-fired:
+			assert.Equal(t, key, got)
+		case <-time.After(time.Second):
+			assert.Fail(t, "task not fired", key)
+		}
+	}
+
+	expectNone := func() {
+		select {
+		case got := <-fired:
+			assert.Fail(t, "unexpected task", got)
+		case <-time.After(10 * time.Millisecond):
+		}
+	}
+
+	// the wheel waits on its timer again once it processed the ticks
+	advance := func(to time.Duration) {
+		clock.Advance(start.Add(to).Sub(clock.Now()))
+		clock.BlockUntil(1)
+	}
+
+	require.NoError(t, tp.AddTask("a", start.Add(25*time.Millisecond), exec))
+	require.NoError(t, tp.AddTask("b", start.Add(200*time.Millisecond), exec))
+	require.NoError(t, tp.AddTask("c", start.Add(time.Second), exec))
+	require.NoError(t, tp.AddTask("d", start.Add(50*time.Millisecond), exec))
+	require.NoError(t, tp.AddTask("e", start.Add(40*time.Millisecond), exec))
+	require.NoError(t, tp.RemoveTask("d"))
+	require.NoError(t, tp.AddTask("e", start.Add(120*time.Millisecond), exec))
+	require.Error(t, tp.AddTask("nil", start, nil))
+	require.Error(t, tp.RemoveTask(""))
+
+	clock.BlockUntil(1)
+
+	// a fires on the first tick after its time
+	advance(20 * time.Millisecond)
+	expectNone()
+	advance(30 * time.Millisecond)
+	expect("a")
+
+	advance(110 * time.Millisecond)
+	expectNone()
+	advance(120 * time.Millisecond)
+	expect("e")
+
+	advance(190 * time.Millisecond)
+	expectNone()
+	advance(200 * time.Millisecond)
+	expect("b")
+
+	// a task in the past fires on the next tick
+	require.NoError(t, tp.AddTask("past", start, exec))
+	advance(210 * time.Millisecond)
+	expect("past")
+
+	advance(990 * time.Millisecond)
+	expectNone()
+
+	clock.Advance(10 * time.Millisecond)
+	expect("c")
+	expectNone()
+}
+
+func Test_TimingWheelTaskPoolWorkers(t *testing.T) {
+	tp := NewTimingWheelTaskPool(WheelConfig{
+		Tick:    time.Millisecond,
+		Workers: 2,
+	})
+
+	const n = 20
+
+	var (
+		wg               sync.WaitGroup
+		running, maxSeen atomic.Int32
+	)
+
+	wg.Add(n)
+
+	for i := range n {
+		err := tp.AddTask(strconv.Itoa(i), time.Now(), func(string, ...any) {
+			defer wg.Done()
+
+			cur := running.Add(1)
+			for {
+				seen := maxSeen.Load()
+				if cur <= seen || maxSeen.CompareAndSwap(seen, cur) {
+					break
+				}
+			}
+
+			time.Sleep(5 * time.Millisecond)
+			running.Add(-1)
+		})
+		require.NoError(t, err)
+	}
+
+	wg.Wait()
+
+	assert.LessOrEqual(t, maxSeen.Load(), int32(2))
+
+	tp.Stop()
+	tp.Stop()
+}
+
+func benchmarkPools() map[string]func() ScheduleTaskPool {
+	return map[string]func() ScheduleTaskPool{
+		"heap": CreateHeapTaskPool,
+		"wheel": func() ScheduleTaskPool {
+			return CreateTimingWheelTaskPool(WheelConfig{Tick: time.Millisecond})
+		},
+	}
+}
+
+// BenchmarkTaskPoolAddRemove is the idle timeout pattern: most timers are removed before they fire.
+func BenchmarkTaskPoolAddRemove(b *testing.B) {
+	for name, create := range benchmarkPools() {
+		b.Run(name, func(b *testing.B) {
+			tp := create()
+			defer tp.Stop()
+
+			exec := func(string, ...any) {}
+			at := time.Now().Add(time.Hour)
+
+			i := 0
+			for b.Loop() {
+				key := strconv.Itoa(i)
+				i++
+
+				_ = tp.AddTask(key, at, exec)
+				_ = tp.RemoveTask(key)
+			}
+		})
+	}
+}
+
+func BenchmarkTaskPoolFire(b *testing.B) {
+	for name, create := range benchmarkPools() {
+		b.Run(name, func(b *testing.B) {
+			tp := create()
+			defer tp.Stop()
+
+			var wg sync.WaitGroup
+
+			wg.Add(b.N)
+
+			exec := func(string, ...any) {
+				wg.Done()
+			}
+
+			at := time.Now()
+
+			b.ResetTimer()
+
+			for i := range b.N {
+				_ = tp.AddTask(strconv.Itoa(i), at, exec)
+			}
+
+			wg.Wait()
+		})
+	}
+}
+
+func Test_TimingWheelTaskPoolInspect(t *testing.T) {
+	clock := base.NewFakeClock(time.Unix(1000, 0))
+
+	testInspectable(t, NewTimingWheelTaskPool(WheelConfig{Clock: clock}), clock.Now())
+}
@@ -5,6 +5,7 @@ import (
 	"os"
 	"time"
 
+	"github.com/GizmoVault/gotools/base"
 	"github.com/GizmoVault/gotools/base/errorx"
 	"github.com/GizmoVault/gotools/base/syncx"
 )
@@ -34,6 +35,7 @@ type MemWithFile[T any, S Serial, L syncx.RWLocker] struct {
 
 	changedFlag      bool
 	autoSaveInterval time.Duration
+	clock            base.Clock
 }
 
 func NewMemWithFile[T any, S Serial, L syncx.RWLocker](d T, serial S, lock L, fileName string, storage FileStorage) (
@@ -48,6 +50,12 @@ func NewMemWithFileEx[T any, S Serial, L syncx.RWLocker](d T, serial S, lock L,
 
 func NewMemWithFileEx1[T any, S Serial, L syncx.RWLocker](d T, serial S, lock L, fileName string, storage FileStorage,
 	ob EventObserver[T], autoSaveInterval time.Duration) (*MemWithFile[T, S, L], error) {
+	return NewMemWithFileEx2(d, serial, lock, fileName, storage, ob, autoSaveInterval, nil)
+}
+
+// NewMemWithFileEx2 waits for the auto-save interval on clock, nil for the system clock.
+func NewMemWithFileEx2[T any, S Serial, L syncx.RWLocker](d T, serial S, lock L, fileName string, storage FileStorage,
+	ob EventObserver[T], autoSaveInterval time.Duration, clock base.Clock) (*MemWithFile[T, S, L], error) {
 	if storage == nil && fileName != "" {
 		storage = NewRawFSStorage("")
 	}
@@ -60,6 +68,7 @@ func NewMemWithFileEx1[T any, S Serial, L syncx.RWLocker](d T, serial S, lock L,
 		storage:          storage,
 		ob:               ob,
 		autoSaveInterval: autoSaveInterval,
+		clock:            base.GetClock(clock),
 	}
 
 	err := mwf.load()
@@ -73,7 +82,7 @@ func NewMemWithFileEx1[T any, S Serial, L syncx.RWLocker](d T, serial S, lock L,
 
 func (mwf *MemWithFile[T, S, L]) autoSaveRoutine() {
 	for {
-		time.Sleep(mwf.autoSaveInterval)
+		mwf.clock.Sleep(mwf.autoSaveInterval)
 
 		mwf.lock.Lock()
 
@@ -118,6 +127,14 @@ func (mwf *MemWithFile[T, S, L]) Change(proc func(memD T) (newMemD T, err error)
 	return nil
 }
 
+// Reload replaces the memory data with the content of the file, for files that other processes write too.
+func (mwf *MemWithFile[T, S, L]) Reload() error {
+	mwf.lock.Lock()
+	defer mwf.lock.Unlock()
+
+	return mwf.load()
+}
+
 func (mwf *MemWithFile[T, S, L]) load() error {
 	if mwf.fileName == "" {
 		return nil
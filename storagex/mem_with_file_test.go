@@ -1,11 +1,16 @@
 package storagex_test
 
 import (
+	"path/filepath"
+	"sync"
 	"testing"
+	"time"
 
+	"github.com/GizmoVault/gotools/base"
 	"github.com/GizmoVault/gotools/base/syncx"
 	"github.com/GizmoVault/gotools/storagex"
 	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
 )
 
 func TestMemAndFile1(t *testing.T) {
@@ -33,3 +38,54 @@ func TestMemAndFile1(t *testing.T) {
 		t.Log(m[1])
 	})
 }
+
+func TestMemAndFileReload(t *testing.T) {
+	fileName := filepath.Join(t.TempDir(), "utReload.txt")
+
+	writer, err := storagex.NewMemWithFile(make(map[int]string), &storagex.JSONSerial{}, &storagex.NoLock{}, fileName, nil)
+	require.NoError(t, err)
+
+	reader, err := storagex.NewMemWithFile(make(map[int]string), &storagex.JSONSerial{}, &storagex.NoLock{}, fileName, nil)
+	require.NoError(t, err)
+
+	require.NoError(t, writer.Change(func(m map[int]string) (map[int]string, error) {
+		m[1] = "1xx"
+
+		return m, nil
+	}))
+
+	reader.Read(func(m map[int]string) {
+		assert.Empty(t, m)
+	})
+
+	require.NoError(t, reader.Reload())
+
+	reader.Read(func(m map[int]string) {
+		assert.Equal(t, "1xx", m[1])
+	})
+}
+
+func TestMemAndFileAutoSave(t *testing.T) {
+	fileName := filepath.Join(t.TempDir(), "utAutoSave.txt")
+	clock := base.NewFakeClock(time.Unix(1000, 0))
+
+	writer, err := storagex.NewMemWithFileEx2(make(map[int]string), &storagex.JSONSerial{}, &sync.RWMutex{}, fileName,
+		nil, nil, time.Minute, clock)
+	require.NoError(t, err)
+
+	require.NoError(t, writer.Change(func(m map[int]string) (map[int]string, error) {
+		m[1] = "1xx"
+
+		return m, nil
+	}))
+
+	// the auto-save routine sleeps on the clock
+	clock.BlockUntil(1)
+	assert.NoFileExists(t, fileName)
+
+	clock.Advance(time.Minute)
+
+	// it sleeps again once it saved
+	clock.BlockUntil(1)
+	assert.FileExists(t, fileName)
+}